@@ -1,23 +1,54 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/timeforaninja/pacserver/internal"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
+	// diff is a subcommand, since it takes the two sets to compare as arguments
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		err := diff(os.Args[2:])
+		if err != nil {
+			log.Errorf("Failed to diff: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Define command-line flags
 	serveFlag := flag.Bool("serve", false, "Start the PAC server")
 	testFlag := flag.Bool("test", false, "Validate configs and PACs without starting the server")
 	reloadFlag := flag.Bool("reload", false, "Tell a running server to reload PACs and config")
+	pinFlag := flag.String("pin", "", "Used with --reload: pin the git source to a ref or commit (e.g. to roll back)")
+	unpinFlag := flag.Bool("unpin", false, "Used with --reload: remove the pin so the git source follows gitRef again")
+	importFlag := flag.String("import", "", "Import zones from a NetBox / phpIPAM export file")
+	importFormat := flag.String("import-format", internal.ImportFormatNetBoxCSV, "Format of the import file (netbox-csv, netbox-json, phpipam-csv, phpipam-json)")
+	importMapping := flag.String("import-map", "field:pac", "Where to read the PAC from, either \"field:<custom field>\" or \"tag:<prefix>\"")
+	importOutput := flag.String("import-out", "-", "Zones file to write the import to, \"-\" for stdout")
+	dryRunFlag := flag.Bool("dry-run", false, "Only print the difference between the import and the current zones")
+	exportFlag := flag.String("export", "", "Export the effective IP ranges of the zones to a file, \"-\" for stdout")
+	exportFormat := flag.String("export-format", internal.ExportFormatCSV, "Format of the export (csv, json)")
+	snapshotsFlag := flag.Bool("snapshots", false, "List the snapshots of the running server (requires adminToken)")
+	rollbackFlag := flag.Int("rollback", 0, "Roll the running server back to the snapshot with this id (requires adminToken)")
+	overrideFlag := flag.String("override", "", "Force a PAC (or DIRECT) for all clients or --override-networks of the running server (requires adminToken)")
+	overrideNetworks := flag.String("override-networks", "", "Used with --override: comma separated networks to override, all clients if empty")
+	overrideFor := flag.Duration("override-for", time.Hour, "Used with --override: how long the override lasts")
+	overrideReason := flag.String("override-reason", "", "Used with --override: why the override was set")
+	overridesFlag := flag.Bool("overrides", false, "List the overrides of the running server (requires adminToken)")
+	clearOverrideFlag := flag.String("clear-override", "", "Remove the override with this id, or \"all\" (requires adminToken)")
 	flag.Parse()
 
 	// If no flags are provided, show usage
-	if !*serveFlag && !*testFlag && !*reloadFlag {
+	if !*serveFlag && !*testFlag && !*reloadFlag && *importFlag == "" && *exportFlag == "" && !*snapshotsFlag && *rollbackFlag == 0 &&
+		*overrideFlag == "" && !*overridesFlag && *clearOverrideFlag == "" {
 		fmt.Println("Please specify one of the following flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -34,6 +65,44 @@ func main() {
 		// Logging to file should only be done if we're actually serving
 		// the test / reload command should send to stdout
 		internal.InitEventLogger()
+		// started before the initial load, so it is traced as well
+		if err := internal.StartTelemetry(); err != nil {
+			log.Errorf("Failed to start the OpenTelemetry export: %v", err)
+		}
+	} else {
+		// only the serving process should write snapshots
+		// and fall back to the last known good one
+		internal.GetConfig().SnapshotDir = ""
+		internal.GetConfig().StateDir = ""
+	}
+
+	// snapshots are managed through the admin API of the running server
+	// so there is no need to load any zones or pacs
+	if *snapshotsFlag || *rollbackFlag != 0 {
+		err := manageSnapshots(*snapshotsFlag, *rollbackFlag)
+		if err != nil {
+			log.Errorf("Failed to manage snapshots: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// overrides are managed through the admin API as well
+	if *overrideFlag != "" || *overridesFlag || *clearOverrideFlag != "" {
+		request := internal.OverrideRequest{
+			PAC:      *overrideFlag,
+			Duration: overrideFor.String(),
+			Reason:   *overrideReason,
+		}
+		if *overrideNetworks != "" {
+			request.Networks = strings.Split(*overrideNetworks, ",")
+		}
+		err := manageOverrides(request, *overridesFlag, *clearOverrideFlag)
+		if err != nil {
+			log.Errorf("Failed to manage overrides: %v", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	if *testFlag || *reloadFlag {
@@ -41,6 +110,27 @@ func main() {
 		internal.GetConfig().IgnoreMinors = false
 	}
 
+	if *importFlag != "" || *exportFlag != "" {
+		// the current zones are only used to compare against or to export,
+		// so problems with them should not stop the import / export
+		internal.GetConfig().IgnoreMinors = true
+	}
+
+	// Handle reload flag
+	if *reloadFlag {
+		// the zones and pacs of the new pin are checked, the current ones could be the reason to pin
+		err := updatePin(*pinFlag, *unpinFlag)
+		if err != nil {
+			log.Errorf("Not reloading, the zones and pacs failed the check: %v", err)
+			os.Exit(1)
+		}
+		err = reload()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize caches (load PACs and zones)
 	err = internal.InitCaches()
 	if err != nil {
@@ -48,10 +138,30 @@ func main() {
 		panic(err)
 	}
 
-	// Handle reload flag
-	if *reloadFlag {
-		err := reload()
+	// Handle import flag
+	if *importFlag != "" {
+		err := internal.RunImport(internal.ImportOptions{
+			File:    *importFlag,
+			Format:  *importFormat,
+			Mapping: *importMapping,
+			Output:  *importOutput,
+			DryRun:  *dryRunFlag,
+		}, os.Stdout)
+		if err != nil {
+			log.Errorf("Failed to import zones: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle export flag
+	if *exportFlag != "" {
+		err := internal.RunExport(internal.ExportOptions{
+			Output: *exportFlag,
+			Format: *exportFormat,
+		}, os.Stdout)
 		if err != nil {
+			log.Errorf("Failed to export ranges: %v", err)
 			os.Exit(1)
 		}
 		return
@@ -76,6 +186,128 @@ func main() {
 	os.Exit(1)
 }
 
+func diff(args []string) error {
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := diffFlags.String("format", internal.DiffFormatText, "Output format (text, json)")
+	diffFlags.Usage = func() {
+		fmt.Println("Usage: pacserver diff [--format text|json] <old dir> <new dir>")
+		diffFlags.PrintDefaults()
+	}
+	_ = diffFlags.Parse(args)
+	if diffFlags.NArg() != 2 {
+		diffFlags.Usage()
+		os.Exit(1)
+	}
+
+	err := internal.LoadConfig("config.yml")
+	if err != nil {
+		return fmt.Errorf("unable to load \"config.yml\": %v", err)
+	}
+	return internal.RunDiff(internal.DiffOptions{
+		Old:    diffFlags.Arg(0),
+		New:    diffFlags.Arg(1),
+		Format: *format,
+	}, os.Stdout)
+}
+
+func manageSnapshots(list bool, rollbackID int) error {
+	if rollbackID != 0 {
+		body, err := internal.AdminRequest("POST", fmt.Sprintf("/snapshots/%d/rollback", rollbackID), nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back to snapshot %d: %s\n", rollbackID, body)
+	}
+	if list {
+		body, err := internal.AdminRequest("GET", "/snapshots", nil)
+		if err != nil {
+			return err
+		}
+		var snapshots []struct {
+			ID       int       `json:"id"`
+			LoadedAt time.Time `json:"loadedAt"`
+			Problems int       `json:"problems"`
+			Commit   string    `json:"commit"`
+			Zones    int       `json:"zones"`
+			PACs     int       `json:"pacs"`
+			Active   bool      `json:"active"`
+		}
+		if err := json.Unmarshal(body, &snapshots); err != nil {
+			return err
+		}
+		fmt.Printf("%-6s %-25s %-6s %-6s %-8s %s\n", "ID", "LOADED", "ZONES", "PACS", "PROBLEMS", "COMMIT")
+		for _, s := range snapshots {
+			active := ""
+			if s.Active {
+				active = " (active)"
+			}
+			fmt.Printf("%-6d %-25s %-6d %-6d %-8d %s%s\n", s.ID, s.LoadedAt.Format(time.RFC3339), s.Zones, s.PACs, s.Problems, s.Commit, active)
+		}
+	}
+	return nil
+}
+
+func manageOverrides(request internal.OverrideRequest, list bool, clearID string) error {
+	if clearID != "" {
+		path := "/overrides"
+		if clearID != "all" {
+			path = "/overrides/" + clearID
+		}
+		if _, err := internal.AdminRequest("DELETE", path, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Removed override %s\n", clearID)
+	}
+	if request.PAC != "" {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body, err := internal.AdminRequest("POST", "/overrides", data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Set override: %s\n", body)
+	}
+	if list {
+		body, err := internal.AdminRequest("GET", "/overrides", nil)
+		if err != nil {
+			return err
+		}
+		var overrides []struct {
+			ID       int       `json:"id"`
+			Networks []string  `json:"networks"`
+			PAC      string    `json:"pac"`
+			Reason   string    `json:"reason"`
+			Until    time.Time `json:"until"`
+		}
+		if err := json.Unmarshal(body, &overrides); err != nil {
+			return err
+		}
+		fmt.Printf("%-6s %-25s %-20s %-30s %s\n", "ID", "UNTIL", "PAC", "NETWORKS", "REASON")
+		for _, o := range overrides {
+			networks := "all"
+			if len(o.Networks) > 0 {
+				networks = strings.Join(o.Networks, ",")
+			}
+			fmt.Printf("%-6d %-25s %-20s %-30s %s\n", o.ID, o.Until.Format(time.RFC3339), o.PAC, networks, o.Reason)
+		}
+	}
+	return nil
+}
+
+// updatePin changes the pin and loads the zones and pacs with it
+// the previous pin is restored if they do not load without problems
+func updatePin(pin string, unpin bool) error {
+	if unpin {
+		return internal.UnpinGitRef(internal.InitCaches)
+	}
+	if pin != "" {
+		return internal.PinGitRef(pin, internal.InitCaches)
+	}
+	return internal.InitCaches()
+}
+
 func reload() error {
 	// config & eventlogger already init in main
 
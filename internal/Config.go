@@ -3,10 +3,11 @@ package internal
 import (
 	"fmt"
 	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/git"
 	"github.com/timeforaninja/pacserver/pkg/utils"
-	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v3"
 	"io"
+	"net"
 	"os"
 	"regexp"
 	"strconv"
@@ -21,6 +22,8 @@ type YAMLConfig struct {
 	WPADFile          *string `yaml:"wpadFile"`
 	ContactInfo       *string `yaml:"contactInfo"`
 	AccessLogFile     *string `yaml:"accessLogFile"`
+	AccessLogFormat   *string `yaml:"accessLogFormat"`
+	ProxyHeader       *string `yaml:"proxyHeader"`
 	EventLogFile      *string `yaml:"eventLogFile"`
 	MaxCacheAge       *int64  `yaml:"maxCacheAge"`
 	PidFile           *string `yaml:"pidFile"`
@@ -29,6 +32,42 @@ type YAMLConfig struct {
 	PrometheusPath    *string `yaml:"prometheusPath"`
 	IgnoreMinors      *bool   `yaml:"ignoreMinors"`
 	Loglevel          *string `yaml:"loglevel"`
+	GitRepo           *string `yaml:"gitRepo"`
+	GitRef            *string `yaml:"gitRef"`
+	GitPinFile        *string `yaml:"gitPinFile"`
+	SnapshotHistory   *int    `yaml:"snapshotHistory"`
+	SnapshotDir       *string `yaml:"snapshotDir"`
+	AdminToken        *string `yaml:"adminToken"`
+	StateDir          *string `yaml:"stateDir"`
+	DuplicateZones    *string `yaml:"duplicateZones"`
+	LookupCacheSize   *int    `yaml:"lookupCacheSize"`
+	LookupCachePrefix *int    `yaml:"lookupCachePrefix"`
+	// Proxies is nil if not set, so it does not need a pointer
+	Proxies            []ProxyCheck `yaml:"proxies"`
+	ProxyCheckInterval *int         `yaml:"proxyCheckInterval"`
+	ProxyCheckTimeout  *int         `yaml:"proxyCheckTimeout"`
+	ProxyCheckFailures *int         `yaml:"proxyCheckFailures"`
+	ZoneMetricsLimit   *int         `yaml:"zoneMetricsLimit"`
+	TopClientSubnets   *int         `yaml:"topClientSubnets"`
+	// ResponseTimeBuckets is nil if not set, so it does not need a pointer
+	ResponseTimeBuckets []float64 `yaml:"responseTimeBuckets"`
+	OTLPEndpoint        *string   `yaml:"otlpEndpoint"`
+	OTLPProtocol        *string   `yaml:"otlpProtocol"`
+	OTLPInsecure        *bool     `yaml:"otlpInsecure"`
+	OTLPTraceRatio      *float64  `yaml:"otlpTraceRatio"`
+	OTLPMetricsInterval *int      `yaml:"otlpMetricsInterval"`
+	// TrustedProxies is nil if not set, so it does not need a pointer
+	TrustedProxies  []string `yaml:"trustedProxies"`
+	EventLogOutput  *string  `yaml:"eventLogOutput"`
+	AccessLogOutput *string  `yaml:"accessLogOutput"`
+	LogMaxSize      *int     `yaml:"logMaxSize"`
+	LogMaxBackups   *int     `yaml:"logMaxBackups"`
+	LogMaxAge       *int     `yaml:"logMaxAge"`
+	LogCompress     *bool    `yaml:"logCompress"`
+	SyslogAddress   *string  `yaml:"syslogAddress"`
+	SyslogFacility  *string  `yaml:"syslogFacility"`
+	// SyslogMaxMessageSize splits longer entries into several syslog messages
+	SyslogMaxMessageSize *int `yaml:"syslogMaxMessageSize"`
 }
 
 type Config struct {
@@ -46,10 +85,72 @@ type Config struct {
 	PrometheusPath    string
 	IgnoreMinors      bool
 	Loglevel          string
+	// GitRepo enables reading ipMapFile and pacRoot from a local git repository
+	GitRepo    string
+	GitRef     string
+	GitPinFile string
+	// SnapshotHistory is the amount of loaded snapshots kept for rollbacks
+	SnapshotHistory int
+	SnapshotDir     string
+	// AdminToken enables the admin API
+	AdminToken string
+	// StateDir stores the last known good snapshot to boot from if the initial load fails
+	StateDir string
+	// DuplicateZones decides which zone is used if a network is mapped more than once
+	DuplicateZones string
+	// LookupCacheSize is the amount of client lookups kept in the lookup cache, 0 disables it
+	LookupCacheSize   int
+	LookupCachePrefix int
+	// Proxies are checked regularly, PAC templates can leave out or reorder the ones that are down
+	Proxies            []ProxyCheck
+	ProxyCheckInterval int
+	ProxyCheckTimeout  int
+	// ProxyCheckFailures is the amount of failed checks in a row before a proxy is down
+	ProxyCheckFailures int
+	// ZoneMetricsLimit is the amount of zones counted with their own label, 0 disables the counters
+	ZoneMetricsLimit int
+	// TopClientSubnets is the amount of client /24 networks tracked as heavy hitters, 0 disables them
+	TopClientSubnets int
+	// ResponseTimeBuckets are the upper bounds of the response time histogram in seconds
+	ResponseTimeBuckets []float64
+	// OTLPEndpoint enables exporting traces and metrics to an OpenTelemetry collector
+	OTLPEndpoint string
+	OTLPProtocol string
+	// OTLPInsecure disables TLS towards the collector
+	OTLPInsecure bool
+	// OTLPTraceRatio is the share of requests traced, reloads are always traced
+	OTLPTraceRatio float64
+	// OTLPMetricsInterval is the interval (in seconds) to export metrics in, 0 disables the export of metrics
+	OTLPMetricsInterval int
+	// AccessLogFormat is "text", "json" or "logfmt"
+	AccessLogFormat string
+	// ProxyHeader contains the client IP if pacserver runs behind a proxy, e.g. X-Forwarded-For
+	ProxyHeader string
+	// TrustedProxies are the IPs and networks the ProxyHeader is accepted from, all if empty
+	TrustedProxies []string
+	// EventLogOutput and AccessLogOutput are "file", "stdout", "syslog" or "journald", the access log can be "none"
+	EventLogOutput  string
+	AccessLogOutput string
+	// LogMaxSize (in megabytes), LogMaxBackups, LogMaxAge (in days) and LogCompress rotate the log files
+	LogMaxSize    int
+	LogMaxBackups int
+	LogMaxAge     int
+	LogCompress   bool
+	// SyslogAddress is udp://host:port, tcp://host:port or unix:///path
+	SyslogAddress  string
+	SyslogFacility string
+	// SyslogMaxMessageSize is the maximum size of a syslog message in bytes, longer entries are split
+	SyslogMaxMessageSize int
+	// hash identifies the content of the config file
+	hash string
 }
 
 var confStorage *Config
 
+// debugLogging is set if the loglevel includes debug messages
+// the request path checks it before logging, since passing the arguments allocates even if the message is dropped
+var debugLogging bool
+
 func LoadConfig(filename string) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -63,6 +164,7 @@ func LoadConfig(filename string) error {
 	}
 
 	newConf := overloadDefaults(yamlConf)
+	newConf.hash = hashConfig(data)
 
 	err = validateConfig(newConf)
 	if err != nil {
@@ -85,6 +187,18 @@ func overloadDefaults(conf *YAMLConfig) *Config {
 	newConf.WPADFile = utils.IfIsNil(conf.WPADFile, newConf.PACRoot+"\\wpad.dat")
 	newConf.ContactInfo = utils.IfIsNil(conf.ContactInfo, "Your Help Desk")
 	newConf.AccessLogFile = utils.IfIsNil(conf.AccessLogFile, "access.log")
+	newConf.AccessLogFormat = utils.IfIsNil(conf.AccessLogFormat, AccessLogFormatText)
+	newConf.ProxyHeader = utils.IfIsNil(conf.ProxyHeader, "")
+	newConf.TrustedProxies = conf.TrustedProxies
+	newConf.EventLogOutput = utils.IfIsNil(conf.EventLogOutput, LogOutputFile)
+	newConf.AccessLogOutput = utils.IfIsNil(conf.AccessLogOutput, LogOutputFile)
+	newConf.LogMaxSize = utils.IfIsNil(conf.LogMaxSize, 500)
+	newConf.LogMaxBackups = utils.IfIsNil(conf.LogMaxBackups, 3)
+	newConf.LogMaxAge = utils.IfIsNil(conf.LogMaxAge, 28)
+	newConf.LogCompress = utils.IfIsNil(conf.LogCompress, true)
+	newConf.SyslogAddress = utils.IfIsNil(conf.SyslogAddress, "unix:///dev/log")
+	newConf.SyslogFacility = utils.IfIsNil(conf.SyslogFacility, "daemon")
+	newConf.SyslogMaxMessageSize = utils.IfIsNil(conf.SyslogMaxMessageSize, 2048)
 	newConf.EventLogFile = utils.IfIsNil(conf.EventLogFile, "event.log")
 	newConf.MaxCacheAge = utils.IfIsNil(conf.MaxCacheAge, int64(900))
 	newConf.PidFile = utils.IfIsNil(conf.PidFile, "pacserver.pid")
@@ -93,6 +207,36 @@ func overloadDefaults(conf *YAMLConfig) *Config {
 	newConf.PrometheusPath = utils.IfIsNil(conf.PrometheusPath, "/metrics")
 	newConf.IgnoreMinors = utils.IfIsNil(conf.IgnoreMinors, false)
 	newConf.Loglevel = utils.IfIsNil(conf.Loglevel, "INFO")
+	newConf.GitRepo = utils.IfIsNil(conf.GitRepo, "")
+	newConf.GitRef = utils.IfIsNil(conf.GitRef, "HEAD")
+	newConf.GitPinFile = utils.IfIsNil(conf.GitPinFile, "pacserver.gitpin")
+	newConf.SnapshotHistory = utils.IfIsNil(conf.SnapshotHistory, 10)
+	newConf.SnapshotDir = utils.IfIsNil(conf.SnapshotDir, "")
+	newConf.AdminToken = utils.IfIsNil(conf.AdminToken, "")
+	newConf.StateDir = utils.IfIsNil(conf.StateDir, "")
+	newConf.DuplicateZones = utils.IfIsNil(conf.DuplicateZones, DuplicateZonesLast)
+	newConf.LookupCacheSize = utils.IfIsNil(conf.LookupCacheSize, 0)
+	newConf.LookupCachePrefix = utils.IfIsNil(conf.LookupCachePrefix, 32)
+	newConf.Proxies = conf.Proxies
+	for i := range newConf.Proxies {
+		if newConf.Proxies[i].Check == "" {
+			newConf.Proxies[i].Check = ProxyCheckTCP
+		}
+	}
+	newConf.ProxyCheckInterval = utils.IfIsNil(conf.ProxyCheckInterval, 10)
+	newConf.ProxyCheckTimeout = utils.IfIsNil(conf.ProxyCheckTimeout, 2)
+	newConf.ProxyCheckFailures = utils.IfIsNil(conf.ProxyCheckFailures, 2)
+	newConf.ZoneMetricsLimit = utils.IfIsNil(conf.ZoneMetricsLimit, 100)
+	newConf.TopClientSubnets = utils.IfIsNil(conf.TopClientSubnets, 20)
+	newConf.ResponseTimeBuckets = conf.ResponseTimeBuckets
+	if len(newConf.ResponseTimeBuckets) == 0 {
+		newConf.ResponseTimeBuckets = defaultResponseTimeBuckets
+	}
+	newConf.OTLPEndpoint = utils.IfIsNil(conf.OTLPEndpoint, "")
+	newConf.OTLPProtocol = utils.IfIsNil(conf.OTLPProtocol, OTLPProtocolGRPC)
+	newConf.OTLPInsecure = utils.IfIsNil(conf.OTLPInsecure, false)
+	newConf.OTLPTraceRatio = utils.IfIsNil(conf.OTLPTraceRatio, 1.0)
+	newConf.OTLPMetricsInterval = utils.IfIsNil(conf.OTLPMetricsInterval, 60)
 	return newConf
 }
 
@@ -108,10 +252,81 @@ func validateConfig(conf *Config) error {
 		return err
 	}
 
-	// Validate the Zone-File exists
-	zoneInfo, err := os.Stat(conf.IPMapFile)
-	if err != nil || zoneInfo.IsDir() {
-		return fmt.Errorf("Zone-File does not exist or is not a file: %s", conf.IPMapFile)
+	switch conf.DuplicateZones {
+	case DuplicateZonesLast, DuplicateZonesFirst, DuplicateZonesError:
+	default:
+		return fmt.Errorf("duplicateZones must be one of \"last\", \"first\" or \"error\": %s", conf.DuplicateZones)
+	}
+
+	if conf.LookupCachePrefix != 24 && conf.LookupCachePrefix != 32 {
+		return fmt.Errorf("lookupCachePrefix must be 24 or 32: %d", conf.LookupCachePrefix)
+	}
+
+	if conf.ZoneMetricsLimit < 0 || conf.TopClientSubnets < 0 {
+		return fmt.Errorf("zoneMetricsLimit and topClientSubnets must not be negative")
+	}
+
+	for i, bucket := range conf.ResponseTimeBuckets {
+		if bucket <= 0 || (i > 0 && bucket <= conf.ResponseTimeBuckets[i-1]) {
+			return fmt.Errorf("responseTimeBuckets must be positive and increasing: %v", conf.ResponseTimeBuckets)
+		}
+	}
+
+	switch conf.AccessLogFormat {
+	case AccessLogFormatText, AccessLogFormatJSON, AccessLogFormatLogfmt:
+	default:
+		return fmt.Errorf("accessLogFormat must be one of \"text\", \"json\" or \"logfmt\": %s", conf.AccessLogFormat)
+	}
+	err = validateLogOutputs(conf)
+	if err != nil {
+		return err
+	}
+
+	for _, proxy := range conf.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("trustedProxies must be IPs or networks: %s", proxy)
+		}
+	}
+
+	if conf.OTLPProtocol != OTLPProtocolGRPC && conf.OTLPProtocol != OTLPProtocolHTTP {
+		return fmt.Errorf("otlpProtocol must be \"grpc\" or \"http\": %s", conf.OTLPProtocol)
+	}
+	if conf.OTLPTraceRatio < 0 || conf.OTLPTraceRatio > 1 {
+		return fmt.Errorf("otlpTraceRatio must be between 0 and 1: %g", conf.OTLPTraceRatio)
+	}
+
+	err = validateProxyChecks(conf)
+	if err != nil {
+		return err
+	}
+
+	if conf.GitRepo != "" {
+		// Zone-File(s) and PACRoot are read from the repository
+		// so we can only check that the ref resolves
+		_, err = git.ResolveRef(conf.GitRepo, conf.GitRef)
+		if err != nil {
+			return fmt.Errorf("unable to resolve gitRef \"%s\" in gitRepo \"%s\": %s", conf.GitRef, conf.GitRepo, err.Error())
+		}
+	} else {
+		err = validateSources(conf)
+		if err != nil && hasLastKnownGood(conf.StateDir) {
+			// InitCaches boots from the last known good snapshot instead
+			log.Warnf("%s - booting from the last known good snapshot in \"%s\"", err.Error(), conf.StateDir)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateSources checks that the Zone-File(s), PACRoot, DefaultPACFile and WPADFile exist on the filesystem
+func validateSources(conf *Config) error {
+	// Validate the Zone-File(s) exist, if any are configured
+	if conf.IPMapFile != "" {
+		if _, err := resolveIPMapFiles(conf.IPMapFile); err != nil {
+			return fmt.Errorf("Zone-File does not exist or does not match any files: %s", conf.IPMapFile)
+		}
 	}
 
 	// Validate that PACRoot exists and is a directory
@@ -121,6 +336,7 @@ func validateConfig(conf *Config) error {
 	}
 
 	// Check if DefaultPACFile exists, and if it does, ensure it's a file
+	// in git mode, it is read from the commit like the zones and PACs
 	fileInfo, err := os.Stat(conf.DefaultPACFile)
 	if err != nil || fileInfo.IsDir() {
 		return fmt.Errorf("DefaultPACFile does not exist or is not a file: %s", conf.DefaultPACFile)
@@ -131,7 +347,6 @@ func validateConfig(conf *Config) error {
 	if err != nil || fileInfo.IsDir() {
 		return fmt.Errorf("WPADFile does not exist or is not a file: %s", conf.WPADFile)
 	}
-
 	return nil
 }
 
@@ -139,41 +354,75 @@ func GetConfig() *Config {
 	return confStorage
 }
 
-var accessLog *lumberjack.Logger
+var accessLog io.Writer
 
 func (conf *Config) getLoglevel() log.Level {
 	return utils.GetLoglevel(conf.Loglevel)
 }
 
 func InitEventLogger() {
-	fileLogger := &lumberjack.Logger{
-		Filename: GetConfig().EventLogFile,
-		// TODO: offload to cfg
-		MaxSize:    500, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28,   //days
-		Compress:   true, // disabled by default
-	}
-	multiLog := io.MultiWriter(os.Stdout, fileLogger)
+	conf := GetConfig()
+	output, err := newLogOutput(conf, conf.EventLogOutput, conf.EventLogFile, "event", eventSeverity)
+	if err != nil {
+		// the messages are not lost, they are at least written to stdout
+		log.Errorf("Unable to log to %s, logging to stdout: %v", conf.EventLogOutput, err)
+		output = os.Stdout
+	}
+	if conf.EventLogOutput == LogOutputFile {
+		output = io.MultiWriter(os.Stdout, output)
+	}
 	log.SetLevel(confStorage.getLoglevel())
-	log.SetOutput(multiLog)
+	debugLogging = confStorage.getLoglevel() <= log.LevelDebug
+	log.SetOutput(output)
 	log.Info("Application starting")
 }
 
+// getAccessLogger returns the output of the access log, or nil if it is disabled
 func getAccessLogger() io.Writer {
 	if accessLog == nil {
-		accessLog = &lumberjack.Logger{
-			Filename: GetConfig().AccessLogFile,
-			// TODO: offload to cfg
-			MaxSize:    500, // megabytes
-			MaxBackups: 3,
-			MaxAge:     28,   //days
-			Compress:   true, // disabled by default
+		conf := GetConfig()
+		output, err := newLogOutput(conf, conf.AccessLogOutput, conf.AccessLogFile, "access", accessSeverity)
+		if err != nil {
+			log.Errorf("Unable to write the access log to %s, writing it to stdout: %v", conf.AccessLogOutput, err)
+			output = os.Stdout
 		}
+		accessLog = output
 	}
 	return accessLog
 }
 
+// validateLogOutputs checks the outputs of the event and access log and their settings
+func validateLogOutputs(conf *Config) error {
+	switch conf.EventLogOutput {
+	case LogOutputFile, LogOutputStdout, LogOutputSyslog, LogOutputJournald:
+	default:
+		return fmt.Errorf("eventLogOutput must be one of \"file\", \"stdout\", \"syslog\" or \"journald\": %s", conf.EventLogOutput)
+	}
+	switch conf.AccessLogOutput {
+	case LogOutputFile, LogOutputStdout, LogOutputSyslog, LogOutputJournald, LogOutputNone:
+	default:
+		return fmt.Errorf("accessLogOutput must be one of \"file\", \"stdout\", \"syslog\", \"journald\" or \"none\": %s", conf.AccessLogOutput)
+	}
+
+	if conf.LogMaxSize < 1 || conf.LogMaxBackups < 0 || conf.LogMaxAge < 0 {
+		return fmt.Errorf("logMaxSize must be positive, logMaxBackups and logMaxAge must not be negative")
+	}
+
+	if conf.EventLogOutput == LogOutputSyslog || conf.AccessLogOutput == LogOutputSyslog {
+		if _, _, err := parseSyslogAddress(conf.SyslogAddress); err != nil {
+			return err
+		}
+		if _, ok := syslogFacilities[conf.SyslogFacility]; !ok {
+			return fmt.Errorf("syslogFacility must be \"user\", \"daemon\" or \"local0\" to \"local7\": %s", conf.SyslogFacility)
+		}
+		// every syslog receiver accepts messages of 480 bytes (RFC 5424)
+		if conf.SyslogMaxMessageSize < 480 {
+			return fmt.Errorf("syslogMaxMessageSize must be at least 480: %d", conf.SyslogMaxMessageSize)
+		}
+	}
+	return nil
+}
+
 // WritePidFile writes the current process ID to the configured PID file
 func WritePidFile() error {
 	pidFile := GetConfig().PidFile
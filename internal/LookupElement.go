@@ -16,6 +16,17 @@ type LookupElement struct {
 	PAC   *pacTemplate `json:"PAC"`
 	// the parsed content of the PAC Template
 	Variant string
+	// proxies are the health states of the proxies the template asked for
+	// it is nil if unknown, e.g. for elements read from a snapshot
+	proxies map[string]bool
+	// clientVariants are the variants of a template with proxy pools, nil without pools
+	// clientBuckets holds the index of the variant served to each bucket of clients
+	clientVariants []string
+	clientBuckets  []uint8
+	// canary is served instead of this element to the clients selected by the canary of the zone
+	canary *LookupElement
+	// isCanary is set for the canary of a zone
+	isCanary bool
 }
 
 func (le1 LookupElement) isIdenticalNet(le2 LookupElement) bool {
@@ -54,27 +65,47 @@ func (le1 LookupElement) _stringify() string {
 type templateParams struct {
 	Filename string
 	Contact  string
+	// Vars are the per-zone variables of the structured zone format
+	Vars map[string]string
 }
 
 func NewLookupElement(ipMap *ipMap, pac *pacTemplate, contactInfo string) (LookupElement, error) {
-	filledTemplate, err := template.New("pac-template").Parse(pac.content)
+	proxies := make(map[string]bool)
+	pools := &poolRender{}
+	filledTemplate, err := template.New("pac-template").Funcs(proxyTemplateFuncs(proxies, pools)).Parse(pac.content)
 	if err != nil {
 		return LookupElement{}, err
 	}
 
-	var buf bytes.Buffer
-	data := templateParams{pac.Filename, contactInfo}
+	data := templateParams{pac.Filename, contactInfo, ipMap.Variables}
+	render := func(bucket int) (string, error) {
+		var buf bytes.Buffer
+		pools.bucket = bucket
+		err := filledTemplate.Execute(&buf, data)
+		return buf.String(), err
+	}
 
-	err = filledTemplate.Execute(&buf, data)
+	variant, err := render(0)
 	if err != nil {
 		return LookupElement{}, err
 	}
 
-	variant := buf.String()
-
-	return LookupElement{
+	element := LookupElement{
 		IPMap:   ipMap,
 		PAC:     pac,
 		Variant: variant,
-	}, nil
+		proxies: proxies,
+	}
+	if len(pools.pools) > 0 {
+		// the orders are compared for the pools declared while rendering the first bucket
+		variants, buckets, err := renderClientVariants(pools.pools, variant, render)
+		if err != nil {
+			return LookupElement{}, err
+		}
+		// e.g. pools of a single proxy serve all clients alike
+		if len(variants) > 1 {
+			element.clientVariants, element.clientBuckets = variants, buckets
+		}
+	}
+	return element, nil
 }
@@ -11,29 +11,48 @@ package internal
  */
 
 import (
+	"context"
+	"time"
+
 	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/IP"
 	"github.com/timeforaninja/pacserver/pkg/utils"
 )
 
+// policies for networks that are mapped more than once
+const (
+	DuplicateZonesLast  = "last"
+	DuplicateZonesFirst = "first"
+	DuplicateZonesError = "error"
+)
+
 var (
 	cachedIPMaps = make([]*ipMap, 0)
 	cachedPACs   = make([]*pacTemplate, 0)
+	// cachedFallbackPACs is the amount of cachedPACs missing in the latest load of PACs
+	cachedFallbackPACs = 0
 )
 
-// buildLookupElementList reads the IPMap and PACFiles from disk
+// buildLookupElementList reads the IPMap and PACFiles from the providers
 // and tries to convert them into a flat list of Lookup Elements
-func buildLookupElementList(ipMapFile, pacRoot, contactInfo string) ([]*LookupElement, int) {
-	problemCounter := 0
+// every network is contained only once, see resolveDuplicateZones,
+// and only the zones active at now are contained, see filterActiveZones
+func buildLookupElementList(ctx context.Context, zones ZoneProvider, pacs PACProvider, contactInfo, duplicates string, now time.Time) ([]*LookupElement, loadProblems) {
+	problems := loadProblems{}
 	// store current cached PACs
 	// they can be useful when calculating LookupElements
 	// if some pac has been partially deleted by accident
 	oldPACs := cachedPACs
 
 	// read new PACs / Zones
-	newIPMaps, err1, probs1 := readIPMap(ipMapFile)
-	problemCounter += probs1
-	newPACs, err2, probs2 := readTemplateFiles(pacRoot)
-	problemCounter += probs2
+	span := traceLoad(ctx, "readIPMap")
+	newIPMaps, err1, probs1 := zones.LoadZones()
+	endLoad(span, len(newIPMaps), probs1, err1)
+	problems.Zones += probs1
+	span = traceLoad(ctx, "readTemplateFiles")
+	newPACs, err2, probs2 := pacs.LoadPACs()
+	endLoad(span, len(newPACs), probs2, err2)
+	problems.PACs += probs2
 
 	// check if the loading worked
 	// if not print error and try to use cached version
@@ -41,21 +60,73 @@ func buildLookupElementList(ipMapFile, pacRoot, contactInfo string) ([]*LookupEl
 	if err1 != nil && err2 != nil {
 		log.Errorf("Completely failed to load IPMap and PACs - keep serving cached data")
 		// no need to recalculate Tree since nothing can change
-		return nil, 2
+		return nil, loadProblems{Zones: 1, PACs: 1}
 	} else if err1 != nil {
 		log.Errorf("Completely failed to load IPMap - loading new PACs with cached Zones")
 		newIPMaps = cachedIPMaps
-		problemCounter++
+		problems.Zones++
 	} else if err2 != nil {
 		log.Errorf("Completely failed to load PACs - loading new Zones with cached PACs")
 		newPACs = oldPACs
-		problemCounter++
+		problems.PACs++
 	}
 
-	list, keepPACs, probs3 := matchIPMapToPac(newPACs, oldPACs, newIPMaps, contactInfo)
+	list, keepPACs, probs3 := matchIPMapToPac(newPACs, oldPACs, filterActiveZones(newIPMaps, now), contactInfo)
+	problems.Matching += probs3
+	list, probs4, rejected := resolveDuplicateZones(list, duplicates)
+	problems.Duplicates += probs4
+	if rejected {
+		log.Errorf("Found %d conflicting zones - keep serving cached data", probs4)
+		return nil, problems
+	}
 	cachedPACs = append(newPACs, keepPACs...)
 	cachedIPMaps = newIPMaps
-	return list, probs3 + problemCounter
+	cachedFallbackPACs = len(keepPACs)
+	return list, problems
+}
+
+// resolveDuplicateZones makes sure every network is only contained once
+// identical networks that are served differently (PAC or rendered variant) are conflicts,
+// each conflict is reported as a problem and the policy decides which element is kept.
+// with the error policy, the whole list is rejected if there is any conflict.
+// an active scheduled zone is no conflict, it takes precedence over the unscheduled zone of the same network
+func resolveDuplicateZones(elements []*LookupElement, policy string) ([]*LookupElement, int, bool) {
+	problemCounter := 0
+	res := make([]*LookupElement, 0, len(elements))
+	// index of each network in res
+	seen := make(map[IP.Net]int)
+	for _, e := range elements {
+		i, ok := seen[e.IPMap.IPNet]
+		if !ok {
+			seen[e.IPMap.IPNet] = len(res)
+			res = append(res, e)
+			continue
+		}
+
+		kept := res[i]
+		// the elements only contain active zones, see filterActiveZones
+		if kept.IPMap.isScheduled() != e.IPMap.isScheduled() {
+			if e.IPMap.isScheduled() {
+				res[i] = e
+			}
+			continue
+		}
+		if !kept.isIdenticalPAC(*e) || !kept.isIdenticalVariant(e) {
+			resolution := "rejecting all zones"
+			if policy != DuplicateZonesError {
+				resolution = "using the " + policy + " one"
+			}
+			log.Errorf(
+				"Conflicting definitions for zone %s: \"%s\" maps it to pac(%s), \"%s\" maps it to pac(%s) - %s",
+				e.IPMap.IPNet.ToString(), kept.IPMap.Source, kept.IPMap.Filename, e.IPMap.Source, e.IPMap.Filename, resolution,
+			)
+			problemCounter++
+		}
+		if policy == DuplicateZonesLast {
+			res[i] = e
+		}
+	}
+	return res, problemCounter, policy == DuplicateZonesError && problemCounter > 0
 }
 
 func matchIPMapToPac(newPACs, oldPACs []*pacTemplate, newIPMaps []*ipMap, contact string) ([]*LookupElement, []*pacTemplate, int) {
@@ -100,7 +171,9 @@ func matchIPMapToPac(newPACs, oldPACs []*pacTemplate, newIPMaps []*ipMap, contac
 		// if we found a match (after checking new and cached PACs)
 		// then try to parse it
 		if match != nil {
-			le, err := NewLookupElement(ipm, match, contact)
+			canaryPAC, problems := matchCanaryPAC(ipm, newPACs, oldPACs, keepPACs)
+			problemCounter += problems
+			le, err := newZoneElement(ipm, match, canaryPAC, contact)
 			if err != nil {
 				// NewLookupElement only fails when the Template could not be filled with the variables
 				// Log it, and recover by skipping this zone
@@ -113,3 +186,38 @@ func matchIPMapToPac(newPACs, oldPACs []*pacTemplate, newIPMaps []*ipMap, contac
 	}
 	return res, utils.MapToArray(keepPACs), problemCounter
 }
+
+// matchCanaryPAC finds the canary PAC of the zone, like matchIPMapToPac does for its PAC
+// without a canary PAC, the zone serves its PAC to all clients
+func matchCanaryPAC(ipm *ipMap, newPACs, oldPACs []*pacTemplate, keepPACs map[string]*pacTemplate) (*pacTemplate, int) {
+	if ipm.Canary == nil {
+		return nil, 0
+	}
+	for _, p := range newPACs {
+		if p.Filename == ipm.Canary.Filename {
+			return p, 0
+		}
+	}
+	for _, p := range oldPACs {
+		if p.Filename == ipm.Canary.Filename {
+			log.Warnf("Unknown canary PAC %s, using available Cached Version", ipm.Canary.Filename)
+			keepPACs[p.Filename] = p
+			return p, 1
+		}
+	}
+	log.Warnf("Unknown canary PAC %s, no Cached Version available, serving %s to all clients of zone %s", ipm.Canary.Filename, ipm.Filename, ipm.IPNet.ToString())
+	return nil, 1
+}
+
+// elementPACs returns the PACs of the elements, each of them once
+func elementPACs(elements []*LookupElement) []*pacTemplate {
+	pacs := make([]*pacTemplate, 0)
+	seen := make(map[*pacTemplate]bool)
+	for _, e := range elements {
+		if !seen[e.PAC] {
+			seen[e.PAC] = true
+			pacs = append(pacs, e.PAC)
+		}
+	}
+	return pacs
+}
@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMatchIPMapToPac(t *testing.T) {
@@ -171,4 +174,249 @@ func TestMatchIPMapToPac(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+// memoryZoneProvider is an in-memory ZoneProvider for testing
+type memoryZoneProvider struct {
+	zones    []*ipMap
+	err      error
+	problems int
+}
+
+func (p memoryZoneProvider) LoadZones() ([]*ipMap, error, int) {
+	return p.zones, p.err, p.problems
+}
+
+// memoryPACProvider is an in-memory PACProvider for testing
+type memoryPACProvider struct {
+	pacs     []*pacTemplate
+	err      error
+	problems int
+}
+
+func (p memoryPACProvider) LoadPACs() ([]*pacTemplate, error, int) {
+	return p.pacs, p.err, p.problems
+}
+
+func TestBuildLookupElementList(t *testing.T) {
+	// buildLookupElementList works on the global cache, so this test can not run in parallel
+	defer func() {
+		cachedIPMaps = make([]*ipMap, 0)
+		cachedPACs = make([]*pacTemplate, 0)
+	}()
+
+	pac1 := &pacTemplate{Filename: "test1.pac", content: "// test1 by {{ .Contact }}"}
+	pac2 := &pacTemplate{Filename: "test2.pac", content: "// test2 by {{ .Contact }}"}
+	zone1 := &ipMap{IPNet: forceIPNet("192.168.0.0", 24), Filename: "test1.pac"}
+	zone2 := &ipMap{IPNet: forceIPNet("10.0.0.0", 8), Filename: "test2.pac"}
+	zone3 := &ipMap{IPNet: forceIPNet("172.16.0.0", 12), Filename: "test1.pac"}
+	errForced := errors.New("forced failure")
+
+	// the steps run in order, each one starting with the cache of the previous one
+	steps := []struct {
+		name          string
+		zones         memoryZoneProvider
+		pacs          memoryPACProvider
+		wantNil       bool
+		wantElements  int
+		wantProbCount int
+		wantCached    int
+	}{
+		{
+			name:          "Initial load",
+			zones:         memoryZoneProvider{zones: []*ipMap{zone1, zone2}},
+			pacs:          memoryPACProvider{pacs: []*pacTemplate{pac1, pac2}},
+			wantElements:  2,
+			wantProbCount: 0,
+			wantCached:    2,
+		},
+		{
+			name:          "Provider problems are counted",
+			zones:         memoryZoneProvider{zones: []*ipMap{zone1, zone2}, problems: 2},
+			pacs:          memoryPACProvider{pacs: []*pacTemplate{pac1, pac2}, problems: 1},
+			wantElements:  2,
+			wantProbCount: 3,
+			wantCached:    2,
+		},
+		{
+			name:          "Deleted PAC is served from cache",
+			zones:         memoryZoneProvider{zones: []*ipMap{zone1, zone2}},
+			pacs:          memoryPACProvider{pacs: []*pacTemplate{pac1}},
+			wantElements:  2,
+			wantProbCount: 1,
+			wantCached:    2,
+		},
+		{
+			name:          "Zones fail, cached zones are used",
+			zones:         memoryZoneProvider{err: errForced, problems: 1},
+			pacs:          memoryPACProvider{pacs: []*pacTemplate{pac1, pac2}},
+			wantElements:  2,
+			wantProbCount: 2,
+			wantCached:    2,
+		},
+		{
+			name:          "PACs fail, cached PACs are used",
+			zones:         memoryZoneProvider{zones: []*ipMap{zone1, zone2, zone3}},
+			pacs:          memoryPACProvider{err: errForced, problems: 1},
+			wantElements:  3,
+			wantProbCount: 2,
+			wantCached:    3,
+		},
+		{
+			name:          "Both fail",
+			zones:         memoryZoneProvider{err: errForced, problems: 1},
+			pacs:          memoryPACProvider{err: errForced, problems: 1},
+			wantNil:       true,
+			wantProbCount: 2,
+			wantCached:    3,
+		},
+	}
+
+	for _, step := range steps {
+		elements, problems := buildLookupElementList(context.Background(), step.zones, step.pacs, "Test Contact", DuplicateZonesLast, time.Now())
+		probCount := problems.total()
+
+		if step.wantNil && elements != nil {
+			t.Errorf("%s: buildLookupElementList() returned %d elements, want nil", step.name, len(elements))
+		}
+		if !step.wantNil && len(elements) != step.wantElements {
+			t.Errorf("%s: buildLookupElementList() returned %d elements, want %d", step.name, len(elements), step.wantElements)
+		}
+		if probCount != step.wantProbCount {
+			t.Errorf("%s: buildLookupElementList() returned problem count %d, want %d", step.name, probCount, step.wantProbCount)
+		}
+		if len(cachedIPMaps) != step.wantCached {
+			t.Errorf("%s: %d zones cached, want %d", step.name, len(cachedIPMaps), step.wantCached)
+		}
+	}
+}
+
+func TestResolveDuplicateZones(t *testing.T) {
+	// createZone creates an element read from source
+	createZone := func(ip string, cidr int, filename, source string) *LookupElement {
+		le := createLookupElement(ip, cidr, filename)
+		le.IPMap.Source = source
+		le.Variant = "// " + filename
+		return le
+	}
+	// scheduled limits the zone to a validity window, it is still active
+	scheduled := func(le *LookupElement) *LookupElement {
+		le.IPMap.ValidUntil = timePtr(time.Now().Add(time.Hour))
+		return le
+	}
+
+	tests := []struct {
+		name         string
+		elements     []*LookupElement
+		policy       string
+		wantPACs     []string
+		wantProblems int
+		wantRejected bool
+	}{
+		{
+			name: "No duplicates",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				createZone("10.0.0.0", 16, "b.pac", "b.csv"),
+			},
+			policy:   DuplicateZonesError,
+			wantPACs: []string{"a.pac", "b.pac"},
+		},
+		{
+			name: "Same prefix and PAC in two files",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				createZone("10.0.0.0", 8, "a.pac", "b.csv"),
+			},
+			policy:   DuplicateZonesError,
+			wantPACs: []string{"a.pac"},
+		},
+		{
+			name: "Same prefix and PAC with a different variant",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				{IPMap: createZone("10.0.0.0", 8, "a.pac", "a.csv").IPMap, PAC: &pacTemplate{Filename: "a.pac"}, Variant: "// other vars"},
+			},
+			policy:       DuplicateZonesLast,
+			wantPACs:     []string{"a.pac"},
+			wantProblems: 1,
+		},
+		{
+			name: "Last wins",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				createZone("172.16.0.0", 12, "c.pac", "a.csv"),
+				createZone("10.0.0.0", 8, "b.pac", "b.csv"),
+			},
+			policy:       DuplicateZonesLast,
+			wantPACs:     []string{"b.pac", "c.pac"},
+			wantProblems: 1,
+		},
+		{
+			name: "First wins",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				createZone("10.0.0.0", 8, "b.pac", "a.csv"),
+				createZone("10.0.0.0", 8, "c.pac", "b.csv"),
+			},
+			policy:       DuplicateZonesFirst,
+			wantPACs:     []string{"a.pac"},
+			wantProblems: 2,
+		},
+		{
+			name: "Error rejects the zones",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				createZone("10.0.0.0", 8, "b.pac", "a.csv"),
+			},
+			policy:       DuplicateZonesError,
+			wantPACs:     []string{"a.pac"},
+			wantProblems: 1,
+			wantRejected: true,
+		},
+		{
+			name: "Scheduled zone takes precedence",
+			elements: []*LookupElement{
+				createZone("10.0.0.0", 8, "a.pac", "a.csv"),
+				scheduled(createZone("10.0.0.0", 8, "drill.pac", "b.csv")),
+			},
+			policy:   DuplicateZonesError,
+			wantPACs: []string{"drill.pac"},
+		},
+		{
+			name: "Scheduled zone takes precedence over a later one",
+			elements: []*LookupElement{
+				scheduled(createZone("10.0.0.0", 8, "drill.pac", "a.csv")),
+				createZone("10.0.0.0", 8, "a.pac", "b.csv"),
+			},
+			policy:   DuplicateZonesLast,
+			wantPACs: []string{"drill.pac"},
+		},
+		{
+			name: "Two scheduled zones conflict",
+			elements: []*LookupElement{
+				scheduled(createZone("10.0.0.0", 8, "drill.pac", "a.csv")),
+				scheduled(createZone("10.0.0.0", 8, "move.pac", "b.csv")),
+			},
+			policy:       DuplicateZonesFirst,
+			wantPACs:     []string{"drill.pac"},
+			wantProblems: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems, rejected := resolveDuplicateZones(tt.elements, tt.policy)
+			if problems != tt.wantProblems || rejected != tt.wantRejected {
+				t.Errorf("resolveDuplicateZones() problems = %d, rejected = %v, want %d, %v", problems, rejected, tt.wantProblems, tt.wantRejected)
+			}
+			if len(got) != len(tt.wantPACs) {
+				t.Fatalf("resolveDuplicateZones() returned %d elements, want %d", len(got), len(tt.wantPACs))
+			}
+			for i, e := range got {
+				if e.IPMap.Filename != tt.wantPACs[i] {
+					t.Errorf("resolveDuplicateZones()[%d] = %s, want %s", i, e.IPMap.Filename, tt.wantPACs[i])
+				}
+			}
+		})
+	}
+}
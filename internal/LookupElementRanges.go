@@ -0,0 +1,62 @@
+package internal
+
+/**
+ * the lookup tree nests zones, so the PAC served for an IP is the one of the most specific zone
+ *
+ * this file flattens a tree into its effective ranges:
+ * a sorted list of non-overlapping IP ranges covering the whole tree,
+ * each with the Lookup Element that is served for the IPs in it
+ */
+
+type ipRange struct {
+	Start   uint32
+	End     uint32
+	Element *LookupElement
+}
+
+func effectiveRanges(root *lookupTreeNode) []ipRange {
+	ranges := make([]ipRange, 0)
+	net := root.data.IPMap.IPNet
+	// uint64 so the cursor can move past 255.255.255.255
+	collectRanges(root, uint64(net.NetworkAddress.Value), uint64(net.LastAddress().Value), &ranges)
+	return ranges
+}
+
+// collectRanges appends the ranges of start-end served by node or its children
+// the children are sorted by their network address, so we can walk them with a cursor
+func collectRanges(node *lookupTreeNode, start, end uint64, ranges *[]ipRange) {
+	cursor := start
+	for _, c := range node.children {
+		net := c.data.IPMap.IPNet
+		childStart, childEnd := uint64(net.NetworkAddress.Value), uint64(net.LastAddress().Value)
+		// only the part not covered by a previous child
+		// children never overlap, this only guards against malformed trees
+		if childStart < cursor {
+			childStart = cursor
+		}
+		if childEnd > end {
+			childEnd = end
+		}
+		if childStart > childEnd {
+			continue
+		}
+		if childStart > cursor {
+			appendRange(ranges, cursor, childStart-1, node.data)
+		}
+		collectRanges(c, childStart, childEnd, ranges)
+		cursor = childEnd + 1
+	}
+	if cursor <= end {
+		appendRange(ranges, cursor, end, node.data)
+	}
+}
+
+// appendRange adds the range, or extends the last one if it is served by the same element
+func appendRange(ranges *[]ipRange, start, end uint64, elem *LookupElement) {
+	last := len(*ranges) - 1
+	if last >= 0 && (*ranges)[last].Element == elem && uint64((*ranges)[last].End)+1 == start {
+		(*ranges)[last].End = uint32(end)
+		return
+	}
+	*ranges = append(*ranges, ipRange{Start: uint32(start), End: uint32(end), Element: elem})
+}
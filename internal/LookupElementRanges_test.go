@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// setupRangeTest sets the config buildLookupTree requires and restores it after the test
+func setupRangeTest(t *testing.T) {
+	t.Helper()
+	oldConf := confStorage
+	t.Cleanup(func() {
+		confStorage = oldConf
+	})
+	confStorage = &Config{DefaultPACFile: "default.pac", ContactInfo: "Test Contact"}
+}
+
+// stringifyRanges turns ranges into "first-last:filename" for easy comparison
+func stringifyRanges(ranges []ipRange) []string {
+	res := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		res = append(res, IP.IP{Value: r.Start}.ToString()+"-"+IP.IP{Value: r.End}.ToString()+":"+r.Element.IPMap.Filename)
+	}
+	return res
+}
+
+func TestEffectiveRanges(t *testing.T) {
+	setupRangeTest(t)
+
+	tests := []struct {
+		name     string
+		elements []*LookupElement
+		want     []string
+	}{
+		{
+			name: "Only the default",
+			want: []string{"0.0.0.0-255.255.255.255:default.pac"},
+		},
+		{
+			name: "Nested zones split their parent",
+			elements: []*LookupElement{
+				createLookupElement("10.0.0.0", 8, "company.pac"),
+				createLookupElement("10.1.0.0", 16, "office.pac"),
+				createLookupElement("10.1.2.0", 24, "lab.pac"),
+			},
+			want: []string{
+				"0.0.0.0-9.255.255.255:default.pac",
+				"10.0.0.0-10.0.255.255:company.pac",
+				"10.1.0.0-10.1.1.255:office.pac",
+				"10.1.2.0-10.1.2.255:lab.pac",
+				"10.1.3.0-10.1.255.255:office.pac",
+				"10.2.0.0-10.255.255.255:company.pac",
+				"11.0.0.0-255.255.255.255:default.pac",
+			},
+		},
+		{
+			name: "Adjacent siblings and the end of the address space",
+			elements: []*LookupElement{
+				createLookupElement("192.168.0.0", 24, "a.pac"),
+				createLookupElement("192.168.1.0", 24, "b.pac"),
+				createLookupElement("255.255.255.255", 32, "last.pac"),
+			},
+			want: []string{
+				"0.0.0.0-192.167.255.255:default.pac",
+				"192.168.0.0-192.168.0.255:a.pac",
+				"192.168.1.0-192.168.1.255:b.pac",
+				"192.168.2.0-255.255.255.254:default.pac",
+				"255.255.255.255-255.255.255.255:last.pac",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stringifyRanges(effectiveRanges(buildLookupTree(testDefaultPAC, tt.elements)))
+			if len(got) != len(tt.want) {
+				t.Fatalf("effectiveRanges() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("effectiveRanges()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -9,7 +9,6 @@ package internal
 
 import (
 	"fmt"
-	"github.com/gofiber/fiber/v2/log"
 	"sort"
 	"strings"
 
@@ -51,37 +50,46 @@ func _stringifyLookupStack(stack []*LookupElement) string {
 	return str
 }
 
+// insertTreeElement inserts elem below root
+// the children of every node are kept sorted by their network address and never overlap,
+// so the position of elem can be found with a binary search instead of scanning all children
 func insertTreeElement(root *lookupTreeNode, elem *LookupElement) {
-	newNode := &lookupTreeNode{data: elem, children: []*lookupTreeNode{}}
-
-	// Iterate backwards
-	// in case we need to remove an element this does not screw up the counter
-	for i := len(root.children) - 1; i >= 0; i-- {
-		child := root.children[i]
-		// Check if the elem is a subnet of the child
-		if elem.isSubnetOf(*child.data) {
-			insertTreeElement(child, elem)
-			return
-		}
-		// Check if the child is a subnet of the elem
-		// Or identical (which simply get stacked)
-		if child.data.isSubnetOf(*elem) || elem.isIdenticalNet(*root.data) {
-			// push child into new node
-			newNode.children = append(newNode.children, child)
-			// remove child from root
-			// watch out for doing i+1 on the last element
-			if i == len(root.children)-1 {
-				root.children = root.children[:i]
-			} else {
-				root.children = append(root.children[:i], root.children[i+1:]...)
-			}
-		}
+	start := elem.IPMap.IPNet.NetworkAddress.Value
+
+	// only the last child starting at or before elem can contain it
+	after := sort.Search(len(root.children), func(i int) bool {
+		return root.children[i].data.IPMap.IPNet.NetworkAddress.Value > start
+	})
+	if after > 0 && elem.isSubnetOf(*root.children[after-1].data) {
+		// identical networks get stacked, so the last inserted one is matched
+		insertTreeElement(root.children[after-1], elem)
+		return
+	}
+
+	// the children that are subnets of elem are a consecutive run starting at elem
+	// push them into the new node
+	first := sort.Search(len(root.children), func(i int) bool {
+		return root.children[i].data.IPMap.IPNet.NetworkAddress.Value >= start
+	})
+	last := first
+	for last < len(root.children) && root.children[last].data.isSubnetOf(*elem) {
+		last++
+	}
+	newNode := &lookupTreeNode{data: elem, children: make([]*lookupTreeNode, last-first)}
+	copy(newNode.children, root.children[first:last])
+
+	// replace the run by the new node
+	// when inserting in sorted order (see buildLookupTree) this is a plain append
+	if first == len(root.children) {
+		root.children = append(root.children, newNode)
+		return
 	}
-	// If no subnet relation found, add newNode as a child
-	root.children = append(root.children, newNode)
+	root.children = append(root.children[:first+1], root.children[last:]...)
+	root.children[first] = newNode
 }
 
-func buildLookupTree(elements []*LookupElement) *lookupTreeNode {
+// buildLookupTree builds the tree of the elements, its root is rendered from the default PAC defaultPAC
+func buildLookupTree(defaultPAC *LookupElement, elements []*LookupElement) *lookupTreeNode {
 	conf := GetConfig()
 	// build a "fake" root element
 	// this massively simplifies code since we
@@ -91,14 +99,20 @@ func buildLookupTree(elements []*LookupElement) *lookupTreeNode {
 	rootElement, _ := NewLookupElement(&ipMap{
 		IPNet:    rootIP,
 		Filename: conf.DefaultPACFile,
-	}, rootPAC.PAC, conf.ContactInfo)
+	}, defaultPAC.PAC, conf.ContactInfo)
 	var root = &lookupTreeNode{
 		data:     &rootElement,
 		children: make([]*lookupTreeNode, 0),
 	}
 
-	// insert one element after another into our tree
-	for _, elem := range elements {
+	// insert the elements sorted by their network, so every insert is an append
+	// the sort is stable, so the order of identical networks is kept
+	sorted := make([]*LookupElement, len(elements))
+	copy(sorted, elements)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].IPMap.CompareForSort(sorted[j].IPMap)
+	})
+	for _, elem := range sorted {
 		insertTreeElement(root, elem)
 	}
 
@@ -139,26 +153,46 @@ func simplifyTree(root *lookupTreeNode) {
 	root.children = simplifiedChildren
 }
 
-func findInTree(root *lookupTreeNode, ip *IP.Net) (*LookupElement, []*LookupElement) {
-	// Check for nil root to prevent panic
-	log.Debug("findInTree", root, ip.ToString())
-
-	for _, c := range root.children {
-		// Check for nil child data or IPMap to prevent panic
-		if c == nil || c.data == nil || c.data.IPMap == nil {
-			continue
-		}
+// findElementInTree returns the most specific element containing ip
+// it is the lookup of every request, so unlike findInTree it does not allocate
+func findElementInTree(root *lookupTreeNode, ip *IP.Net) *LookupElement {
+	node := root
+	for child := findChild(node, ip); child != nil; child = findChild(node, ip) {
+		node = child
+	}
+	return node.data
+}
 
-		if ip.IsSubnetOf(c.data.IPMap.IPNet) {
-			// Use a recursive call to check if we have more detailed children
-			node, stack := findInTree(c, ip)
-			// append to the front of the stack
-			stack = append([]*LookupElement{root.data}, stack...)
-			return node, stack
+// findInTree returns the most specific element containing ip
+// and the stack of all elements from the root down to it
+func findInTree(root *lookupTreeNode, ip *IP.Net) (*LookupElement, []*LookupElement) {
+	stack := []*LookupElement{root.data}
+	node := root
+	for {
+		child := findChild(node, ip)
+		if child == nil {
+			// no (more specific) child matched
+			return node.data, stack
 		}
+		stack = append(stack, child.data)
+		node = child
 	}
+}
 
-	// no child matched
-	// we return our dummy root as "default"-pac
-	return root.data, []*LookupElement{root.data}
+// findChild returns the child containing ip or nil
+// since the children are sorted and do not overlap,
+// only the last child starting at or before ip can contain it
+func findChild(node *lookupTreeNode, ip *IP.Net) *lookupTreeNode {
+	start := ip.NetworkAddress.Value
+	after := sort.Search(len(node.children), func(i int) bool {
+		return node.children[i].data.IPMap.IPNet.NetworkAddress.Value > start
+	})
+	if after == 0 {
+		return nil
+	}
+	child := node.children[after-1]
+	if !ip.IsSubnetOf(child.data.IPMap.IPNet) {
+		return nil
+	}
+	return child
 }
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// run with: go test ./internal -run '^$' -bench LookupTree -benchmem
+
+const benchmarkZones = 100_000
+
+// generateZones creates n random zones
+// nested zones are a mix of /16 regions, /24 sites and /28 subnets, like in a large enterprise
+func generateZones(n int, nested bool) []*LookupElement {
+	r := rand.New(rand.NewSource(42))
+	elements := make([]*LookupElement, 0, n)
+	for i := 0; i < n; i++ {
+		cidr := 24
+		if nested {
+			cidr = []int{16, 24, 24, 28, 28}[r.Intn(5)]
+		}
+		mask, _ := IP.NewCIDR(cidr)
+		filename := fmt.Sprintf("pac-%d.pac", i%50)
+		elements = append(elements, &LookupElement{
+			IPMap: &ipMap{
+				IPNet:    IP.Net{NetworkAddress: IP.IP{Value: r.Uint32() & mask.Mask}, CIDR: mask},
+				Filename: filename,
+			},
+			PAC:     &pacTemplate{Filename: filename},
+			Variant: filename,
+		})
+	}
+	return elements
+}
+
+// randomHosts creates the /32 networks to look up
+func randomHosts(n int) []*IP.Net {
+	r := rand.New(rand.NewSource(7))
+	hosts := make([]*IP.Net, n)
+	for i := range hosts {
+		hosts[i] = &IP.Net{NetworkAddress: IP.IP{Value: r.Uint32()}, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}
+	}
+	return hosts
+}
+
+// linearFindInTree is the previous lookup that scanned all children of a node
+// it is only kept to compare against
+func linearFindInTree(root *lookupTreeNode, ip *IP.Net) (*LookupElement, []*LookupElement) {
+	for _, c := range root.children {
+		if ip.IsSubnetOf(c.data.IPMap.IPNet) {
+			node, stack := linearFindInTree(c, ip)
+			return node, append([]*LookupElement{root.data}, stack...)
+		}
+	}
+	return root.data, []*LookupElement{root.data}
+}
+
+func benchmarkFind(b *testing.B, nested bool, find func(*lookupTreeNode, *IP.Net) (*LookupElement, []*LookupElement)) {
+	log.SetLevel(log.LevelInfo)
+	oldConf := confStorage
+	defer func() { confStorage = oldConf }()
+	confStorage = &Config{DefaultPACFile: "default.pac"}
+
+	tree := buildLookupTree(testDefaultPAC, generateZones(benchmarkZones, nested))
+	hosts := randomHosts(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		find(tree, hosts[i%len(hosts)])
+	}
+}
+
+func BenchmarkLookupTreeFindFlat(b *testing.B) {
+	benchmarkFind(b, false, findInTree)
+}
+
+func BenchmarkLookupTreeFindNested(b *testing.B) {
+	benchmarkFind(b, true, findInTree)
+}
+
+func BenchmarkLookupTreeFindFlatLinear(b *testing.B) {
+	benchmarkFind(b, false, linearFindInTree)
+}
+
+func BenchmarkLookupTreeFindNestedLinear(b *testing.B) {
+	benchmarkFind(b, true, linearFindInTree)
+}
+
+func BenchmarkLookupTreeBuild(b *testing.B) {
+	log.SetLevel(log.LevelInfo)
+	oldConf := confStorage
+	defer func() { confStorage = oldConf }()
+	confStorage = &Config{DefaultPACFile: "default.pac"}
+
+	elements := generateZones(benchmarkZones, true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buildLookupTree(testDefaultPAC, elements)
+	}
+}
+
+// benchmarkFindPAC looks up a busy floor of 1024 clients, which fits into the lookup cache
+func benchmarkFindPAC(b *testing.B, cacheSize int) {
+	log.SetLevel(log.LevelInfo)
+	oldConf, oldServed := confStorage, served.Load()
+	defer func() { confStorage = oldConf; served.Store(oldServed) }()
+	confStorage = &Config{DefaultPACFile: "default.pac"}
+	initLookupCache(cacheSize, 32)
+	defer initLookupCache(0, 32)
+
+	served.Store(&servedData{tree: buildLookupTree(testDefaultPAC, generateZones(benchmarkZones, true)), root: testDefaultPAC})
+	hosts := randomHosts(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findPAC(hosts[i%len(hosts)].NetworkAddress, 32)
+	}
+}
+
+func BenchmarkLookupTreeFindPAC(b *testing.B) {
+	benchmarkFindPAC(b, 0)
+}
+
+func BenchmarkLookupTreeFindPACCached(b *testing.B) {
+	benchmarkFindPAC(b, 4096)
+}
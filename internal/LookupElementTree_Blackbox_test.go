@@ -107,7 +107,7 @@ func TestBuildAndFindCombined(t *testing.T) {
 			}
 
 			// Build the tree
-			tree := buildLookupTree(tt.elements)
+			tree := buildLookupTree(testDefaultPAC, tt.elements)
 
 			// Verify the tree is not nil
 			if tree == nil {
@@ -198,18 +198,16 @@ func createLookupElement(ip string, cidr int, filename string) *LookupElement {
 	return element
 }
 
+// testDefaultPAC is the default PAC the trees of the tests are built with
+var testDefaultPAC = &LookupElement{
+	PAC: &pacTemplate{
+		Filename: "default.pac",
+		content:  "// Default PAC file",
+	},
+}
+
 // Setup the test environment with necessary global variables
 func setupTestEnvironment() {
-	// Initialize rootPAC if needed
-	if rootPAC == nil {
-		rootPAC = &LookupElement{
-			PAC: &pacTemplate{
-				Filename: "default.pac",
-				content:  "// Default PAC file",
-			},
-		}
-	}
-
 	// Initialize config if needed
 	if confStorage == nil {
 		confStorage = &Config{
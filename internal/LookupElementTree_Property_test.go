@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// randomZoneSet creates n zones within 10.0.0.0/16
+// the space is small enough that nested, adjacent and identical networks are common
+func randomZoneSet(r *rand.Rand, n int) []*LookupElement {
+	elements := make([]*LookupElement, 0, n)
+	for i := 0; i < n; i++ {
+		mask, _ := IP.NewCIDR(16 + r.Intn(15))
+		addr := IP.IP{Value: (10<<24 | r.Uint32()&0xFFFF) & mask.Mask}
+		filename := fmt.Sprintf("pac-%d.pac", r.Intn(5))
+		elements = append(elements, &LookupElement{
+			IPMap:   &ipMap{IPNet: IP.Net{NetworkAddress: addr, CIDR: mask}, Filename: filename},
+			PAC:     &pacTemplate{Filename: filename},
+			Variant: filename,
+		})
+	}
+	return elements
+}
+
+// bruteForceMatch returns the element with the longest prefix containing ip, or nil
+// for identical prefixes the policy decides between the first and the last one
+func bruteForceMatch(elements []*LookupElement, ip *IP.Net, policy string) *LookupElement {
+	var best *LookupElement
+	for _, e := range elements {
+		if !ip.IsSubnetOf(e.IPMap.IPNet) {
+			continue
+		}
+		if best == nil || e.getRawCIDR() > best.getRawCIDR() ||
+			(e.getRawCIDR() == best.getRawCIDR() && policy == DuplicateZonesLast) {
+			best = e
+		}
+	}
+	return best
+}
+
+func TestLookupTreeMatchesLongestPrefix(t *testing.T) {
+	setupRangeTest(t)
+
+	for seed := int64(0); seed < 50; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		elements := randomZoneSet(r, 1+r.Intn(300))
+
+		for _, policy := range []string{DuplicateZonesFirst, DuplicateZonesLast} {
+			resolved, _, _ := resolveDuplicateZones(elements, policy)
+
+			// the tree has to cope with any insert order
+			shuffled := make([]*LookupElement, len(resolved))
+			copy(shuffled, resolved)
+			r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			tree := buildLookupTree(testDefaultPAC, shuffled)
+
+			// and also without the sorting done by buildLookupTree
+			unsorted := &lookupTreeNode{data: tree.data}
+			for _, e := range shuffled {
+				insertTreeElement(unsorted, e)
+			}
+
+			for i := 0; i < 500; i++ {
+				// mostly hosts within the zones, some outside of them
+				host := &IP.Net{NetworkAddress: IP.IP{Value: 10<<24 | r.Uint32()&0x1FFFF}, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}
+				want := bruteForceMatch(elements, host, policy)
+				if want == nil {
+					want = tree.data
+				}
+				if got, _ := findInTree(tree, host); got != want {
+					t.Fatalf("seed %d, policy %s: findInTree(%s) = %s, want %s", seed, policy, host.ToString(), got._stringify(), want._stringify())
+				}
+				if got, _ := findInTree(unsorted, host); got != want {
+					t.Fatalf("seed %d, policy %s: unsorted findInTree(%s) = %s, want %s", seed, policy, host.ToString(), got._stringify(), want._stringify())
+				}
+				if got := findElementInTree(tree, host); got != want {
+					t.Fatalf("seed %d, policy %s: findElementInTree(%s) = %s, want %s", seed, policy, host.ToString(), got._stringify(), want._stringify())
+				}
+			}
+		}
+	}
+}
@@ -246,14 +246,14 @@ func TestBuildLookupTree(t *testing.T) {
 	}
 
 	// prepare by defining required global objects
-	rootPAC = &LookupElement{PAC: &pacTemplate{}}
+	defaultPAC := &LookupElement{PAC: &pacTemplate{}}
 	confStorage = &Config{}
 
 	// Execute all the test cases
 	for _, testCase := range testCases {
 		t.Run(testCase.Name, func(t *testing.T) {
 			// call the function to test with the test case input and get the output
-			actualOutput := buildLookupTree(testCase.Input)
+			actualOutput := buildLookupTree(defaultPAC, testCase.Input)
 
 			if !simpleTreeCompare(testCase.Expected, actualOutput) {
 				t.Error("Tree differs from expected Tree")
@@ -462,3 +462,19 @@ func TestInsertTreeElement(t *testing.T) {
 		}
 	})
 }
+
+func TestFindInTreeMatchesLinearScan(t *testing.T) {
+	setupRangeTest(t)
+
+	for _, nested := range []bool{false, true} {
+		tree := buildLookupTree(testDefaultPAC, generateZones(5000, nested))
+		for _, host := range randomHosts(2000) {
+			want, wantStack := linearFindInTree(tree, host)
+			got, gotStack := findInTree(tree, host)
+			if got != want || len(gotStack) != len(wantStack) {
+				t.Fatalf("findInTree(%s) = %s with %d parents, want %s with %d parents (nested: %v)",
+					host.ToString(), got._stringify(), len(gotStack), want._stringify(), len(wantStack), nested)
+			}
+		}
+	}
+}
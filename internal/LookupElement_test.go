@@ -340,6 +340,21 @@ func TestNewLookupElement(t *testing.T) {
 			contactInfo:     "Test Contact",
 			wantErr:         false,
 		},
+		{
+			name: "Template with zone variables",
+			ipMap: &ipMap{
+				IPNet:     forceIPNet("192.168.0.0", 24),
+				Filename:  "test.pac",
+				Variables: map[string]string{"proxy": "proxy01:8080"},
+			},
+			pac: &pacTemplate{
+				Filename: "test.pac",
+				content:  "return \"PROXY {{ .Vars.proxy }}\"",
+			},
+			expectedVariant: "return \"PROXY proxy01:8080\"",
+			contactInfo:     "Test Contact",
+			wantErr:         false,
+		},
 		{
 			name: "Invalid template",
 			ipMap: &ipMap{
@@ -0,0 +1,204 @@
+package internal
+
+/**
+ * the access log records every request after the health routes
+ *
+ * "text" keeps the classic line per request, "json" and "logfmt" write a structured entry
+ * with the details of the lookup, i.e. the zone matched, the PAC served and a hash of its content.
+ *
+ * the PAC routes note the details of the lookup on the request, if the structured access log collected them,
+ * so the request path does not allocate with the text format
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// formats of the access log
+const (
+	AccessLogFormatText   = "text"
+	AccessLogFormatJSON   = "json"
+	AccessLogFormatLogfmt = "logfmt"
+)
+
+// accessDetailsKey stores the lookupDetails of a request in its locals
+type accessDetailsKey struct{}
+
+// lookupDetails are noted by servePAC for the access log
+type lookupDetails struct {
+	// zone is the element looked up, pac the one served, which differ for canary rollouts
+	zone    *LookupElement
+	pac     *LookupElement
+	lookup  IP.Net
+	content string
+	debug   bool
+}
+
+// accessLogEntry is a line of the structured access log
+type accessLogEntry struct {
+	Time   string `json:"time"`
+	Status int    `json:"status"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// ClientIP is the source of the connection, ResolvedIP the client after the proxyHeader, which is looked up
+	ClientIP   string `json:"client_ip"`
+	ResolvedIP string `json:"resolved_ip"`
+	// Lookup is the network looked up, which is the client for "/" and the requested network otherwise
+	Lookup      string  `json:"lookup,omitempty"`
+	Zone        string  `json:"zone,omitempty"`
+	PAC         string  `json:"pac,omitempty"`
+	Variant     string  `json:"variant,omitempty"`
+	ContentHash string  `json:"content_hash,omitempty"`
+	UserAgent   string  `json:"user_agent"`
+	Bytes       int     `json:"bytes"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Debug       bool    `json:"debug"`
+}
+
+// newAccessLogger returns the middleware writing the access log in the format to output
+func newAccessLogger(format string, output io.Writer) fiber.Handler {
+	if format == AccessLogFormatText {
+		return logger.New(logger.Config{
+			// For more options, see the Config section
+			Format:     "${time} ${ip} ${status} - ${method} ${path}\n",
+			TimeFormat: "2006-Jan-02 15:04:05",
+			Output:     output,
+		})
+	}
+
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		details := &lookupDetails{}
+		c.Locals(accessDetailsKey{}, details)
+
+		// like the text format, the error is handled here, so the entry has the status sent
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		entry := newAccessLogEntry(c, details, start)
+		var line []byte
+		if format == AccessLogFormatJSON {
+			var err error
+			line, err = json.Marshal(entry)
+			if err != nil {
+				log.Errorf("Error marshaling access log entry: %v", err)
+				return nil
+			}
+		} else {
+			line = []byte(entry.logfmt())
+		}
+		if _, err := output.Write(append(line, '\n')); err != nil {
+			log.Errorf("Failed to write access log: %v", err)
+		}
+		return nil
+	}
+}
+
+// noteLookup notes the details of a served PAC for the structured access log, if it collects them
+func noteLookup(c *fiber.Ctx, zone, pac *LookupElement, ipNet *IP.Net, content string, debug bool) {
+	details, ok := c.Locals(accessDetailsKey{}).(*lookupDetails)
+	if !ok {
+		return
+	}
+	details.zone, details.pac = zone, pac
+	details.lookup = *ipNet
+	details.content = content
+	details.debug = debug
+}
+
+func newAccessLogEntry(c *fiber.Ctx, details *lookupDetails, start time.Time) accessLogEntry {
+	entry := accessLogEntry{
+		Time:       start.Format(time.RFC3339Nano),
+		Status:     c.Response().StatusCode(),
+		Method:     c.Method(),
+		Path:       c.Path(),
+		ClientIP:   c.Context().RemoteIP().String(),
+		ResolvedIP: c.IP(),
+		UserAgent:  c.Get(fiber.HeaderUserAgent),
+		Bytes:      len(c.Response().Body()),
+		LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+		Debug:      details.debug,
+	}
+	if details.pac == nil {
+		return entry
+	}
+
+	entry.Lookup = details.lookup.ToString()
+	if zone := details.zone; zone.IPMap != nil && zone.IPMap.Filename != "" {
+		entry.Zone = zone.IPMap.IPNet.ToString()
+	}
+	switch {
+	case details.pac.IPMap != nil && details.pac.IPMap.Filename != "":
+		entry.PAC = details.pac.IPMap.Filename
+	case details.pac.PAC != nil:
+		entry.PAC = details.pac.PAC.Filename
+	}
+	entry.Variant = "stable"
+	if details.pac.isCanary {
+		entry.Variant = "canary"
+	}
+	sum := sha256.Sum256([]byte(details.content))
+	entry.ContentHash = shortHash(sum[:])
+	return entry
+}
+
+// logfmt formats the entry as key=value pairs in the order of the JSON fields
+func (e accessLogEntry) logfmt() string {
+	var b strings.Builder
+	pair := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(value))
+	}
+	optional := func(key, value string) {
+		if value != "" {
+			pair(key, value)
+		}
+	}
+
+	pair("time", e.Time)
+	pair("status", strconv.Itoa(e.Status))
+	pair("method", e.Method)
+	pair("path", e.Path)
+	pair("client_ip", e.ClientIP)
+	pair("resolved_ip", e.ResolvedIP)
+	optional("lookup", e.Lookup)
+	optional("zone", e.Zone)
+	optional("pac", e.PAC)
+	optional("variant", e.Variant)
+	optional("content_hash", e.ContentHash)
+	pair("user_agent", e.UserAgent)
+	pair("bytes", strconv.Itoa(e.Bytes))
+	pair("latency_ms", strconv.FormatFloat(e.LatencyMs, 'f', 3, 64))
+	pair("debug", strconv.FormatBool(e.Debug))
+	return b.String()
+}
+
+// logfmtValue quotes values that are empty or contain spaces, quotes, equal signs or control characters
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// setupAccessLogApp serves the PAC routes behind the access log in the format, as LaunchServer does
+func setupAccessLogApp(format string, config fiber.Config, output *bytes.Buffer) fasthttp.RequestHandler {
+	app := fiber.New(config)
+	app.Use(newAccessLogger(format, output))
+	registerPACRoutes(app, trackPACFile)
+	return app.Handler()
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	elements := webserverTestZones()
+	setupPACRoutes(t, elements)
+	office := elements[1]
+
+	confStorage.ProxyHeader = fiber.HeaderXForwardedFor
+	var output bytes.Buffer
+	handler := setupAccessLogApp(AccessLogFormatJSON, fiber.Config{ProxyHeader: fiber.HeaderXForwardedFor, EnableIPValidation: true}, &output)
+
+	tests := []struct {
+		name   string
+		uri    string
+		header string
+		want   accessLogEntry
+	}{
+		{name: "Source IP", uri: "/", want: accessLogEntry{
+			Status: 200, Method: "GET", Path: "/", ClientIP: "10.1.2.3", ResolvedIP: "10.1.2.3",
+			Lookup: "10.1.2.3/32", Zone: "10.1.2.0/24", PAC: "office.pac", Variant: "stable",
+			UserAgent: "test-agent", Bytes: len(office.Variant),
+		}},
+		{name: "Proxy header", uri: "/", header: "10.1.2.77, 172.16.0.1", want: accessLogEntry{
+			Status: 200, Method: "GET", Path: "/", ClientIP: "10.1.2.3", ResolvedIP: "10.1.2.77",
+			Lookup: "10.1.2.77/32", Zone: "10.1.2.0/24", PAC: "office.pac", Variant: "stable",
+			UserAgent: "test-agent", Bytes: len(office.Variant),
+		}},
+		{name: "Invalid proxy header", uri: "/", header: "unknown", want: accessLogEntry{
+			Status: 200, Method: "GET", Path: "/", ClientIP: "10.1.2.3", ResolvedIP: "10.1.2.3",
+			Lookup: "10.1.2.3/32", Zone: "10.1.2.0/24", PAC: "office.pac", Variant: "stable",
+			UserAgent: "test-agent", Bytes: len(office.Variant),
+		}},
+		{name: "Proxy header and debug", uri: "/10.1.2/24?debug", header: "172.16.0.1", want: accessLogEntry{
+			Status: 200, Method: "GET", Path: "/10.1.2/24", ClientIP: "10.1.2.3", ResolvedIP: "172.16.0.1",
+			Lookup: "10.1.2.0/24", Zone: "10.1.2.0/24", PAC: "office.pac", Variant: "stable",
+			UserAgent: "test-agent", Debug: true,
+		}},
+		{name: "Unmatched", uri: "/a/b/c", want: accessLogEntry{
+			Status: 404, Method: "GET", Path: "/a/b/c", ClientIP: "10.1.2.3", ResolvedIP: "10.1.2.3",
+			UserAgent: "test-agent", Bytes: len("Cannot GET /a/b/c"),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output.Reset()
+			ctx := newRequest(tt.uri, net.ParseIP("10.1.2.3"))
+			ctx.Request.Header.Set(fiber.HeaderUserAgent, "test-agent")
+			if tt.header != "" {
+				ctx.Request.Header.Set(fiber.HeaderXForwardedFor, tt.header)
+			}
+			handler(ctx)
+
+			if strings.Count(output.String(), "\n") != 1 {
+				t.Fatalf("access log = %q, want a single line", output.String())
+			}
+			var got accessLogEntry
+			if err := json.Unmarshal(output.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal() unexpected error: %v", err)
+			}
+			if got.Time == "" || got.LatencyMs < 0 {
+				t.Errorf("time = %q, latency_ms = %g", got.Time, got.LatencyMs)
+			}
+			if tt.want.PAC != "" {
+				sum := sha256.Sum256([]byte(office.Variant))
+				tt.want.ContentHash = shortHash(sum[:])
+			}
+			if tt.want.Debug {
+				// the debug output is larger than the PAC
+				tt.want.Bytes = len(ctx.Response.Body())
+			}
+			got.Time, got.LatencyMs = "", 0
+			if got != tt.want {
+				t.Errorf("access log entry = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogLogfmt(t *testing.T) {
+	setupPACRoutes(t, webserverTestZones())
+
+	var output bytes.Buffer
+	handler := setupAccessLogApp(AccessLogFormatLogfmt, fiber.Config{}, &output)
+	ctx := newRequest("/10.0.0.1", net.ParseIP("192.168.0.1"))
+	ctx.Request.Header.Set(fiber.HeaderUserAgent, `Mozilla/5.0 "test"`)
+	handler(ctx)
+
+	line := output.String()
+	for _, want := range []string{
+		"status=200 method=GET path=/10.0.0.1 client_ip=192.168.0.1 resolved_ip=192.168.0.1",
+		"lookup=10.0.0.1/32 zone=10.0.0.0/8 pac=company.pac variant=stable content_hash=",
+		`user_agent="Mozilla/5.0 \"test\""`,
+		"debug=false\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log = %q, does not contain %q", line, want)
+		}
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"":            `""`,
+		"office.pac":  "office.pac",
+		"two words":   `"two words"`,
+		"a=b":         `"a=b"`,
+		"line\nbreak": `"line\nbreak"`,
+	}
+	for value, want := range tests {
+		if got := logfmtValue(value); got != want {
+			t.Errorf("logfmtValue(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+/**
+ * the admin API allows managing a running server
+ *
+ * it is only enabled when an adminToken is configured,
+ * every request has to send it as "Authorization: Bearer <token>"
+ *
+ * the CLI uses the same API to talk to the running server,
+ * e.g. to roll back to a snapshot or to set an emergency override
+ */
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+const adminPrefix = "/admin"
+
+func registerAdminRoutes(app *fiber.App) {
+	token := GetConfig().AdminToken
+	if token == "" {
+		log.Debug("No adminToken configured - admin API is disabled")
+		return
+	}
+
+	admin := app.Group(adminPrefix, func(c *fiber.Ctx) error {
+		auth := c.Get(fiber.HeaderAuthorization)
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if auth == given || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid or missing admin token"})
+		}
+		return c.Next()
+	})
+
+	admin.Get("/snapshots", func(c *fiber.Ctx) error {
+		return c.JSON(listSnapshots())
+	})
+
+	admin.Post("/snapshots/:id/rollback", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid snapshot id"})
+		}
+		info, err := rollbackToSnapshot(id)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(info)
+	})
+
+	admin.Get("/ranges", func(c *fiber.Ctx) error {
+		format := c.Query("format", ExportFormatJSON)
+		if format == ExportFormatCSV {
+			c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		} else {
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		}
+		err := writeRanges(c, exportRanges(getServed().tree), format)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return nil
+	})
+
+	admin.Get("/overrides", func(c *fiber.Ctx) error {
+		return c.JSON(listOverrides())
+	})
+
+	admin.Post("/overrides", func(c *fiber.Ctx) error {
+		var req OverrideRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid override: " + err.Error()})
+		}
+		o, err := addOverride(req)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(fiber.StatusCreated).JSON(o)
+	})
+
+	// removes all overrides
+	admin.Delete("/overrides", func(c *fiber.Ctx) error {
+		removeOverride(0)
+		return c.JSON(listOverrides())
+	})
+
+	admin.Delete("/overrides/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid override id"})
+		}
+		if !removeOverride(id) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("no active override %d", id)})
+		}
+		return c.JSON(listOverrides())
+	})
+
+	admin.Get("/proxies", func(c *fiber.Ctx) error {
+		return c.JSON(listProxyStates())
+	})
+
+	admin.Get("/requests", func(c *fiber.Ctx) error {
+		return c.JSON(listRequestStats())
+	})
+
+	// any other admin route should not fall through to the PAC routes
+	admin.Use(func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown admin route"})
+	})
+}
+
+// AdminRequest sends a request to the admin API of the server running on this host
+// the body is sent as JSON, if not nil
+// it returns the response body, or an error if the server did not reply with 2xx
+func AdminRequest(method, path string, body []byte) ([]byte, error) {
+	conf := GetConfig()
+	if conf.AdminToken == "" {
+		return nil, fmt.Errorf("no adminToken configured")
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s%s", conf.Port, adminPrefix, path)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+conf.AdminToken)
+	if body != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server replied with %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
@@ -0,0 +1,167 @@
+package internal
+
+/**
+ * canary rollouts serve a new version of a PAC to a part of the clients of a zone first
+ *
+ * a zone references the canary PAC together with a percentage of its clients,
+ * the networks of its clients that get it, or both.
+ * the percentage is decided by a hash of the client IP, so a client keeps its decision across reloads
+ * and raising the percentage only adds clients to the canary.
+ *
+ * both versions are rendered when the zone is loaded, so serving a client only picks one of them
+ */
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/timeforaninja/pacserver/pkg/utils"
+)
+
+// canaryPoints is the resolution of the canary percentage, i.e. 0.01%
+const canaryPoints = 10000
+
+type zoneCanary struct {
+	// Filename of the canary PAC
+	Filename string `json:"Filename"`
+	// Percent of the clients of the zone served the canary PAC
+	Percent float64 `json:"Percent,omitempty"`
+	// Networks are served the canary PAC regardless of the percentage
+	Networks []IP.Net `json:"Networks,omitempty"`
+}
+
+type structuredCanary struct {
+	PAC      string   `yaml:"pac" json:"pac"`
+	Percent  float64  `yaml:"percent,omitempty" json:"percent,omitempty"`
+	Networks []string `yaml:"networks,omitempty" json:"networks,omitempty"`
+}
+
+// toZoneCanary validates the canary of the zone
+func (c structuredCanary) toZoneCanary(zone IP.Net) (*zoneCanary, error) {
+	if c.PAC == "" {
+		return nil, fmt.Errorf("the canary is missing its pac")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return nil, fmt.Errorf("the canary percent must be between 0 and 100: %g", c.Percent)
+	}
+	if c.Percent == 0 && len(c.Networks) == 0 {
+		return nil, fmt.Errorf("the canary requires a percent or networks")
+	}
+	nets := make([]IP.Net, 0, len(c.Networks))
+	for _, n := range c.Networks {
+		ipNet, err := IP.NewIPNetFromNotation(n)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse canary network \"%s\": %s", n, err.Error())
+		}
+		if !ipNet.IsSubnetOf(zone) {
+			return nil, fmt.Errorf("canary network %s is not part of the zone %s", n, zone.ToString())
+		}
+		nets = append(nets, ipNet)
+	}
+	return &zoneCanary{
+		Filename: utils.NormalizePath(c.PAC),
+		Percent:  c.Percent,
+		Networks: nets,
+	}, nil
+}
+
+// canaryPoint places the client on a scale of canaryPoints
+// it does not allocate, since it is used on the request path
+func canaryPoint(ip IP.IP) uint32 {
+	// the finalizer of murmur3, salted to be independent of the buckets of proxy pools
+	h := ip.Value ^ 0x5bd1e995
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h % canaryPoints
+}
+
+// selects checks if the client network is served the canary PAC
+func (c *zoneCanary) selects(client *IP.Net) bool {
+	return c.networkOf(client) != nil || c.includesPoint(canaryPoint(client.NetworkAddress))
+}
+
+// networkOf returns the canary network containing the client network, or nil
+func (c *zoneCanary) networkOf(client *IP.Net) *IP.Net {
+	for i := range c.Networks {
+		if client.IsSubnetOf(c.Networks[i]) {
+			return &c.Networks[i]
+		}
+	}
+	return nil
+}
+
+func (c *zoneCanary) includesPoint(point uint32) bool {
+	return float64(point) < c.Percent*canaryPoints/100
+}
+
+// reason explains the decision for the client network in the debug output
+func (c *zoneCanary) reason(client *IP.Net) string {
+	if n := c.networkOf(client); n != nil {
+		return "network " + n.ToString()
+	}
+	point := canaryPoint(client.NetworkAddress)
+	if c.includesPoint(point) {
+		return fmt.Sprintf("hash %d of %d is within %g%%", point, canaryPoints, c.Percent)
+	}
+	return fmt.Sprintf("hash %d of %d is outside of %g%%", point, canaryPoints, c.Percent)
+}
+
+// newZoneElement renders the element of a zone and, if canaryPAC is set, the canary next to it
+func newZoneElement(ipm *ipMap, pac, canaryPAC *pacTemplate, contactInfo string) (LookupElement, error) {
+	le, err := NewLookupElement(ipm, pac, contactInfo)
+	if err != nil || canaryPAC == nil {
+		return le, err
+	}
+	// the canary is served for the same zone, but shows its own PAC in the debug output and metrics
+	canaryMap := *ipm
+	canaryMap.Filename, canaryMap.Canary = canaryPAC.Filename, nil
+	canary, err := NewLookupElement(&canaryMap, canaryPAC, contactInfo)
+	if err != nil {
+		return LookupElement{}, fmt.Errorf("canary %s: %s", canaryPAC.Filename, err.Error())
+	}
+	canary.isCanary = true
+	le.canary = &canary
+	return le, nil
+}
+
+// canaryPAC returns the template of the canary, or nil
+func (le1 *LookupElement) canaryPAC() *pacTemplate {
+	if le1.canary == nil {
+		return nil
+	}
+	return le1.canary.PAC
+}
+
+// rolloutFor returns the element served to the client network, which is either the canary or the element itself
+func (le1 *LookupElement) rolloutFor(client *IP.Net) *LookupElement {
+	if le1.canary == nil {
+		return le1
+	}
+	if le1.IPMap.Canary.selects(client) {
+		return le1.canary
+	}
+	return le1
+}
+
+// debugCanary describes the decision for the client network in the debug output
+func (le1 *LookupElement) debugCanary(client *IP.Net) fiber.Map {
+	if le1.canary == nil {
+		return nil
+	}
+	c := le1.IPMap.Canary
+	networks := make([]string, len(c.Networks))
+	for i, n := range c.Networks {
+		networks[i] = n.ToString()
+	}
+	return fiber.Map{
+		"pac":      c.Filename,
+		"percent":  c.Percent,
+		"networks": networks,
+		"selected": c.selects(client),
+		"reason":   c.reason(client),
+	}
+}
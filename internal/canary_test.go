@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+func TestStructuredCanary(t *testing.T) {
+	t.Parallel()
+
+	zone := forceIPNet("10.43.0.0", 16)
+	tests := []struct {
+		name    string
+		canary  structuredCanary
+		wantErr bool
+	}{
+		{name: "Percentage", canary: structuredCanary{PAC: "v2\\germany.pac", Percent: 12.5}},
+		{name: "Networks", canary: structuredCanary{PAC: "germany-v2.pac", Networks: []string{"10.43.12.0/24", "10.43.13.7"}}},
+		{name: "Missing pac", canary: structuredCanary{Percent: 10}, wantErr: true},
+		{name: "Neither percent nor networks", canary: structuredCanary{PAC: "germany-v2.pac"}, wantErr: true},
+		{name: "Percent above 100", canary: structuredCanary{PAC: "germany-v2.pac", Percent: 101}, wantErr: true},
+		{name: "Negative percent", canary: structuredCanary{PAC: "germany-v2.pac", Percent: -1}, wantErr: true},
+		{name: "Invalid network", canary: structuredCanary{PAC: "germany-v2.pac", Networks: []string{"10.43.300.0/24"}}, wantErr: true},
+		{name: "Network outside of the zone", canary: structuredCanary{PAC: "germany-v2.pac", Networks: []string{"10.44.0.0/24"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.canary.toZoneCanary(zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("toZoneCanary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (strings.Contains(got.Filename, "\\") || len(got.Networks) != len(tt.canary.Networks)) {
+				t.Errorf("toZoneCanary() = %+v", got)
+			}
+		})
+	}
+
+	zones, errs, err := parseStructuredZones([]byte(`
+zones:
+  - network: 10.43.0.0/16
+    pac: germany.pac
+    canary:
+      pac: germany-v2.pac
+      percent: 10
+      networks: [10.43.12.0/24]
+  - network: 10.44.0.0/16
+    pac: germany.pac
+    canary:
+      pac: germany-v2.pac
+`), false)
+	if err != nil || len(zones) != 1 || len(errs) != 1 {
+		t.Fatalf("parseStructuredZones() = %d zones, %v, %v, want one zone and one error", len(zones), errs, err)
+	}
+	if c := zones[0].Canary; c == nil || c.Filename != "germany-v2.pac" || c.Percent != 10 || len(c.Networks) != 1 {
+		t.Errorf("parseStructuredZones() canary = %+v", c)
+	}
+}
+
+func TestCanarySelects(t *testing.T) {
+	t.Parallel()
+
+	client := func(ip string) *IP.Net {
+		return createIPNet(ip, 32)
+	}
+	networks := &zoneCanary{Filename: "v2.pac", Networks: []IP.Net{forceIPNet("10.43.12.0", 24)}}
+	if !networks.selects(client("10.43.12.7")) || !strings.Contains(networks.reason(client("10.43.12.7")), "10.43.12.0/24") {
+		t.Errorf("selects() for a canary network = false, %q", networks.reason(client("10.43.12.7")))
+	}
+	if networks.selects(client("10.43.13.7")) {
+		t.Errorf("selects() selected a client outside of the canary networks without a percentage")
+	}
+	if networks.selects(createIPNet("10.43.0.0", 16)) {
+		t.Errorf("selects() selected a network larger than the canary network")
+	}
+
+	// the share of selected clients follows the percentage, and raising it only adds clients
+	selectedAt := func(percent float64) map[uint32]bool {
+		c := &zoneCanary{Filename: "v2.pac", Percent: percent}
+		selected := make(map[uint32]bool)
+		for i := uint32(0); i < 1<<16; i++ {
+			if c.selects(&IP.Net{NetworkAddress: IP.IP{Value: 10<<24 | i}}) {
+				selected[i] = true
+			}
+		}
+		return selected
+	}
+	previous := selectedAt(0)
+	if len(previous) != 0 {
+		t.Errorf("0%% selected %d clients", len(previous))
+	}
+	for _, percent := range []float64{1, 10, 50, 100} {
+		current := selectedAt(percent)
+		if share := float64(len(current)) / (1 << 16) * 100; share < percent*0.8 || share > percent*1.2 {
+			t.Errorf("%g%% selected %.2f%% of the clients", percent, share)
+		}
+		for i := range previous {
+			if !current[i] {
+				t.Errorf("client %d left the canary when raising it to %g%%", i, percent)
+				break
+			}
+		}
+		previous = current
+	}
+}
+
+func TestMatchCanaryPAC(t *testing.T) {
+	t.Parallel()
+
+	stable := &pacTemplate{Filename: "germany.pac", content: "// stable"}
+	canary := &pacTemplate{Filename: "germany-v2.pac", content: "// canary by {{ .Contact }}"}
+	zone := func() *ipMap {
+		return &ipMap{
+			IPNet:    forceIPNet("10.43.0.0", 16),
+			Filename: "germany.pac",
+			Canary:   &zoneCanary{Filename: "germany-v2.pac", Percent: 10},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		newPACs      []*pacTemplate
+		oldPACs      []*pacTemplate
+		wantCanary   string
+		wantProblems int
+		wantKept     int
+	}{
+		{name: "Canary PAC loaded", newPACs: []*pacTemplate{stable, canary}, wantCanary: "// canary by Test Contact"},
+		{name: "Canary PAC from cache", newPACs: []*pacTemplate{stable}, oldPACs: []*pacTemplate{canary}, wantCanary: "// canary by Test Contact", wantProblems: 1, wantKept: 1},
+		{name: "Canary PAC missing", newPACs: []*pacTemplate{stable}, wantProblems: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, kept, problems := matchIPMapToPac(tt.newPACs, tt.oldPACs, []*ipMap{zone()}, "Test Contact")
+			if len(list) != 1 || list[0].Variant != "// stable" {
+				t.Fatalf("matchIPMapToPac() = %d elements, want the stable zone", len(list))
+			}
+			if problems != tt.wantProblems || len(kept) != tt.wantKept {
+				t.Errorf("matchIPMapToPac() = %d problems and %d kept PACs, want %d and %d", problems, len(kept), tt.wantProblems, tt.wantKept)
+			}
+			got := ""
+			if c := list[0].canary; c != nil {
+				got = c.Variant
+				if !c.isCanary || c.IPMap.Filename != "germany-v2.pac" || c.IPMap.Canary != nil {
+					t.Errorf("matchIPMapToPac() canary = %+v", c.IPMap)
+				}
+			}
+			if got != tt.wantCanary {
+				t.Errorf("matchIPMapToPac() canary variant = %q, want %q", got, tt.wantCanary)
+			}
+		})
+	}
+}
+
+func TestPACRoutesCanary(t *testing.T) {
+	zone := &ipMap{
+		IPNet:    forceIPNet("10.0.0.0", 8),
+		Filename: "company.pac",
+		Canary:   &zoneCanary{Filename: "company-v2.pac", Percent: 25, Networks: []IP.Net{forceIPNet("10.9.0.0", 16)}},
+	}
+	e, err := newZoneElement(zone, &pacTemplate{Filename: "company.pac", content: "// stable"}, &pacTemplate{Filename: "company-v2.pac", content: "// canary"}, "Test Contact")
+	if err != nil {
+		t.Fatalf("newZoneElement() unexpected error: %v", err)
+	}
+	handler := setupPACRoutes(t, []*LookupElement{&e})
+
+	// the canary network and the percentage of the other clients get the canary
+	canaries := 0
+	for i := 1; i <= 200; i++ {
+		client := net.IPv4(10, 1, 0, byte(i))
+		ctx := newRequest("/", client)
+		handler(ctx)
+		ip, _ := IP.ParseIP(client.String())
+		want := "// stable"
+		if canaryPoint(ip) < canaryPoints/4 {
+			want = "// canary"
+			canaries++
+		}
+		if got := string(ctx.Response.Body()); got != want {
+			t.Errorf("GET / from %s = %q, want %q", client, got, want)
+		}
+	}
+	if canaries == 0 || canaries == 200 {
+		t.Fatalf("%d of 200 clients got the canary, want about 50", canaries)
+	}
+	ctx := newRequest("/", net.ParseIP("10.9.1.1"))
+	handler(ctx)
+	if got := string(ctx.Response.Body()); got != "// canary" {
+		t.Errorf("GET / from the canary network = %q", got)
+	}
+
+	// the decision is shown in the debug output
+	ctx = newRequest("/10.9.1.1?debug", net.ParseIP("192.168.0.1"))
+	handler(ctx)
+	body := string(ctx.Response.Body())
+	for _, want := range []string{`"canary": {`, `"selected": true`, `"reason": "network 10.9.0.0/16"`, "pac(company-v2.pac)", "10.0.0.0/8 | pac(company.pac)"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /10.9.1.1?debug does not contain %q:\n%s", want, body)
+		}
+	}
+
+	// both versions are counted separately
+	stable := testutil.ToFloat64(pacFileCounter.WithLabelValues("company.pac", "stable"))
+	canary := testutil.ToFloat64(pacFileCounter.WithLabelValues("company-v2.pac", "canary"))
+	handler(newRequest("/", net.ParseIP("10.9.1.1")))
+	if got := testutil.ToFloat64(pacFileCounter.WithLabelValues("company-v2.pac", "canary")); got != canary+1 {
+		t.Errorf("app_pac_file_total{variant=\"canary\"} = %g, want %g", got, canary+1)
+	}
+	if got := testutil.ToFloat64(pacFileCounter.WithLabelValues("company.pac", "stable")); got != stable {
+		t.Errorf("app_pac_file_total{variant=\"stable\"} = %g, want %g", got, stable)
+	}
+
+	ctx = newRequest("/", net.ParseIP("10.9.1.1"))
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+		ctx.Response.Reset()
+	})
+	if allocs > 0 {
+		t.Errorf("GET / of a canary allocates %.1f times per request", allocs)
+	}
+
+	// the canary survives a snapshot
+	pacs := make(map[string]string)
+	restored := persistElement(&e, pacs).restore(map[string]*pacTemplate{"company.pac": e.PAC, "company-v2.pac": e.canary.PAC})
+	if restored.canary == nil || !restored.canary.isCanary || !restored.isIdenticalVariant(&e) || pacs["company-v2.pac"] != "// canary" {
+		t.Errorf("restore() lost the canary")
+	}
+}
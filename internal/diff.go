@@ -0,0 +1,188 @@
+package internal
+
+/**
+ * this file compares two sets of zones and PACs
+ *
+ * both sets are directories in which ipMapFile, pacRoot and (if present) defaultPACFile
+ * are resolved just like in the cwd, e.g. two checkouts of the config repository.
+ * for both sets a lookup tree is built and flattened into its effective ranges,
+ * so the diff shows exactly which IPs receive a different PAC - not which lines of a zone file changed
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+const (
+	DiffFormatText = "text"
+	DiffFormatJSON = "json"
+)
+
+// DiffOptions configure a single diff run
+type DiffOptions struct {
+	// Old and New are the directories of the two sets
+	Old string
+	New string
+	// Format is one of the DiffFormat* constants
+	Format string
+}
+
+// rangeChange is a range of IPs that is served differently by the new set
+type rangeChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	OldPAC string `json:"oldPAC"`
+	NewPAC string `json:"newPAC"`
+	// end is kept to merge adjacent changes
+	end uint32
+}
+
+type zoneSetDiff struct {
+	// PACs are the ranges that receive a different PAC file
+	PACs []rangeChange `json:"pacs"`
+	// Variants are the ranges that receive the same PAC file, but its rendered content changed
+	Variants    []rangeChange `json:"variants"`
+	OldProblems int           `json:"oldProblems"`
+	NewProblems int           `json:"newProblems"`
+}
+
+// RunDiff loads both sets and writes the difference between them
+func RunDiff(opts DiffOptions, out io.Writer) error {
+	if opts.Format != DiffFormatText && opts.Format != DiffFormatJSON {
+		return fmt.Errorf("unknown diff format \"%s\"", opts.Format)
+	}
+
+	// loading a set works on the global caches, restore them afterwards
+	oldIPMaps, oldPACs := cachedIPMaps, cachedPACs
+	defer func() {
+		cachedIPMaps, cachedPACs = oldIPMaps, oldPACs
+	}()
+
+	oldTree, oldProblems, err := loadZoneSet(opts.Old)
+	if err != nil {
+		return fmt.Errorf("unable to load \"%s\": %s", opts.Old, err.Error())
+	}
+	newTree, newProblems, err := loadZoneSet(opts.New)
+	if err != nil {
+		return fmt.Errorf("unable to load \"%s\": %s", opts.New, err.Error())
+	}
+
+	diff := diffRanges(effectiveRanges(oldTree), effectiveRanges(newTree))
+	diff.OldProblems, diff.NewProblems = oldProblems, newProblems
+
+	if opts.Format == DiffFormatJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	_, err = io.WriteString(out, formatZoneSetDiff(diff))
+	return err
+}
+
+// loadZoneSet builds the lookup tree of the set in dir
+func loadZoneSet(dir string) (*lookupTreeNode, int, error) {
+	conf := GetConfig()
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, 0, fmt.Errorf("not a directory")
+	}
+
+	// the default PAC is part of the set if it exists in there
+	defaultFile := filepath.Join(dir, conf.DefaultPACFile)
+	if _, err := os.Stat(defaultFile); err != nil {
+		defaultFile = conf.DefaultPACFile
+	}
+	rawDefault, err := readAndParse(".", defaultFile)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read the default PAC: %s", err.Error())
+	}
+	newRootPAC, err := NewLookupElement(&ipMap{}, rawDefault, conf.ContactInfo)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to parse the default PAC: %s", err.Error())
+	}
+
+	// no fallback to the zones or pacs of the other set
+	cachedIPMaps, cachedPACs = nil, nil
+	zones := fileZoneProvider{}
+	if conf.IPMapFile != "" {
+		zones.path = filepath.Join(dir, conf.IPMapFile)
+	}
+	pacs := filePACProvider{root: filepath.Join(dir, conf.PACRoot)}
+	table, problems := buildLookupElementList(context.Background(), zones, pacs, conf.ContactInfo, conf.DuplicateZones, time.Now())
+	if table == nil {
+		return nil, problems.total(), fmt.Errorf("zones or pacs could not be loaded, or contain conflicts")
+	}
+	return buildLookupTree(&newRootPAC, table), problems.total(), nil
+}
+
+// diffRanges walks the effective ranges of both trees side by side
+// both cover the whole address space, so every IP is compared exactly once
+func diffRanges(oldRanges, newRanges []ipRange) zoneSetDiff {
+	diff := zoneSetDiff{PACs: make([]rangeChange, 0), Variants: make([]rangeChange, 0)}
+	i, j := 0, 0
+	start := uint64(0)
+	for i < len(oldRanges) && j < len(newRanges) {
+		o, n := oldRanges[i], newRanges[j]
+		end := o.End
+		if n.End < end {
+			end = n.End
+		}
+
+		oldPAC, newPAC := o.Element.IPMap.Filename, n.Element.IPMap.Filename
+		if oldPAC != newPAC {
+			diff.PACs = appendChange(diff.PACs, start, end, oldPAC, newPAC)
+		} else if !o.Element.isIdenticalVariant(n.Element) {
+			diff.Variants = appendChange(diff.Variants, start, end, oldPAC, newPAC)
+		}
+
+		if o.End == end {
+			i++
+		}
+		if n.End == end {
+			j++
+		}
+		start = uint64(end) + 1
+	}
+	return diff
+}
+
+// appendChange adds the change, or extends the last one if it is an adjacent range with the same PACs
+func appendChange(changes []rangeChange, start uint64, end uint32, oldPAC, newPAC string) []rangeChange {
+	last := len(changes) - 1
+	if last >= 0 && changes[last].OldPAC == oldPAC && changes[last].NewPAC == newPAC && uint64(changes[last].end)+1 == start {
+		changes[last].end = end
+		changes[last].To = IP.IP{Value: end}.ToString()
+		return changes
+	}
+	return append(changes, rangeChange{
+		From:   IP.IP{Value: uint32(start)}.ToString(),
+		To:     IP.IP{Value: end}.ToString(),
+		OldPAC: oldPAC,
+		NewPAC: newPAC,
+		end:    end,
+	})
+}
+
+func formatZoneSetDiff(diff zoneSetDiff) string {
+	str := ""
+	if diff.OldProblems > 0 || diff.NewProblems > 0 {
+		str += fmt.Sprintf("! %d problems in the old set, %d problems in the new set\n", diff.OldProblems, diff.NewProblems)
+	}
+	if len(diff.PACs) == 0 && len(diff.Variants) == 0 {
+		return str + "no changes\n"
+	}
+	for _, c := range diff.PACs {
+		str += fmt.Sprintf("~ %s - %s pac(%s) -> pac(%s)\n", c.From, c.To, c.OldPAC, c.NewPAC)
+	}
+	for _, c := range diff.Variants {
+		str += fmt.Sprintf("* %s - %s pac(%s) content changed\n", c.From, c.To, c.NewPAC)
+	}
+	return str
+}
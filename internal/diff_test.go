@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffRanges(t *testing.T) {
+	setupRangeTest(t)
+
+	changedVariant := createLookupElement("10.0.0.0", 8, "company.pac")
+	changedVariant.Variant = "// changed"
+
+	tests := []struct {
+		name         string
+		old          []*LookupElement
+		new          []*LookupElement
+		wantPACs     []rangeChange
+		wantVariants []rangeChange
+	}{
+		{
+			name: "Identical sets",
+			old:  []*LookupElement{createLookupElement("10.0.0.0", 8, "company.pac")},
+			new:  []*LookupElement{createLookupElement("10.0.0.0", 8, "company.pac")},
+		},
+		{
+			name: "New subnet with a different PAC",
+			old:  []*LookupElement{createLookupElement("10.0.0.0", 8, "company.pac")},
+			new: []*LookupElement{
+				createLookupElement("10.0.0.0", 8, "company.pac"),
+				createLookupElement("10.1.0.0", 16, "office.pac"),
+			},
+			wantPACs: []rangeChange{{From: "10.1.0.0", To: "10.1.255.255", OldPAC: "company.pac", NewPAC: "office.pac"}},
+		},
+		{
+			name: "Removed zone falls back to the default",
+			old: []*LookupElement{
+				createLookupElement("10.0.0.0", 8, "company.pac"),
+				createLookupElement("172.16.0.0", 12, "company.pac"),
+			},
+			new:      []*LookupElement{createLookupElement("10.0.0.0", 8, "company.pac")},
+			wantPACs: []rangeChange{{From: "172.16.0.0", To: "172.31.255.255", OldPAC: "company.pac", NewPAC: "default.pac"}},
+		},
+		{
+			name: "Adjacent changes are merged",
+			old: []*LookupElement{
+				createLookupElement("10.0.0.0", 24, "a.pac"),
+				createLookupElement("10.0.1.0", 24, "a.pac"),
+			},
+			new:      []*LookupElement{createLookupElement("10.0.0.0", 23, "b.pac")},
+			wantPACs: []rangeChange{{From: "10.0.0.0", To: "10.0.1.255", OldPAC: "a.pac", NewPAC: "b.pac"}},
+		},
+		{
+			name:         "Changed content of the same PAC",
+			old:          []*LookupElement{createLookupElement("10.0.0.0", 8, "company.pac")},
+			new:          []*LookupElement{changedVariant},
+			wantVariants: []rangeChange{{From: "10.0.0.0", To: "10.255.255.255", OldPAC: "company.pac", NewPAC: "company.pac"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffRanges(effectiveRanges(buildLookupTree(testDefaultPAC, tt.old)), effectiveRanges(buildLookupTree(testDefaultPAC, tt.new)))
+			compareChanges(t, "PACs", diff.PACs, tt.wantPACs)
+			compareChanges(t, "Variants", diff.Variants, tt.wantVariants)
+		})
+	}
+}
+
+func compareChanges(t *testing.T, kind string, got, want []rangeChange) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s = %+v, want %+v", kind, got, want)
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.From != w.From || g.To != w.To || g.OldPAC != w.OldPAC || g.NewPAC != w.NewPAC {
+			t.Errorf("%s[%d] = %+v, want %+v", kind, i, g, w)
+		}
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	setupRangeTest(t)
+	oldIPMaps, oldPACs := cachedIPMaps, cachedPACs
+	defer func() { cachedIPMaps, cachedPACs = oldIPMaps, oldPACs }()
+
+	dir := t.TempDir()
+	confStorage.IPMapFile = "zones.csv"
+	confStorage.PACRoot = "pacs"
+	confStorage.DefaultPACFile = filepath.Join("pacs", "default.pac")
+	for _, set := range []string{"old", "new"} {
+		writeTestFile(t, filepath.Join(dir, set, "pacs", "default.pac"), "// default")
+		writeTestFile(t, filepath.Join(dir, set, "pacs", "company.pac"), "// company")
+		writeTestFile(t, filepath.Join(dir, set, "pacs", "office.pac"), "// office")
+	}
+	writeTestFile(t, filepath.Join(dir, "old", "zones.csv"), "10.0.0.0,8,company.pac\n")
+	writeTestFile(t, filepath.Join(dir, "new", "zones.csv"), "10.0.0.0,8,company.pac\n10.1.0.0,16,office.pac\n")
+
+	out := &bytes.Buffer{}
+	err := RunDiff(DiffOptions{Old: filepath.Join(dir, "old"), New: filepath.Join(dir, "new"), Format: DiffFormatJSON}, out)
+	if err != nil {
+		t.Fatalf("RunDiff() unexpected error: %v", err)
+	}
+	diff := zoneSetDiff{}
+	if err := json.Unmarshal(out.Bytes(), &diff); err != nil {
+		t.Fatalf("RunDiff() wrote invalid JSON: %v", err)
+	}
+	compareChanges(t, "PACs", diff.PACs, []rangeChange{{From: "10.1.0.0", To: "10.1.255.255", OldPAC: "company.pac", NewPAC: "office.pac"}})
+
+	if err := RunDiff(DiffOptions{Old: filepath.Join(dir, "missing"), New: filepath.Join(dir, "new"), Format: DiffFormatText}, out); err == nil {
+		t.Errorf("RunDiff() expected an error for a missing directory")
+	}
+}
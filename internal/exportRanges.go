@@ -0,0 +1,95 @@
+package internal
+
+/**
+ * this file exports the effective ranges of the lookup tree
+ *
+ * every IP is part of exactly one exported range, together with the PAC it receives
+ * and the zone that decided it. each range is also split into the minimal set of CIDRs,
+ * since firewalls and DHCP documentation usually expect networks instead of ranges
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+const (
+	ExportFormatCSV  = "csv"
+	ExportFormatJSON = "json"
+)
+
+// ExportOptions configure a single export run
+type ExportOptions struct {
+	// Output is the file to write, "-" for stdout
+	Output string
+	// Format is one of the ExportFormat* constants
+	Format string
+}
+
+type exportedRange struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	CIDRs []string `json:"cidrs"`
+	PAC   string   `json:"pac"`
+	// Zone is the network of the zone serving the range
+	Zone    string `json:"zone"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// RunExport writes the effective ranges of the currently loaded lookup tree
+func RunExport(opts ExportOptions, out io.Writer) error {
+	if opts.Output != "" && opts.Output != "-" {
+		file, err := os.Create(opts.Output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return writeRanges(out, exportRanges(getServed().tree), opts.Format)
+}
+
+func exportRanges(root *lookupTreeNode) []exportedRange {
+	ranges := effectiveRanges(root)
+	res := make([]exportedRange, 0, len(ranges))
+	for _, r := range ranges {
+		start, end := IP.IP{Value: r.Start}, IP.IP{Value: r.End}
+		cidrs := make([]string, 0)
+		for _, n := range IP.RangeToNets(start, end) {
+			cidrs = append(cidrs, n.ToString())
+		}
+		res = append(res, exportedRange{
+			Start:   start.ToString(),
+			End:     end.ToString(),
+			CIDRs:   cidrs,
+			PAC:     r.Element.IPMap.Filename,
+			Zone:    r.Element.IPMap.IPNet.ToString(),
+			Comment: r.Element.IPMap.Comment,
+		})
+	}
+	return res
+}
+
+func writeRanges(out io.Writer, ranges []exportedRange, format string) error {
+	switch format {
+	case ExportFormatJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ranges)
+	case ExportFormatCSV:
+		w := csv.NewWriter(out)
+		_ = w.Write([]string{"start", "end", "cidrs", "pac", "zone", "comment"})
+		for _, r := range ranges {
+			_ = w.Write([]string{r.Start, r.End, strings.Join(r.CIDRs, " "), r.PAC, r.Zone, r.Comment})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown export format \"%s\"", format)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExportRanges(t *testing.T) {
+	setupRangeTest(t)
+
+	company := createLookupElement("10.0.0.0", 8, "company.pac")
+	company.IPMap.Comment = "company, all offices"
+	tree := buildLookupTree(testDefaultPAC, []*LookupElement{company, createLookupElement("10.1.0.0", 16, "office.pac")})
+	ranges := exportRanges(tree)
+
+	if len(ranges) != 5 {
+		t.Fatalf("exportRanges() returned %d ranges, want 5: %+v", len(ranges), ranges)
+	}
+	rest := ranges[3]
+	if rest.Start != "10.2.0.0" || rest.End != "10.255.255.255" || rest.PAC != "company.pac" || rest.Zone != "10.0.0.0/8" {
+		t.Errorf("exportRanges()[3] = %+v", rest)
+	}
+	wantCIDRs := "10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 10.16.0.0/12 10.32.0.0/11 10.64.0.0/10 10.128.0.0/9"
+	if strings.Join(rest.CIDRs, " ") != wantCIDRs {
+		t.Errorf("exportRanges()[3].CIDRs = %v, want %s", rest.CIDRs, wantCIDRs)
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		check   func(t *testing.T, out string)
+		wantErr bool
+	}{
+		{
+			name:   "CSV",
+			format: ExportFormatCSV,
+			check: func(t *testing.T, out string) {
+				lines := strings.Split(strings.TrimSpace(out), "\n")
+				if len(lines) != 6 || lines[0] != "start,end,cidrs,pac,zone,comment" {
+					t.Fatalf("unexpected CSV:\n%s", out)
+				}
+				if lines[2] != `10.0.0.0,10.0.255.255,10.0.0.0/16,company.pac,10.0.0.0/8,"company, all offices"` {
+					t.Errorf("unexpected CSV line: %s", lines[2])
+				}
+			},
+		},
+		{
+			name:   "JSON",
+			format: ExportFormatJSON,
+			check: func(t *testing.T, out string) {
+				parsed := make([]exportedRange, 0)
+				if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+					t.Fatalf("invalid JSON: %v", err)
+				}
+				if len(parsed) != 5 || parsed[2].PAC != "office.pac" || parsed[2].CIDRs[0] != "10.1.0.0/16" {
+					t.Errorf("unexpected JSON: %+v", parsed)
+				}
+			},
+		},
+		{
+			name:    "Unknown format",
+			format:  "xml",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := writeRanges(out, ranges, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, out.String())
+			}
+		})
+	}
+}
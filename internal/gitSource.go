@@ -0,0 +1,262 @@
+package internal
+
+/**
+ * this file implements reading Zones and PACs from a local git repository
+ *
+ * instead of the working tree, the files are read from a specific commit,
+ * either resolved from the configured ref or from the pin file.
+ * this makes every reload reproducible and allows to roll back to any commit
+ * by pinning it and triggering a reload
+ */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/git"
+	"github.com/timeforaninja/pacserver/pkg/utils"
+)
+
+// gitSource is both a ZoneProvider and a PACProvider
+// reading from a single commit of a git repository
+type gitSource struct {
+	repo     string
+	commit   string
+	zonePath string
+	pacRoot  string
+	// err is set if the ref could not be resolved to a commit
+	err error
+}
+
+func newGitSource(conf *Config) gitSource {
+	ref := conf.GitRef
+	pinned, err := readGitPin(conf)
+	if err != nil {
+		log.Errorf("Unable to read git pin file \"%s\": %s", conf.GitPinFile, err.Error())
+	} else if pinned != "" {
+		log.Infof("Using pinned git ref \"%s\" instead of \"%s\"", pinned, conf.GitRef)
+		ref = pinned
+	}
+
+	src := gitSource{
+		repo:    conf.GitRepo,
+		pacRoot: toRepoPath(conf.PACRoot),
+	}
+	if conf.IPMapFile != "" {
+		src.zonePath = toRepoPath(conf.IPMapFile)
+	}
+	src.commit, src.err = git.ResolveRef(conf.GitRepo, ref)
+	if src.err != nil {
+		log.Errorf("Unable to resolve git ref \"%s\" in \"%s\": %s", ref, conf.GitRepo, src.err.Error())
+	} else {
+		log.Infof("Loading Zones and PACs from commit %s of \"%s\"", src.commit, conf.GitRepo)
+	}
+	return src
+}
+
+// toRepoPath converts a configured path to the slash-separated form git expects
+func toRepoPath(p string) string {
+	return strings.TrimPrefix(filepath.ToSlash(utils.NormalizePath(p)), "./")
+}
+
+func (g gitSource) Commit() string {
+	return g.commit
+}
+
+func (g gitSource) LoadZones() ([]*ipMap, error, int) {
+	if g.err != nil {
+		return make([]*ipMap, 0), g.err, 1
+	}
+	if g.zonePath == "" {
+		return make([]*ipMap, 0), nil, 0
+	}
+
+	files, err := g.resolveZoneFiles()
+	if err != nil {
+		log.Errorf("Unable to find IPMap files for \"%s\" in commit %s: %s", g.zonePath, g.commit, err.Error())
+		return make([]*ipMap, 0), err, 1
+	}
+
+	return mergeIPMapFiles(files, func(file string) ([]byte, error) {
+		return git.ReadFile(g.repo, g.commit, file)
+	})
+}
+
+// resolveZoneFiles mirrors resolveIPMapFiles, but inside the commit
+func (g gitSource) resolveZoneFiles() ([]string, error) {
+	if isGlobPattern(g.zonePath) {
+		all, err := git.ListFiles(g.repo, g.commit, ".")
+		if err != nil {
+			return nil, err
+		}
+		files := make([]string, 0)
+		for _, f := range all {
+			if ok, _ := path.Match(g.zonePath, f); ok {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files match the pattern")
+		}
+		return files, nil
+	}
+
+	isFile, err := git.IsFile(g.repo, g.commit, g.zonePath)
+	if err != nil {
+		return nil, err
+	}
+	if isFile {
+		return []string{g.zonePath}, nil
+	}
+
+	all, err := git.ListFiles(g.repo, g.commit, g.zonePath)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(all))
+	for _, f := range all {
+		// only the part within the directory is checked, the directory itself may be hidden
+		if isZoneFile(strings.TrimPrefix(f, strings.TrimSuffix(g.zonePath, "/")+"/")) {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("directory does not contain any zone files")
+	}
+	return files, nil
+}
+
+// LoadDefault reads the default PAC or the WPAD file from the commit
+// so they are pinned and rolled back together with the zones and PACs
+func (g gitSource) LoadDefault(file string) (*pacTemplate, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	content, err := git.ReadFile(g.repo, g.commit, toRepoPath(file))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read \"%s\" from commit %s: %s", file, g.commit, err.Error())
+	}
+	return &pacTemplate{
+		Filename: utils.NormalizePath(file),
+		content:  string(content),
+	}, nil
+}
+
+func (g gitSource) LoadPACs() ([]*pacTemplate, error, int) {
+	if g.err != nil {
+		return make([]*pacTemplate, 0), g.err, 1
+	}
+
+	files, err := git.ListFiles(g.repo, g.commit, g.pacRoot)
+	if err != nil {
+		log.Errorf("Failed to List PAC Files in \"%s\" of commit %s: %s", g.pacRoot, g.commit, err.Error())
+		return make([]*pacTemplate, 0), err, 1
+	}
+	if len(files) == 0 {
+		err = fmt.Errorf("directory \"%s\" does not exist in commit %s", g.pacRoot, g.commit)
+		log.Errorf("Failed to List PAC Files: %s", err.Error())
+		return make([]*pacTemplate, 0), err, 1
+	}
+
+	var templates []*pacTemplate
+	problemCounter := 0
+	for _, file := range files {
+		content, err := git.ReadFile(g.repo, g.commit, file)
+		if err != nil {
+			log.Warnf("Unable to read PAC at \"%s\": %s", file, err.Error())
+			problemCounter++
+			continue
+		}
+		// Filenames are relative to the pacRoot, same as for the filesystem
+		rel := strings.TrimPrefix(file, strings.TrimSuffix(g.pacRoot, "/")+"/")
+		templates = append(templates, &pacTemplate{
+			Filename: utils.NormalizePath(rel),
+			content:  string(content),
+		})
+	}
+
+	return templates, nil, problemCounter
+}
+
+// readGitPin returns the pinned ref, or an empty string if nothing is pinned
+func readGitPin(conf *Config) (string, error) {
+	if conf.GitPinFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(conf.GitPinFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// PinGitRef pins all following reloads to a specific ref (usually a commit)
+// the ref gets resolved first, so a typo does not break the next reload,
+// and check has to succeed with the new pin, e.g. by loading its commit, otherwise the previous pin is restored
+func PinGitRef(ref string, check func() error) error {
+	conf := GetConfig()
+	if conf.GitRepo == "" {
+		return fmt.Errorf("no gitRepo configured")
+	}
+	if conf.GitPinFile == "" {
+		return fmt.Errorf("no gitPinFile configured")
+	}
+	commit, err := git.ResolveRef(conf.GitRepo, ref)
+	if err != nil {
+		return err
+	}
+	log.Infof("Pinning \"%s\" to commit %s", conf.GitRepo, commit)
+	return changeGitPin(conf.GitPinFile, commit, check)
+}
+
+// UnpinGitRef removes the pin, so reloads follow the configured ref again
+// like PinGitRef, the pin is restored if check fails with the configured ref
+func UnpinGitRef(check func() error) error {
+	conf := GetConfig()
+	if conf.GitPinFile == "" {
+		return check()
+	}
+	return changeGitPin(conf.GitPinFile, "", check)
+}
+
+// changeGitPin writes the commit to the pin file, or removes it for an empty commit, and runs check
+// if check fails, the previous content of the pin file is restored
+func changeGitPin(file, commit string, check func() error) error {
+	previous, err := os.ReadFile(file)
+	hadPin := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := writeGitPin(file, commit); err != nil {
+		return err
+	}
+	if err := check(); err != nil {
+		if hadPin {
+			err = errors.Join(err, os.WriteFile(file, previous, 0644))
+		} else {
+			err = errors.Join(err, writeGitPin(file, ""))
+		}
+		return fmt.Errorf("the previous pin is kept: %w", err)
+	}
+	return nil
+}
+
+// writeGitPin writes the commit to the pin file, an empty commit removes it
+func writeGitPin(file, commit string) error {
+	if commit != "" {
+		return os.WriteFile(file, []byte(commit), 0644)
+	}
+	err := os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
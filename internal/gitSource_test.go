@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupGitRepo creates a repository with two commits of zones and pacs
+// and returns the path and both commit hashes
+func setupGitRepo(t *testing.T) (string, string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := t.TempDir()
+	gitCmd := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	writeTestFile(t, filepath.Join(repo, "zones", "emea.csv"), "10.0.0.0,8,company.pac\n")
+	writeTestFile(t, filepath.Join(repo, "pacs", "company.pac"), "// company v1")
+	writeTestFile(t, filepath.Join(repo, "defaults", "default.pac"), "// default v1")
+	gitCmd("init", "-q")
+	gitCmd("add", "-A")
+	gitCmd("commit", "-q", "-m", "first")
+	first := gitCmd("rev-parse", "HEAD")
+
+	writeTestFile(t, filepath.Join(repo, "zones", "apac.csv"), "172.16.0.0,12,countries/japan.pac\n")
+	writeTestFile(t, filepath.Join(repo, "pacs", "company.pac"), "// company v2")
+	writeTestFile(t, filepath.Join(repo, "defaults", "default.pac"), "// default v2")
+	writeTestFile(t, filepath.Join(repo, "pacs", "countries", "japan.pac"), "// japan")
+	// neither notes nor files in hidden directories are zone files
+	writeTestFile(t, filepath.Join(repo, "zones", "README.md"), "# zones")
+	writeTestFile(t, filepath.Join(repo, "zones", ".archive", "old.csv"), "192.168.0.0,16,company.pac\n")
+	gitCmd("add", "-A")
+	gitCmd("commit", "-q", "-m", "second")
+	second := gitCmd("rev-parse", "HEAD")
+
+	// changes in the working tree must never be picked up
+	writeTestFile(t, filepath.Join(repo, "pacs", "company.pac"), "// uncommitted")
+	writeTestFile(t, filepath.Join(repo, "defaults", "default.pac"), "// uncommitted")
+
+	return repo, first, second
+}
+
+func TestGitSource(t *testing.T) {
+	repo, first, second := setupGitRepo(t)
+
+	conf := &Config{
+		IPMapFile:  "zones",
+		PACRoot:    "pacs",
+		GitRepo:    repo,
+		GitRef:     "HEAD",
+		GitPinFile: filepath.Join(t.TempDir(), "pacserver.gitpin"),
+	}
+
+	tests := []struct {
+		name        string
+		pin         string
+		wantCommit  string
+		wantZones   int
+		wantPACs    map[string]string
+		wantDefault string
+		wantLoadErr bool
+	}{
+		{
+			name:       "Follows the configured ref",
+			wantCommit: second,
+			wantZones:  2,
+			wantPACs: map[string]string{
+				"company.pac":                           "// company v2",
+				filepath.Join("countries", "japan.pac"): "// japan",
+			},
+			wantDefault: "// default v2",
+		},
+		{
+			name:        "Pinned to an older commit",
+			pin:         first,
+			wantCommit:  first,
+			wantZones:   1,
+			wantPACs:    map[string]string{"company.pac": "// company v1"},
+			wantDefault: "// default v1",
+		},
+		{
+			name:        "Pinned to an unknown ref",
+			pin:         "does-not-exist",
+			wantLoadErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(conf.GitPinFile)
+			if tt.pin != "" {
+				writeTestFile(t, conf.GitPinFile, tt.pin+"\n")
+			}
+
+			src := newGitSource(conf)
+			zones, zoneErr, _ := src.LoadZones()
+			pacs, pacErr, _ := src.LoadPACs()
+			// the default PAC is read from the same commit, not the working tree
+			defaultPAC, defaultErr := src.LoadDefault("defaults/default.pac")
+			if tt.wantLoadErr {
+				if zoneErr == nil || pacErr == nil || defaultErr == nil {
+					t.Errorf("expected both providers and the default PAC to fail, got %v, %v and %v", zoneErr, pacErr, defaultErr)
+				}
+				return
+			}
+			if defaultErr != nil || defaultPAC.content != tt.wantDefault {
+				t.Errorf("LoadDefault() = %v, %v, want %q", defaultPAC, defaultErr, tt.wantDefault)
+			}
+			if zoneErr != nil || pacErr != nil {
+				t.Fatalf("unexpected errors: %v, %v", zoneErr, pacErr)
+			}
+
+			if src.Commit() != tt.wantCommit {
+				t.Errorf("Commit() = %s, want %s", src.Commit(), tt.wantCommit)
+			}
+			if len(zones) != tt.wantZones {
+				t.Errorf("LoadZones() returned %d zones, want %d", len(zones), tt.wantZones)
+			}
+			if len(pacs) != len(tt.wantPACs) {
+				t.Errorf("LoadPACs() returned %d pacs, want %d", len(pacs), len(tt.wantPACs))
+			}
+			for _, p := range pacs {
+				if tt.wantPACs[p.Filename] != p.content {
+					t.Errorf("PAC %s = %q, want %q", p.Filename, p.content, tt.wantPACs[p.Filename])
+				}
+			}
+		})
+	}
+
+	// without an ipMapFile no zones are read from the repository
+	_ = os.Remove(conf.GitPinFile)
+	conf.IPMapFile = ""
+	if zones, err, problems := newGitSource(conf).LoadZones(); err != nil || problems != 0 || len(zones) != 0 {
+		t.Errorf("LoadZones() = %v, %v, %d, want no zones and no problems", zones, err, problems)
+	}
+}
+
+func TestPinGitRef(t *testing.T) {
+	repo, first, second := setupGitRepo(t)
+
+	oldConf := confStorage
+	defer func() { confStorage = oldConf }()
+	confStorage = &Config{
+		GitRepo:    repo,
+		GitRef:     "HEAD",
+		GitPinFile: filepath.Join(t.TempDir(), "pacserver.gitpin"),
+	}
+	// checkPin expects the check to run with the pin, it fails if fail is set
+	checkPin := func(want string, fail bool) func() error {
+		return func() error {
+			if pinned, _ := readGitPin(confStorage); pinned != want {
+				t.Errorf("check ran with the pin %q, want %q", pinned, want)
+			}
+			if fail {
+				return errors.New("zones or pac files includes errors")
+			}
+			return nil
+		}
+	}
+
+	// a short hash gets resolved to the full commit
+	if err := PinGitRef(first[:8], checkPin(first, false)); err != nil {
+		t.Fatalf("PinGitRef() unexpected error: %v", err)
+	}
+	pinned, err := readGitPin(confStorage)
+	if err != nil || pinned != first {
+		t.Errorf("readGitPin() = %q, %v, want %q", pinned, err, first)
+	}
+
+	// unknown refs are rejected and do not touch the pin
+	if err := PinGitRef("does-not-exist", checkPin("", false)); err == nil {
+		t.Errorf("PinGitRef() expected an error for an unknown ref")
+	}
+	pinned, _ = readGitPin(confStorage)
+	if pinned != first {
+		t.Errorf("pin changed to %q after a failed PinGitRef", pinned)
+	}
+
+	// a commit failing the check restores the previous pin
+	if err := PinGitRef(second, checkPin(second, true)); err == nil {
+		t.Errorf("PinGitRef() expected an error for a commit failing the check")
+	}
+	if pinned, _ = readGitPin(confStorage); pinned != first {
+		t.Errorf("pin = %q after a failed check, want the previous %q", pinned, first)
+	}
+	if err := UnpinGitRef(checkPin("", true)); err == nil {
+		t.Errorf("UnpinGitRef() expected an error for a gitRef failing the check")
+	}
+	if pinned, _ = readGitPin(confStorage); pinned != first {
+		t.Errorf("pin = %q after a failed check of unpinning, want the previous %q", pinned, first)
+	}
+
+	if err := UnpinGitRef(checkPin("", false)); err != nil {
+		t.Fatalf("UnpinGitRef() unexpected error: %v", err)
+	}
+	pinned, err = readGitPin(confStorage)
+	if err != nil || pinned != "" {
+		t.Errorf("readGitPin() after unpin = %q, %v, want empty", pinned, err)
+	}
+	// unpinning twice is fine
+	if err := UnpinGitRef(checkPin("", false)); err != nil {
+		t.Errorf("UnpinGitRef() second call unexpected error: %v", err)
+	}
+	// without a previous pin, a failed check leaves none
+	if err := PinGitRef(second, checkPin(second, true)); err == nil {
+		t.Errorf("PinGitRef() expected an error for a commit failing the check")
+	}
+	if pinned, _ = readGitPin(confStorage); pinned != "" {
+		t.Errorf("pin = %q after a failed check without a previous pin, want none", pinned)
+	}
+}
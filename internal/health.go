@@ -0,0 +1,136 @@
+package internal
+
+/**
+ * this file provides the health endpoints
+ * that load balancers and orchestrators can probe
+ *
+ *  - /healthz: liveness, reports that the process is up and answering
+ *  - /readyz: readiness, reports if the caches are loaded and usable
+ *
+ * both routes are registered before the access log and metrics middlewares,
+ * so frequent probes do not show up in the access log or the PAC metrics
+ */
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// reloadStatus describes the outcome of the last (re)load of Zones and PACs and the data served since
+// a load that is not served, e.g. a failed one, only changes the outcome, see recordLoad and recordServed
+type reloadStatus struct {
+	// Initialised is only set once InitCaches finished successfully
+	Initialised bool `json:"initialised"`
+	// ZonesConfigured is false if no ipMapFile is configured and only the default PAC is served
+	ZonesConfigured bool `json:"zonesConfigured"`
+	// Result of the last load is reloadSuccess, reloadDegraded or reloadFailed
+	Result string `json:"result"`
+	// Finished is the time the last load finished
+	Finished time.Time `json:"finished"`
+	// LastSuccess is the time the last load without problems finished
+	LastSuccess time.Time `json:"lastSuccess"`
+	// Duration of the last load
+	Duration time.Duration `json:"duration"`
+	// Problems are the minor problems found during the last load
+	Problems loadProblems `json:"problems"`
+	// LastReload is the time the served data was last replaced
+	LastReload time.Time `json:"lastReload"`
+	// Zones is the amount of Lookup Elements in the current tree
+	Zones int `json:"zones"`
+	// LoadedZones is the amount of Zones the tree was built from, including those outside their window
+	LoadedZones int `json:"loadedZones"`
+	// TreeDepth is the depth of the current tree
+	TreeDepth int `json:"treeDepth"`
+	// PACs is the amount of PAC templates available to the zones
+	PACs int `json:"pacs"`
+	// CachedPACs is the amount of those that are missing in their source and served from a previous load
+	CachedPACs int `json:"cachedPACs"`
+	// PACHash identifies the content of all PAC templates
+	PACHash string `json:"pacHash"`
+	// DefaultPACLoaded is false if the default PAC of the current tree failed to load
+	DefaultPACLoaded bool `json:"defaultPACLoaded"`
+	// Commit is the commit the Zones and PACs were loaded from (only for git sources)
+	Commit string `json:"commit,omitempty"`
+	// LastKnownGood is the load time of the last known good snapshot while we are serving it
+	LastKnownGood *time.Time `json:"lastKnownGood,omitempty"`
+}
+
+var (
+	currentStatus reloadStatus
+	statusLock    sync.RWMutex
+)
+
+func recordCommit(commit string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	currentStatus.Commit = commit
+}
+
+func recordLastKnownGood(loadedAt *time.Time) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	currentStatus.LastKnownGood = loadedAt
+}
+
+func markInitialised(zonesConfigured bool) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	currentStatus.Initialised = true
+	currentStatus.ZonesConfigured = zonesConfigured
+}
+
+func getReloadStatus() reloadStatus {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+	return currentStatus
+}
+
+// readinessProblem returns a human-readable reason why we are not ready,
+// or an empty string if we are able to serve PACs
+func (s reloadStatus) readinessProblem() string {
+	if !s.Initialised {
+		return "caches not initialised"
+	}
+	if !s.DefaultPACLoaded {
+		return "default PAC failed to load"
+	}
+	// without zones to load only the default PAC is served, and zones may all be outside their window
+	if s.ZonesConfigured && s.LoadedZones == 0 {
+		return "zone sources did not provide any zones"
+	}
+	return ""
+}
+
+func registerHealthRoutes(app *fiber.App) {
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"status": "ok",
+		})
+	})
+
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		status := getReloadStatus()
+		problem := status.readinessProblem()
+
+		resp := fiber.Map{
+			"status":     "ready",
+			"lastReload": status.LastReload,
+			"problems":   status.Problems.total(),
+			"zones":      status.Zones,
+		}
+		if status.Commit != "" {
+			resp["commit"] = status.Commit
+		}
+		if status.LastKnownGood != nil {
+			resp["lastKnownGood"] = status.LastKnownGood
+		}
+		if problem != "" {
+			resp["status"] = "not ready"
+			resp["reason"] = problem
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return c.JSON(resp)
+	})
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestReadinessProblem(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		status reloadStatus
+		want   string
+	}{
+		{
+			name:   "Not initialised",
+			status: reloadStatus{DefaultPACLoaded: true, ZonesConfigured: true, Zones: 3, LoadedZones: 3},
+			want:   "caches not initialised",
+		},
+		{
+			name:   "Default PAC failed",
+			status: reloadStatus{Initialised: true, ZonesConfigured: true, Zones: 3, LoadedZones: 3},
+			want:   "default PAC failed to load",
+		},
+		{
+			name:   "No zones loaded",
+			status: reloadStatus{Initialised: true, DefaultPACLoaded: true, ZonesConfigured: true},
+			want:   "zone sources did not provide any zones",
+		},
+		{
+			name:   "Only the default PAC",
+			status: reloadStatus{Initialised: true, DefaultPACLoaded: true},
+			want:   "",
+		},
+		{
+			name:   "All zones outside their window",
+			status: reloadStatus{Initialised: true, DefaultPACLoaded: true, ZonesConfigured: true, LoadedZones: 2},
+			want:   "",
+		},
+		{
+			name:   "Ready",
+			status: reloadStatus{Initialised: true, DefaultPACLoaded: true, ZonesConfigured: true, Zones: 3, LoadedZones: 3, Problems: loadProblems{Zones: 2}},
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.status.readinessProblem()
+			if got != tt.want {
+				t.Errorf("readinessProblem() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	app := fiber.New()
+	registerHealthRoutes(app)
+
+	// reset the global status after the test
+	defer func() {
+		statusLock.Lock()
+		currentStatus = reloadStatus{}
+		statusLock.Unlock()
+	}()
+
+	statusLock.Lock()
+	currentStatus = reloadStatus{}
+	statusLock.Unlock()
+
+	tests := []struct {
+		name       string
+		path       string
+		setup      func()
+		wantStatus int
+	}{
+		{
+			name:       "Liveness before init",
+			path:       "/healthz",
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Readiness before init",
+			path:       "/readyz",
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name: "Readiness after init",
+			path: "/readyz",
+			setup: func() {
+				recordServed(&servedData{elements: webserverTestZones()}, []*ipMap{{}}, nil, 0, true)
+				markInitialised(true)
+			},
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name: "Readiness after a load serving the previous default PAC",
+			path: "/readyz",
+			setup: func() {
+				recordServed(&servedData{elements: webserverTestZones()}, []*ipMap{{}}, nil, 0, false)
+			},
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name: "Readiness serving only the default PAC",
+			path: "/readyz",
+			setup: func() {
+				recordServed(&servedData{}, nil, nil, 0, true)
+				markInitialised(false)
+			},
+			wantStatus: fiber.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil), int(time.Second.Milliseconds()))
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+func TestWithoutZones(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "pacs", "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "pacs", "wpad.dat"), "// wpad")
+	conf := &Config{
+		PACRoot:        filepath.Join(dir, "pacs"),
+		DefaultPACFile: filepath.Join(dir, "pacs", "default.pac"),
+		WPADFile:       filepath.Join(dir, "pacs", "wpad.dat"),
+	}
+
+	// without an ipMapFile there is nothing to validate or load
+	if err := validateSources(conf); err != nil {
+		t.Errorf("validateSources() unexpected error without an ipMapFile: %v", err)
+	}
+	zones, err, problems := fileZoneProvider{path: conf.IPMapFile}.LoadZones()
+	if err != nil || problems != 0 || len(zones) != 0 {
+		t.Errorf("LoadZones() = %v, %v, %d, want no zones and no problems", zones, err, problems)
+	}
+}
@@ -0,0 +1,428 @@
+package internal
+
+/**
+ * this file imports zones from IPAM exports
+ *
+ * supported are the prefix exports of NetBox and phpIPAM, both as CSV and as JSON (API responses)
+ * a custom field or a tag of each prefix is mapped to the PAC filename,
+ * prefixes without a mapping are skipped
+ *
+ * the result can either be written as a zones file,
+ * or compared against the currently loaded zones (dry-run)
+ */
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/timeforaninja/pacserver/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ImportFormatNetBoxCSV   = "netbox-csv"
+	ImportFormatNetBoxJSON  = "netbox-json"
+	ImportFormatPhpIPAMCSV  = "phpipam-csv"
+	ImportFormatPhpIPAMJSON = "phpipam-json"
+)
+
+// ImportOptions configure a single import run
+type ImportOptions struct {
+	// File is the (local) IPAM export to read
+	File string
+	// Format is one of the ImportFormat* constants
+	Format string
+	// Mapping selects where the PAC is read from
+	// either "field:<custom field>" or "tag:<prefix>"
+	Mapping string
+	// Output is the zones file to write, "-" for stdout
+	// the format is chosen by the extension (.yml, .yaml, .json or csv)
+	Output string
+	// DryRun only prints the difference to the currently loaded zones
+	DryRun bool
+}
+
+// ipamPrefix is the format-independent representation of a single IPAM prefix
+type ipamPrefix struct {
+	Network     string
+	Description string
+	Owner       string
+	Tags        []string
+	Fields      map[string]string
+}
+
+// RunImport reads an IPAM export and writes (or diffs) the resulting zones
+func RunImport(opts ImportOptions, out io.Writer) error {
+	data, err := os.ReadFile(opts.File)
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := parseIPAMExport(data, opts.Format)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s export: %s", opts.Format, err.Error())
+	}
+
+	zones, skipped, err := mapIPAMPrefixes(prefixes, opts.Mapping)
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported %d zones from \"%s\", skipped %d prefixes", len(zones), opts.File, skipped)
+
+	if opts.DryRun {
+		_, err = io.WriteString(out, formatIPMapDiff(diffIPMaps(cachedIPMaps, zones)))
+		return err
+	}
+
+	if opts.Output == "" || opts.Output == "-" {
+		return writeZones(out, zones, ".csv")
+	}
+	file, err := os.Create(opts.Output)
+	if err != nil {
+		return err
+	}
+	err = writeZones(file, zones, strings.ToLower(filepath.Ext(opts.Output)))
+	// a failed close can leave a truncated file, so it fails the import as well
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func parseIPAMExport(data []byte, format string) ([]ipamPrefix, error) {
+	switch format {
+	case ImportFormatNetBoxCSV:
+		return parseIPAMCSV(data, false)
+	case ImportFormatPhpIPAMCSV:
+		return parseIPAMCSV(data, true)
+	case ImportFormatNetBoxJSON:
+		return parseNetBoxJSON(data)
+	case ImportFormatPhpIPAMJSON:
+		return parsePhpIPAMJSON(data)
+	}
+	return nil, fmt.Errorf("unknown import format \"%s\"", format)
+}
+
+// parseIPAMCSV reads the CSV exports of NetBox and phpIPAM
+// NetBox has a single "prefix" column, phpIPAM splits it into "subnet" and "mask"
+// all columns that are not known get stored as fields
+func parseIPAMCSV(data []byte, phpIPAM bool) ([]ipamPrefix, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("export is empty")
+	}
+
+	header := make(map[string]int)
+	for i, h := range records[0] {
+		header[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	get := func(row []string, col string) string {
+		i, ok := header[col]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	if phpIPAM {
+		if _, ok := header["subnet"]; !ok {
+			return nil, fmt.Errorf("missing column \"subnet\"")
+		}
+	} else if _, ok := header["prefix"]; !ok {
+		return nil, fmt.Errorf("missing column \"prefix\"")
+	}
+
+	prefixes := make([]ipamPrefix, 0, len(records)-1)
+	for _, row := range records[1:] {
+		p := ipamPrefix{
+			Description: get(row, "description"),
+			Fields:      make(map[string]string),
+		}
+		if phpIPAM {
+			p.Network = get(row, "subnet") + "/" + get(row, "mask")
+			p.Owner = get(row, "owner")
+		} else {
+			p.Network = get(row, "prefix")
+			p.Owner = get(row, "tenant")
+			p.Tags = splitTags(get(row, "tags"))
+		}
+		for col, i := range header {
+			if i < len(row) {
+				p.Fields[col] = strings.TrimSpace(row[i])
+			}
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func splitTags(tags string) []string {
+	res := make([]string, 0)
+	for _, t := range strings.Split(tags, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+type netBoxPrefix struct {
+	Prefix      string                 `json:"prefix"`
+	Description string                 `json:"description"`
+	Tenant      *struct{ Name string } `json:"tenant"`
+	Tags        []struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"tags"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+// parseNetBoxJSON reads a NetBox API response (with "results") or a plain list of prefixes
+func parseNetBoxJSON(data []byte) ([]ipamPrefix, error) {
+	var raw []netBoxPrefix
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var paged struct {
+			Results []netBoxPrefix `json:"results"`
+		}
+		if err2 := json.Unmarshal(data, &paged); err2 != nil {
+			return nil, err
+		}
+		raw = paged.Results
+	}
+
+	prefixes := make([]ipamPrefix, 0, len(raw))
+	for _, nb := range raw {
+		p := ipamPrefix{
+			Network:     nb.Prefix,
+			Description: nb.Description,
+			Fields:      make(map[string]string),
+		}
+		if nb.Tenant != nil {
+			p.Owner = nb.Tenant.Name
+		}
+		for _, t := range nb.Tags {
+			p.Tags = append(p.Tags, t.Slug)
+		}
+		for k, v := range nb.CustomFields {
+			if v != nil {
+				p.Fields[strings.ToLower(k)] = fmt.Sprint(v)
+			}
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// parsePhpIPAMJSON reads a phpIPAM API response (with "data") or a plain list of subnets
+// custom fields are part of the subnet object and are prefixed with "custom_"
+func parsePhpIPAMJSON(data []byte) ([]ipamPrefix, error) {
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var wrapped struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+			return nil, err
+		}
+		raw = wrapped.Data
+	}
+
+	prefixes := make([]ipamPrefix, 0, len(raw))
+	for _, subnet := range raw {
+		p := ipamPrefix{Fields: make(map[string]string)}
+		for k, v := range subnet {
+			if v != nil {
+				p.Fields[strings.ToLower(k)] = fmt.Sprint(v)
+			}
+		}
+		p.Network = p.Fields["subnet"] + "/" + p.Fields["mask"]
+		p.Description = p.Fields["description"]
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// mapIPAMPrefixes converts the IPAM prefixes to zones, based on the mapping
+// it returns the zones and the amount of prefixes that were skipped
+func mapIPAMPrefixes(prefixes []ipamPrefix, mapping string) ([]*ipMap, int, error) {
+	kind, key, found := strings.Cut(mapping, ":")
+	if !found || key == "" || (kind != "field" && kind != "tag") {
+		return nil, 0, fmt.Errorf("invalid mapping \"%s\", expected \"field:<name>\" or \"tag:<prefix>\"", mapping)
+	}
+	key = strings.ToLower(key)
+
+	zones := make([]*ipMap, 0, len(prefixes))
+	skipped := 0
+	for _, p := range prefixes {
+		pac := ""
+		if kind == "field" {
+			pac = p.Fields[key]
+			// phpIPAM prefixes custom fields, NetBox CSV exports might
+			if pac == "" {
+				pac = p.Fields["custom_"+key]
+			}
+			if pac == "" {
+				pac = p.Fields["cf_"+key]
+			}
+		} else {
+			for _, t := range p.Tags {
+				if strings.HasPrefix(strings.ToLower(t), key) {
+					pac = t[len(key):]
+					break
+				}
+			}
+		}
+		if pac == "" {
+			log.Debugf("Skipping prefix %s since it has no PAC mapped", p.Network)
+			skipped++
+			continue
+		}
+
+		ipNet, err := IP.NewIPNetFromNotation(p.Network)
+		if err != nil {
+			log.Warnf("Skipping prefix \"%s\" since it is not a valid IPv4 network: %s", p.Network, err.Error())
+			skipped++
+			continue
+		}
+
+		zones = append(zones, &ipMap{
+			IPNet:    ipNet,
+			Filename: utils.NormalizePath(pac),
+			Comment:  p.Description,
+			Owner:    p.Owner,
+			Tags:     p.Tags,
+		})
+	}
+
+	sort.SliceStable(zones, func(i, j int) bool {
+		return zones[i].CompareForSort(zones[j])
+	})
+	return zones, skipped, nil
+}
+
+func writeZones(out io.Writer, zones []*ipMap, ext string) error {
+	switch ext {
+	case ".yml", ".yaml", ".json":
+		zoneFile := structuredZoneFile{Zones: make([]structuredZone, 0, len(zones))}
+		for _, z := range zones {
+			zoneFile.Zones = append(zoneFile.Zones, structuredZone{
+				Network: z.IPNet.ToString(),
+				PAC:     filepath.ToSlash(z.Filename),
+				Comment: z.Comment,
+				Owner:   z.Owner,
+				Tags:    z.Tags,
+			})
+		}
+		if ext == ".json" {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "\t")
+			return enc.Encode(zoneFile)
+		}
+		enc := yaml.NewEncoder(out)
+		enc.SetIndent(2)
+		if err := enc.Encode(zoneFile); err != nil {
+			_ = enc.Close()
+			return err
+		}
+		// Close flushes the encoder
+		return enc.Close()
+	default:
+		w := csv.NewWriter(out)
+		if _, err := io.WriteString(out, "// IP, CIDR, PAC, Comment\n"); err != nil {
+			return err
+		}
+		for _, z := range zones {
+			addr, cidr, _ := strings.Cut(z.IPNet.ToString(), "/")
+			record := []string{addr, cidr, filepath.ToSlash(z.Filename)}
+			if z.Comment != "" {
+				record = append(record, z.Comment)
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+}
+
+// ipMapChange describes the change of a single network between two zone sets
+type ipMapChange struct {
+	Network string
+	OldPAC  string
+	NewPAC  string
+}
+
+// diffIPMaps compares two zone sets by network
+// a missing OldPAC means the network was added, a missing NewPAC that it got removed
+func diffIPMaps(oldZones, newZones []*ipMap) []ipMapChange {
+	oldByNet := make(map[IP.Net]*ipMap)
+	for _, z := range oldZones {
+		oldByNet[z.IPNet] = z
+	}
+	newByNet := make(map[IP.Net]*ipMap)
+	for _, z := range newZones {
+		newByNet[z.IPNet] = z
+	}
+
+	nets := make([]IP.Net, 0, len(oldByNet)+len(newByNet))
+	for n := range oldByNet {
+		nets = append(nets, n)
+	}
+	for n := range newByNet {
+		if _, ok := oldByNet[n]; !ok {
+			nets = append(nets, n)
+		}
+	}
+	sort.Slice(nets, func(i, j int) bool {
+		return (&ipMap{IPNet: nets[i]}).CompareForSort(&ipMap{IPNet: nets[j]})
+	})
+
+	changes := make([]ipMapChange, 0)
+	for _, n := range nets {
+		change := ipMapChange{Network: n.ToString()}
+		if z, ok := oldByNet[n]; ok {
+			change.OldPAC = z.Filename
+		}
+		if z, ok := newByNet[n]; ok {
+			change.NewPAC = z.Filename
+		}
+		if change.OldPAC != change.NewPAC {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func formatIPMapDiff(changes []ipMapChange) string {
+	if len(changes) == 0 {
+		return "no changes\n"
+	}
+	str := ""
+	for _, c := range changes {
+		switch {
+		case c.OldPAC == "":
+			str += fmt.Sprintf("+ %s pac(%s)\n", c.Network, c.NewPAC)
+		case c.NewPAC == "":
+			str += fmt.Sprintf("- %s pac(%s)\n", c.Network, c.OldPAC)
+		default:
+			str += fmt.Sprintf("~ %s pac(%s) -> pac(%s)\n", c.Network, c.OldPAC, c.NewPAC)
+		}
+	}
+	return str
+}
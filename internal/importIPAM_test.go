@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIPAMExport(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		format      string
+		data        string
+		wantNets    []string
+		wantField   string
+		wantFieldOf string
+		wantErr     bool
+	}{
+		{
+			name:   "NetBox CSV",
+			format: ImportFormatNetBoxCSV,
+			data: "Prefix,Tenant,Description,Tags,cf_pac\n" +
+				"10.0.0.0/8,Corp,\"all sites, worldwide\",\"office,emea\",company.pac\n",
+			wantNets:    []string{"10.0.0.0/8"},
+			wantField:   "cf_pac",
+			wantFieldOf: "company.pac",
+		},
+		{
+			name:   "phpIPAM CSV",
+			format: ImportFormatPhpIPAMCSV,
+			data: "Subnet,Mask,Description,custom_pac\n" +
+				"10.43.0.0,16,Germany,germany.pac\n",
+			wantNets:    []string{"10.43.0.0/16"},
+			wantField:   "custom_pac",
+			wantFieldOf: "germany.pac",
+		},
+		{
+			name:   "NetBox JSON API response",
+			format: ImportFormatNetBoxJSON,
+			data: `{"count": 1, "results": [{"prefix": "172.16.0.0/12", "description": "vpn",
+				"tags": [{"name": "PAC vpn", "slug": "pac-vpn.pac"}], "custom_fields": {"pac": "vpn.pac", "empty": null}}]}`,
+			wantNets:    []string{"172.16.0.0/12"},
+			wantField:   "pac",
+			wantFieldOf: "vpn.pac",
+		},
+		{
+			name:        "phpIPAM JSON API response",
+			format:      ImportFormatPhpIPAMJSON,
+			data:        `{"code": 200, "success": true, "data": [{"subnet": "192.168.0.0", "mask": "16", "custom_pac": "lab.pac"}]}`,
+			wantNets:    []string{"192.168.0.0/16"},
+			wantField:   "custom_pac",
+			wantFieldOf: "lab.pac",
+		},
+		{
+			name:    "NetBox CSV without prefix column",
+			format:  ImportFormatNetBoxCSV,
+			data:    "Network,Description\n10.0.0.0/8,test\n",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown format",
+			format:  "infoblox",
+			data:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIPAMExport([]byte(tt.data), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPAMExport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			nets := make([]string, 0, len(got))
+			for _, p := range got {
+				nets = append(nets, p.Network)
+			}
+			if !reflect.DeepEqual(nets, tt.wantNets) {
+				t.Errorf("parseIPAMExport() networks = %v, want %v", nets, tt.wantNets)
+			}
+			if got[0].Fields[tt.wantField] != tt.wantFieldOf {
+				t.Errorf("parseIPAMExport() field %s = %q, want %q", tt.wantField, got[0].Fields[tt.wantField], tt.wantFieldOf)
+			}
+		})
+	}
+}
+
+func TestMapIPAMPrefixes(t *testing.T) {
+	t.Parallel()
+
+	prefixes := []ipamPrefix{
+		{Network: "10.43.0.0/16", Tags: []string{"office", "pac-germany.pac"}, Fields: map[string]string{"cf_pac": "countries\\germany.pac"}},
+		{Network: "10.0.0.0/8", Tags: []string{"pac-company.pac"}, Fields: map[string]string{"custom_pac": "company.pac"}},
+		{Network: "10.99.0.0/16", Fields: map[string]string{}},
+		{Network: "2001:db8::/32", Tags: []string{"pac-v6.pac"}, Fields: map[string]string{"pac": "v6.pac"}},
+	}
+
+	tests := []struct {
+		name        string
+		mapping     string
+		wantZones   []string
+		wantSkipped int
+		wantErr     bool
+	}{
+		{
+			name:        "Map by custom field",
+			mapping:     "field:pac",
+			wantZones:   []string{"10.0.0.0/8 company.pac", "10.43.0.0/16 countries/germany.pac"},
+			wantSkipped: 2,
+		},
+		{
+			name:        "Map by tag prefix",
+			mapping:     "tag:pac-",
+			wantZones:   []string{"10.0.0.0/8 company.pac", "10.43.0.0/16 germany.pac"},
+			wantSkipped: 2,
+		},
+		{
+			name:    "Invalid mapping",
+			mapping: "description",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := mapIPAMPrefixes(prefixes, tt.mapping)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapIPAMPrefixes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			zones := make([]string, 0, len(got))
+			for _, z := range got {
+				zones = append(zones, z.IPNet.ToString()+" "+strings.ReplaceAll(z.Filename, "\\", "/"))
+			}
+			if !reflect.DeepEqual(zones, tt.wantZones) {
+				t.Errorf("mapIPAMPrefixes() = %v, want %v", zones, tt.wantZones)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("mapIPAMPrefixes() skipped = %d, want %d", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestWriteZones(t *testing.T) {
+	t.Parallel()
+
+	zones := []*ipMap{
+		{IPNet: forceIPNet("10.0.0.0", 8), Filename: "company.pac", Comment: "all sites, worldwide"},
+		{IPNet: forceIPNet("10.43.0.0", 16), Filename: "germany.pac"},
+	}
+
+	for _, ext := range []string{".csv", ".yml", ".json"} {
+		t.Run(ext, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeZones(&buf, zones, ext); err != nil {
+				t.Fatalf("writeZones() unexpected error: %v", err)
+			}
+
+			// whatever we write must be readable as a zones file again
+			var got []*ipMap
+			if ext == ".csv" {
+				for _, line := range strings.Split(buf.String(), "\n") {
+					m, err := parseIPMapLine(line)
+					if err != nil {
+						t.Fatalf("written CSV line %q is invalid: %v", line, err)
+					}
+					if m != nil {
+						got = append(got, m)
+					}
+				}
+			} else {
+				var zoneErrors []error
+				var err error
+				got, zoneErrors, err = parseStructuredZones(buf.Bytes(), ext == ".json")
+				if err != nil || len(zoneErrors) != 0 {
+					t.Fatalf("written zones are invalid: %v %v", err, zoneErrors)
+				}
+			}
+
+			if len(got) != len(zones) {
+				t.Fatalf("read back %d zones, want %d", len(got), len(zones))
+			}
+			for i := range zones {
+				if !got[i].IPNet.IsIdentical(zones[i].IPNet) || got[i].Filename != zones[i].Filename || got[i].Comment != zones[i].Comment {
+					t.Errorf("zone %d = %+v, want %+v", i, got[i], zones[i])
+				}
+			}
+		})
+	}
+}
+
+// failingWriter fails every write, like a full disk
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriteZonesFails(t *testing.T) {
+	t.Parallel()
+
+	zones := []*ipMap{{IPNet: forceIPNet("10.0.0.0", 8), Filename: "company.pac"}}
+	for _, ext := range []string{".csv", ".yml", ".json"} {
+		if err := writeZones(failingWriter{}, zones, ext); err == nil {
+			t.Errorf("writeZones(%s) to a failing writer did not fail", ext)
+		}
+	}
+}
+
+func TestDiffIPMaps(t *testing.T) {
+	t.Parallel()
+
+	oldZones := []*ipMap{
+		{IPNet: forceIPNet("10.0.0.0", 8), Filename: "company.pac"},
+		{IPNet: forceIPNet("10.43.0.0", 16), Filename: "germany.pac"},
+		{IPNet: forceIPNet("172.16.0.0", 12), Filename: "vpn.pac"},
+	}
+	newZones := []*ipMap{
+		{IPNet: forceIPNet("10.0.0.0", 8), Filename: "company.pac"},
+		{IPNet: forceIPNet("10.43.0.0", 16), Filename: "emea.pac"},
+		{IPNet: forceIPNet("192.168.0.0", 16), Filename: "lab.pac"},
+	}
+
+	want := []ipMapChange{
+		{Network: "10.43.0.0/16", OldPAC: "germany.pac", NewPAC: "emea.pac"},
+		{Network: "172.16.0.0/12", OldPAC: "vpn.pac"},
+		{Network: "192.168.0.0/16", NewPAC: "lab.pac"},
+	}
+
+	got := diffIPMaps(oldZones, newZones)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffIPMaps() = %+v, want %+v", got, want)
+	}
+
+	wantText := "~ 10.43.0.0/16 pac(germany.pac) -> pac(emea.pac)\n" +
+		"- 172.16.0.0/12 pac(vpn.pac)\n" +
+		"+ 192.168.0.0/16 pac(lab.pac)\n"
+	if text := formatIPMapDiff(got); text != wantText {
+		t.Errorf("formatIPMapDiff() = %q, want %q", text, wantText)
+	}
+	if text := formatIPMapDiff(nil); text != "no changes\n" {
+		t.Errorf("formatIPMapDiff(nil) = %q, want %q", text, "no changes\n")
+	}
+}
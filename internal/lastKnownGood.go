@@ -0,0 +1,115 @@
+package internal
+
+/**
+ * this file persists the last known good snapshot to the stateDir
+ *
+ * a snapshot is known good if it was loaded without any problems.
+ * if the initial load fails when the process starts (e.g. a bad deploy followed by a restart),
+ * we boot from the last known good snapshot instead of refusing to start or serving a degraded tree
+ *
+ * while serving it, the regular refresh keeps loading the sources
+ * but only replaces the snapshot once they load without problems again, or with minor problems if they are ignored
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+const lastKnownGoodFile = "last-known-good.json"
+
+var (
+	servingLastKnownGood bool
+	lastKnownGoodLock    sync.Mutex
+)
+
+func lastKnownGoodPath(dir string) string {
+	return filepath.Join(dir, lastKnownGoodFile)
+}
+
+// hasLastKnownGood checks if there is a last known good snapshot in the dir we could boot from
+func hasLastKnownGood(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	info, err := os.Stat(lastKnownGoodPath(dir))
+	return err == nil && !info.IsDir()
+}
+
+// saveLastKnownGood persists the snapshot if it was loaded without problems
+func saveLastKnownGood(s *snapshot) {
+	dir := GetConfig().StateDir
+	if dir == "" || s.Problems > 0 {
+		return
+	}
+	err := writeSnapshotFile(dir, lastKnownGoodPath(dir), s)
+	if err != nil {
+		log.Errorf("Failed to write the last known good snapshot to \"%s\": %s", dir, err.Error())
+	}
+}
+
+// bootFromLastKnownGood replaces the served data with the persisted last known good snapshot
+// it returns false if there is none we could boot from
+func bootFromLastKnownGood() bool {
+	dir := GetConfig().StateDir
+	if dir == "" {
+		return false
+	}
+	s, err := readSnapshot(lastKnownGoodPath(dir))
+	if os.IsNotExist(err) {
+		log.Warnf("There is no last known good snapshot in \"%s\" to fall back to", dir)
+		return false
+	}
+	if err != nil {
+		log.Errorf("Unable to read the last known good snapshot: %s", err.Error())
+		return false
+	}
+
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	// seed the caches first, so a later partial load can fall back to the zones or pacs of the snapshot
+	// and the overrides are rendered with its pacs
+	s.restoreCaches()
+	wpad := s.WPAD
+	if wpad == nil {
+		wpad = getServed().wpad
+	}
+	d := serveLookupTree(&servedData{root: s.DefaultPAC, wpad: wpad, elements: s.Elements})
+
+	// the served data is not part of the snapshot history of this process
+	snapshotLock.Lock()
+	activeSnapshot = 0
+	snapshotLock.Unlock()
+
+	lastKnownGoodLock.Lock()
+	servingLastKnownGood = true
+	lastKnownGoodLock.Unlock()
+
+	recordServed(d, s.zones(), elementPACs(s.Elements), 0, true)
+	recordCommit(s.Commit)
+	recordLastKnownGood(&s.LoadedAt)
+	log.Warnf("!!! SERVING THE LAST KNOWN GOOD SNAPSHOT loaded at %s with %d zones !!!", s.LoadedAt.Format(time.RFC3339), len(s.Elements))
+	log.Warnf("!!! The current zones and pacs failed to load - fix them, it will be replaced by the next load without problems !!!")
+	return true
+}
+
+func isServingLastKnownGood() bool {
+	lastKnownGoodLock.Lock()
+	defer lastKnownGoodLock.Unlock()
+	return servingLastKnownGood
+}
+
+// leaveLastKnownGood is called once a load of the sources is served again
+func leaveLastKnownGood() {
+	lastKnownGoodLock.Lock()
+	defer lastKnownGoodLock.Unlock()
+	if servingLastKnownGood {
+		log.Info("Sources loaded - no longer serving the last known good snapshot")
+		servingLastKnownGood = false
+		recordLastKnownGood(nil)
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resetServedData clears everything a fresh process would start without
+func resetServedData() {
+	served.Store(nil)
+	cachedIPMaps, cachedPACs, cachedFallbackPACs = nil, nil, 0
+	servingLastKnownGood = false
+}
+
+func TestLastKnownGood(t *testing.T) {
+	oldConf, oldZones, oldPACs := confStorage, zoneProvider, pacProvider
+	oldServed := served.Load()
+	oldIPMaps, oldCachedPACs := cachedIPMaps, cachedPACs
+	defer func() {
+		confStorage, zoneProvider, pacProvider = oldConf, oldZones, oldPACs
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs = oldIPMaps, oldCachedPACs
+		servingLastKnownGood = false
+		currentStatus = reloadStatus{}
+	}()
+
+	dir := t.TempDir()
+	defaultFile := filepath.Join(dir, "default.pac")
+	writeTestFile(t, defaultFile, "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	confStorage = &Config{
+		DefaultPACFile: defaultFile,
+		WPADFile:       filepath.Join(dir, "wpad.dat"),
+		ContactInfo:    "Test Contact",
+		StateDir:       filepath.Join(dir, "state"),
+	}
+
+	goodZone := createLookupElement("10.0.0.0", 8, "good.pac")
+	goodZones := memoryZoneProvider{zones: []*ipMap{goodZone.IPMap}}
+	goodPACs := memoryPACProvider{pacs: []*pacTemplate{goodZone.PAC}}
+	brokenZones := memoryZoneProvider{zones: []*ipMap{createLookupElement("10.0.0.0", 8, "broken.pac").IPMap}, problems: 1}
+
+	findFilename := func() string {
+		pac, _ := findInTree(getServed().tree, createIPNet("10.1.2.3", 32))
+		return pac.IPMap.Filename
+	}
+
+	// a load with problems is never persisted
+	resetServedData()
+	zoneProvider, pacProvider = brokenZones, goodPACs
+	updateLookupTree()
+	if _, err := os.Stat(lastKnownGoodPath(confStorage.StateDir)); !os.IsNotExist(err) {
+		t.Fatalf("a load with problems should not be persisted as last known good")
+	}
+
+	// without a last known good snapshot the start fails
+	resetServedData()
+	if err := InitCaches(); err == nil {
+		t.Errorf("InitCaches() expected an error without a last known good snapshot")
+	}
+
+	// a load without problems is persisted
+	zoneProvider, pacProvider = goodZones, goodPACs
+	if problems := updateLookupTree(); problems != 0 {
+		t.Fatalf("updateLookupTree() = %d problems, want 0", problems)
+	}
+
+	// a restart with broken zones boots from the last known good snapshot
+	resetServedData()
+	zoneProvider = brokenZones
+	if err := InitCaches(); err != nil {
+		t.Fatalf("InitCaches() unexpected error: %v", err)
+	}
+	if !isServingLastKnownGood() || getReloadStatus().LastKnownGood == nil {
+		t.Errorf("expected to serve the last known good snapshot")
+	}
+	if filename := findFilename(); filename != "good.pac" {
+		t.Errorf("findInTree() = %s, want good.pac", filename)
+	}
+	if len(cachedIPMaps) != 1 || len(cachedPACs) != 1 {
+		t.Errorf("caches were not seeded: %d zones, %d pacs", len(cachedIPMaps), len(cachedPACs))
+	}
+
+	// a refresh with problems keeps the last known good snapshot, and the zones it is rebuilt from
+	updateLookupTree()
+	if !isServingLastKnownGood() || findFilename() != "good.pac" {
+		t.Errorf("a refresh with problems should keep serving the last known good snapshot")
+	}
+	if len(cachedIPMaps) != 1 || cachedIPMaps[0].Filename != "good.pac" {
+		t.Errorf("a refresh with problems replaced the cached zones: %v", cachedIPMaps)
+	}
+
+	// with ignoreMinors the refresh is served like any other, but not persisted
+	confStorage.IgnoreMinors = true
+	if problems := updateLookupTree(); problems == 0 || isServingLastKnownGood() || getReloadStatus().LastKnownGood != nil {
+		t.Errorf("a refresh with ignored problems should end serving the last known good snapshot")
+	}
+	if filename := findFilename(); filename == "good.pac" {
+		t.Errorf("findInTree() = %s after a refresh with ignored problems", filename)
+	}
+	if s, err := readSnapshot(lastKnownGoodPath(confStorage.StateDir)); err != nil || s.Elements[0].PAC.Filename != "good.pac" {
+		t.Errorf("a refresh with ignored problems replaced the last known good snapshot: %v", err)
+	}
+	confStorage.IgnoreMinors = false
+
+	// a refresh without problems replaces it
+	fixedZone := createLookupElement("10.0.0.0", 8, "fixed.pac")
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{fixedZone.IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{fixedZone.PAC}}
+	updateLookupTree()
+	if isServingLastKnownGood() || getReloadStatus().LastKnownGood != nil {
+		t.Errorf("a load without problems should end serving the last known good snapshot")
+	}
+	if filename := findFilename(); filename != "fixed.pac" {
+		t.Errorf("findInTree() = %s, want fixed.pac", filename)
+	}
+
+	// a missing default PAC without a fallback fails instead of panicking
+	resetServedData()
+	confStorage.StateDir = ""
+	confStorage.IgnoreMinors = true
+	confStorage.DefaultPACFile = filepath.Join(dir, "missing.pac")
+	if err := InitCaches(); err == nil {
+		t.Errorf("InitCaches() expected an error without a default PAC")
+	}
+}
+
+func TestValidateConfigWithLastKnownGood(t *testing.T) {
+	dir := t.TempDir()
+	conf := overloadDefaults(&YAMLConfig{})
+	conf.IPMapFile = filepath.Join(dir, "missing.csv")
+	conf.PACRoot = filepath.Join(dir, "missing")
+
+	// without a snapshot, missing sources are an error
+	if err := validateConfig(conf); err == nil {
+		t.Errorf("validateConfig() expected an error without a stateDir")
+	}
+	conf.StateDir = filepath.Join(dir, "state")
+	if err := validateConfig(conf); err == nil {
+		t.Errorf("validateConfig() expected an error without a last known good snapshot")
+	}
+
+	// with a snapshot to boot from, they are only a warning
+	s := newSnapshot(&servedData{root: createLookupElement("0.0.0.0", 0, "default.pac")}, nil, nil, 0, "")
+	if err := writeSnapshotFile(conf.StateDir, lastKnownGoodPath(conf.StateDir), s); err != nil {
+		t.Fatalf("writeSnapshotFile() unexpected error: %v", err)
+	}
+	if err := validateConfig(conf); err != nil {
+		t.Errorf("validateConfig() unexpected error with a last known good snapshot: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package internal
+
+/**
+ * log outputs are the sinks of the event and the access log
+ *
+ * - file: a file rotated by size and age, the event log is written to stdout as well
+ * - stdout: stdout only, e.g. for containers
+ * - syslog: RFC 5424 messages via udp, tcp (octet counted) or a unix socket,
+ *   entries longer than syslogMaxMessageSize are split into several messages
+ * - journald: the native protocol of the systemd journal,
+ *   entries too large for a datagram are passed in a sealed memfd
+ * - none: the access log is not written at all
+ *
+ * each write is a single entry, which is what the fiber loggers and the access log do.
+ * the connections to syslog and journald are opened on the first write and reopened after a failed one,
+ * so a restarted syslog server does not require a restart of pacserver
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// outputs of the event and access log
+const (
+	LogOutputFile     = "file"
+	LogOutputStdout   = "stdout"
+	LogOutputSyslog   = "syslog"
+	LogOutputJournald = "journald"
+	LogOutputNone     = "none"
+)
+
+// severities of RFC 5424, which journald uses as well
+const (
+	severityCritical = 2
+	severityError    = 3
+	severityWarning  = 4
+	severityInfo     = 6
+	severityDebug    = 7
+)
+
+// syslogFacilities are the facilities pacserver can log as
+var syslogFacilities = map[string]int{
+	"user":   1,
+	"daemon": 3,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// journalSocket is where journald receives entries
+var journalSocket = "/run/systemd/journal/socket"
+
+// syslogAppName is the APP-NAME of the syslog messages and the SYSLOG_IDENTIFIER of the journal entries
+const syslogAppName = "pacserver"
+
+// newLogOutput returns the writer for the output of a log, or nil for LogOutputNone
+// name tells the event and the access log apart in syslog and journald
+func newLogOutput(conf *Config, output, filename, name string, severity func([]byte) int) (io.Writer, error) {
+	switch output {
+	case LogOutputNone:
+		return nil, nil
+	case LogOutputStdout:
+		return os.Stdout, nil
+	case LogOutputSyslog:
+		network, address, err := parseSyslogAddress(conf.SyslogAddress)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogWriter{
+			network:  network,
+			address:  address,
+			facility: syslogFacilities[conf.SyslogFacility],
+			hostname: syslogHostname(),
+			msgID:    name,
+			severity: severity,
+			maxSize:  conf.SyslogMaxMessageSize,
+		}, nil
+	case LogOutputJournald:
+		if _, err := os.Stat(journalSocket); err != nil {
+			return nil, fmt.Errorf("journald is not available: %s", err.Error())
+		}
+		return &journaldWriter{socket: journalSocket, name: name, severity: severity}, nil
+	default:
+		return &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    conf.LogMaxSize, // megabytes
+			MaxBackups: conf.LogMaxBackups,
+			MaxAge:     conf.LogMaxAge, //days
+			Compress:   conf.LogCompress,
+		}, nil
+	}
+}
+
+// parseSyslogAddress splits an address like udp://host:514, tcp://host:601 or unix:///dev/log
+func parseSyslogAddress(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslogAddress \"%s\": %s", address, err.Error())
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("syslogAddress \"%s\" is missing the host", address)
+		}
+		if u.Port() == "" {
+			return u.Scheme, net.JoinHostPort(u.Host, "514"), nil
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("syslogAddress \"%s\" is missing the path of the socket", address)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("syslogAddress must start with udp://, tcp:// or unix://: %s", address)
+	}
+}
+
+// eventSeverity reads the severity from the level fiber prefixes the messages with
+// the first level in the line is used, the message itself could contain another one
+func eventSeverity(line []byte) int {
+	severity, first := severityInfo, -1
+	for _, level := range []struct {
+		tag      string
+		severity int
+	}{
+		{"[Trace] ", severityDebug},
+		{"[Debug] ", severityDebug},
+		{"[Info] ", severityInfo},
+		{"[Warn] ", severityWarning},
+		{"[Error] ", severityError},
+		{"[Fatal] ", severityCritical},
+		{"[Panic] ", severityCritical},
+	} {
+		if i := bytes.Index(line, []byte(level.tag)); i >= 0 && (first < 0 || i < first) {
+			severity, first = level.severity, i
+		}
+	}
+	return severity
+}
+
+// accessSeverity is the severity of all access log entries
+func accessSeverity([]byte) int {
+	return severityInfo
+}
+
+// syslogHostname is the HOSTNAME of the syslog messages, "-" if it is unknown
+func syslogHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "-"
+	}
+	return hostname
+}
+
+// syslogWriter sends each write as RFC 5424 messages
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	msgID    string
+	severity func([]byte) int
+	// maxSize is the maximum size of a message (without the framing of tcp), 0 for no limit
+	maxSize int
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msgs := w.format(bytes.TrimRight(p, "\n"), time.Now())
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, msg := range msgs {
+		if err := w.send(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// send writes a message, a failed write is retried once on a new connection
+// the caller has to hold the lock
+func (w *syslogWriter) send(msg []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return err
+			}
+		}
+		if _, err = w.conn.Write(msg); err == nil {
+			return nil
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	if w.network != "unix" {
+		return net.DialTimeout(w.network, w.address, 5*time.Second)
+	}
+	// local syslog daemons usually listen on a datagram socket
+	conn, err := net.Dial("unixgram", w.address)
+	if err != nil {
+		return net.Dial("unix", w.address)
+	}
+	return conn, nil
+}
+
+// format builds the messages of the entry, tcp messages are framed by their length (RFC 6587)
+// an entry longer than the maxSize is split into several messages with the same header
+func (w *syslogWriter) format(entry []byte, now time.Time) [][]byte {
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		w.facility*8+w.severity(entry),
+		now.Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, syslogAppName, os.Getpid(), w.msgID,
+	)
+	size := len(entry)
+	if w.maxSize > 0 {
+		// at least a single character per message, even with a long hostname
+		size = max(w.maxSize-len(header), utf8.UTFMax)
+	}
+	msgs := make([][]byte, 0, 1)
+	for first := true; first || len(entry) > 0; first = false {
+		part := entry[:splitEntry(entry, size)]
+		entry = entry[len(part):]
+		msg := append([]byte(header), part...)
+		if w.network == "tcp" {
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// splitEntry returns the length of the first part of the entry of at most size bytes
+// characters are not split, unless a single one is longer than size
+func splitEntry(entry []byte, size int) int {
+	if len(entry) <= size {
+		return len(entry)
+	}
+	for n := size; n > 0; n-- {
+		if utf8.RuneStart(entry[n]) {
+			return n
+		}
+	}
+	return size
+}
+
+// journaldWriter sends each write as an entry of the systemd journal
+type journaldWriter struct {
+	socket   string
+	name     string
+	severity func([]byte) int
+
+	lock sync.Mutex
+	conn *net.UnixConn
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	entry := w.format(bytes.TrimRight(p, "\n"))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: w.socket, Net: "unixgram"}); err != nil {
+				return 0, err
+			}
+		}
+		_, err = w.conn.Write(entry)
+		if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+			// the entry is larger than the send buffer of the socket
+			err = w.sendMemfd(entry)
+		}
+		if err == nil {
+			return len(p), nil
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	return 0, err
+}
+
+// sendMemfd passes the entry to journald in a sealed memfd, like sd_journal_send does for large entries
+// the file descriptor is sent as SCM_RIGHTS of an empty datagram
+func (w *journaldWriter) sendMemfd(entry []byte) error {
+	fd, err := unix.MemfdCreate("pacserver-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	file := os.NewFile(uintptr(fd), "pacserver-journal")
+	defer file.Close()
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+	// journald only maps the memfd if it can not be changed anymore
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals); err != nil {
+		return err
+	}
+	// net refuses WriteMsgUnix on connected datagram sockets, so the message is sent on the raw socket
+	raw, err := w.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := raw.Write(func(socket uintptr) bool {
+		err = unix.Sendmsg(int(socket), nil, unix.UnixRights(fd), nil, 0)
+		return err != unix.EAGAIN
+	}); err != nil {
+		return err
+	}
+	return err
+}
+
+// format builds the fields of the entry, PACSERVER_LOG tells the event and the access log apart
+func (w *journaldWriter) format(entry []byte) []byte {
+	var fields bytes.Buffer
+	field := func(key string, value []byte) {
+		fields.WriteString(key)
+		if bytes.IndexByte(value, '\n') < 0 {
+			fields.WriteByte('=')
+			fields.Write(value)
+		} else {
+			// values spanning lines are prefixed by their length
+			fields.WriteByte('\n')
+			_ = binary.Write(&fields, binary.LittleEndian, uint64(len(value)))
+			fields.Write(value)
+		}
+		fields.WriteByte('\n')
+	}
+	field("PRIORITY", []byte(strconv.Itoa(w.severity(entry))))
+	field("SYSLOG_IDENTIFIER", []byte(syslogAppName))
+	field("PACSERVER_LOG", []byte(w.name))
+	field("MESSAGE", entry)
+	return fields.Bytes()
+}
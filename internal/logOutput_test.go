@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func TestParseSyslogAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{address: "udp://syslog.example.com:1514", wantNetwork: "udp", wantAddress: "syslog.example.com:1514"},
+		{address: "udp://syslog.example.com", wantNetwork: "udp", wantAddress: "syslog.example.com:514"},
+		{address: "tcp://10.0.0.1:601", wantNetwork: "tcp", wantAddress: "10.0.0.1:601"},
+		{address: "unix:///dev/log", wantNetwork: "unix", wantAddress: "/dev/log"},
+		{address: "syslog.example.com:514", wantErr: true},
+		{address: "tcp://", wantErr: true},
+		{address: "unix://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			network, address, err := parseSyslogAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSyslogAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Errorf("parseSyslogAddress() = %s %s, want %s %s", network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestEventSeverity(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]int{
+		"2024/01/02 15:04:05.000000 storage.go:42: [Info] Application starting":           severityInfo,
+		"2024/01/02 15:04:05.000000 storage.go:42: [Error] Failed to read Zone-File":      severityError,
+		"2024/01/02 15:04:05.000000 storage.go:42: [Warn] Proxy proxy1 is down":           severityWarning,
+		"2024/01/02 15:04:05.000000 storage.go:42: [Debug] Received for /":                severityDebug,
+		"2024/01/02 15:04:05.000000 storage.go:42: [Info] PAC contains \"[Error] \" text": severityInfo,
+		"a line without a level": severityInfo,
+	}
+	for line, want := range tests {
+		if got := eventSeverity([]byte(line)); got != want {
+			t.Errorf("eventSeverity(%q) = %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestNewLogOutput(t *testing.T) {
+	conf := overloadDefaults(&YAMLConfig{})
+	conf.LogMaxSize, conf.LogMaxBackups, conf.LogMaxAge, conf.LogCompress = 10, 5, 7, false
+
+	output, err := newLogOutput(conf, LogOutputFile, "access.log", "access", accessSeverity)
+	file, ok := output.(*lumberjack.Logger)
+	if err != nil || !ok {
+		t.Fatalf("newLogOutput(file) = %T, %v, want a rotated file", output, err)
+	}
+	if file.Filename != "access.log" || file.MaxSize != 10 || file.MaxBackups != 5 || file.MaxAge != 7 || file.Compress {
+		t.Errorf("newLogOutput(file) = %+v, want the rotation of the config", file)
+	}
+	if output, err := newLogOutput(conf, LogOutputStdout, "access.log", "access", accessSeverity); err != nil || output != os.Stdout {
+		t.Errorf("newLogOutput(stdout) = %v, %v, want stdout", output, err)
+	}
+	if output, err := newLogOutput(conf, LogOutputNone, "access.log", "access", accessSeverity); err != nil || output != nil {
+		t.Errorf("newLogOutput(none) = %v, %v, want nil", output, err)
+	}
+
+	oldSocket := journalSocket
+	defer func() { journalSocket = oldSocket }()
+	journalSocket = filepath.Join(t.TempDir(), "missing")
+	if _, err := newLogOutput(conf, LogOutputJournald, "", "event", eventSeverity); err == nil {
+		t.Errorf("newLogOutput(journald) without a journal socket did not fail")
+	}
+}
+
+// syslogMessage matches a RFC 5424 message of the event log with the facility daemon
+var syslogMessage = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\S+ \S+ pacserver \d+ event - (.*)$`)
+
+func checkSyslogMessage(t *testing.T, msg string, wantPri int, wantEntry string) {
+	t.Helper()
+	match := syslogMessage.FindStringSubmatch(msg)
+	if match == nil {
+		t.Fatalf("syslog message %q is not a RFC 5424 message of the event log", msg)
+	}
+	if match[1] != strconv.Itoa(wantPri) || match[2] != wantEntry {
+		t.Errorf("syslog message = <%s> %q, want <%d> %q", match[1], match[2], wantPri, wantEntry)
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	conf := overloadDefaults(&YAMLConfig{})
+	const entry = "storage.go:42: [Error] Failed to read Zone-File"
+	// daemon (3) * 8 + error (3)
+	const wantPri = 27
+
+	newWriter := func(t *testing.T, address string) *syslogWriter {
+		t.Helper()
+		conf.SyslogAddress = address
+		output, err := newLogOutput(conf, LogOutputSyslog, "", "event", eventSeverity)
+		if err != nil {
+			t.Fatalf("newLogOutput(syslog) unexpected error: %v", err)
+		}
+		if n, err := output.Write([]byte(entry + "\n")); err != nil || n != len(entry)+1 {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+		return output.(*syslogWriter)
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.ListenPacket() unexpected error: %v", err)
+		}
+		defer server.Close()
+		newWriter(t, "udp://"+server.LocalAddr().String())
+
+		buf := make([]byte, 2048)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() unexpected error: %v", err)
+		}
+		checkSyslogMessage(t, string(buf[:n]), wantPri, entry)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() unexpected error: %v", err)
+		}
+		defer listener.Close()
+		writer := newWriter(t, "tcp://"+listener.Addr().String())
+		_, _ = writer.Write([]byte(entry))
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept() unexpected error: %v", err)
+		}
+		defer conn.Close()
+		// both messages are framed by their length
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				t.Fatalf("reading the length unexpected error: %v", err)
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+			if err != nil {
+				t.Fatalf("message %d is not framed by its length: %q", i+1, length)
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				t.Fatalf("reading the message unexpected error: %v", err)
+			}
+			checkSyslogMessage(t, string(msg), wantPri, entry)
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		// the path of unix sockets is limited to about 100 characters, which t.TempDir() can exceed
+		dir, err := os.MkdirTemp("", "pacserver")
+		if err != nil {
+			t.Fatalf("os.MkdirTemp() unexpected error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "log")
+		server, err := net.ListenPacket("unixgram", path)
+		if err != nil {
+			t.Fatalf("net.ListenPacket() unexpected error: %v", err)
+		}
+		defer server.Close()
+		newWriter(t, "unix://"+path)
+
+		buf := make([]byte, 2048)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() unexpected error: %v", err)
+		}
+		checkSyslogMessage(t, string(buf[:n]), wantPri, entry)
+	})
+
+	t.Run("split", func(t *testing.T) {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.ListenPacket() unexpected error: %v", err)
+		}
+		defer server.Close()
+		conf.SyslogAddress, conf.SyslogMaxMessageSize = "udp://"+server.LocalAddr().String(), 480
+		defer func() { conf.SyslogMaxMessageSize = 2048 }()
+		output, err := newLogOutput(conf, LogOutputSyslog, "", "event", eventSeverity)
+		if err != nil {
+			t.Fatalf("newLogOutput(syslog) unexpected error: %v", err)
+		}
+		// characters of two bytes are not split between messages
+		long := entry + " " + strings.Repeat("Zone-Datei enthält ungültige Zeilen ", 30)
+		if _, err := output.Write([]byte(long + "\n")); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+
+		var joined strings.Builder
+		buf := make([]byte, 2048)
+		for joined.Len() < len(long) {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom() unexpected error: %v", err)
+			}
+			if n > 480 {
+				t.Errorf("syslog message of %d bytes, want at most 480", n)
+			}
+			match := syslogMessage.FindStringSubmatch(string(buf[:n]))
+			if match == nil || !utf8.ValidString(match[2]) {
+				t.Fatalf("syslog message %q is not a RFC 5424 message of valid UTF-8", buf[:n])
+			}
+			// every part has the severity of the entry
+			checkSyslogMessage(t, string(buf[:n]), wantPri, match[2])
+			joined.WriteString(match[2])
+		}
+		if joined.String() != long {
+			t.Errorf("joined syslog messages = %q, want %q", joined.String(), long)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		conf.SyslogAddress = "unix://" + filepath.Join(t.TempDir(), "missing")
+		output, _ := newLogOutput(conf, LogOutputSyslog, "", "event", eventSeverity)
+		if _, err := output.Write([]byte(entry)); err == nil {
+			t.Errorf("Write() to a missing socket did not fail")
+		}
+	})
+}
+
+// journalFields parses the fields of a journal entry, including the ones prefixed by their length
+func journalFields(t *testing.T, entry []byte) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for len(entry) > 0 {
+		end := bytes.IndexAny(entry, "=\n")
+		if end < 0 {
+			t.Fatalf("journal entry ends within a field: %q", entry)
+		}
+		key := string(entry[:end])
+		if entry[end] == '=' {
+			value, rest, _ := bytes.Cut(entry[end+1:], []byte("\n"))
+			fields[key], entry = string(value), rest
+			continue
+		}
+		length := binary.LittleEndian.Uint64(entry[end+1 : end+9])
+		value := entry[end+9 : end+9+int(length)]
+		fields[key], entry = string(value), entry[end+10+int(length):]
+	}
+	return fields
+}
+
+func TestJournaldWriter(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pacserver")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp() unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldSocket := journalSocket
+	defer func() { journalSocket = oldSocket }()
+	journalSocket = filepath.Join(dir, "socket")
+	server, err := net.ListenPacket("unixgram", journalSocket)
+	if err != nil {
+		t.Fatalf("net.ListenPacket() unexpected error: %v", err)
+	}
+	defer server.Close()
+
+	output, err := newLogOutput(overloadDefaults(&YAMLConfig{}), LogOutputJournald, "", "event", eventSeverity)
+	if err != nil {
+		t.Fatalf("newLogOutput(journald) unexpected error: %v", err)
+	}
+	for _, tt := range []struct {
+		entry        string
+		wantPriority string
+	}{
+		{entry: "storage.go:42: [Warn] Proxy proxy1 is down", wantPriority: "4"},
+		// entries spanning lines are sent with their length
+		{entry: "webserver.go:42: [Info] first line\nsecond line", wantPriority: "6"},
+	} {
+		if _, err := output.Write([]byte(tt.entry + "\n")); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+		buf := make([]byte, 2048)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() unexpected error: %v", err)
+		}
+		fields := journalFields(t, buf[:n])
+		want := map[string]string{
+			"PRIORITY":          tt.wantPriority,
+			"SYSLOG_IDENTIFIER": "pacserver",
+			"PACSERVER_LOG":     "event",
+			"MESSAGE":           tt.entry,
+		}
+		for key, value := range want {
+			if fields[key] != value {
+				t.Errorf("journal entry %s = %q, want %q", key, fields[key], value)
+			}
+		}
+	}
+}
+
+func TestJournaldWriterMemfd(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pacserver")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp() unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldSocket := journalSocket
+	defer func() { journalSocket = oldSocket }()
+	journalSocket = filepath.Join(dir, "socket")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("net.ListenUnixgram() unexpected error: %v", err)
+	}
+	defer server.Close()
+
+	output, err := newLogOutput(overloadDefaults(&YAMLConfig{}), LogOutputJournald, "", "access", accessSeverity)
+	if err != nil {
+		t.Fatalf("newLogOutput(journald) unexpected error: %v", err)
+	}
+	// larger than the send buffer of a unix socket
+	entry := strings.Repeat("GET /10.1.2.3 ", 100000)
+	if _, err := output.Write([]byte(entry + "\n")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	buf, oob := make([]byte, 16), make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := server.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatalf("ReadMsgUnix() unexpected error: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("the datagram passing the memfd contains %d bytes, want none", n)
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("ParseSocketControlMessage() = %v, %v, want a single message", messages, err)
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("ParseUnixRights() = %v, %v, want a single file descriptor", fds, err)
+	}
+	file := os.NewFile(uintptr(fds[0]), "memfd")
+	defer file.Close()
+
+	seals, err := unix.FcntlInt(file.Fd(), unix.F_GET_SEALS, 0)
+	if err != nil || seals&unix.F_SEAL_WRITE == 0 || seals&unix.F_SEAL_SEAL == 0 {
+		t.Errorf("the memfd is not sealed: %x, %v", seals, err)
+	}
+	// the file offset is shared with the writer, which left it at the end
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<30))
+	if err != nil {
+		t.Fatalf("reading the memfd unexpected error: %v", err)
+	}
+	fields := journalFields(t, content)
+	if fields["MESSAGE"] != entry || fields["PACSERVER_LOG"] != "access" {
+		t.Errorf("journal entry of the memfd = %s with a message of %d bytes, want the access log entry of %d bytes", fields["PACSERVER_LOG"], len(fields["MESSAGE"]), len(entry))
+	}
+}
+
+func TestValidateLogOutputs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		modify  func(conf *Config)
+		wantErr bool
+	}{
+		{name: "Default", modify: func(conf *Config) {}},
+		{name: "Syslog", modify: func(conf *Config) {
+			conf.AccessLogOutput, conf.SyslogAddress, conf.SyslogFacility = LogOutputSyslog, "udp://127.0.0.1:514", "local3"
+		}},
+		{name: "Access log disabled", modify: func(conf *Config) { conf.AccessLogOutput = LogOutputNone }},
+		{name: "Event log disabled", modify: func(conf *Config) { conf.EventLogOutput = LogOutputNone }, wantErr: true},
+		{name: "Unknown output", modify: func(conf *Config) { conf.AccessLogOutput = "kafka" }, wantErr: true},
+		{name: "Invalid syslog address", modify: func(conf *Config) {
+			conf.EventLogOutput, conf.SyslogAddress = LogOutputSyslog, "syslog.example.com:514"
+		}, wantErr: true},
+		{name: "Unknown facility", modify: func(conf *Config) {
+			conf.EventLogOutput, conf.SyslogFacility = LogOutputSyslog, "kern"
+		}, wantErr: true},
+		{name: "Syslog message size below 480", modify: func(conf *Config) {
+			conf.EventLogOutput, conf.SyslogMaxMessageSize = LogOutputSyslog, 479
+		}, wantErr: true},
+		{name: "Log size of 0", modify: func(conf *Config) { conf.LogMaxSize = 0 }, wantErr: true},
+		{name: "Negative backups", modify: func(conf *Config) { conf.LogMaxBackups = -1 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := overloadDefaults(&YAMLConfig{})
+			tt.modify(conf)
+			if err := validateLogOutputs(conf); (err != nil) != tt.wantErr {
+				t.Errorf("validateLogOutputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+/**
+ * the lookup cache remembers the results of recent lookups of client IPs
+ *
+ * clients re-request their PAC on every network event, so the same IPs are parsed and looked up over and over.
+ * the cache is a set-associative LRU: every key maps to a set of lookupCacheWays slots
+ * and a new entry replaces the least recently used slot of its set.
+ * slots are replaced atomically, so neither lookups nor inserts take a lock.
+ *
+ * results can be cached for whole networks (e.g. /24) instead of single IPs,
+ * but only if no more specific zone overlaps the network - otherwise the result is cached for the /32.
+ * every entry remembers the tree it was found in and is only served while that tree is served
+ */
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+const lookupCacheWays = 4
+
+type lookupCacheEntry struct {
+	// key is the network address of the cached network, bits its length
+	key  uint32
+	bits uint8
+	tree *lookupTreeNode
+	pac  *LookupElement
+	// lastUsed is the tick of the latest hit, to find the least recently used slot of a set
+	lastUsed atomic.Uint64
+}
+
+type lookupCache struct {
+	slots []atomic.Pointer[lookupCacheEntry]
+	// setMask selects the set of a key, the amount of sets is a power of two
+	setMask uint32
+	// prefix is the length of the networks results are cached for
+	prefix int
+	tick   atomic.Uint64
+}
+
+// the cache is nil if it is disabled
+var clientLookupCache *lookupCache
+
+// initLookupCache creates a cache for at least size entries (rounded up to a power of two)
+func initLookupCache(size int, prefix int) {
+	if size <= 0 {
+		clientLookupCache = nil
+		return
+	}
+	sets := 1
+	for sets*lookupCacheWays < size {
+		sets <<= 1
+	}
+	clientLookupCache = &lookupCache{
+		slots:   make([]atomic.Pointer[lookupCacheEntry], sets*lookupCacheWays),
+		setMask: uint32(sets - 1),
+		prefix:  prefix,
+	}
+}
+
+// resetLookupCache drops all entries, it is called whenever the served tree is swapped
+// entries of an old tree would never be served anyway, this only frees their memory
+func resetLookupCache() {
+	cache := clientLookupCache
+	if cache == nil {
+		return
+	}
+	for i := range cache.slots {
+		cache.slots[i].Store(nil)
+	}
+}
+
+// findCachedInTree is findElementInTree for a single client IP, answered from the cache if possible
+func findCachedInTree(cache *lookupCache, root *lookupTreeNode, ip IP.IP) *LookupElement {
+	host := IP.Net{NetworkAddress: ip, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}
+	prefix, _ := IP.NewCIDR(cache.prefix)
+	network := IP.Net{NetworkAddress: IP.IP{Value: ip.Value & prefix.Mask}, CIDR: prefix}
+
+	if e := cache.get(root, network.NetworkAddress.Value, uint8(cache.prefix)); e != nil {
+		return e.pac
+	}
+	if cache.prefix != 32 {
+		if e := cache.get(root, ip.Value, 32); e != nil {
+			return e.pac
+		}
+	}
+	lookupCacheMisses.Inc()
+
+	if cache.prefix != 32 {
+		if pac, uniform := findNetworkInTree(root, &network); uniform {
+			cache.put(root, network.NetworkAddress.Value, uint8(cache.prefix), pac)
+			return pac
+		}
+	}
+	pac := findElementInTree(root, &host)
+	cache.put(root, ip.Value, 32, pac)
+	return pac
+}
+
+// findNetworkInTree looks up the network like findElementInTree
+// and reports whether all of its IPs receive the same element, which is the case if no more specific zone overlaps it
+func findNetworkInTree(root *lookupTreeNode, network *IP.Net) (*LookupElement, bool) {
+	node := root
+	for child := findChild(node, network); child != nil; child = findChild(node, network) {
+		node = child
+	}
+
+	// none of the children contains the network, so a child overlapping it lies within it
+	last := network.LastAddress().Value
+	after := sort.Search(len(node.children), func(i int) bool {
+		return node.children[i].data.IPMap.IPNet.NetworkAddress.Value > last
+	})
+	uniform := after == 0 || node.children[after-1].data.IPMap.IPNet.NetworkAddress.Value < network.NetworkAddress.Value
+	return node.data, uniform
+}
+
+func (cache *lookupCache) set(key uint32, bits uint8) []atomic.Pointer[lookupCacheEntry] {
+	// fibonacci hashing spreads neighbouring networks over all sets
+	hash := (key ^ uint32(bits)) * 2654435769
+	first := int(hash>>16&cache.setMask) * lookupCacheWays
+	return cache.slots[first : first+lookupCacheWays]
+}
+
+func (cache *lookupCache) get(tree *lookupTreeNode, key uint32, bits uint8) *lookupCacheEntry {
+	set := cache.set(key, bits)
+	for i := range set {
+		e := set[i].Load()
+		if e != nil && e.key == key && e.bits == bits && e.tree == tree {
+			e.lastUsed.Store(cache.tick.Add(1))
+			lookupCacheHits.Inc()
+			return e
+		}
+	}
+	return nil
+}
+
+func (cache *lookupCache) put(tree *lookupTreeNode, key uint32, bits uint8, pac *LookupElement) {
+	e := &lookupCacheEntry{key: key, bits: bits, tree: tree, pac: pac}
+	e.lastUsed.Store(cache.tick.Add(1))
+
+	// replace an empty or outdated slot, otherwise the least recently used one
+	set := cache.set(key, bits)
+	victim := 0
+	var oldest uint64
+	for i := range set {
+		current := set[i].Load()
+		if current == nil || current.tree != tree {
+			victim = i
+			break
+		}
+		if used := current.lastUsed.Load(); i == 0 || used < oldest {
+			victim, oldest = i, used
+		}
+	}
+	set[victim].Store(e)
+}
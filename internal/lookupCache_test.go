@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+func TestLookupCache(t *testing.T) {
+	setupRangeTest(t)
+	tree := buildLookupTree(testDefaultPAC, []*LookupElement{
+		createLookupElement("10.0.0.0", 8, "company.pac"),
+		createLookupElement("10.1.2.0", 24, "office.pac"),
+		createLookupElement("10.1.3.16", 28, "lab.pac"),
+	})
+
+	tests := []struct {
+		name   string
+		prefix int
+		// lookups are done in order on the same cache
+		lookups []string
+		want    []string
+		hits    []bool
+	}{
+		{
+			name:    "Repeated host is a hit",
+			prefix:  32,
+			lookups: []string{"10.1.2.5", "10.1.2.5", "10.1.2.6"},
+			want:    []string{"office.pac", "office.pac", "office.pac"},
+			hits:    []bool{false, true, false},
+		},
+		{
+			name:    "Uniform /24 is shared by its hosts",
+			prefix:  24,
+			lookups: []string{"10.1.2.5", "10.1.2.6", "10.5.5.5", "10.5.5.200"},
+			want:    []string{"office.pac", "office.pac", "company.pac", "company.pac"},
+			hits:    []bool{false, true, false, true},
+		},
+		{
+			name:    "/24 with a more specific zone is cached per host",
+			prefix:  24,
+			lookups: []string{"10.1.3.5", "10.1.3.20", "10.1.3.5", "10.1.3.6"},
+			want:    []string{"company.pac", "lab.pac", "company.pac", "company.pac"},
+			hits:    []bool{false, false, true, false},
+		},
+		{
+			name:    "Outside of all zones",
+			prefix:  24,
+			lookups: []string{"192.168.0.1", "192.168.0.2"},
+			want:    []string{"default.pac", "default.pac"},
+			hits:    []bool{false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initLookupCache(64, tt.prefix)
+			defer initLookupCache(0, 32)
+
+			for i, lookup := range tt.lookups {
+				ip, _ := IP.ParseIP(lookup)
+				hits := testutil.ToFloat64(lookupCacheHits)
+				pac := findCachedInTree(clientLookupCache, tree, ip)
+				if pac.IPMap.Filename != tt.want[i] {
+					t.Errorf("lookup %s = %s, want %s", lookup, pac.IPMap.Filename, tt.want[i])
+				}
+				if hit := testutil.ToFloat64(lookupCacheHits) > hits; hit != tt.hits[i] {
+					t.Errorf("lookup %s: hit = %v, want %v", lookup, hit, tt.hits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLookupCacheInvalidatedOnSwap(t *testing.T) {
+	setupRangeTest(t)
+	initLookupCache(64, 24)
+	defer initLookupCache(0, 32)
+
+	ip, _ := IP.ParseIP("10.1.2.5")
+	oldTree := buildLookupTree(testDefaultPAC, []*LookupElement{createLookupElement("10.1.2.0", 24, "old.pac")})
+	newTree := buildLookupTree(testDefaultPAC, []*LookupElement{createLookupElement("10.1.2.0", 24, "new.pac")})
+
+	findCachedInTree(clientLookupCache, oldTree, ip)
+	// even without a reset, entries of another tree are never served
+	if pac := findCachedInTree(clientLookupCache, newTree, ip); pac.IPMap.Filename != "new.pac" {
+		t.Errorf("lookup in the new tree = %s, want new.pac", pac.IPMap.Filename)
+	}
+
+	resetLookupCache()
+	for i := range clientLookupCache.slots {
+		if clientLookupCache.slots[i].Load() != nil {
+			t.Fatalf("resetLookupCache() left slot %d filled", i)
+		}
+	}
+}
+
+func TestLookupCacheMatchesTree(t *testing.T) {
+	setupRangeTest(t)
+	defer initLookupCache(0, 32)
+
+	for seed := int64(0); seed < 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		resolved, _, _ := resolveDuplicateZones(randomZoneSet(r, 1+r.Intn(300)), DuplicateZonesLast)
+		tree := buildLookupTree(testDefaultPAC, resolved)
+
+		for _, prefix := range []int{24, 32} {
+			// a small cache, so entries are evicted all the time
+			initLookupCache(16, prefix)
+			for i := 0; i < 2000; i++ {
+				ip := IP.IP{Value: 10<<24 | r.Uint32()&0x1FFFF}
+				host := &IP.Net{NetworkAddress: ip, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}
+				want, _ := findInTree(tree, host)
+				if got := findCachedInTree(clientLookupCache, tree, ip); got != want {
+					t.Fatalf("seed %d, prefix %d: lookup %s = %s, want %s", seed, prefix, ip.ToString(), got._stringify(), want._stringify())
+				}
+			}
+			if len(clientLookupCache.slots) != 16 {
+				t.Errorf("cache of size 16 has %d slots", len(clientLookupCache.slots))
+			}
+		}
+	}
+}
+
+func TestLookupCacheConcurrent(t *testing.T) {
+	setupRangeTest(t)
+	initLookupCache(16, 24)
+	defer initLookupCache(0, 32)
+
+	tree := buildLookupTree(testDefaultPAC, generateZones(1000, true))
+	hosts := randomHosts(256)
+	done := make(chan bool)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			defer func() { done <- true }()
+			for i := 0; i < 2000; i++ {
+				host := hosts[(i*(w+1))%len(hosts)]
+				want, _ := findInTree(tree, host)
+				if got := findCachedInTree(clientLookupCache, tree, host.NetworkAddress); got != want {
+					t.Errorf("lookup %s = %s, want %s", host.ToString(), got._stringify(), want._stringify())
+					return
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+}
@@ -0,0 +1,348 @@
+package internal
+
+/**
+ * emergency overrides force a PAC for all or selected clients, e.g. to switch everyone to DIRECT during a proxy outage
+ *
+ * overrides are set through the admin API (or the CLI using it), expire after their duration
+ * and are persisted to the stateDir, so they survive a restart.
+ * they are checked before the lookup tree and win over all zones.
+ * like for zones, the override with the most specific network is served, the newest one if there are several
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/timeforaninja/pacserver/pkg/utils"
+)
+
+const overridesFile = "overrides.json"
+
+// overrideSource is the source of the Lookup Elements rendered for overrides
+const overrideSource = "override"
+
+// OverrideDirect is the name of the built-in PAC sending all clients direct
+const OverrideDirect = "DIRECT"
+
+const directPACContent = `function FindProxyForURL(url, host) {
+    return "DIRECT";
+}
+`
+
+type override struct {
+	ID int `json:"id"`
+	// Networks the override applies to, all clients if empty
+	Networks []string  `json:"networks,omitempty"`
+	PAC      string    `json:"pac"`
+	Reason   string    `json:"reason,omitempty"`
+	Created  time.Time `json:"created"`
+	Until    time.Time `json:"until"`
+
+	// nets are the parsed Networks, elements the rendered PAC for each of them
+	nets     []IP.Net
+	elements []*LookupElement
+}
+
+// OverrideRequest is the body to set an override through the admin API
+type OverrideRequest struct {
+	PAC      string   `json:"pac"`
+	Networks []string `json:"networks,omitempty"`
+	// Duration until the override expires, e.g. "30m"
+	Duration string `json:"duration"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+var (
+	// activeOverrides is read for every request, so it is swapped as a whole, newest override first
+	activeOverrides atomic.Pointer[[]*override]
+	// overrideLock serializes all changes of the overrides
+	overrideLock   sync.Mutex
+	nextOverrideID = 1
+)
+
+func overridesPath(dir string) string {
+	return filepath.Join(dir, overridesFile)
+}
+
+// findOverride returns the active override with the most specific network containing the network of ip, or nil
+// it does not allocate, since it is called for every request
+func findOverride(ip IP.IP, networkBits int) (*override, *LookupElement, IP.Net) {
+	list := activeOverrides.Load()
+	if list == nil || len(*list) == 0 {
+		return nil, nil, IP.Net{}
+	}
+	ipNet, err := IP.NewIPNetFromIP(ip, networkBits)
+	if err != nil {
+		return nil, nil, IP.Net{}
+	}
+	now := time.Now()
+	var found *override
+	var pac *LookupElement
+	for _, o := range *list {
+		if !now.Before(o.Until) {
+			continue
+		}
+		for i, n := range o.nets {
+			// the list is sorted newest first, so only a more specific network replaces a match
+			if ipNet.IsSubnetOf(n) && (pac == nil || n.CIDR.Value > pac.IPMap.IPNet.CIDR.Value) {
+				found, pac = o, o.elements[i]
+			}
+		}
+	}
+	return found, pac, ipNet
+}
+
+// overrideOf returns the override the Lookup Element was rendered for, or nil
+func overrideOf(pac *LookupElement) *override {
+	list := activeOverrides.Load()
+	if list == nil {
+		return nil
+	}
+	for _, o := range *list {
+		for _, e := range o.elements {
+			if e == pac {
+				return o
+			}
+		}
+	}
+	return nil
+}
+
+// listOverrides returns all overrides that did not expire yet
+func listOverrides() []*override {
+	result := make([]*override, 0)
+	list := activeOverrides.Load()
+	if list == nil {
+		return result
+	}
+	now := time.Now()
+	for _, o := range *list {
+		if now.Before(o.Until) {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// addOverride validates the request, serves the override immediately and persists it
+func addOverride(req OverrideRequest) (*override, error) {
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive, e.g. \"30m\": %s", req.Duration)
+	}
+	now := time.Now()
+	o := &override{
+		Networks: req.Networks,
+		PAC:      utils.NormalizePath(req.PAC),
+		Reason:   req.Reason,
+		Created:  now,
+		Until:    now.Add(duration),
+	}
+	if req.PAC == OverrideDirect {
+		o.PAC = OverrideDirect
+	}
+	// a reload replaces the loaded PACs, so they are only read under the treeLock
+	// it has to be released before the overrideLock is taken, reloads take both in the opposite order
+	treeLock.Lock()
+	pacs := cachedPACs
+	treeLock.Unlock()
+	if err := o.prepare(pacs); err != nil {
+		return nil, err
+	}
+
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	o.ID = nextOverrideID
+	nextOverrideID++
+	list := append([]*override{o}, listOverrides()...)
+	activeOverrides.Store(&list)
+	saveOverrides(list)
+	time.AfterFunc(duration, expireOverrides)
+
+	log.Warnf("!!! OVERRIDE %d: serving \"%s\" to %s until %s (%s) !!!", o.ID, o.PAC, o.scope(), o.Until.Format(time.RFC3339), o.Reason)
+	return o, nil
+}
+
+// removeOverride ends the override with the id, or all overrides if id is 0
+// it returns false if there was no such override
+func removeOverride(id int) bool {
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	list := make([]*override, 0)
+	found := false
+	for _, o := range listOverrides() {
+		if id == 0 || o.ID == id {
+			log.Warnf("Override %d serving \"%s\" to %s was removed", o.ID, o.PAC, o.scope())
+			found = true
+			continue
+		}
+		list = append(list, o)
+	}
+	activeOverrides.Store(&list)
+	saveOverrides(list)
+	return found
+}
+
+// expireOverrides drops the expired overrides, it is called once the duration of an override passed
+func expireOverrides() {
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	list := activeOverrides.Load()
+	if list == nil {
+		return
+	}
+	active := listOverrides()
+	if len(active) == len(*list) {
+		return
+	}
+	for _, o := range *list {
+		if !time.Now().Before(o.Until) {
+			log.Warnf("Override %d serving \"%s\" to %s expired", o.ID, o.PAC, o.scope())
+		}
+	}
+	activeOverrides.Store(&active)
+	saveOverrides(active)
+}
+
+// refreshOverrides renders the overrides again after the served data was replaced, so they serve the current PAC
+// an override keeps serving its previous PAC if it can no longer be found
+// the caller has to hold the treeLock, see serveLookupTree
+func refreshOverrides() {
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	list := listOverrides()
+	for i, o := range list {
+		refreshed := *o
+		if err := refreshed.prepare(cachedPACs); err != nil {
+			log.Errorf("Override %d keeps serving its previous PAC: %s", o.ID, err.Error())
+			continue
+		}
+		list[i] = &refreshed
+	}
+	activeOverrides.Store(&list)
+}
+
+// loadOverrides restores the overrides persisted by a previous run
+func loadOverrides() {
+	dir := GetConfig().StateDir
+	if dir == "" {
+		return
+	}
+	data, err := os.ReadFile(overridesPath(dir))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to read the overrides: %s", err.Error())
+		return
+	}
+	var persisted []*override
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		log.Errorf("Unable to parse the overrides in \"%s\": %s", overridesPath(dir), err.Error())
+		return
+	}
+
+	treeLock.Lock()
+	pacs := cachedPACs
+	treeLock.Unlock()
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	now := time.Now()
+	list := make([]*override, 0, len(persisted))
+	for _, o := range persisted {
+		if o.ID >= nextOverrideID {
+			nextOverrideID = o.ID + 1
+		}
+		if !now.Before(o.Until) {
+			continue
+		}
+		if err := o.prepare(pacs); err != nil {
+			log.Errorf("Unable to restore override %d: %s", o.ID, err.Error())
+			continue
+		}
+		list = append(list, o)
+		time.AfterFunc(o.Until.Sub(now), expireOverrides)
+		log.Warnf("!!! OVERRIDE %d: serving \"%s\" to %s until %s (%s) !!!", o.ID, o.PAC, o.scope(), o.Until.Format(time.RFC3339), o.Reason)
+	}
+	activeOverrides.Store(&list)
+}
+
+// saveOverrides persists the overrides to the stateDir, if configured
+func saveOverrides(list []*override) {
+	dir := GetConfig().StateDir
+	if dir == "" {
+		return
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		// write to a temporary file first, so we never leave a half-written file
+		tmp := overridesPath(dir) + ".tmp"
+		err = os.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, overridesPath(dir))
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to persist the overrides to \"%s\": %s", dir, err.Error())
+	}
+}
+
+// prepare parses the networks and renders the PAC of the override, which is one of pacs or DIRECT
+func (o *override) prepare(pacs []*pacTemplate) error {
+	o.nets = make([]IP.Net, 0, len(o.Networks))
+	for _, network := range o.Networks {
+		ipNet, err := IP.NewIPNetFromNotation(network)
+		if err != nil {
+			return fmt.Errorf("unable to parse network \"%s\": %s", network, err.Error())
+		}
+		o.nets = append(o.nets, ipNet)
+	}
+	if len(o.nets) == 0 {
+		o.nets = append(o.nets, IP.Net{})
+	}
+
+	pac := findOverridePAC(o.PAC, pacs)
+	if pac == nil {
+		return fmt.Errorf("unknown pac \"%s\"", o.PAC)
+	}
+	o.elements = make([]*LookupElement, 0, len(o.nets))
+	for _, n := range o.nets {
+		e, err := NewLookupElement(&ipMap{IPNet: n, Filename: o.PAC, Source: overrideSource, Comment: o.Reason}, pac, GetConfig().ContactInfo)
+		if err != nil {
+			return fmt.Errorf("unable to render pac \"%s\": %s", o.PAC, err.Error())
+		}
+		o.elements = append(o.elements, &e)
+	}
+	return nil
+}
+
+// scope describes the clients of the override for the logs
+func (o *override) scope() string {
+	if len(o.Networks) == 0 {
+		return "all clients"
+	}
+	return fmt.Sprintf("%v", o.Networks)
+}
+
+// findOverridePAC returns the built-in DIRECT PAC or one of the loaded pacs
+func findOverridePAC(filename string, pacs []*pacTemplate) *pacTemplate {
+	if filename == OverrideDirect {
+		return &pacTemplate{Filename: OverrideDirect, content: directPACContent}
+	}
+	for _, pac := range pacs {
+		if pac.Filename == filename {
+			return pac
+		}
+	}
+	return nil
+}
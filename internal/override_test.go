@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// setupOverrides serves the pacs for overrides and removes all overrides after the test
+func setupOverrides(t *testing.T, stateDir string, pacs ...*pacTemplate) {
+	t.Helper()
+	oldConf, oldCachedPACs := confStorage, cachedPACs
+	t.Cleanup(func() {
+		confStorage, cachedPACs = oldConf, oldCachedPACs
+		activeOverrides.Store(nil)
+	})
+	confStorage = &Config{ContactInfo: "Test Contact", StateDir: stateDir}
+	cachedPACs = pacs
+	activeOverrides.Store(nil)
+}
+
+func mustAddOverride(t *testing.T, req OverrideRequest) *override {
+	t.Helper()
+	o, err := addOverride(req)
+	if err != nil {
+		t.Fatalf("addOverride(%+v) unexpected error: %v", req, err)
+	}
+	return o
+}
+
+func TestFindOverride(t *testing.T) {
+	setupOverrides(t, "", &pacTemplate{Filename: "backup.pac", content: "// backup by {{ .Contact }}"})
+
+	office := mustAddOverride(t, OverrideRequest{PAC: "backup.pac", Networks: []string{"10.1.0.0/16", "192.168.1.1"}, Duration: "1h"})
+	all := mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Duration: "1h", Reason: "proxy outage"})
+	// the newest of two overrides for the same network wins
+	mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Networks: []string{"10.3.0.0/16"}, Duration: "1h"})
+	newest := mustAddOverride(t, OverrideRequest{PAC: "backup.pac", Networks: []string{"10.3.0.0/16"}, Duration: "1h"})
+	// an expired override is never served
+	expired := mustAddOverride(t, OverrideRequest{PAC: "backup.pac", Networks: []string{"172.16.0.0/12"}, Duration: "1h"})
+	expired.Until = time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name        string
+		ip          string
+		bits        int
+		want        *override
+		wantVariant string
+	}{
+		{name: "All clients", ip: "10.2.0.1", bits: 32, want: all, wantVariant: directPACContent},
+		{name: "Most specific override wins", ip: "10.1.2.3", bits: 32, want: office, wantVariant: "// backup by Test Contact"},
+		{name: "Newest of the same network wins", ip: "10.3.0.1", bits: 32, want: newest, wantVariant: "// backup by Test Contact"},
+		{name: "Single host", ip: "192.168.1.1", bits: 32, want: office, wantVariant: "// backup by Test Contact"},
+		{name: "Network within the override", ip: "10.1.2.0", bits: 24, want: office, wantVariant: "// backup by Test Contact"},
+		{name: "Network larger than the override", ip: "10.0.0.0", bits: 8, want: all, wantVariant: directPACContent},
+		{name: "Expired override", ip: "172.16.0.1", bits: 32, want: all, wantVariant: directPACContent},
+		{name: "Invalid CIDR", ip: "10.1.2.3", bits: 40, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, _ := IP.ParseIP(tt.ip)
+			got, pac, _ := findOverride(ip, tt.bits)
+			if got != tt.want {
+				t.Fatalf("findOverride(%s/%d) = %+v, want %+v", tt.ip, tt.bits, got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if pac.Variant != tt.wantVariant {
+				t.Errorf("findOverride(%s/%d) variant = %q, want %q", tt.ip, tt.bits, pac.Variant, tt.wantVariant)
+			}
+			if overrideOf(pac) != got {
+				t.Errorf("overrideOf() does not return the override of its element")
+			}
+		})
+	}
+
+	if got := listOverrides(); len(got) != 4 {
+		t.Errorf("listOverrides() returned %d overrides, want 4", len(got))
+	}
+	expireOverrides()
+	if got := activeOverrides.Load(); len(*got) != 4 {
+		t.Errorf("expireOverrides() kept %d overrides, want 4", len(*got))
+	}
+}
+
+func TestAddOverrideErrors(t *testing.T) {
+	setupOverrides(t, "", &pacTemplate{Filename: "backup.pac", content: "// backup"}, &pacTemplate{Filename: "broken.pac", content: "{{ .Missing"})
+
+	tests := []struct {
+		name string
+		req  OverrideRequest
+	}{
+		{name: "Missing duration", req: OverrideRequest{PAC: OverrideDirect}},
+		{name: "Negative duration", req: OverrideRequest{PAC: OverrideDirect, Duration: "-1h"}},
+		{name: "Unknown PAC", req: OverrideRequest{PAC: "missing.pac", Duration: "1h"}},
+		{name: "Broken PAC", req: OverrideRequest{PAC: "broken.pac", Duration: "1h"}},
+		{name: "Invalid network", req: OverrideRequest{PAC: "backup.pac", Networks: []string{"10.0.0.0/40"}, Duration: "1h"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := addOverride(tt.req); err == nil {
+				t.Errorf("addOverride(%+v) expected an error", tt.req)
+			}
+		})
+	}
+	if got := listOverrides(); len(got) != 0 {
+		t.Errorf("invalid overrides were added: %+v", got)
+	}
+}
+
+func TestOverridePersistence(t *testing.T) {
+	dir := t.TempDir()
+	backup := &pacTemplate{Filename: "backup.pac", content: "// backup v1"}
+	setupOverrides(t, dir, backup)
+
+	first := mustAddOverride(t, OverrideRequest{PAC: "backup.pac", Networks: []string{"10.0.0.0/8"}, Duration: "1h", Reason: "proxy outage"})
+	second := mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Duration: "1h"})
+	if _, err := os.Stat(filepath.Join(dir, overridesFile)); err != nil {
+		t.Fatalf("the overrides were not persisted: %v", err)
+	}
+
+	// a restart restores the overrides and continues their ids
+	activeOverrides.Store(nil)
+	nextOverrideID = 1
+	loadOverrides()
+	restored := listOverrides()
+	if len(restored) != 2 || restored[0].ID != second.ID || restored[1].ID != first.ID {
+		t.Fatalf("loadOverrides() = %+v, want overrides %d and %d", restored, second.ID, first.ID)
+	}
+	if restored[1].Reason != "proxy outage" || !restored[1].Until.Equal(first.Until) {
+		t.Errorf("loadOverrides() did not restore the override: %+v", restored[1])
+	}
+	third := mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Duration: "1h"})
+	if third.ID <= second.ID {
+		t.Errorf("addOverride() after a restart reused id %d", third.ID)
+	}
+
+	// a reload renders the overrides with the current pacs
+	backup.content = "// backup v2"
+	refreshOverrides()
+	ip, _ := IP.ParseIP("10.1.2.3")
+	if o, pac, _ := findOverride(ip, 32); o == nil || o.ID != first.ID || pac.Variant != "// backup v2" {
+		t.Errorf("refreshOverrides() did not render the current pac")
+	}
+	// a pac that is gone keeps serving the previous content
+	cachedPACs = nil
+	refreshOverrides()
+	if _, pac, _ := findOverride(ip, 32); pac == nil || pac.Variant != "// backup v2" {
+		t.Errorf("refreshOverrides() dropped an override whose pac is gone")
+	}
+
+	if !removeOverride(first.ID) {
+		t.Fatalf("removeOverride() did not find override %d", first.ID)
+	}
+	if o, _, _ := findOverride(ip, 32); o == nil || o.ID != third.ID {
+		t.Errorf("findOverride() = %+v, want the newest override for all clients", o)
+	}
+	if removeOverride(first.ID) {
+		t.Errorf("removeOverride() found an override that was already removed")
+	}
+	removeOverride(0)
+	data, err := os.ReadFile(filepath.Join(dir, overridesFile))
+	if err != nil || strings.TrimSpace(string(data)) != "[]" {
+		t.Errorf("removing all overrides persisted %q, %v", data, err)
+	}
+}
+
+func TestOverridesOnSwaps(t *testing.T) {
+	oldZones, oldPACs, oldIPMaps := zoneProvider, pacProvider, cachedIPMaps
+	defer func() {
+		zoneProvider, pacProvider, cachedIPMaps = oldZones, oldPACs, oldIPMaps
+		currentStatus = reloadStatus{}
+	}()
+	backup := &pacTemplate{Filename: "backup.pac", content: "// backup v1"}
+	setupOverrides(t, "", backup)
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	resetSnapshots(t, &Config{
+		DefaultPACFile:  filepath.Join(dir, "default.pac"),
+		WPADFile:        filepath.Join(dir, "wpad.dat"),
+		ContactInfo:     "Test Contact",
+		SnapshotHistory: 10,
+	})
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "company.pac"))
+	mustAddOverride(t, OverrideRequest{PAC: "backup.pac", Duration: "1h"})
+
+	// a rollback renders the overrides again
+	backup.content = "// backup v2"
+	if _, err := rollbackToSnapshot(1); err != nil {
+		t.Fatalf("rollbackToSnapshot(1) unexpected error: %v", err)
+	}
+	if _, pac, _ := findOverride(IP.IP{}, 0); pac == nil || pac.Variant != "// backup v2" {
+		t.Errorf("rollbackToSnapshot() did not render the overrides again: %+v", pac)
+	}
+
+	// overrides can be added while reloads replace the loaded pacs
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{backup}}
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		for i := 0; i < 20; i++ {
+			if _, err := addOverride(OverrideRequest{PAC: "backup.pac", Duration: "1h"}); err != nil {
+				t.Errorf("addOverride() unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		updateLookupTree()
+	}
+	<-done
+}
@@ -6,140 +6,445 @@ package internal
  */
 
 import (
-	"github.com/ansrivas/fiberprometheus/v2"
 	"github.com/cakturk/go-netstat/netstat"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	myPrometheus "github.com/timeforaninja/pacserver/pkg/prometheus"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// Custom metrics for Prometheus
-var (
-	// Response time metrics
-	responseTimeHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "app_response_time_hist_seconds",
-		Help:    "Response time distribution in seconds",
-		Buckets: []float64{1e-7, 5e-7, 1e-6, 5e-6, 1e-5, 5e-5, 0.0001, 0.0005, 0.001, 0.005, 0.01},
-	})
+// defaultResponseTimeBuckets range from PACs served from the lookup cache to slow clients
+var defaultResponseTimeBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
-	responseTimeSummary = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name: "app_response_time_summary_seconds",
-		Help: "Response time distribution in seconds",
-		Objectives: map[float64]float64{
-			0.5:   0.05,   // 50th percentile (median) with 5% error
-			0.9:   0.01,   // 90th percentile with 1% error
-			0.99:  0.001,  // 99th percentile with 0.1% error
-			0.999: 0.0001, // 99.9th percentile with 0.01% error
-		},
-	})
+// httpMetrics are created with each registry, since their buckets and the socket port are taken from the config
+type httpMetrics struct {
+	responseTimeHistogram *prometheus.HistogramVec
+	responseTimeSummary   *prometheus.SummaryVec
+	httpStatusCounter     *prometheus.CounterVec
+	socketStates          *myPrometheus.GaugeVecFunc
+}
+
+// unmatchedRoute labels requests not matching any route
+// it is also the key of the local set for them by the last handler, see registerPACRoutes
+const unmatchedRoute = "unmatched"
+
+// routeOf returns the route pattern that handled c, e.g. "/:ip", so the amount of labels is bounded
+// after a middleware, c.Route() is the last middleware for requests no route matched, so they are marked explicitly
+func routeOf(c *fiber.Ctx) string {
+	if c.Locals(unmatchedRoute) != nil {
+		return unmatchedRoute
+	}
+	return c.Route().Path
+}
+
+func newHTTPMetrics(buckets []float64, port uint16) *httpMetrics {
+	return &httpMetrics{
+		responseTimeHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "app_response_time_hist_seconds",
+			Help:    "Response time distribution in seconds by route",
+			Buckets: buckets,
+		}, []string{"route"}),
+		responseTimeSummary: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "app_response_time_summary_seconds",
+			Help: "Response time distribution in seconds by route",
+			Objectives: map[float64]float64{
+				0.5:   0.05,   // 50th percentile (median) with 5% error
+				0.9:   0.01,   // 90th percentile with 1% error
+				0.99:  0.001,  // 99th percentile with 0.1% error
+				0.999: 0.0001, // 99.9th percentile with 0.01% error
+			},
+		}, []string{"route"}),
+		httpStatusCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "app_http_errors_total",
+			Help: "Total number of HTTP status codes by route",
+		}, []string{"route", "status_code"}),
+		socketStates: myPrometheus.NewGaugeVecFunc(
+			prometheus.GaugeOpts{
+				Name: "app_socket_states",
+				Help: "number of sockets of the server port by state",
+			},
+			[]string{"state"},
+			func() map[string]float64 { return countSocketStates(port) },
+		),
+	}
+}
+
+// countSocketStates counts the TCP sockets (IPv4 and IPv6) with the local port by state
+func countSocketStates(port uint16) map[string]float64 {
+	onPort := func(s *netstat.SockTabEntry) bool {
+		return s.LocalAddr != nil && s.LocalAddr.Port == port
+	}
+	stateCounts := make(map[string]float64)
+	for _, socks := range []func(netstat.AcceptFn) ([]netstat.SockTabEntry, error){netstat.TCPSocks, netstat.TCP6Socks} {
+		tabs, err := socks(onPort)
+		if err != nil {
+			// e.g. IPv6 disabled on the host
+			continue
+		}
+		for _, tab := range tabs {
+			stateCounts[tab.State.String()]++
+		}
+	}
+	return stateCounts
+}
 
-	// Response time metrics
-	openSocketCounter = myPrometheus.NewGaugeVecFunc(
+// Custom metrics for Prometheus
+// they are shared by all registries, so they keep counting if the metrics are set up again
+var (
+	// commit of the git source the zones and pacs were loaded from
+	sourceCommitInfo = myPrometheus.NewGaugeVecFunc(
 		prometheus.GaugeOpts{
-			Name: "app_socket_states",
-			Help: "number of active sockets by state",
+			Name: "app_source_commit_info",
+			Help: "commit of the git repository the zones and pacs were loaded from",
 		},
-		[]string{"state"},
+		[]string{"commit"},
 		func() map[string]float64 {
-			// list all the TCP sockets for your HTTP server
-			tabs, err := netstat.TCPSocks(netstat.NoopFilter)
-			if err != nil {
+			commit := getReloadStatus().Commit
+			if commit == "" {
 				return make(map[string]float64)
 			}
-			// Create a map and count states
-			stateCounts := make(map[string]float64)
-			for _, tab := range tabs {
-				state := tab.State.String()
-				stateCounts[state]++
-			}
-			return stateCounts
-		},
-	)
-
-	// HTTP status code metrics
-	httpErrorCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "app_http_errors_total",
-			Help: "Total number of HTTP status codes",
+			return map[string]float64{commit: 1}
 		},
-		[]string{"status_code"},
 	)
 
 	// Response pac file metric
 	pacFileCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "app_pac_file",
-			Help: "Number of PAC files server.",
+			Name: "app_pac_file_total",
+			Help: "Number of PAC files served",
 		},
-		[]string{"file"},
+		// variant is "canary" for the canary PAC of a zone, "stable" otherwise
+		[]string{"file", "variant"},
 	)
 
 	// Data I/O metrics
 	dataInCounter = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "app_bytes_in",
+		Name: "app_bytes_in_total",
 		Help: "Total bytes received",
 	})
 	dataOutCounter = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "app_bytes_out",
+		Name: "app_bytes_out_total",
 		Help: "Total bytes sent",
 	})
 
-	// various other metrics are already tracked by fiberprometheus by default
-	// those include cgo, memory and cpu times
+	// lookup cache metrics
+	lookupCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "app_lookup_cache_hits_total",
+		Help: "Lookups of client IPs answered by the lookup cache",
+	})
+	lookupCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "app_lookup_cache_misses_total",
+		Help: "Lookups of client IPs that had to walk the lookup tree",
+	})
+
+	// emergency override metrics
+	overrideRequestCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "app_override_requests_total",
+		Help: "Requests answered by an emergency override instead of the zones",
+	})
+	activeOverridesGauge = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_overrides_active",
+			Help: "number of active emergency overrides by pac",
+		},
+		[]string{"pac"},
+		func() map[string]float64 {
+			counts := make(map[string]float64)
+			for _, o := range listOverrides() {
+				counts[o.PAC]++
+			}
+			return counts
+		},
+	)
+
+	// proxy health metrics
+	proxyUpGauge = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_proxy_up",
+			Help: "1 if the checked proxy is up, 0 if it is down",
+		},
+		[]string{"proxy"},
+		func() map[string]float64 {
+			states := make(map[string]float64)
+			for _, status := range listProxyStates() {
+				states[status.Address] = 0
+				if status.Healthy {
+					states[status.Address] = 1
+				}
+			}
+			return states
+		},
+	)
+	proxyRerenderCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "app_proxy_rerenders_total",
+		Help: "How often the PACs were rendered again since a proxy went down or came back",
+	})
+
+	// request stats, bounded by zoneMetricsLimit and topClientSubnets
+	zoneRequestCounter = myPrometheus.NewCounterVecFunc(
+		prometheus.CounterOpts{
+			Name: "app_zone_requests_total",
+			Help: "Requests by zone, zones beyond zoneMetricsLimit are counted as \"other\", requests served by an override as \"override\"",
+		},
+		[]string{"zone"},
+		func() map[string]float64 {
+			counts := make(map[string]float64)
+			for _, z := range listRequestStats().Zones {
+				counts[z.Zone] = float64(z.Requests)
+			}
+			return counts
+		},
+	)
+	clientSubnetGauge = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_client_subnet_requests",
+			Help: "Estimated requests of the topClientSubnets most requesting client /24 networks",
+		},
+		[]string{"subnet"},
+		func() map[string]float64 {
+			counts := make(map[string]float64)
+			for _, s := range listRequestStats().ClientSubnets {
+				counts[s.Subnet] = float64(s.Requests)
+			}
+			return counts
+		},
+	)
+
+	// reload metrics, see reloadMetrics.go
+	reloadCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_reloads_total",
+			Help: "Loads of the zones and pacs by result (success, degraded or failed)",
+		},
+		[]string{"result"},
+	)
+	reloadTimestampGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_reload_last_timestamp_seconds",
+			Help: "Unix time the last load of the zones and pacs finished",
+		},
+		func() float64 { return unixSeconds(getReloadStatus().Finished) },
+	)
+	reloadSuccessTimestampGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_reload_last_success_timestamp_seconds",
+			Help: "Unix time the last load without any problems finished",
+		},
+		func() float64 { return unixSeconds(getReloadStatus().LastSuccess) },
+	)
+	reloadDurationGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_reload_duration_seconds",
+			Help: "Duration of the last load of the zones and pacs",
+		},
+		func() float64 { return getReloadStatus().Duration.Seconds() },
+	)
+	reloadProblemsGauge = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_reload_problems",
+			Help: "Minor problems of the last load by category",
+		},
+		[]string{"category"},
+		func() map[string]float64 { return getReloadStatus().Problems.byCategory() },
+	)
+	zonesGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_zones",
+			Help: "Number of zones in the served lookup tree",
+		},
+		func() float64 { return float64(getReloadStatus().Zones) },
+	)
+	pacsGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_pacs",
+			Help: "Number of PAC templates available to the zones",
+		},
+		func() float64 { return float64(getReloadStatus().PACs) },
+	)
+	cachedPACsGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_pacs_cached_fallback",
+			Help: "Number of PAC templates missing in their source and served from a previous load",
+		},
+		func() float64 { return float64(getReloadStatus().CachedPACs) },
+	)
+	treeDepthGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "app_lookup_tree_depth",
+			Help: "Levels of nested zones in the served lookup tree",
+		},
+		func() float64 { return float64(getReloadStatus().TreeDepth) },
+	)
+	configHashInfo = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_config_hash_info",
+			Help: "Hash of the content of the loaded config file",
+		},
+		[]string{"hash"},
+		func() map[string]float64 {
+			if conf := GetConfig(); conf != nil {
+				return map[string]float64{conf.hash: 1}
+			}
+			return map[string]float64{}
+		},
+	)
+	pacsHashInfo = myPrometheus.NewGaugeVecFunc(
+		prometheus.GaugeOpts{
+			Name: "app_pacs_hash_info",
+			Help: "Hash of the names and contents of the served PAC templates",
+		},
+		[]string{"hash"},
+		func() map[string]float64 { return map[string]float64{getReloadStatus().PACHash: 1} },
+	)
+
+	// the go runtime and process metrics are added to each registry
+)
+
+// newMetricsRegistry registers all metrics in a registry of their own
+// unlike the default registry, it can be created again, e.g. by tests
+func newMetricsRegistry(conf *Config) (*prometheus.Registry, *httpMetrics) {
+	buckets := conf.ResponseTimeBuckets
+	if len(buckets) == 0 {
+		buckets = defaultResponseTimeBuckets
+	}
+	metrics := newHTTPMetrics(buckets, conf.Port)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.responseTimeHistogram,
+		metrics.responseTimeSummary,
+		metrics.httpStatusCounter,
+		metrics.socketStates,
+		sourceCommitInfo,
+		pacFileCounter,
+		dataInCounter,
+		dataOutCounter,
+		lookupCacheHits,
+		lookupCacheMisses,
+		overrideRequestCounter,
+		activeOverridesGauge,
+		proxyUpGauge,
+		proxyRerenderCounter,
+		zoneRequestCounter,
+		clientSubnetGauge,
+		reloadCounter,
+		reloadTimestampGauge,
+		reloadSuccessTimestampGauge,
+		reloadDurationGauge,
+		reloadProblemsGauge,
+		zonesGauge,
+		pacsGauge,
+		cachedPACsGauge,
+		treeDepthGauge,
+		configHashInfo,
+		pacsHashInfo,
+	)
+	return registry, metrics
+}
+
+// servedRegistry is the registry of the running webserver, nil if neither scraped nor exported
+var (
+	servedRegistry     *prometheus.Registry
+	servedRegistryLock sync.RWMutex
 )
 
 func setupPrometheus(app *fiber.App) func(pac *LookupElement) {
-	// skip Prometheus setup if not enabled
-	if !GetConfig().PrometheusEnabled {
+	conf := GetConfig()
+	// skip Prometheus setup if the metrics are neither scraped nor exported via OTLP
+	if !conf.PrometheusEnabled && (conf.OTLPEndpoint == "" || conf.OTLPMetricsInterval <= 0) {
 		return func(pac *LookupElement) {}
 	}
 
-	// Register custom metrics with Prometheus
-	prometheus.MustRegister(responseTimeHistogram)
-	prometheus.MustRegister(responseTimeSummary)
-	prometheus.MustRegister(openSocketCounter)
-	prometheus.MustRegister(httpErrorCounter)
-	prometheus.MustRegister(pacFileCounter)
-	prometheus.MustRegister(dataInCounter)
-	prometheus.MustRegister(dataOutCounter)
+	registry, metrics := newMetricsRegistry(conf)
+	servedRegistryLock.Lock()
+	servedRegistry = registry
+	servedRegistryLock.Unlock()
 
 	// register prometheus app route
-	prom := fiberprometheus.New("pacserver")
-	prom.RegisterAt(app, GetConfig().PrometheusPath)
+	// it is registered before the middleware, so scrapes are not measured
+	if conf.PrometheusEnabled {
+		app.Get(conf.PrometheusPath, adaptor.HTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	}
 
 	// Add middleware to track response times and errors
-	app.Use(func(c *fiber.Ctx) error {
-		// Record request size
-		dataInCounter.Add(float64(len(c.Request().Body())))
+	app.Use(metrics.middleware)
 
-		// Start timer for response time
-		startTime := time.Now()
+	// return a func to track PAC Files chosen
+	return trackPACFile
+}
 
-		// Process request
-		err := c.Next()
+// middleware tracks the response times, sizes and status codes of the routes after it
+func (m *httpMetrics) middleware(c *fiber.Ctx) error {
+	// Record request size
+	dataInCounter.Add(float64(len(c.Request().Body())))
 
-		// Record response time
-		duration := time.Since(startTime).Seconds()
-		responseTimeHistogram.Observe(duration)
-		responseTimeSummary.Observe(duration)
+	// Start timer for response time
+	startTime := time.Now()
 
-		// Record response size
-		dataOutCounter.Add(float64(len(c.Response().Body())))
+	// Process request
+	err := c.Next()
 
-		// Track HTTP codes
-		httpErrorCounter.WithLabelValues(strconv.Itoa(c.Response().StatusCode())).Inc()
+	route := routeOf(c)
+	status := responseStatus(c, err)
 
-		return err
-	})
+	// Record response time
+	duration := time.Since(startTime).Seconds()
+	m.responseTimeHistogram.WithLabelValues(route).Observe(duration)
+	m.responseTimeSummary.WithLabelValues(route).Observe(duration)
 
-	// return a func to track PAC Files chosen
-	return func(pac *LookupElement) {
-		if pac == nil {
-			pacFileCounter.WithLabelValues("default").Inc()
-		} else {
-			pacFileCounter.WithLabelValues(pac.IPMap.Filename).Inc()
-		}
+	// Record response size
+	dataOutCounter.Add(float64(len(c.Response().Body())))
+
+	// Track HTTP codes
+	m.httpStatusCounter.WithLabelValues(route, strconv.Itoa(status)).Inc()
+
+	return err
+}
+
+// responseStatus returns the status code of the response to c
+// an error is only written to the response by the error handler, after the middlewares
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	if e, ok := err.(*fiber.Error); ok {
+		return e.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+// gatherServedMetrics gathers the registry of the running webserver, e.g. to export it via OTLP
+func gatherServedMetrics() ([]*dto.MetricFamily, error) {
+	servedRegistryLock.RLock()
+	defer servedRegistryLock.RUnlock()
+	if servedRegistry == nil {
+		return nil, nil
+	}
+	return servedRegistry.Gather()
+}
+
+// unixSeconds returns the unix time of t, or 0 if t is not set
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func trackPACFile(pac *LookupElement) {
+	if pac == nil {
+		pacFileCounter.WithLabelValues("default", "stable").Inc()
+	} else if pac.isCanary {
+		pacFileCounter.WithLabelValues(pac.IPMap.Filename, "canary").Inc()
+	} else {
+		pacFileCounter.WithLabelValues(pac.IPMap.Filename, "stable").Inc()
 	}
 }
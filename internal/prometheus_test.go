@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// setupMetricsApp serves the PAC routes with the metrics set up, as StartWebserver does
+func setupMetricsApp() fasthttp.RequestHandler {
+	app := fiber.New()
+	trackPac := setupPrometheus(app)
+	if tracingEnabled {
+		app.Use(tracingMiddleware)
+	}
+	registerPACRoutes(app, trackPac)
+	return app.Handler()
+}
+
+func scrapeMetrics(t *testing.T, handler fasthttp.RequestHandler) string {
+	t.Helper()
+	ctx := newRequest("/metrics", net.ParseIP("127.0.0.1"))
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("GET /metrics = %d", ctx.Response.StatusCode())
+	}
+	return string(ctx.Response.Body())
+}
+
+func TestSetupPrometheus(t *testing.T) {
+	setupPACRoutes(t, webserverTestZones())
+	confStorage = &Config{
+		PrometheusEnabled:   true,
+		PrometheusPath:      "/metrics",
+		ResponseTimeBuckets: []float64{0.001, 1},
+	}
+
+	defer func() { tracingEnabled = false }()
+
+	// setting the metrics up again does not panic, and each setup counts on its own
+	// the second one also traces the requests, which must not change the routes
+	for i := 0; i < 2; i++ {
+		tracingEnabled = i == 1
+		handler := setupMetricsApp()
+		handler(newRequest("/", net.ParseIP("10.1.2.3")))
+		handler(newRequest("/10.1.2.9", net.ParseIP("192.168.0.1")))
+		handler(newRequest("/10.1.2.9", net.ParseIP("192.168.0.1")))
+		post := newRequest("/", net.ParseIP("10.1.2.3"))
+		post.Request.Header.SetMethod(fiber.MethodPost)
+		handler(post)
+		handler(newRequest("/10.1.2.9/24/more", net.ParseIP("10.1.2.3")))
+
+		body := scrapeMetrics(t, handler)
+		for _, want := range []string{
+			`app_response_time_hist_seconds_bucket{route="/",le="1"} 1`,
+			`app_response_time_hist_seconds_bucket{route="/:ip",le="1"} 2`,
+			`app_response_time_summary_seconds_count{route="/:ip"} 2`,
+			`app_http_errors_total{route="/",status_code="200"} 1`,
+			`app_http_errors_total{route="/:ip",status_code="200"} 2`,
+			`app_http_errors_total{route="unmatched",status_code="405"} 1`,
+			`app_http_errors_total{route="unmatched",status_code="404"} 1`,
+			`app_pac_file_total{file="office.pac",variant="stable"}`,
+			"app_bytes_out_total",
+			"go_goroutines",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("setup %d: GET /metrics does not contain %q", i+1, want)
+			}
+		}
+		// only the configured buckets are used, and scrapes are not measured
+		for _, unwanted := range []string{`le="0.005"`, `route="/metrics"`} {
+			if strings.Contains(body, unwanted) {
+				t.Errorf("setup %d: GET /metrics contains %q", i+1, unwanted)
+			}
+		}
+	}
+}
+
+func TestCountSocketStates(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() unexpected error: %v", err)
+	}
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	if got := countSocketStates(port); got["LISTEN"] != 1 {
+		t.Errorf("countSocketStates() = %v, want the listening socket", got)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() unexpected error: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() unexpected error: %v", err)
+	}
+	defer accepted.Close()
+
+	// the client socket has another local port, so only the accepted one is counted
+	if got := countSocketStates(port); got["LISTEN"] != 1 || got["ESTABLISHED"] != 1 {
+		t.Errorf("countSocketStates() = %v, want one listening and one established socket", got)
+	}
+}
+
+func TestValidateResponseTimeBuckets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		buckets []float64
+		wantErr bool
+	}{
+		{name: "Default", buckets: defaultResponseTimeBuckets},
+		{name: "Custom", buckets: []float64{0.001, 0.1, 10}},
+		{name: "Not increasing", buckets: []float64{0.1, 0.1}, wantErr: true},
+		{name: "Not positive", buckets: []float64{0, 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := overloadDefaults(&YAMLConfig{})
+			conf.ResponseTimeBuckets = tt.buckets
+			// the later checks fail on the missing files, so only the message tells the buckets apart
+			err := validateConfig(conf)
+			if got := err != nil && strings.Contains(err.Error(), "responseTimeBuckets"); got != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
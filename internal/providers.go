@@ -0,0 +1,87 @@
+package internal
+
+/**
+ * this file defines where Zones and PACs are loaded from
+ *
+ * the loading pipeline only talks to a ZoneProvider and a PACProvider,
+ * which allows adding other sources (e.g. HTTP, git, an embedded fs.FS)
+ * and testing the pipeline with in-memory data
+ *
+ * by default the files configured in config.yml are used,
+ * or, if a gitRepo is configured, the same paths inside the repository
+ */
+
+// ZoneProvider loads the list of Zones
+//
+// the error is only set if the Zones could not be loaded at all,
+// in which case the previously cached Zones are used
+// the int is the amount of minor problems found while loading
+type ZoneProvider interface {
+	LoadZones() ([]*ipMap, error, int)
+}
+
+// PACProvider loads the PAC templates
+//
+// the error is only set if the PACs could not be loaded at all,
+// in which case the previously cached PACs are used
+// the int is the amount of minor problems found while loading
+type PACProvider interface {
+	LoadPACs() ([]*pacTemplate, error, int)
+}
+
+// committedProvider is implemented by providers that read from a versioned snapshot
+// the commit of the last load gets exposed in the debug output and metrics
+type committedProvider interface {
+	Commit() string
+}
+
+// defaultsProvider is implemented by PACProviders that also provide the default PAC and the WPAD file
+// otherwise both are read from the local filesystem
+type defaultsProvider interface {
+	LoadDefault(file string) (*pacTemplate, error)
+}
+
+// fileZoneProvider reads Zones from a file, directory or glob on the local filesystem
+// without a path there are no Zones, only the default PAC is served
+type fileZoneProvider struct {
+	path string
+}
+
+func (p fileZoneProvider) LoadZones() ([]*ipMap, error, int) {
+	if p.path == "" {
+		return make([]*ipMap, 0), nil, 0
+	}
+	return readIPMap(p.path)
+}
+
+// filePACProvider reads all PACs in a directory on the local filesystem
+type filePACProvider struct {
+	root string
+}
+
+func (p filePACProvider) LoadPACs() ([]*pacTemplate, error, int) {
+	return readTemplateFiles(p.root)
+}
+
+// override the providers, e.g. for tests or when embedding the server
+// if they are nil the file providers based on the config are used
+var (
+	zoneProvider ZoneProvider
+	pacProvider  PACProvider
+)
+
+func getProviders(conf *Config) (ZoneProvider, PACProvider) {
+	var zones ZoneProvider = fileZoneProvider{path: conf.IPMapFile}
+	var pacs PACProvider = filePACProvider{root: conf.PACRoot}
+	if conf.GitRepo != "" {
+		src := newGitSource(conf)
+		zones, pacs = src, src
+	}
+	if zoneProvider != nil {
+		zones = zoneProvider
+	}
+	if pacProvider != nil {
+		pacs = pacProvider
+	}
+	return zones, pacs
+}
@@ -0,0 +1,324 @@
+package internal
+
+/**
+ * the proxy health checker probes the configured proxies and exposes their state to the PAC templates
+ *
+ * templates ask for the proxies they use, e.g. {{ healthyProxies "proxy01:8080" "proxy02:8080" }},
+ * and every Lookup Element remembers the states it was rendered with.
+ * once a proxy goes down or comes back, only the elements asking for it are rendered again
+ * and the lookup tree is swapped, so clients no longer wait for the timeout of a dead proxy
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+const (
+	// ProxyCheckTCP only connects to the proxy
+	ProxyCheckTCP = "tcp"
+	// ProxyCheckConnect requests a tunnel to the target through the proxy
+	ProxyCheckConnect = "connect"
+)
+
+type ProxyCheck struct {
+	// Address of the proxy as "host:port", as used in the PAC templates
+	Address string `yaml:"address"`
+	Check   string `yaml:"check"`
+	// Target is requested through the proxy by the connect check, e.g. "example.com:443"
+	Target string `yaml:"target"`
+}
+
+type proxyStatus struct {
+	Address   string    `json:"address"`
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+	LastCheck time.Time `json:"lastCheck"`
+	Error     string    `json:"error,omitempty"`
+	// failures is the amount of failed checks in a row
+	failures int
+}
+
+var (
+	// proxyStates holds the state of every configured proxy, proxies without a state are healthy
+	proxyStates    = make(map[string]*proxyStatus)
+	proxyStateLock sync.RWMutex
+)
+
+func validateProxyChecks(conf *Config) error {
+	for _, p := range conf.Proxies {
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("proxy address must be \"host:port\": %s", p.Address)
+		}
+		switch p.Check {
+		case ProxyCheckTCP:
+		case ProxyCheckConnect:
+			if _, _, err := net.SplitHostPort(p.Target); err != nil {
+				return fmt.Errorf("the connect check of proxy %s requires a target as \"host:port\": %s", p.Address, p.Target)
+			}
+		default:
+			return fmt.Errorf("proxy check must be \"tcp\" or \"connect\": %s", p.Check)
+		}
+	}
+	if conf.ProxyCheckInterval < 1 || conf.ProxyCheckTimeout < 1 || conf.ProxyCheckFailures < 1 {
+		return fmt.Errorf("proxyCheckInterval, proxyCheckTimeout and proxyCheckFailures must be at least 1")
+	}
+	return nil
+}
+
+// StartProxyChecks checks the configured proxies regularly
+func StartProxyChecks() {
+	conf := GetConfig()
+	if len(conf.Proxies) == 0 {
+		return
+	}
+	interval := time.Duration(conf.ProxyCheckInterval) * time.Second
+	timeout := time.Duration(conf.ProxyCheckTimeout) * time.Second
+	log.Infof("Checking %d proxies every %s", len(conf.Proxies), interval)
+	go func() {
+		for {
+			if checkProxies(conf.Proxies, timeout, conf.ProxyCheckFailures) {
+				rerenderProxyPACs()
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// checkProxies probes all proxies at once and updates their states
+// it returns true if any proxy went down or came back
+func checkProxies(checks []ProxyCheck, timeout time.Duration, failures int) bool {
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check ProxyCheck) {
+			defer wg.Done()
+			errs[i] = probeProxy(check, timeout)
+		}(i, check)
+	}
+	wg.Wait()
+
+	proxyStateLock.Lock()
+	defer proxyStateLock.Unlock()
+	now := time.Now()
+	changed := false
+	for i, check := range checks {
+		status := proxyStates[check.Address]
+		if status == nil {
+			status = &proxyStatus{Address: check.Address, Healthy: true, Since: now}
+			proxyStates[check.Address] = status
+		}
+		status.LastCheck = now
+		healthy := status.Healthy
+		if errs[i] == nil {
+			status.Error, status.failures = "", 0
+			healthy = true
+		} else {
+			status.Error = errs[i].Error()
+			status.failures++
+			if status.failures >= failures {
+				healthy = false
+			}
+		}
+		if healthy != status.Healthy {
+			status.Healthy, status.Since = healthy, now
+			changed = true
+			if healthy {
+				log.Infof("Proxy %s is up again", check.Address)
+			} else {
+				log.Warnf("Proxy %s is down: %s", check.Address, status.Error)
+			}
+		}
+	}
+	return changed
+}
+
+// probeProxy connects to the proxy and, for the connect check, requests a tunnel through it
+func probeProxy(check ProxyCheck, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", check.Address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if check.Check != ProxyCheckConnect {
+		return nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   check.Target,
+		Header: make(http.Header),
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", check.Target, check.Target)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s returned %s", check.Target, resp.Status)
+	}
+	return nil
+}
+
+// isProxyHealthy returns the state of the proxy, unknown proxies are healthy
+func isProxyHealthy(address string) bool {
+	proxyStateLock.RLock()
+	defer proxyStateLock.RUnlock()
+	status := proxyStates[address]
+	return status == nil || status.Healthy
+}
+
+// listProxyStates returns the states of all checked proxies, sorted by their address
+func listProxyStates() []proxyStatus {
+	proxyStateLock.RLock()
+	defer proxyStateLock.RUnlock()
+	list := make([]proxyStatus, 0, len(proxyStates))
+	for _, status := range proxyStates {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// proxyTemplateFuncs are the functions available in PAC templates
+// every proxy asked for is recorded in used with its state
+func proxyTemplateFuncs(used map[string]bool, pools *poolRender) template.FuncMap {
+	healthy := func(address string) bool {
+		up := isProxyHealthy(address)
+		used[address] = up
+		return up
+	}
+	return template.FuncMap{
+		// proxyUp checks a single proxy, e.g. for conditions
+		"proxyUp": healthy,
+		// healthyProxies lists the proxies that are up, or all of them if none is up
+		"healthyProxies": func(addresses ...string) string {
+			up := make([]string, 0, len(addresses))
+			for _, address := range addresses {
+				if healthy(address) {
+					up = append(up, address)
+				}
+			}
+			if len(up) == 0 {
+				up = addresses
+			}
+			return formatProxies(up)
+		},
+		// orderedProxies lists the proxies that are up first, followed by the ones that are down
+		"orderedProxies": func(addresses ...string) string {
+			return formatProxies(orderByHealth(addresses, healthy))
+		},
+		// proxyPool lists the proxies of a weighted pool in the order of the client
+		"proxyPool": proxyPoolFunc(healthy, pools),
+	}
+}
+
+// orderByHealth moves the proxies that are down to the end, keeping the order otherwise
+func orderByHealth(addresses []string, healthy func(string) bool) []string {
+	up := make([]string, 0, len(addresses))
+	down := make([]string, 0)
+	for _, address := range addresses {
+		if healthy(address) {
+			up = append(up, address)
+		} else {
+			down = append(down, address)
+		}
+	}
+	return append(up, down...)
+}
+
+// formatProxies formats the proxies as a result of FindProxyForURL, e.g. "PROXY a:8080; PROXY b:8080"
+func formatProxies(addresses []string) string {
+	parts := make([]string, len(addresses))
+	for i, address := range addresses {
+		parts[i] = "PROXY " + address
+	}
+	return strings.Join(parts, "; ")
+}
+
+// isProxyStale checks if a proxy the element was rendered with changed its state since
+func (le1 *LookupElement) isProxyStale() bool {
+	if le1.proxies == nil {
+		// elements read from a snapshot were not rendered by this process
+		return true
+	}
+	for address, up := range le1.proxies {
+		if isProxyHealthy(address) != up {
+			return true
+		}
+	}
+	return le1.canary != nil && le1.canary.isProxyStale()
+}
+
+// rerenderProxyPACs renders all served elements again whose proxies changed their state
+// and swaps the lookup tree if any of them did
+func rerenderProxyPACs() {
+	if len(GetConfig().Proxies) == 0 {
+		return
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
+
+	d, rendered := rerenderStaleElements(getServed())
+	if rendered == 0 {
+		return
+	}
+	serveLookupTree(d)
+}
+
+// rerenderStaleElements renders all elements of d again whose proxies changed their state
+// it returns d itself if none of them did, otherwise new data without a tree, and the amount of rendered elements
+func rerenderStaleElements(d *servedData) (*servedData, int) {
+	if len(GetConfig().Proxies) == 0 {
+		return d, 0
+	}
+	contactInfo := GetConfig().ContactInfo
+	rendered := 0
+	rerender := func(e *LookupElement) *LookupElement {
+		if e == nil || e.PAC == nil || !e.isProxyStale() {
+			return e
+		}
+		newElement, err := newZoneElement(e.IPMap, e.PAC, e.canaryPAC(), contactInfo)
+		if err != nil {
+			log.Errorf("Unable to render \"%s\" for the current proxy health: %s", e.PAC.Filename, err.Error())
+			return e
+		}
+		if newElement.isIdenticalVariant(e) {
+			// served elements are never modified, an element with stale states is checked again next time
+			return e
+		}
+		rendered++
+		return &newElement
+	}
+
+	elements := make([]*LookupElement, len(d.elements))
+	for i, e := range d.elements {
+		elements[i] = rerender(e)
+	}
+	root, wpad := rerender(d.root), rerender(d.wpad)
+	if rendered == 0 {
+		return d, 0
+	}
+	proxyRerenderCounter.Inc()
+	log.Infof("Rendered %d PACs again for the current proxy health", rendered)
+	return &servedData{root: root, wpad: wpad, elements: elements}, rendered
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setProxyStates replaces the proxy states for the test
+func setProxyStates(t *testing.T, states map[string]bool) {
+	t.Helper()
+	proxyStateLock.Lock()
+	old := proxyStates
+	proxyStates = make(map[string]*proxyStatus)
+	for address, healthy := range states {
+		proxyStates[address] = &proxyStatus{Address: address, Healthy: healthy}
+	}
+	proxyStateLock.Unlock()
+	t.Cleanup(func() {
+		proxyStateLock.Lock()
+		proxyStates = old
+		proxyStateLock.Unlock()
+	})
+}
+
+// startProxyStandIn listens on a local port and replies to CONNECT requests with status
+// a status of 0 accepts connections without ever replying
+func startProxyStandIn(t *testing.T, status int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || status == 0 {
+					// wait for the client to give up
+					_, _ = conn.Read(make([]byte, 1))
+					return
+				}
+				if req.Method != http.MethodConnect {
+					status = http.StatusMethodNotAllowed
+				}
+				resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Request: req}
+				_ = resp.Write(conn)
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// closedAddress returns a local address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestProbeProxy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		check   ProxyCheck
+		wantErr bool
+	}{
+		{name: "TCP to a listening proxy", check: ProxyCheck{Address: startProxyStandIn(t, 0), Check: ProxyCheckTCP}},
+		{name: "TCP to a closed port", check: ProxyCheck{Address: closedAddress(t), Check: ProxyCheckTCP}, wantErr: true},
+		{name: "CONNECT is established", check: ProxyCheck{Address: startProxyStandIn(t, http.StatusOK), Check: ProxyCheckConnect, Target: "example.com:443"}},
+		{name: "CONNECT is forbidden", check: ProxyCheck{Address: startProxyStandIn(t, http.StatusForbidden), Check: ProxyCheckConnect, Target: "example.com:443"}, wantErr: true},
+		{name: "CONNECT without a reply", check: ProxyCheck{Address: startProxyStandIn(t, 0), Check: ProxyCheckConnect, Target: "example.com:443"}, wantErr: true},
+		{name: "CONNECT to a closed port", check: ProxyCheck{Address: closedAddress(t), Check: ProxyCheckConnect, Target: "example.com:443"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := probeProxy(tt.check, 200*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probeProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if time.Since(start) > time.Second {
+				t.Errorf("probeProxy() took %s despite the timeout", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestCheckProxiesFailures(t *testing.T) {
+	setProxyStates(t, nil)
+	address := closedAddress(t)
+	checks := []ProxyCheck{{Address: address, Check: ProxyCheckTCP}}
+
+	// the steps run in order, the proxy is down after 2 failed checks in a row
+	steps := []struct {
+		name        string
+		listen      bool
+		wantChanged bool
+		wantHealthy bool
+	}{
+		{name: "First failure", listen: false, wantChanged: false, wantHealthy: true},
+		{name: "Second failure", listen: false, wantChanged: true, wantHealthy: false},
+		{name: "Still down", listen: false, wantChanged: false, wantHealthy: false},
+		{name: "Up again after a single success", listen: true, wantChanged: true, wantHealthy: true},
+		{name: "Single failure", listen: false, wantChanged: false, wantHealthy: true},
+	}
+	for _, step := range steps {
+		var listener net.Listener
+		if step.listen {
+			var err error
+			if listener, err = net.Listen("tcp", address); err != nil {
+				t.Fatalf("unable to listen on %s: %v", address, err)
+			}
+		}
+		changed := checkProxies(checks, 200*time.Millisecond, 2)
+		if listener != nil {
+			listener.Close()
+		}
+		if changed != step.wantChanged {
+			t.Errorf("%s: checkProxies() = %v, want %v", step.name, changed, step.wantChanged)
+		}
+		if got := isProxyHealthy(address); got != step.wantHealthy {
+			t.Errorf("%s: isProxyHealthy() = %v, want %v", step.name, got, step.wantHealthy)
+		}
+	}
+	if states := listProxyStates(); len(states) != 1 || states[0].Error == "" {
+		t.Errorf("listProxyStates() = %+v, want the last error of %s", states, address)
+	}
+	if !isProxyHealthy("unchecked:3128") {
+		t.Errorf("a proxy that was never checked should be healthy")
+	}
+}
+
+func TestProxyTemplateFuncs(t *testing.T) {
+	setProxyStates(t, map[string]bool{"proxy01:8080": false, "proxy02:8080": true, "proxy03:8080": false})
+
+	tests := []struct {
+		name        string
+		content     string
+		want        string
+		wantProxies map[string]bool
+	}{
+		{
+			name:        "Without proxies",
+			content:     `return "PROXY proxy01:8080";`,
+			want:        `return "PROXY proxy01:8080";`,
+			wantProxies: map[string]bool{},
+		},
+		{
+			name:        "Dead proxies are removed",
+			content:     `return "{{ healthyProxies "proxy01:8080" "proxy02:8080" "unchecked:3128" }}";`,
+			want:        `return "PROXY proxy02:8080; PROXY unchecked:3128";`,
+			wantProxies: map[string]bool{"proxy01:8080": false, "proxy02:8080": true, "unchecked:3128": true},
+		},
+		{
+			name:        "All proxies are kept if all are dead",
+			content:     `return "{{ healthyProxies "proxy01:8080" "proxy03:8080" }}";`,
+			want:        `return "PROXY proxy01:8080; PROXY proxy03:8080";`,
+			wantProxies: map[string]bool{"proxy01:8080": false, "proxy03:8080": false},
+		},
+		{
+			name:        "Dead proxies are moved to the end",
+			content:     `return "{{ orderedProxies "proxy01:8080" "proxy02:8080" }}";`,
+			want:        `return "PROXY proxy02:8080; PROXY proxy01:8080";`,
+			wantProxies: map[string]bool{"proxy01:8080": false, "proxy02:8080": true},
+		},
+		{
+			name:        "Conditions",
+			content:     `{{ if proxyUp "proxy01:8080" }}primary{{ else }}backup{{ end }}`,
+			want:        `backup`,
+			wantProxies: map[string]bool{"proxy01:8080": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewLookupElement(&ipMap{}, &pacTemplate{Filename: "test.pac", content: tt.content}, "Test Contact")
+			if err != nil {
+				t.Fatalf("NewLookupElement() unexpected error: %v", err)
+			}
+			if e.Variant != tt.want {
+				t.Errorf("NewLookupElement() = %q, want %q", e.Variant, tt.want)
+			}
+			if len(e.proxies) != len(tt.wantProxies) {
+				t.Errorf("NewLookupElement() recorded %v, want %v", e.proxies, tt.wantProxies)
+			}
+			for address, up := range tt.wantProxies {
+				if got, ok := e.proxies[address]; !ok || got != up {
+					t.Errorf("NewLookupElement() recorded %s as %v, want %v", address, got, up)
+				}
+			}
+		})
+	}
+}
+
+func TestRerenderProxyPACs(t *testing.T) {
+	oldConf, oldServed := confStorage, served.Load()
+	defer func() {
+		confStorage = oldConf
+		served.Store(oldServed)
+	}()
+	setProxyStates(t, map[string]bool{"proxy01:8080": true})
+	confStorage = &Config{ContactInfo: "Test Contact", Proxies: []ProxyCheck{{Address: "proxy01:8080", Check: ProxyCheckTCP}}}
+
+	render := func(ip string, cidr int, content string) *LookupElement {
+		e, err := NewLookupElement(&ipMap{IPNet: forceIPNet(ip, cidr), Filename: ip + ".pac"}, &pacTemplate{Filename: ip + ".pac", content: content}, "Test Contact")
+		if err != nil {
+			t.Fatalf("NewLookupElement() unexpected error: %v", err)
+		}
+		return &e
+	}
+	root := render("0.0.0.0", 0, `{{ healthyProxies "proxy01:8080" "proxy02:8080" }}`)
+	wpad := render("0.0.0.0", 0, "// wpad")
+	withProxy := render("10.0.0.0", 8, `{{ healthyProxies "proxy01:8080" "proxy02:8080" }}`)
+	withoutProxy := render("10.1.0.0", 16, "// static")
+	// elements read from a snapshot do not know their proxies
+	restored := &LookupElement{IPMap: &ipMap{IPNet: forceIPNet("10.2.0.0", 16), Filename: "restored.pac"}, PAC: withProxy.PAC, Variant: "PROXY proxy01:8080; PROXY proxy02:8080"}
+	serveLookupTree(&servedData{root: root, wpad: wpad, elements: []*LookupElement{withProxy, withoutProxy, restored}})
+
+	find := func(ip string) *LookupElement {
+		return findElementInTree(getServed().tree, createIPNet(ip, 32))
+	}
+
+	// nothing changed, so the tree is kept
+	tree := getServed().tree
+	rerenderProxyPACs()
+	if getServed().tree != tree {
+		t.Errorf("rerenderProxyPACs() swapped the tree without a change")
+	}
+
+	setProxyStates(t, map[string]bool{"proxy01:8080": false})
+	rerenderProxyPACs()
+	if getServed().tree == tree {
+		t.Fatalf("rerenderProxyPACs() did not swap the tree")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.2.0.1", "192.168.0.1"} {
+		if got := find(ip).Variant; got != "PROXY proxy02:8080" {
+			t.Errorf("%s is served %q after proxy01 went down", ip, got)
+		}
+	}
+	if find("10.1.0.1") != withoutProxy {
+		t.Errorf("an element without proxies was rendered again")
+	}
+	if getServed().wpad != wpad {
+		t.Errorf("wpad.dat was rendered again: %q", getServed().wpad.Variant)
+	}
+	if withProxy.Variant != "PROXY proxy01:8080; PROXY proxy02:8080" {
+		t.Errorf("a served element was modified: %q", withProxy.Variant)
+	}
+
+	// without any checked proxies nothing is rendered again
+	confStorage.Proxies = nil
+	setProxyStates(t, map[string]bool{"proxy01:8080": true})
+	tree = getServed().tree
+	rerenderProxyPACs()
+	if getServed().tree != tree || !strings.Contains(find("10.0.0.1").Variant, "proxy02") {
+		t.Errorf("rerenderProxyPACs() rendered again without checked proxies")
+	}
+}
+
+func TestRerenderDuringReload(t *testing.T) {
+	oldConf, oldZones, oldPACs, oldServed := confStorage, zoneProvider, pacProvider, served.Load()
+	oldIPMaps, oldCachedPACs := cachedIPMaps, cachedPACs
+	defer func() {
+		confStorage, zoneProvider, pacProvider = oldConf, oldZones, oldPACs
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs = oldIPMaps, oldCachedPACs
+		currentStatus = reloadStatus{}
+	}()
+	setProxyStates(t, map[string]bool{"proxy01:8080": true})
+
+	dir := t.TempDir()
+	defaultFile := filepath.Join(dir, "default.pac")
+	writeTestFile(t, defaultFile, "// default 0")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	confStorage = &Config{
+		DefaultPACFile: defaultFile,
+		WPADFile:       filepath.Join(dir, "wpad.dat"),
+		ContactInfo:    "Test Contact",
+		Proxies:        []ProxyCheck{{Address: "proxy01:8080", Check: ProxyCheckTCP}},
+	}
+	zone := createLookupElement("10.0.0.0", 8, "office.pac")
+	zone.PAC.content = `{{ healthyProxies "proxy01:8080" "proxy02:8080" }}`
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{zone.IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{zone.PAC}}
+	updateLookupTree()
+
+	// proxies change their state and requests are served while the default PAC is reloaded
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		for i := 0; i < 50; i++ {
+			proxyStateLock.Lock()
+			proxyStates["proxy01:8080"].Healthy = i%2 == 1
+			proxyStateLock.Unlock()
+			rerenderProxyPACs()
+		}
+	}()
+	go func() {
+		defer func() { done <- true }()
+		ip := createIPNet("10.1.2.3", 32).NetworkAddress
+		for i := 0; i < 1000; i++ {
+			if pac, _, _ := findPAC(ip, 32); pac.IPMap.Filename != "office.pac" {
+				t.Errorf("findPAC() = %s, want office.pac", pac.IPMap.Filename)
+				return
+			}
+		}
+	}()
+	for i := 1; i <= 20; i++ {
+		writeTestFile(t, defaultFile, fmt.Sprintf("// default %d", i))
+		updateLookupTree()
+	}
+	<-done
+	<-done
+
+	// a rerender must never bring back the default PAC of an older load
+	if got := getServed().root.PAC.content; got != "// default 20" {
+		t.Errorf("served default PAC = %q, want the last loaded one", got)
+	}
+	if got := getServed().tree.data.PAC.content; got != "// default 20" {
+		t.Errorf("root of the served tree = %q, want the last loaded default PAC", got)
+	}
+}
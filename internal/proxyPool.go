@@ -0,0 +1,203 @@
+package internal
+
+/**
+ * proxy pools distribute the clients of a zone across weighted proxies
+ *
+ * templates declare a pool, e.g. {{ proxyPool "proxy01:8080=3" "proxy02:8080=1" }},
+ * and every client gets all proxies of the pool in its own order.
+ * the clients are hashed by their IP into a fixed amount of buckets,
+ * and each bucket orders the pool by weighted rendezvous hashing.
+ * neither depends on the time of loading, so a client keeps its order across reloads and restarts,
+ * and adding or removing a proxy only moves the clients that have to move.
+ *
+ * the template is rendered once per distinct order, so serving a client does not render anything
+ */
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// proxyPoolBuckets is the amount of buckets clients are hashed into
+// changing it moves clients to other proxies
+const proxyPoolBuckets = 256
+
+type poolMember struct {
+	Address string
+	Weight  float64
+}
+
+// poolRender is the state of rendering a template with proxy pools
+type poolRender struct {
+	// bucket is the bucket of clients rendered for
+	bucket int
+	// pools are the pools the template declared
+	pools [][]poolMember
+}
+
+// parseProxyPool reads the members of a pool
+// every entry is "host:port" or "host:port=weight", an argument may contain several entries
+// separated by commas or spaces, e.g. a zone variable
+func parseProxyPool(args []string) ([]poolMember, error) {
+	pool := make([]poolMember, 0, len(args))
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		entries := strings.FieldsFunc(arg, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		for _, entry := range entries {
+			address, rawWeight, hasWeight := strings.Cut(entry, "=")
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("proxy address must be \"host:port\": %s", address)
+			}
+			weight := 1.0
+			if hasWeight {
+				var err error
+				weight, err = strconv.ParseFloat(rawWeight, 64)
+				if err != nil || !(weight > 0) || math.IsInf(weight, 0) {
+					return nil, fmt.Errorf("weight of proxy %s must be a positive number: %s", address, rawWeight)
+				}
+			}
+			if seen[address] {
+				return nil, fmt.Errorf("proxy %s is listed twice in the pool", address)
+			}
+			seen[address] = true
+			pool = append(pool, poolMember{Address: address, Weight: weight})
+		}
+	}
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("proxyPool requires at least one proxy")
+	}
+	return pool, nil
+}
+
+// clientBucket returns the bucket of the client
+// it does not allocate, since it is used on the request path
+func clientBucket(ip IP.IP) int {
+	// the finalizer of murmur3 spreads neighbouring IPs evenly
+	h := ip.Value
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return int(h % proxyPoolBuckets)
+}
+
+// orderProxyPool orders the addresses of the pool for the bucket
+// the first proxy is chosen with a probability proportional to its weight
+func orderProxyPool(pool []poolMember, bucket int) []string {
+	type scored struct {
+		address string
+		score   float64
+	}
+	scores := make([]scored, len(pool))
+	for i, m := range pool {
+		scores[i] = scored{m.Address, -math.Log(bucketHash(m.Address, bucket)) / m.Weight}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score < scores[j].score
+		}
+		return scores[i].address < scores[j].address
+	})
+	ordered := make([]string, len(scores))
+	for i, s := range scores {
+		ordered[i] = s.address
+	}
+	return ordered
+}
+
+// bucketHash maps the proxy and the bucket to a number in (0, 1)
+func bucketHash(address string, bucket int) float64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(address))
+	// the finalizer of splitmix64
+	h := f.Sum64() ^ uint64(bucket)*0x9e3779b97f4a7c15
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return (float64(h>>11) + 0.5) / (1 << 53)
+}
+
+// proxyPoolFunc is the template function ordering the pool for the bucket rendered
+// the proxies that are up come first, the ones that are down keep their order at the end
+func proxyPoolFunc(healthy func(string) bool, render *poolRender) func(...string) (string, error) {
+	return func(args ...string) (string, error) {
+		pool, err := parseProxyPool(args)
+		if err != nil {
+			return "", err
+		}
+		render.pools = append(render.pools, pool)
+		return formatProxies(orderByHealth(orderProxyPool(pool, render.bucket), healthy)), nil
+	}
+}
+
+// renderClientVariants renders the template for every distinct order of the pools
+// it returns the variants and the index of the variant of each bucket,
+// first is the variant already rendered for bucket 0
+func renderClientVariants(pools [][]poolMember, first string, render func(bucket int) (string, error)) ([]string, []uint8, error) {
+	variants := []string{first}
+	buckets := make([]uint8, proxyPoolBuckets)
+	index := map[string]uint8{poolOrderKey(pools, 0): 0}
+	for bucket := 1; bucket < proxyPoolBuckets; bucket++ {
+		key := poolOrderKey(pools, bucket)
+		i, ok := index[key]
+		if !ok {
+			variant, err := render(bucket)
+			if err != nil {
+				return nil, nil, err
+			}
+			// there are at most as many variants as buckets, so the index fits
+			i = uint8(len(variants))
+			variants = append(variants, variant)
+			index[key] = i
+		}
+		buckets[bucket] = i
+	}
+	return variants, buckets, nil
+}
+
+// poolOrderKey identifies the orders of all pools for the bucket
+func poolOrderKey(pools [][]poolMember, bucket int) string {
+	parts := make([]string, len(pools))
+	for i, pool := range pools {
+		parts[i] = strings.Join(orderProxyPool(pool, bucket), ";")
+	}
+	return strings.Join(parts, "|")
+}
+
+// variantFor returns the variant served to the client
+func (le1 *LookupElement) variantFor(ip IP.IP) string {
+	if le1.clientVariants == nil {
+		return le1.Variant
+	}
+	return le1.clientVariants[le1.clientBuckets[clientBucket(ip)]]
+}
+
+// isIdenticalVariant checks if both elements serve the same content to every client
+func (le1 *LookupElement) isIdenticalVariant(le2 *LookupElement) bool {
+	if le1.Variant != le2.Variant || len(le1.clientVariants) != len(le2.clientVariants) {
+		return false
+	}
+	if (le1.canary == nil) != (le2.canary == nil) ||
+		le1.canary != nil && !le1.canary.isIdenticalVariant(le2.canary) {
+		return false
+	}
+	for bucket := range le1.clientBuckets {
+		if le1.clientVariants[le1.clientBuckets[bucket]] != le2.clientVariants[le2.clientBuckets[bucket]] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+func TestParseProxyPool(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []poolMember
+		wantErr bool
+	}{
+		{
+			name: "Weighted arguments",
+			args: []string{"proxy01:8080=3", "proxy02:8080=0.5"},
+			want: []poolMember{{"proxy01:8080", 3}, {"proxy02:8080", 0.5}},
+		},
+		{
+			name: "Default weight",
+			args: []string{"proxy01:8080"},
+			want: []poolMember{{"proxy01:8080", 1}},
+		},
+		{
+			name: "Entries of a zone variable",
+			args: []string{"proxy01:8080=2, proxy02:8080\nproxy03:8080=1"},
+			want: []poolMember{{"proxy01:8080", 2}, {"proxy02:8080", 1}, {"proxy03:8080", 1}},
+		},
+		{name: "Empty pool", args: []string{""}, wantErr: true},
+		{name: "Missing port", args: []string{"proxy01=2"}, wantErr: true},
+		{name: "Zero weight", args: []string{"proxy01:8080=0"}, wantErr: true},
+		{name: "Negative weight", args: []string{"proxy01:8080=-1"}, wantErr: true},
+		{name: "Invalid weight", args: []string{"proxy01:8080=many"}, wantErr: true},
+		{name: "Duplicate proxy", args: []string{"proxy01:8080", "proxy01:8080=2"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProxyPool(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProxyPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseProxyPool() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseProxyPool()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOrderProxyPoolWeights(t *testing.T) {
+	t.Parallel()
+
+	pool := []poolMember{{"proxy01:8080", 3}, {"proxy02:8080", 1}}
+	first := 0
+	for bucket := 0; bucket < proxyPoolBuckets; bucket++ {
+		order := orderProxyPool(pool, bucket)
+		if len(order) != 2 || order[0] == order[1] {
+			t.Fatalf("orderProxyPool(%d) = %v, want both proxies", bucket, order)
+		}
+		if order[0] == "proxy01:8080" {
+			first++
+		}
+	}
+	// proxy01 should be first for about 3/4 of the buckets
+	if share := float64(first) / proxyPoolBuckets; share < 0.65 || share > 0.85 {
+		t.Errorf("proxy01:8080 is first for %.2f of the buckets, want about 0.75", share)
+	}
+
+	// the clients of a network are spread across the buckets evenly
+	counts := make(map[int]int)
+	for i := uint32(0); i < 1<<16; i++ {
+		counts[clientBucket(IP.IP{Value: 10<<24 | i})]++
+	}
+	if len(counts) != proxyPoolBuckets {
+		t.Fatalf("the clients of a /16 only hit %d buckets", len(counts))
+	}
+	for bucket, count := range counts {
+		if count < 128 || count > 384 {
+			t.Errorf("bucket %d has %d of the 65536 clients, want about 256", bucket, count)
+		}
+	}
+}
+
+func TestOrderProxyPoolStability(t *testing.T) {
+	t.Parallel()
+
+	pool := []poolMember{{"proxy01:8080", 1}, {"proxy02:8080", 1}}
+	grown := append(pool, poolMember{"proxy03:8080", 1})
+	moved := 0
+	for bucket := 0; bucket < proxyPoolBuckets; bucket++ {
+		before, after := orderProxyPool(pool, bucket), orderProxyPool(grown, bucket)
+		if again := orderProxyPool(pool, bucket); strings.Join(again, ";") != strings.Join(before, ";") {
+			t.Fatalf("orderProxyPool(%d) is not deterministic: %v and %v", bucket, before, again)
+		}
+		// only clients moving to the new proxy change their first proxy
+		if after[0] != before[0] {
+			moved++
+			if after[0] != "proxy03:8080" {
+				t.Errorf("bucket %d moved from %s to %s", bucket, before[0], after[0])
+			}
+		}
+	}
+	if moved == 0 || moved > proxyPoolBuckets/2 {
+		t.Errorf("%d buckets moved to the new proxy, want about a third", moved)
+	}
+}
+
+func TestProxyPoolTemplate(t *testing.T) {
+	setProxyStates(t, map[string]bool{"proxy03:8080": false})
+
+	render := func(content string, vars map[string]string) LookupElement {
+		t.Helper()
+		e, err := NewLookupElement(&ipMap{Variables: vars}, &pacTemplate{Filename: "pool.pac", content: content}, "Test Contact")
+		if err != nil {
+			t.Fatalf("NewLookupElement() unexpected error: %v", err)
+		}
+		return e
+	}
+
+	e := render(`return "{{ proxyPool .Vars.pool }}";`, map[string]string{"pool": "proxy01:8080=3 proxy02:8080=1 proxy03:8080=2"})
+	if len(e.clientVariants) < 2 || len(e.clientBuckets) != proxyPoolBuckets {
+		t.Fatalf("NewLookupElement() rendered %d variants for %d buckets", len(e.clientVariants), len(e.clientBuckets))
+	}
+	if up, ok := e.proxies["proxy03:8080"]; !ok || up {
+		t.Errorf("NewLookupElement() did not record the dead proxy: %v", e.proxies)
+	}
+	pool := []poolMember{{"proxy01:8080", 3}, {"proxy02:8080", 1}}
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "192.168.1.20"} {
+		ip, _ := IP.ParseIP(client)
+		order := orderProxyPool(pool, clientBucket(ip))
+		// the dead proxy is always last, the others keep the order of the client
+		want := `return "` + formatProxies(append(order, "proxy03:8080")) + `";`
+		if got := e.variantFor(ip); got != want {
+			t.Errorf("variantFor(%s) = %q, want %q", client, got, want)
+		}
+	}
+
+	// rendering again produces the same variants, e.g. after a reload
+	again := render(`return "{{ proxyPool .Vars.pool }}";`, map[string]string{"pool": "proxy01:8080=3 proxy02:8080=1 proxy03:8080=2"})
+	if !again.isIdenticalVariant(&e) {
+		t.Errorf("NewLookupElement() rendered different variants for the same pool")
+	}
+	other := render(`return "{{ proxyPool "proxy01:8080" "proxy02:8080=5" }}";`, nil)
+	if other.isIdenticalVariant(&e) {
+		t.Errorf("isIdenticalVariant() = true for different pools")
+	}
+
+	// a single proxy serves all clients alike
+	single := render(`return "{{ proxyPool "proxy01:8080" }}";`, nil)
+	if single.clientVariants != nil || single.Variant != `return "PROXY proxy01:8080";` {
+		t.Errorf("NewLookupElement() = %q with %d variants, want a single variant", single.Variant, len(single.clientVariants))
+	}
+
+	if _, err := NewLookupElement(&ipMap{}, &pacTemplate{Filename: "pool.pac", content: `{{ proxyPool .Vars.pool }}`}, "Test Contact"); err == nil {
+		t.Errorf("NewLookupElement() without pool members should fail")
+	}
+
+	// the variants survive a snapshot
+	pacs := make(map[string]string)
+	restored := persistElement(&e, pacs).restore(map[string]*pacTemplate{"pool.pac": e.PAC})
+	if !restored.isIdenticalVariant(&e) {
+		t.Errorf("restore() lost the variants of the clients")
+	}
+}
+
+func TestPACRoutesProxyPool(t *testing.T) {
+	e, err := NewLookupElement(
+		&ipMap{IPNet: forceIPNet("10.0.0.0", 8), Filename: "pool.pac"},
+		&pacTemplate{Filename: "pool.pac", content: `{{ proxyPool "proxy01:8080" "proxy02:8080" }}`},
+		"Test Contact",
+	)
+	if err != nil {
+		t.Fatalf("NewLookupElement() unexpected error: %v", err)
+	}
+	handler := setupPACRoutes(t, []*LookupElement{&e})
+
+	served := make(map[string]bool)
+	for i := 1; i < 64; i++ {
+		client := net.IPv4(10, 0, 0, byte(i))
+		ctx := newRequest("/", client)
+		handler(ctx)
+		got := string(ctx.Response.Body())
+		ip, _ := IP.ParseIP(client.String())
+		if want := formatProxies(orderProxyPool([]poolMember{{"proxy01:8080", 1}, {"proxy02:8080", 1}}, clientBucket(ip))); got != want {
+			t.Errorf("GET / from %s = %q, want %q", client, got, want)
+		}
+		served[got] = true
+
+		// the testing route serves the order of the requested IP
+		ctx = newRequest("/"+client.String(), net.ParseIP("192.168.0.1"))
+		handler(ctx)
+		if string(ctx.Response.Body()) != got {
+			t.Errorf("GET /%s = %q, want %q", client, ctx.Response.Body(), got)
+		}
+	}
+	if len(served) != 2 {
+		t.Errorf("the clients were served %d orders, want 2", len(served))
+	}
+
+	ctx := newRequest("/", net.ParseIP("10.0.0.1"))
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+		ctx.Response.Reset()
+	})
+	if allocs > 0 {
+		t.Errorf("GET / of a proxy pool allocates %.1f times per request", allocs)
+	}
+}
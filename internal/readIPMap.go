@@ -1,26 +1,45 @@
 package internal
 
 /**
- * this file reads in the zone file and parses it into a list of IP Maps
+ * this file reads in the zone file(s) and parses them into a list of IP Maps
+ *
+ * the zone source can either be a single file, a directory or a glob pattern
+ * when multiple files are found, their zones get merged into a single list
  */
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"github.com/timeforaninja/pacserver/pkg/utils"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/timeforaninja/pacserver/pkg/cron"
 )
 
 type ipMap struct {
 	IPNet    IP.Net `json:"IPNet"`
 	Filename string `json:"Filename"`
 	Comment  string `json:"Comment"`
+	// Source is the zone file this entry was read from
+	Source string `json:"Source"`
+	// the following fields are only available in the structured (YAML / JSON) format
+	Owner      string            `json:"Owner,omitempty"`
+	Tags       []string          `json:"Tags,omitempty"`
+	Variables  map[string]string `json:"Variables,omitempty"`
+	ValidFrom  *time.Time        `json:"ValidFrom,omitempty"`
+	ValidUntil *time.Time        `json:"ValidUntil,omitempty"`
+	// Schedule opens a window of Duration at every match, see zoneSchedule.go
+	Schedule *cron.Schedule `json:"Schedule,omitempty"`
+	Duration time.Duration  `json:"Duration,omitempty"`
+	// Canary serves another PAC to a part of the clients, see canary.go
+	Canary *zoneCanary `json:"Canary,omitempty"`
 }
 
 func (x1 *ipMap) CompareForSort(x2 *ipMap) bool {
@@ -33,19 +52,139 @@ func (x1 *ipMap) CompareForSort(x2 *ipMap) bool {
 }
 
 func readIPMap(relPath string) ([]*ipMap, error, int) {
-	absPath, err := filepath.Abs(relPath)
+	files, err := resolveIPMapFiles(relPath)
 	if err != nil {
-		log.Errorf("Invalid Filepath for IPMap found: \"%s\": %s", absPath, err.Error())
+		log.Errorf("Unable to find IPMap files for \"%s\": %s", relPath, err.Error())
 		return make([]*ipMap, 0), err, 1
 	}
-	file, err := os.Open(absPath)
+
+	return mergeIPMapFiles(files, os.ReadFile)
+}
+
+// mergeIPMapFiles reads all zone files and merges them into a single list
+// readFile allows reading the files from other sources than the local filesystem
+func mergeIPMapFiles(files []string, readFile func(string) ([]byte, error)) ([]*ipMap, error, int) {
+	var mappings []*ipMap
+	problemCounter := 0
+	for _, file := range files {
+		data, err := readFile(file)
+		if err != nil {
+			// a single missing file would silently drop zones
+			// so we treat it like the whole IPMap failed to load
+			log.Errorf("Unable to open IPMap at \"%s\": %s", file, err.Error())
+			return make([]*ipMap, 0), err, 1
+		}
+		fileMappings, err, probs := parseIPMapFile(file, data)
+		if err != nil {
+			return make([]*ipMap, 0), err, probs
+		}
+		problemCounter += probs
+		mappings = append(mappings, fileMappings...)
+	}
+
+	return mappings, nil, problemCounter
+}
+
+// resolveIPMapFiles converts the configured zone source to a list of files
+// the source can be a single file, a directory (all files get read recursively) or a glob
+func resolveIPMapFiles(relPath string) ([]string, error) {
+	if isGlobPattern(relPath) {
+		matches, err := filepath.Glob(relPath)
+		if err != nil {
+			return nil, err
+		}
+		// Glob also matches directories, which we can not read
+		files := make([]string, 0, len(matches))
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err == nil && !info.IsDir() {
+				files = append(files, m)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files match the pattern")
+		}
+		return files, nil
+	}
+
+	info, err := os.Stat(relPath)
 	if err != nil {
-		log.Errorf("Unable to open IPMap at \"%s\": %s", absPath, err.Error())
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{relPath}, nil
+	}
+
+	relFiles, err := utils.ListFiles(relPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(relFiles))
+	for _, f := range relFiles {
+		if isZoneFile(filepath.ToSlash(f)) {
+			files = append(files, filepath.Join(relPath, f))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("directory does not contain any zone files")
+	}
+	return files, nil
+}
+
+// isZoneFile checks if a file found in a directory of zone files is read
+// only .csv, .yaml, .yml and .json files are, and none within hidden directories like .git or hidden files like editor swap files
+// f is relative to the directory and uses "/" as separator
+func isZoneFile(f string) bool {
+	for _, part := range strings.Split(f, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return false
+		}
+	}
+	switch strings.ToLower(filepath.Ext(f)) {
+	case ".csv", ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+func isGlobPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// parseIPMapFile parses the content of a single zone file
+// the format is detected based on the file extension, defaulting to CSV
+func parseIPMapFile(path string, data []byte) ([]*ipMap, error, int) {
+	source := utils.NormalizePath(path)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return parseStructuredIPMapFile(source, data, false)
+	case ".json":
+		return parseStructuredIPMapFile(source, data, true)
+	default:
+		return parseCSVIPMapFile(source, data)
+	}
+}
+
+func parseStructuredIPMapFile(source string, data []byte, isJSON bool) ([]*ipMap, error, int) {
+	mappings, zoneErrors, err := parseStructuredZones(data, isJSON)
+	if err != nil {
+		// a file we can not decode at all is handled like a file we can not open
+		log.Errorf("Unable to decode IPMap at \"%s\": %s", source, err.Error())
 		return make([]*ipMap, 0), err, 1
 	}
-	defer file.Close()
+	for _, zoneErr := range zoneErrors {
+		log.Errorf("Failed to parse Zone in \"%s\": %s", source, zoneErr.Error())
+	}
+	for _, mapping := range mappings {
+		mapping.Source = source
+	}
+
+	return mappings, nil, len(zoneErrors)
+}
 
-	scanner := bufio.NewScanner(file)
+func parseCSVIPMapFile(source string, data []byte) ([]*ipMap, error, int) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	var mappings []*ipMap
 
 	problemCounter := 0
@@ -57,12 +196,13 @@ func readIPMap(relPath string) ([]*ipMap, error, int) {
 
 		mapping, err := parseIPMapLine(textLine)
 		if err != nil {
-			log.Errorf("Failed to parse CSV Line %d: %s", lineCount, err.Error())
+			log.Errorf("Failed to parse CSV Line %d in \"%s\": %s", lineCount, source, err.Error())
 			problemCounter++
 		}
 		// mapping=nil and error=nil for skipping lines
 		if mapping != nil {
 			// if we made it this far then store the zone
+			mapping.Source = source
 			mappings = append(mappings, mapping)
 		}
 	}
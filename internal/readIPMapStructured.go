@@ -0,0 +1,122 @@
+package internal
+
+/**
+ * this file parses the structured (YAML / JSON) zone format
+ *
+ * unlike the CSV format it supports per-zone metadata,
+ * but it produces the same ipMap entries so the rest of the pipeline is unchanged
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/timeforaninja/pacserver/pkg/cron"
+	"github.com/timeforaninja/pacserver/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+type structuredZoneFile struct {
+	Zones []structuredZone `yaml:"zones" json:"zones"`
+}
+
+type structuredZone struct {
+	Network    string            `yaml:"network" json:"network"`
+	PAC        string            `yaml:"pac" json:"pac"`
+	Comment    string            `yaml:"comment,omitempty" json:"comment,omitempty"`
+	Owner      string            `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Tags       []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Variables  map[string]string `yaml:"variables,omitempty" json:"variables,omitempty"`
+	ValidFrom  *time.Time        `yaml:"validFrom,omitempty" json:"validFrom,omitempty"`
+	ValidUntil *time.Time        `yaml:"validUntil,omitempty" json:"validUntil,omitempty"`
+	// Schedule is a cron expression opening a window of Duration (e.g. "10h") at every match
+	Schedule string `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+	Duration string `yaml:"duration,omitempty" json:"duration,omitempty"`
+	// Canary serves another PAC to a percentage or some networks of the clients
+	Canary *structuredCanary `yaml:"canary,omitempty" json:"canary,omitempty"`
+}
+
+// parseStructuredZones decodes a YAML or JSON zone file
+// it returns all valid zones, and an error for each zone that could not be converted
+func parseStructuredZones(data []byte, isJSON bool) ([]*ipMap, []error, error) {
+	zoneFile := structuredZoneFile{}
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, &zoneFile)
+	} else {
+		err = yaml.Unmarshal(data, &zoneFile)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mappings := make([]*ipMap, 0, len(zoneFile.Zones))
+	zoneErrors := make([]error, 0)
+	for i, zone := range zoneFile.Zones {
+		mapping, err := zone.toIPMap()
+		if err != nil {
+			zoneErrors = append(zoneErrors, fmt.Errorf("zone %d: %s", i+1, err.Error()))
+			continue
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, zoneErrors, nil
+}
+
+func (z structuredZone) toIPMap() (*ipMap, error) {
+	if z.Network == "" {
+		return nil, fmt.Errorf("missing network")
+	}
+	if z.PAC == "" {
+		return nil, fmt.Errorf("missing pac")
+	}
+
+	ipNet, err := IP.NewIPNetFromNotation(z.Network)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse network \"%s\": %s", z.Network, err.Error())
+	}
+
+	if z.ValidFrom != nil && z.ValidUntil != nil && !z.ValidFrom.Before(*z.ValidUntil) {
+		return nil, fmt.Errorf("validFrom must be before validUntil")
+	}
+
+	var schedule *cron.Schedule
+	var duration time.Duration
+	if z.Schedule != "" || z.Duration != "" {
+		if z.Schedule == "" || z.Duration == "" {
+			return nil, fmt.Errorf("schedule and duration must be set together")
+		}
+		schedule, err = cron.Parse(z.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse schedule \"%s\": %s", z.Schedule, err.Error())
+		}
+		duration, err = time.ParseDuration(z.Duration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("duration must be positive, e.g. \"10h\": %s", z.Duration)
+		}
+	}
+
+	var canary *zoneCanary
+	if z.Canary != nil {
+		canary, err = z.Canary.toZoneCanary(ipNet)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ipMap{
+		IPNet:      ipNet,
+		Filename:   utils.NormalizePath(z.PAC),
+		Comment:    z.Comment,
+		Owner:      z.Owner,
+		Tags:       z.Tags,
+		Variables:  z.Variables,
+		ValidFrom:  z.ValidFrom,
+		ValidUntil: z.ValidUntil,
+		Schedule:   schedule,
+		Duration:   duration,
+		Canary:     canary,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStructuredZones(t *testing.T) {
+	t.Parallel()
+
+	yamlZones := `
+zones:
+  - network: 10.0.0.0/8
+    pac: my-company.pac
+    comment: the whole company
+    owner: team-network
+    tags: [emea, office]
+    variables:
+      proxy: proxy01:8080
+  - network: 10.43.0.0/16
+    pac: countries\germany.pac
+    validFrom: 2024-01-01T00:00:00Z
+    validUntil: 2024-02-01T00:00:00Z
+  - network: 10.44.0.0/16
+  - network: invalid/16
+    pac: broken.pac
+`
+	jsonZones := `{"zones": [
+		{"network": "172.16.0.0/12", "pac": "vpn.pac", "owner": "team-vpn", "variables": {"proxy": "proxy02:8080"}},
+		{"network": "192.168.0.1", "pac": "host.pac", "validFrom": "2024-02-01T00:00:00Z", "validUntil": "2024-01-01T00:00:00Z"}
+	]}`
+	scheduledZones := `
+zones:
+  - network: 10.1.0.0/16
+    pac: office-hours.pac
+    schedule: 0 8 * * 1-5
+    duration: 10h
+  - network: 10.2.0.0/16
+    pac: no-duration.pac
+    schedule: 0 8 * * 1-5
+  - network: 10.3.0.0/16
+    pac: broken-schedule.pac
+    schedule: 0 25 * * *
+    duration: 1h
+  - network: 10.4.0.0/16
+    pac: zero-duration.pac
+    schedule: 0 8 * * *
+    duration: 0s
+`
+
+	tests := []struct {
+		name         string
+		data         string
+		isJSON       bool
+		wantZones    []string
+		wantProblems int
+		wantErr      bool
+	}{
+		{
+			name:         "YAML with valid and invalid zones",
+			data:         yamlZones,
+			wantZones:    []string{"10.0.0.0/8", "10.43.0.0/16"},
+			wantProblems: 2,
+		},
+		{
+			name:         "JSON with invalid validity window",
+			data:         jsonZones,
+			isJSON:       true,
+			wantZones:    []string{"172.16.0.0/12"},
+			wantProblems: 1,
+		},
+		{
+			name:         "Schedules with invalid expressions and durations",
+			data:         scheduledZones,
+			wantZones:    []string{"10.1.0.0/16"},
+			wantProblems: 3,
+		},
+		{
+			name:    "Broken YAML",
+			data:    "zones: [",
+			wantErr: true,
+		},
+		{
+			name:    "Broken JSON",
+			data:    "{\"zones\": ",
+			isJSON:  true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, zoneErrors, err := parseStructuredZones([]byte(tt.data), tt.isJSON)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStructuredZones() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(zoneErrors) != tt.wantProblems {
+				t.Errorf("parseStructuredZones() returned %d zone errors, want %d: %v", len(zoneErrors), tt.wantProblems, zoneErrors)
+			}
+			if len(got) != len(tt.wantZones) {
+				t.Fatalf("parseStructuredZones() returned %d zones, want %d", len(got), len(tt.wantZones))
+			}
+			for i, zone := range got {
+				if zone.IPNet.ToString() != tt.wantZones[i] {
+					t.Errorf("zone %d = %s, want %s", i, zone.IPNet.ToString(), tt.wantZones[i])
+				}
+			}
+		})
+	}
+
+	t.Run("Metadata is mapped", func(t *testing.T) {
+		got, _, err := parseStructuredZones([]byte(yamlZones), false)
+		if err != nil {
+			t.Fatalf("parseStructuredZones() unexpected error: %v", err)
+		}
+		first := got[0]
+		if first.Filename != "my-company.pac" || first.Comment != "the whole company" || first.Owner != "team-network" {
+			t.Errorf("unexpected zone metadata: %+v", first)
+		}
+		if len(first.Tags) != 2 || first.Variables["proxy"] != "proxy01:8080" {
+			t.Errorf("unexpected zone tags or variables: %+v", first)
+		}
+		second := got[1]
+		if second.ValidFrom == nil || second.ValidUntil == nil {
+			t.Fatalf("expected validity window to be set: %+v", second)
+		}
+
+		got, _, err = parseStructuredZones([]byte(scheduledZones), false)
+		if err != nil {
+			t.Fatalf("parseStructuredZones() unexpected error: %v", err)
+		}
+		if got[0].Schedule == nil || got[0].Schedule.String() != "0 8 * * 1-5" || got[0].Duration != 10*time.Hour {
+			t.Errorf("unexpected schedule: %+v", got[0])
+		}
+	})
+}
+
+func TestIsActiveAt(t *testing.T) {
+	t.Parallel()
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		zone *ipMap
+		at   time.Time
+		want bool
+	}{
+		{
+			name: "No window",
+			zone: &ipMap{},
+			at:   from,
+			want: true,
+		},
+		{
+			name: "Before validFrom",
+			zone: &ipMap{ValidFrom: &from, ValidUntil: &until},
+			at:   from.Add(-time.Second),
+			want: false,
+		},
+		{
+			name: "Exactly at validFrom",
+			zone: &ipMap{ValidFrom: &from, ValidUntil: &until},
+			at:   from,
+			want: true,
+		},
+		{
+			name: "Exactly at validUntil",
+			zone: &ipMap{ValidFrom: &from, ValidUntil: &until},
+			at:   until,
+			want: false,
+		},
+		{
+			name: "Only validUntil",
+			zone: &ipMap{ValidUntil: &until},
+			at:   from,
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.zone.isActiveAt(tt.at); got != tt.want {
+				t.Errorf("isActiveAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
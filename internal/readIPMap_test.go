@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -186,3 +189,112 @@ func TestParseIPMapLine(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveIPMapFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "emea.csv"), "10.0.0.0,8,emea.pac\n")
+	writeTestFile(t, filepath.Join(dir, "apac.csv"), "172.16.0.0,12,apac.pac\n")
+	writeTestFile(t, filepath.Join(dir, "nested", "amer.csv"), "192.168.0.0,16,amer.pac\n")
+	writeTestFile(t, filepath.Join(dir, ".hidden.csv"), "1.1.1.0,24,hidden.pac\n")
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "some notes\n")
+	writeTestFile(t, filepath.Join(dir, "nested", "amer.yaml"), "zones: []\n")
+	writeTestFile(t, filepath.Join(dir, ".git", "objects", "zones.csv"), "1.1.1.0,24,git.pac\n")
+	writeTestFile(t, filepath.Join(dir, "nested", ".archive", "old.csv"), "1.1.2.0,24,old.pac\n")
+
+	tests := []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Single file",
+			path: filepath.Join(dir, "emea.csv"),
+			want: []string{filepath.Join(dir, "emea.csv")},
+		},
+		{
+			name: "Directory",
+			path: dir,
+			want: []string{
+				filepath.Join(dir, "apac.csv"),
+				filepath.Join(dir, "emea.csv"),
+				filepath.Join(dir, "nested", "amer.csv"),
+				filepath.Join(dir, "nested", "amer.yaml"),
+			},
+		},
+		{
+			name: "Glob",
+			path: filepath.Join(dir, "*.csv"),
+			want: []string{
+				filepath.Join(dir, ".hidden.csv"),
+				filepath.Join(dir, "apac.csv"),
+				filepath.Join(dir, "emea.csv"),
+			},
+		},
+		{
+			name:    "Glob without matches",
+			path:    filepath.Join(dir, "*.yml"),
+			wantErr: true,
+		},
+		{
+			name:    "Glob matching only directories",
+			path:    filepath.Join(dir, "nest*"),
+			wantErr: true,
+		},
+		{
+			name:    "Missing file",
+			path:    filepath.Join(dir, "missing.csv"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveIPMapFiles(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveIPMapFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveIPMapFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIPMapMergesFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "emea.csv"), "10.0.0.0,8,emea.pac\n10.43.0.0,16,germany.pac\n")
+	writeTestFile(t, filepath.Join(dir, "apac.csv"), "172.16.0.0,12,apac.pac\n")
+
+	got, err, problems := readIPMap(dir)
+	if err != nil {
+		t.Fatalf("readIPMap() unexpected error: %v", err)
+	}
+	if problems != 0 {
+		t.Errorf("readIPMap() problems = %d, want 0", problems)
+	}
+	if len(got) != 3 {
+		t.Fatalf("readIPMap() returned %d zones, want 3", len(got))
+	}
+	wantSources := []string{"apac.csv", "emea.csv", "emea.csv"}
+	for i, m := range got {
+		if filepath.Base(m.Source) != wantSources[i] {
+			t.Errorf("zone %d Source = %q, want file %q", i, m.Source, wantSources[i])
+		}
+	}
+}
+
+// writeTestFile creates a file (and all parent directories) with the given content
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+}
@@ -48,6 +48,10 @@ func readTemplateFiles(relPacDir string) ([]*pacTemplate, error, int) {
 
 func readAndParse(basePath, file string) (*pacTemplate, error) {
 	fullPath := filepath.Join(basePath, file)
+	if filepath.IsAbs(file) {
+		// e.g. the default PAC, which is configured relative to the cwd
+		fullPath = file
+	}
 	fileBytes, err := os.ReadFile(fullPath)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,127 @@
+package internal
+
+/**
+ * reload metrics describe the outcome of the latest loads of Zones and PACs
+ *
+ * a load with minor problems still replaces the served tree, e.g. with a PAC served from the cache,
+ * so the problems are split by category and the load is counted as degraded,
+ * which allows alerting on a silently degraded tree
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// results of a load
+const (
+	// reloadSuccess is a load without problems
+	reloadSuccess = "success"
+	// reloadDegraded is a load that is served despite minor problems
+	reloadDegraded = "degraded"
+	// reloadFailed is a load that is not served, the previous tree is kept
+	reloadFailed = "failed"
+)
+
+// loadProblems are the minor problems of a load by category
+type loadProblems struct {
+	// Defaults are problems with the default PAC and the WPAD file
+	Defaults int `json:"defaults"`
+	// Zones are problems of the zone source, e.g. invalid lines
+	Zones int `json:"zones"`
+	// PACs are problems of the PAC source, e.g. unreadable files
+	PACs int `json:"pacs"`
+	// Matching are zones with a missing PAC or a template that failed to render
+	Matching int `json:"matching"`
+	// Duplicates are conflicting definitions of the same network
+	Duplicates int `json:"duplicates"`
+}
+
+func (p loadProblems) total() int {
+	return p.Defaults + p.Zones + p.PACs + p.Matching + p.Duplicates
+}
+
+func (p loadProblems) byCategory() map[string]float64 {
+	return map[string]float64{
+		"defaults":   float64(p.Defaults),
+		"zones":      float64(p.Zones),
+		"pacs":       float64(p.PACs),
+		"matching":   float64(p.Matching),
+		"duplicates": float64(p.Duplicates),
+	}
+}
+
+// recordLoad records the outcome of a load that started at start
+func recordLoad(result string, start time.Time, problems loadProblems) {
+	reloadCounter.WithLabelValues(result).Inc()
+
+	now := time.Now()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	currentStatus.Result = result
+	currentStatus.Finished = now
+	if result == reloadSuccess {
+		currentStatus.LastSuccess = now
+	}
+	currentStatus.Duration = now.Sub(start)
+	currentStatus.Problems = problems
+}
+
+// recordServed records the served data after it was replaced by a load, a rollback or the last known good snapshot
+// zones and pacs are the Zones and templates it was built from, cached of the pacs are served from a previous load
+func recordServed(d *servedData, zones []*ipMap, pacs []*pacTemplate, cached int, defaultPACLoaded bool) {
+	depth, hash := treeDepth(d.tree), hashPACs(pacs)
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	currentStatus.LastReload = time.Now()
+	currentStatus.Zones = len(d.elements)
+	currentStatus.LoadedZones = len(zones)
+	currentStatus.TreeDepth = depth
+	currentStatus.PACs = len(pacs)
+	currentStatus.CachedPACs = cached
+	currentStatus.PACHash = hash
+	currentStatus.DefaultPACLoaded = defaultPACLoaded
+}
+
+// treeDepth returns the amount of levels below the root, 0 for a tree without zones
+func treeDepth(node *lookupTreeNode) int {
+	if node == nil {
+		return 0
+	}
+	depth := 0
+	for _, child := range node.children {
+		if d := treeDepth(child) + 1; d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// hashPACs hashes the names and contents of the templates, independent of their order
+func hashPACs(pacs []*pacTemplate) string {
+	sorted := append([]*pacTemplate(nil), pacs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Filename < sorted[j].Filename
+	})
+	h := sha256.New()
+	for _, pac := range sorted {
+		h.Write([]byte(pac.Filename))
+		h.Write([]byte{0})
+		h.Write([]byte(pac.content))
+		h.Write([]byte{0})
+	}
+	return shortHash(h.Sum(nil))
+}
+
+// shortHash formats the first 6 bytes of a hash, enough to tell versions apart
+func shortHash(sum []byte) string {
+	return hex.EncodeToString(sum[:6])
+}
+
+// hashConfig hashes the content of the config file
+func hashConfig(data []byte) string {
+	sum := sha256.Sum256(data)
+	return shortHash(sum[:])
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTreeDepth(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		elements []*LookupElement
+		want     int
+	}{
+		{name: "No zones", want: 0},
+		{name: "Flat", elements: []*LookupElement{
+			createLookupElement("10.0.0.0", 8, "a.pac"),
+			createLookupElement("192.168.0.0", 16, "b.pac"),
+		}, want: 1},
+		{name: "Nested", elements: []*LookupElement{
+			createLookupElement("10.0.0.0", 8, "a.pac"),
+			createLookupElement("10.1.0.0", 16, "b.pac"),
+			createLookupElement("10.1.2.0", 24, "c.pac"),
+			createLookupElement("192.168.0.0", 16, "d.pac"),
+		}, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := treeDepth(buildLookupTree(testDefaultPAC, tt.elements)); got != tt.want {
+				t.Errorf("treeDepth() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if got := treeDepth(nil); got != 0 {
+		t.Errorf("treeDepth(nil) = %d, want 0", got)
+	}
+}
+
+func TestHashPACs(t *testing.T) {
+	t.Parallel()
+
+	a := &pacTemplate{Filename: "a.pac", content: "// a"}
+	b := &pacTemplate{Filename: "b.pac", content: "// b"}
+	changed := &pacTemplate{Filename: "b.pac", content: "// changed"}
+	renamed := &pacTemplate{Filename: "c.pac", content: "// b"}
+
+	if hashPACs([]*pacTemplate{a, b}) != hashPACs([]*pacTemplate{b, a}) {
+		t.Errorf("hashPACs() depends on the order of the templates")
+	}
+	for name, pacs := range map[string][]*pacTemplate{
+		"changed content": {a, changed},
+		"renamed file":    {a, renamed},
+		"removed file":    {a},
+	} {
+		if hashPACs(pacs) == hashPACs([]*pacTemplate{a, b}) {
+			t.Errorf("hashPACs() did not change with a %s", name)
+		}
+	}
+	if hashConfig([]byte("a: 1")) == hashConfig([]byte("a: 2")) {
+		t.Errorf("hashConfig() did not change with the content")
+	}
+}
+
+func TestReloadMetrics(t *testing.T) {
+	oldConf, oldZones, oldPACs := confStorage, zoneProvider, pacProvider
+	oldServed := served.Load()
+	oldIPMaps, oldCachedPACs, oldFallback := cachedIPMaps, cachedPACs, cachedFallbackPACs
+	defer func() {
+		confStorage, zoneProvider, pacProvider = oldConf, oldZones, oldPACs
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs, cachedFallbackPACs = oldIPMaps, oldCachedPACs, oldFallback
+		currentStatus = reloadStatus{}
+	}()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	confStorage = &Config{
+		DefaultPACFile: filepath.Join(dir, "default.pac"),
+		WPADFile:       filepath.Join(dir, "wpad.dat"),
+		ContactInfo:    "Test Contact",
+	}
+	resetServedData()
+
+	company := createLookupElement("10.0.0.0", 8, "company.pac")
+	office := createLookupElement("10.1.2.0", 24, "office.pac")
+	office.PAC.content = "// office"
+	zones := memoryZoneProvider{zones: []*ipMap{company.IPMap, office.IPMap}}
+
+	// counts the loads with a result during step
+	loads := func(result string, step func()) float64 {
+		before := testutil.ToFloat64(reloadCounter.WithLabelValues(result))
+		step()
+		return testutil.ToFloat64(reloadCounter.WithLabelValues(result)) - before
+	}
+
+	// a load without problems
+	zoneProvider, pacProvider = zones, memoryPACProvider{pacs: []*pacTemplate{company.PAC, office.PAC}}
+	if n := loads(reloadSuccess, func() { updateLookupTree() }); n != 1 {
+		t.Fatalf("app_reloads_total{result=\"success\"} increased by %g, want 1", n)
+	}
+	stats := getReloadStatus()
+	if stats.Finished.IsZero() || stats.LastSuccess != stats.Finished || stats.Problems.total() != 0 {
+		t.Errorf("getReloadStatus() after a successful load = %+v", stats)
+	}
+	if stats.PACs != 2 || stats.CachedPACs != 0 || stats.TreeDepth != 2 {
+		t.Errorf("getReloadStatus() = %d pacs, %d cached, depth %d, want 2, 0 and 2", stats.PACs, stats.CachedPACs, stats.TreeDepth)
+	}
+	if got := testutil.ToFloat64(zonesGauge); got != 2 {
+		t.Errorf("app_zones = %g, want 2", got)
+	}
+	success, hash := stats.LastSuccess, stats.PACHash
+
+	// a PAC vanished from its source is served from the cache, which degrades the load
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{company.PAC}}
+	if n := loads(reloadDegraded, func() { updateLookupTree() }); n != 1 {
+		t.Fatalf("app_reloads_total{result=\"degraded\"} increased by %g, want 1", n)
+	}
+	stats = getReloadStatus()
+	if stats.Problems != (loadProblems{Matching: 1}) {
+		t.Errorf("getReloadStatus().Problems = %+v, want one matching problem", stats.Problems)
+	}
+	if stats.LastSuccess != success || !stats.Finished.After(success) {
+		t.Errorf("a degraded load changed the last success")
+	}
+	if got := testutil.ToFloat64(cachedPACsGauge); got != 1 {
+		t.Errorf("app_pacs_cached_fallback = %g, want 1", got)
+	}
+	if stats.PACHash != hash {
+		t.Errorf("the PAC hash changed although the same templates are served")
+	}
+
+	// a load with problems is rejected while serving the last known good snapshot
+	// it has already replaced the cached PACs, but the served ones are still recorded
+	lastKnownGoodLock.Lock()
+	servingLastKnownGood = true
+	lastKnownGoodLock.Unlock()
+	defer leaveLastKnownGood()
+	zoneProvider = memoryZoneProvider{zones: zones.zones, problems: 1}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{company.PAC, office.PAC, {Filename: "lab.pac", content: "// lab"}}}
+	if n := loads(reloadFailed, func() { updateLookupTree() }); n != 1 {
+		t.Fatalf("app_reloads_total{result=\"failed\"} increased by %g, want 1", n)
+	}
+	stats = getReloadStatus()
+	if stats.PACs != 2 || stats.CachedPACs != 1 || stats.PACHash != hash || stats.Problems != (loadProblems{Zones: 1}) {
+		t.Errorf("getReloadStatus() after a rejected load = %d pacs, %d cached, hash %s, problems %+v, want the served 2, 1 and %s", stats.PACs, stats.CachedPACs, stats.PACHash, stats.Problems, hash)
+	}
+	leaveLastKnownGood()
+
+	// a failed load keeps serving the tree and counts the problems of both sources
+	zoneProvider = memoryZoneProvider{err: errors.New("unreachable")}
+	pacProvider = memoryPACProvider{err: errors.New("unreachable")}
+	if n := loads(reloadFailed, func() { updateLookupTree() }); n != 1 {
+		t.Fatalf("app_reloads_total{result=\"failed\"} increased by %g, want 1", n)
+	}
+	if got := getReloadStatus().Problems; got != (loadProblems{Zones: 1, PACs: 1}) {
+		t.Errorf("getReloadStatus().Problems = %+v, want one problem of each source", got)
+	}
+	if got := testutil.ToFloat64(treeDepthGauge); got != 2 {
+		t.Errorf("app_lookup_tree_depth = %g, want the depth of the served tree", got)
+	}
+}
@@ -0,0 +1,250 @@
+package internal
+
+/**
+ * request stats count which zones and which client networks request PACs
+ *
+ * labelling metrics by client IP or by every zone would explode the amount of series,
+ * so both are bounded by the config:
+ * the first zoneMetricsLimit zones served get a counter of their own, later ones are counted as "other".
+ * emergency overrides are not zones, requests served by one are counted as "override".
+ * the client /24 networks are tracked by a heavy-hitter sketch (space-saving) of topClientSubnets slots,
+ * which keeps the most requesting networks with an upper bound of the error of their count.
+ *
+ * both are updated on the request path, so they do not allocate once a zone or network is known
+ * and requests do not wait for a global lock:
+ * known zones are counted without any lock, the map of their counters is only copied when a zone is added.
+ * the sketch is split into shards by network, each with topClientSubnets slots of its own,
+ * so a network is always counted by the same shard and its error is never larger than in a single sketch
+ */
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/timeforaninja/pacserver/pkg/IP"
+)
+
+// otherZones is the label of the requests of zones beyond the limit
+const otherZones = "other"
+
+// overrideZones is the label of the requests served by an emergency override
+const overrideZones = "override"
+
+type zoneCounters struct {
+	// lock serializes adding zones, counting them does not need it
+	lock  sync.Mutex
+	limit int
+	// counters are keyed by the network address and the CIDR of the zone
+	// the map is never modified, it is replaced by a copy with the added zone
+	counters  atomic.Pointer[map[uint64]*zoneCounter]
+	other     atomic.Uint64
+	overrides atomic.Uint64
+}
+
+type zoneCounter struct {
+	zone     IP.Net
+	requests atomic.Uint64
+}
+
+// subnetSketchShards is the amount of shards of the sketch
+const subnetSketchShards = 16
+
+type subnetSketch struct {
+	// limit is the amount of networks listed
+	limit  int
+	shards [subnetSketchShards]subnetSketchShard
+}
+
+type subnetSketchShard struct {
+	lock sync.Mutex
+	// index maps the network address of a /24 to its slot
+	index map[uint32]int
+	slots []subnetSlot
+}
+
+type subnetSlot struct {
+	subnet   uint32
+	requests uint64
+	// err is the upper bound of requests counted for networks this slot was taken from
+	err uint64
+}
+
+// zoneRequests is the count of a zone, as shown by the admin API
+type zoneRequests struct {
+	Zone     string `json:"zone"`
+	Requests uint64 `json:"requests"`
+}
+
+// subnetRequests is the estimated count of a client network, as shown by the admin API
+// the actual count is between requests-maxError and requests
+type subnetRequests struct {
+	Subnet   string `json:"subnet"`
+	Requests uint64 `json:"requests"`
+	MaxError uint64 `json:"maxError"`
+}
+
+type requestStats struct {
+	Zones         []zoneRequests   `json:"zones"`
+	ClientSubnets []subnetRequests `json:"clientSubnets"`
+}
+
+// the stats are nil if they are disabled
+var (
+	zoneRequestCounters *zoneCounters
+	clientSubnetSketch  *subnetSketch
+)
+
+// initRequestStats enables the counters of up to zoneLimit zones and the sketch of topSubnets client networks
+func initRequestStats(zoneLimit, topSubnets int) {
+	zoneRequestCounters, clientSubnetSketch = nil, nil
+	if zoneLimit > 0 {
+		zoneRequestCounters = &zoneCounters{limit: zoneLimit}
+		counters := make(map[uint64]*zoneCounter)
+		zoneRequestCounters.counters.Store(&counters)
+	}
+	if topSubnets > 0 {
+		clientSubnetSketch = &subnetSketch{limit: topSubnets}
+		for i := range clientSubnetSketch.shards {
+			shard := &clientSubnetSketch.shards[i]
+			shard.index, shard.slots = make(map[uint32]int, topSubnets), make([]subnetSlot, 0, topSubnets)
+		}
+	}
+}
+
+// recordRequest counts the request for the zone of the client looked up
+// only lookups of a single client or a /24 are part of the client networks, so IPv6 clients are not
+func recordRequest(zone *LookupElement, client *IP.Net) {
+	if counters := zoneRequestCounters; counters != nil && zone != nil && zone.IPMap != nil {
+		if zone.IPMap.Source == overrideSource {
+			counters.overrides.Add(1)
+		} else {
+			counters.add(zone.IPMap.IPNet)
+		}
+	}
+	if sketch := clientSubnetSketch; sketch != nil && client != nil && client.CIDR.Value >= 24 {
+		sketch.add(client.NetworkAddress.Value & 0xffffff00)
+	}
+}
+
+func (zc *zoneCounters) add(zone IP.Net) {
+	key := uint64(zone.NetworkAddress.Value)<<8 | uint64(zone.CIDR.Value)
+	counter, ok := (*zc.counters.Load())[key]
+	if !ok {
+		if counter = zc.addZone(key, zone); counter == nil {
+			zc.other.Add(1)
+			return
+		}
+	}
+	counter.requests.Add(1)
+}
+
+// addZone adds the counter of the zone, it returns nil if the limit is reached
+func (zc *zoneCounters) addZone(key uint64, zone IP.Net) *zoneCounter {
+	zc.lock.Lock()
+	defer zc.lock.Unlock()
+	counters := *zc.counters.Load()
+	if counter, ok := counters[key]; ok {
+		// added while we waited for the lock
+		return counter
+	}
+	if len(counters) >= zc.limit {
+		return nil
+	}
+	added := make(map[uint64]*zoneCounter, len(counters)+1)
+	for k, c := range counters {
+		added[k] = c
+	}
+	counter := &zoneCounter{zone: zone}
+	added[key] = counter
+	zc.counters.Store(&added)
+	return counter
+}
+
+// list returns the counts of all zones, the most requested first, followed by the other zones and the overrides
+func (zc *zoneCounters) list() []zoneRequests {
+	counters := *zc.counters.Load()
+	list := make([]zoneRequests, 0, len(counters)+2)
+	for _, counter := range counters {
+		list = append(list, zoneRequests{Zone: counter.zone.ToString(), Requests: counter.requests.Load()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Requests != list[j].Requests {
+			return list[i].Requests > list[j].Requests
+		}
+		return list[i].Zone < list[j].Zone
+	})
+	return append(list,
+		zoneRequests{Zone: otherZones, Requests: zc.other.Load()},
+		zoneRequests{Zone: overrideZones, Requests: zc.overrides.Load()},
+	)
+}
+
+// add counts a request of the network in its shard
+func (s *subnetSketch) add(subnet uint32) {
+	s.shards[(subnet>>8)%subnetSketchShards].add(subnet)
+}
+
+// add counts a request of the network
+// an unknown network takes the slot of the least requested one, inheriting its count as error
+func (s *subnetSketchShard) add(subnet uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i, ok := s.index[subnet]; ok {
+		s.slots[i].requests++
+		return
+	}
+	if len(s.slots) < cap(s.slots) {
+		s.index[subnet] = len(s.slots)
+		s.slots = append(s.slots, subnetSlot{subnet: subnet, requests: 1})
+		return
+	}
+	least := 0
+	for i := range s.slots {
+		if s.slots[i].requests < s.slots[least].requests {
+			least = i
+		}
+	}
+	delete(s.index, s.slots[least].subnet)
+	lowest := s.slots[least].requests
+	s.slots[least] = subnetSlot{subnet: subnet, requests: lowest + 1, err: lowest}
+	s.index[subnet] = least
+}
+
+// list returns the limit most requested networks of all shards, the most requested first
+func (s *subnetSketch) list() []subnetRequests {
+	slots := make([]subnetSlot, 0)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		slots = append(slots, shard.slots...)
+		shard.lock.Unlock()
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].requests != slots[j].requests {
+			return slots[i].requests > slots[j].requests
+		}
+		return slots[i].subnet < slots[j].subnet
+	})
+	if len(slots) > s.limit {
+		slots = slots[:s.limit]
+	}
+	list := make([]subnetRequests, len(slots))
+	for i, slot := range slots {
+		subnet := IP.Net{NetworkAddress: IP.IP{Value: slot.subnet}, CIDR: IP.CIDR{Value: 24}}
+		list[i] = subnetRequests{Subnet: subnet.ToString(), Requests: slot.requests, MaxError: slot.err}
+	}
+	return list
+}
+
+// listRequestStats returns the stats of the zones and client networks, which are empty if disabled
+func listRequestStats() requestStats {
+	stats := requestStats{Zones: make([]zoneRequests, 0), ClientSubnets: make([]subnetRequests, 0)}
+	if counters := zoneRequestCounters; counters != nil {
+		stats.Zones = counters.list()
+	}
+	if sketch := clientSubnetSketch; sketch != nil {
+		stats.ClientSubnets = sketch.list()
+	}
+	return stats
+}
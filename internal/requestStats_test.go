@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	"github.com/valyala/fasthttp"
+)
+
+// enableRequestStats enables the request stats for the test and disables them afterwards
+func enableRequestStats(t *testing.T, zoneLimit, topSubnets int) {
+	t.Helper()
+	initRequestStats(zoneLimit, topSubnets)
+	t.Cleanup(func() { initRequestStats(0, 0) })
+}
+
+func TestZoneCounters(t *testing.T) {
+	enableRequestStats(t, 2, 0)
+
+	company := createLookupElement("10.0.0.0", 8, "company.pac")
+	office := createLookupElement("10.1.2.0", 24, "office.pac")
+	// the same network as office, e.g. after a reload
+	reloaded := createLookupElement("10.1.2.0", 24, "office.pac")
+	lab := createLookupElement("10.1.3.0", 24, "lab.pac")
+	// overrides do not take the slot of a zone
+	override := createLookupElement("0.0.0.0", 0, OverrideDirect)
+	override.IPMap.Source = overrideSource
+	for _, e := range []*LookupElement{override, office, company, office, reloaded, lab, lab, nil} {
+		recordRequest(e, nil)
+	}
+
+	want := []zoneRequests{{"10.1.2.0/24", 3}, {"10.0.0.0/8", 1}, {otherZones, 2}, {overrideZones, 1}}
+	got := listRequestStats().Zones
+	if len(got) != len(want) {
+		t.Fatalf("listRequestStats().Zones = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("listRequestStats().Zones[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if subnets := listRequestStats().ClientSubnets; len(subnets) != 0 {
+		t.Errorf("disabled client subnets listed %v", subnets)
+	}
+}
+
+func TestSubnetSketch(t *testing.T) {
+	enableRequestStats(t, 0, 3)
+
+	request := func(ip string, times int) {
+		for i := 0; i < times; i++ {
+			recordRequest(nil, createIPNet(ip, 32))
+		}
+	}
+	// one network requests the most, three others take turns on the remaining two slots
+	// all of them are 16 /24s apart, so they are counted by the same shard
+	for round := 0; round < 10; round++ {
+		request("10.1.2.3", 5)
+		request("10.1.2.200", 5)
+		request("10.1.18.9", 3)
+		request("10.1.34.1", 3)
+		request("10.1.50.1", 3)
+	}
+	// IPv6 clients and wider lookups are not counted
+	recordRequest(nil, &IP.Net{})
+	recordRequest(nil, createIPNet("10.1.0.0", 16))
+
+	got := listRequestStats().ClientSubnets
+	if len(got) != 3 {
+		t.Fatalf("listRequestStats().ClientSubnets = %v, want 3 networks", got)
+	}
+	// a single /24 holding both hosts leads with an exact count
+	if got[0].Subnet != "10.1.2.0/24" || got[0].Requests != 100 || got[0].MaxError != 0 {
+		t.Errorf("listRequestStats().ClientSubnets[0] = %+v, want 10.1.2.0/24 with 100 requests", got[0])
+	}
+	// the estimates are upper bounds of the actual counts
+	for _, s := range got[1:] {
+		if s.Requests < 30 || s.Requests-s.MaxError > 30 {
+			t.Errorf("%s is estimated at %d (max error %d), the actual count is 30", s.Subnet, s.Requests, s.MaxError)
+		}
+	}
+	if zones := listRequestStats().Zones; len(zones) != 0 {
+		t.Errorf("disabled zone counters listed %v", zones)
+	}
+}
+
+func TestRecordRequestsConcurrent(t *testing.T) {
+	enableRequestStats(t, 4, 20)
+
+	zones := []*LookupElement{
+		createLookupElement("10.0.0.0", 8, "company.pac"),
+		createLookupElement("10.1.2.0", 24, "office.pac"),
+	}
+	done := make(chan bool)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			defer func() { done <- true }()
+			// every worker is a network of its own, all request both zones
+			client := createIPNet(fmt.Sprintf("10.%d.0.1", w), 32)
+			for i := 0; i < 1000; i++ {
+				recordRequest(zones[i%2], client)
+			}
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+
+	stats := listRequestStats()
+	if len(stats.Zones) != 4 || stats.Zones[0].Requests != 4000 || stats.Zones[1].Requests != 4000 {
+		t.Errorf("listRequestStats().Zones = %v, want 4000 requests of both zones", stats.Zones)
+	}
+	if len(stats.ClientSubnets) != 8 {
+		t.Fatalf("listRequestStats().ClientSubnets = %v, want 8 networks", stats.ClientSubnets)
+	}
+	for _, s := range stats.ClientSubnets {
+		if s.Requests != 1000 || s.MaxError != 0 {
+			t.Errorf("%s = %d requests (max error %d), want 1000", s.Subnet, s.Requests, s.MaxError)
+		}
+	}
+}
+
+func TestPACRoutesRecordRequests(t *testing.T) {
+	handler := setupPACRoutes(t, webserverTestZones())
+	enableRequestStats(t, 10, 10)
+
+	for _, client := range []string{"10.1.2.3", "10.1.2.4", "10.2.0.1", "192.168.0.1"} {
+		handler(newRequest("/", net.ParseIP(client)))
+	}
+	// the testing routes count the zone and the network requested, not the client
+	handler(newRequest("/10.1.2.9", net.ParseIP("192.168.0.1")))
+	handler(newRequest("/10.1.2.0/24", net.ParseIP("192.168.0.1")))
+
+	stats := listRequestStats()
+	zones := make(map[string]uint64)
+	for _, z := range stats.Zones {
+		zones[z.Zone] = z.Requests
+	}
+	if zones["10.1.2.0/24"] != 4 || zones["10.0.0.0/8"] != 1 || zones["0.0.0.0/0"] != 1 {
+		t.Errorf("listRequestStats().Zones = %v", stats.Zones)
+	}
+	// 10.1.2.0/24 requested by two clients and looked up twice, 10.2.0.0/24 and 192.168.0.0/24 once
+	if len(stats.ClientSubnets) != 3 || stats.ClientSubnets[0] != (subnetRequests{"10.1.2.0/24", 4, 0}) || stats.ClientSubnets[1] != (subnetRequests{"10.2.0.0/24", 1, 0}) {
+		t.Errorf("listRequestStats().ClientSubnets = %v", stats.ClientSubnets)
+	}
+
+	// known zones and networks are counted without allocating
+	ctx := newRequest("/", net.ParseIP("10.1.2.3"))
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+		ctx.Response.Reset()
+	})
+	if allocs > 0 {
+		t.Errorf("GET / with request stats allocates %.1f times per request", allocs)
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	oldConf := confStorage
+	defer func() { confStorage = oldConf }()
+	confStorage = &Config{AdminToken: "secret"}
+	enableRequestStats(t, 10, 10)
+	recordRequest(createLookupElement("10.0.0.0", 8, "company.pac"), createIPNet("10.1.2.3", 32))
+
+	app := fiber.New()
+	registerAdminRoutes(app)
+	ctx := newRequest("/admin/requests", net.ParseIP("127.0.0.1"))
+	ctx.Request.Header.Set(fiber.HeaderAuthorization, "Bearer secret")
+	app.Handler()(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("GET /admin/requests = %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	var stats requestStats
+	if err := json.Unmarshal(ctx.Response.Body(), &stats); err != nil {
+		t.Fatalf("GET /admin/requests returned invalid JSON: %v", err)
+	}
+	if len(stats.Zones) != 3 || stats.Zones[0] != (zoneRequests{"10.0.0.0/8", 1}) || stats.Zones[1].Zone != otherZones || stats.Zones[2].Zone != overrideZones {
+		t.Errorf("GET /admin/requests zones = %v", stats.Zones)
+	}
+	if len(stats.ClientSubnets) != 1 || stats.ClientSubnets[0].Subnet != "10.1.2.0/24" {
+		t.Errorf("GET /admin/requests client subnets = %v", stats.ClientSubnets)
+	}
+}
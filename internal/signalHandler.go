@@ -11,11 +11,13 @@ package internal
  */
 
 import (
+	"context"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // setupSignalHandling sets up a goroutine to handle OS signals
@@ -55,6 +57,13 @@ func setupSignalHandling(app *fiber.App) {
 					os.Exit(1)
 				}
 
+				// export the remaining spans and metrics
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := ShutdownTelemetry(ctx); err != nil {
+					log.Errorf("Failed to export the remaining telemetry: %v", err)
+				}
+				cancel()
+
 				log.Info("Server has been gracefully shut down")
 				os.Exit(0)
 			}
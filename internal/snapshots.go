@@ -0,0 +1,462 @@
+package internal
+
+/**
+ * this file keeps a history of the last served loads as snapshots
+ *
+ * a snapshot holds everything required to serve clients (zones, rendered PACs, default PACs),
+ * so rolling back to it does neither read nor touch any files of the zone and pac sources.
+ * if a snapshotDir is configured, the history also survives restarts.
+ * a load serving the same commit or content as the newest snapshot does not add another one
+ *
+ * after a rollback, the regular refresh is paused until the next explicit reload,
+ * otherwise the rollback would be undone after maxCacheAge.
+ * the snapshot also keeps the zones outside their windows, so the tree is still rebuilt at their transitions
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+type snapshot struct {
+	ID         int
+	LoadedAt   time.Time
+	Problems   int
+	Commit     string
+	Elements   []*LookupElement
+	DefaultPAC *LookupElement
+	WPAD       *LookupElement
+	// Zones and PACs are all zones and PACs loaded, including the zones outside their windows
+	// they are nil for snapshots of older versions, see zones and pacs
+	Zones []*ipMap
+	PACs  []*pacTemplate
+	// tree is only available for snapshots loaded by this process
+	// snapshots read from disk get their tree build on rollback
+	tree *lookupTreeNode
+	// hash identifies the content, it is set by contentHash
+	hash string
+}
+
+// snapshotInfo is the summary of a snapshot used when listing them
+type snapshotInfo struct {
+	ID       int       `json:"id"`
+	LoadedAt time.Time `json:"loadedAt"`
+	Problems int       `json:"problems"`
+	Commit   string    `json:"commit,omitempty"`
+	Zones    int       `json:"zones"`
+	PACs     int       `json:"pacs"`
+	Active   bool      `json:"active"`
+}
+
+var (
+	snapshots      []*snapshot
+	activeSnapshot int
+	nextSnapshotID = 1
+	rolledBack     bool
+	snapshotLock   sync.Mutex
+)
+
+func (s *snapshot) info() snapshotInfo {
+	pacs := make(map[string]bool)
+	for _, e := range s.Elements {
+		pacs[e.PAC.Filename] = true
+	}
+	return snapshotInfo{
+		ID:       s.ID,
+		LoadedAt: s.LoadedAt,
+		Problems: s.Problems,
+		Commit:   s.Commit,
+		Zones:    len(s.Elements),
+		PACs:     len(pacs),
+		Active:   s.ID == activeSnapshot,
+	}
+}
+
+// newSnapshot captures the served data d, and the zones and pacs it was built from
+func newSnapshot(d *servedData, zones []*ipMap, pacs []*pacTemplate, problems int, commit string) *snapshot {
+	return &snapshot{
+		LoadedAt:   time.Now(),
+		Problems:   problems,
+		Commit:     commit,
+		Elements:   d.elements,
+		DefaultPAC: d.root,
+		WPAD:       d.wpad,
+		Zones:      zones,
+		PACs:       pacs,
+		tree:       d.tree,
+	}
+}
+
+// zones returns all zones of the snapshot, or the zones of its elements if it does not know them
+func (s *snapshot) zones() []*ipMap {
+	if s.Zones != nil {
+		return s.Zones
+	}
+	zones := make([]*ipMap, 0, len(s.Elements))
+	for _, e := range s.Elements {
+		zones = append(zones, e.IPMap)
+	}
+	return zones
+}
+
+// pacs returns all pacs of the snapshot, or the pacs of its elements if it does not know them
+func (s *snapshot) pacs() []*pacTemplate {
+	if s.PACs != nil {
+		return s.PACs
+	}
+	return elementPACs(s.Elements)
+}
+
+// restoreCaches replaces the cached zones and pacs by the ones of the snapshot
+// so a later partial load falls back to them, and the tree is rebuilt from them at the transitions of the zones.
+// a transition between the load of the snapshot and now is rebuilt right away.
+// the caller has to hold the treeLock
+func (s *snapshot) restoreCaches() {
+	cachedIPMaps, cachedPACs, cachedFallbackPACs = s.zones(), s.pacs(), 0
+	scheduleTransition(nextZoneTransition(cachedIPMaps, s.LoadedAt))
+}
+
+// contentHash returns the hash of the zones and PACs of the snapshot
+func (s *snapshot) contentHash() string {
+	if s.hash == "" {
+		p := s.persist()
+		// the metadata differs between loads of the same content
+		p.ID, p.LoadedAt, p.Problems, p.Commit = 0, time.Time{}, 0, ""
+		data, err := json.Marshal(p)
+		if err != nil {
+			return ""
+		}
+		sum := sha256.Sum256(data)
+		s.hash = hex.EncodeToString(sum[:])
+	}
+	return s.hash
+}
+
+// sameAs returns true if both snapshots were loaded from the same commit or have the same content
+func (s *snapshot) sameAs(other *snapshot) bool {
+	if s.Commit != "" && s.Commit == other.Commit {
+		return true
+	}
+	hash := s.contentHash()
+	return hash != "" && hash == other.contentHash()
+}
+
+// recordSnapshot adds the snapshot to the history
+// and ends a rollback, since we serve freshly loaded data again
+// if it is the same as the newest snapshot, that one is active again instead
+func recordSnapshot(s *snapshot) {
+	conf := GetConfig()
+	if conf.SnapshotHistory < 1 {
+		return
+	}
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	if len(snapshots) > 0 {
+		if newest := snapshots[len(snapshots)-1]; s.sameAs(newest) {
+			activeSnapshot = newest.ID
+			rolledBack = false
+			return
+		}
+	}
+
+	s.ID = nextSnapshotID
+	nextSnapshotID++
+	snapshots = append(snapshots, s)
+	activeSnapshot = s.ID
+	rolledBack = false
+
+	if conf.SnapshotDir != "" {
+		err := writeSnapshot(conf.SnapshotDir, s)
+		if err != nil {
+			log.Errorf("Failed to write snapshot %d to \"%s\": %s", s.ID, conf.SnapshotDir, err.Error())
+		}
+	}
+
+	// drop the oldest snapshots
+	for len(snapshots) > conf.SnapshotHistory {
+		if conf.SnapshotDir != "" {
+			err := os.Remove(snapshotPath(conf.SnapshotDir, snapshots[0].ID))
+			if err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove old snapshot %d: %s", snapshots[0].ID, err.Error())
+			}
+		}
+		snapshots = snapshots[1:]
+	}
+}
+
+func listSnapshots() []snapshotInfo {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	infos := make([]snapshotInfo, 0, len(snapshots))
+	for _, s := range snapshots {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// rollbackToSnapshot replaces the served data with the snapshot
+func rollbackToSnapshot(id int) (snapshotInfo, error) {
+	// the treeLock is always taken before the snapshotLock, like updateLookupTree does
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	var s *snapshot
+	for _, candidate := range snapshots {
+		if candidate.ID == id {
+			s = candidate
+			break
+		}
+	}
+	if s == nil {
+		return snapshotInfo{}, fmt.Errorf("unknown snapshot %d", id)
+	}
+
+	wpad := s.WPAD
+	if wpad == nil {
+		wpad = getServed().wpad
+	}
+	s.restoreCaches()
+	d := &servedData{tree: s.tree, root: s.DefaultPAC, wpad: wpad, elements: s.Elements}
+	// the snapshot may have been rendered with other proxy states
+	if rendered, n := rerenderStaleElements(d); n > 0 {
+		d = serveLookupTree(rendered)
+	} else {
+		s.tree = serveLookupTree(d).tree
+	}
+	activeSnapshot = s.ID
+	rolledBack = true
+
+	recordServed(d, s.zones(), elementPACs(s.Elements), 0, true)
+	recordCommit(s.Commit)
+	log.Warnf("Rolled back to snapshot %d loaded at %s - regular refreshes are paused until the next reload", s.ID, s.LoadedAt.Format(time.RFC3339))
+	return s.info(), nil
+}
+
+func isRolledBack() bool {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	return rolledBack
+}
+
+/**
+ * persistence
+ */
+
+// persistedSnapshot is the on-disk format of a snapshot
+// PAC templates are stored once and referenced by their filename
+type persistedSnapshot struct {
+	ID         int                `json:"id"`
+	LoadedAt   time.Time          `json:"loadedAt"`
+	Problems   int                `json:"problems"`
+	Commit     string             `json:"commit,omitempty"`
+	PACs       map[string]string  `json:"pacs"`
+	Elements   []persistedElement `json:"elements"`
+	DefaultPAC persistedElement   `json:"defaultPAC"`
+	WPAD       *persistedElement  `json:"wpad,omitempty"`
+	// Zones and PACFiles are all zones and pacs loaded, the content of the pacs is part of PACs
+	Zones    []*ipMap `json:"zones,omitempty"`
+	PACFiles []string `json:"pacFiles,omitempty"`
+}
+
+type persistedElement struct {
+	Zone    *ipMap `json:"zone"`
+	PAC     string `json:"pac"`
+	Variant string `json:"variant"`
+	// ClientVariants and ClientBuckets are only set for templates with proxy pools
+	ClientVariants []string `json:"clientVariants,omitempty"`
+	ClientBuckets  []uint8  `json:"clientBuckets,omitempty"`
+	// Canary is the canary of the zone, if any
+	Canary *persistedElement `json:"canary,omitempty"`
+}
+
+func snapshotPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("snapshot-%06d.json", id))
+}
+
+func persistElement(le *LookupElement, pacs map[string]string) persistedElement {
+	pacs[le.PAC.Filename] = le.PAC.content
+	pe := persistedElement{
+		Zone:           le.IPMap,
+		PAC:            le.PAC.Filename,
+		Variant:        le.Variant,
+		ClientVariants: le.clientVariants,
+		ClientBuckets:  le.clientBuckets,
+	}
+	if le.canary != nil {
+		canary := persistElement(le.canary, pacs)
+		pe.Canary = &canary
+	}
+	return pe
+}
+
+func (pe persistedElement) restore(pacs map[string]*pacTemplate) *LookupElement {
+	e := &LookupElement{IPMap: pe.Zone, PAC: pacs[pe.PAC], Variant: pe.Variant}
+	// a snapshot of another version might not match the buckets
+	if len(pe.ClientVariants) > 0 && len(pe.ClientBuckets) == proxyPoolBuckets {
+		e.clientVariants, e.clientBuckets = pe.ClientVariants, pe.ClientBuckets
+		for _, i := range pe.ClientBuckets {
+			if int(i) >= len(pe.ClientVariants) {
+				e.clientVariants, e.clientBuckets = nil, nil
+				break
+			}
+		}
+	}
+	if pe.Canary != nil && pe.Zone != nil && pe.Zone.Canary != nil {
+		e.canary = pe.Canary.restore(pacs)
+		e.canary.isCanary = true
+	}
+	return e
+}
+
+func writeSnapshot(dir string, s *snapshot) error {
+	return writeSnapshotFile(dir, snapshotPath(dir, s.ID), s)
+}
+
+// persist returns the snapshot in its on-disk format
+func (s *snapshot) persist() persistedSnapshot {
+	p := persistedSnapshot{
+		ID:       s.ID,
+		LoadedAt: s.LoadedAt,
+		Problems: s.Problems,
+		Commit:   s.Commit,
+		PACs:     make(map[string]string),
+		Elements: make([]persistedElement, 0, len(s.Elements)),
+	}
+	for _, e := range s.Elements {
+		p.Elements = append(p.Elements, persistElement(e, p.PACs))
+	}
+	p.Zones = s.Zones
+	for _, pac := range s.PACs {
+		p.PACs[pac.Filename] = pac.content
+		p.PACFiles = append(p.PACFiles, pac.Filename)
+	}
+	p.DefaultPAC = persistElement(s.DefaultPAC, p.PACs)
+	if s.WPAD != nil {
+		wpad := persistElement(s.WPAD, p.PACs)
+		p.WPAD = &wpad
+	}
+	return p
+}
+
+// writeSnapshotFile writes the snapshot to path, creating the dir if required
+func writeSnapshotFile(dir, path string, s *snapshot) error {
+	data, err := json.Marshal(s.persist())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first, so we never leave a half-written snapshot
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := persistedSnapshot{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	pacs := make(map[string]*pacTemplate, len(p.PACs))
+	for filename, content := range p.PACs {
+		pacs[filename] = &pacTemplate{Filename: filename, content: content}
+	}
+	if pacs[p.DefaultPAC.PAC] == nil {
+		return nil, fmt.Errorf("snapshot is missing the default PAC")
+	}
+
+	s := &snapshot{
+		ID:         p.ID,
+		LoadedAt:   p.LoadedAt,
+		Problems:   p.Problems,
+		Commit:     p.Commit,
+		Elements:   make([]*LookupElement, 0, len(p.Elements)),
+		DefaultPAC: p.DefaultPAC.restore(pacs),
+	}
+	for _, pe := range p.Elements {
+		if pacs[pe.PAC] == nil || pe.Zone == nil {
+			return nil, fmt.Errorf("snapshot element references unknown PAC \"%s\"", pe.PAC)
+		}
+		s.Elements = append(s.Elements, pe.restore(pacs))
+	}
+	if p.WPAD != nil {
+		s.WPAD = p.WPAD.restore(pacs)
+	}
+	if p.Zones != nil {
+		s.Zones = p.Zones
+		s.PACs = make([]*pacTemplate, 0, len(p.PACFiles))
+		for _, filename := range p.PACFiles {
+			if pacs[filename] != nil {
+				s.PACs = append(s.PACs, pacs[filename])
+			}
+		}
+	}
+	return s, nil
+}
+
+// loadSnapshotHistory reads all snapshots of previous runs from the snapshotDir
+func loadSnapshotHistory() {
+	conf := GetConfig()
+	if conf.SnapshotDir == "" || conf.SnapshotHistory < 1 {
+		return
+	}
+
+	entries, err := os.ReadDir(conf.SnapshotDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to read snapshot directory \"%s\": %s", conf.SnapshotDir, err.Error())
+		return
+	}
+
+	loaded := make([]*snapshot, 0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "snapshot-") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		s, err := readSnapshot(filepath.Join(conf.SnapshotDir, e.Name()))
+		if err != nil {
+			log.Warnf("Skipping broken snapshot \"%s\": %s", e.Name(), err.Error())
+			continue
+		}
+		loaded = append(loaded, s)
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ID < loaded[j].ID
+	})
+	if len(loaded) > conf.SnapshotHistory {
+		loaded = loaded[len(loaded)-conf.SnapshotHistory:]
+	}
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	snapshots = loaded
+	if len(loaded) > 0 {
+		nextSnapshotID = loaded[len(loaded)-1].ID + 1
+	}
+	log.Infof("Loaded %d snapshots from \"%s\"", len(loaded), conf.SnapshotDir)
+}
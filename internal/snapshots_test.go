@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resetSnapshots sets up an empty history and restores the globals after the test
+func resetSnapshots(t *testing.T, conf *Config) {
+	t.Helper()
+	oldConf, oldServed := confStorage, served.Load()
+	// rollbacks replace the cached zones and pacs
+	oldIPMaps, oldCachedPACs, oldFallback := cachedIPMaps, cachedPACs, cachedFallbackPACs
+	t.Cleanup(func() {
+		confStorage = oldConf
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs, cachedFallbackPACs = oldIPMaps, oldCachedPACs, oldFallback
+		snapshots, activeSnapshot, nextSnapshotID, rolledBack = nil, 0, 1, false
+	})
+	confStorage = conf
+	snapshots, activeSnapshot, nextSnapshotID, rolledBack = nil, 0, 1, false
+	root := &LookupElement{
+		IPMap:   &ipMap{},
+		PAC:     &pacTemplate{Filename: "default.pac", content: "// default by {{ .Contact }}"},
+		Variant: "// default by Test Contact",
+	}
+	served.Store(&servedData{root: root, wpad: root})
+}
+
+// loadTestSnapshot serves a tree of the elements and records it as a snapshot with the cached pacs
+func loadTestSnapshot(elements ...*LookupElement) {
+	current := getServed()
+	d := serveLookupTree(&servedData{root: current.root, wpad: current.wpad, elements: elements})
+	recordSnapshot(newSnapshot(d, nil, cachedPACs, 0, ""))
+}
+
+func TestSnapshotHistory(t *testing.T) {
+	resetSnapshots(t, &Config{DefaultPACFile: "default.pac", ContactInfo: "Test Contact", SnapshotHistory: 2})
+
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "first.pac"))
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "second.pac"))
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "third.pac"))
+
+	infos := listSnapshots()
+	if len(infos) != 2 || infos[0].ID != 2 || infos[1].ID != 3 {
+		t.Fatalf("listSnapshots() = %+v, want snapshots 2 and 3", infos)
+	}
+	if !infos[1].Active {
+		t.Errorf("the latest snapshot should be active")
+	}
+
+	if _, err := rollbackToSnapshot(1); err == nil {
+		t.Errorf("rollbackToSnapshot(1) expected an error for a dropped snapshot")
+	}
+
+	info, err := rollbackToSnapshot(2)
+	if err != nil {
+		t.Fatalf("rollbackToSnapshot(2) unexpected error: %v", err)
+	}
+	if !info.Active || !isRolledBack() {
+		t.Errorf("expected snapshot 2 to be active and rolled back")
+	}
+	pac, _ := findInTree(getServed().tree, createIPNet("10.1.2.3", 32))
+	if pac.IPMap.Filename != "second.pac" {
+		t.Errorf("after rollback findInTree() = %s, want second.pac", pac.IPMap.Filename)
+	}
+
+	// the regular refresh is paused while rolled back
+	if problems := refreshLookupTree(); problems != 0 || getServed().tree == nil {
+		t.Errorf("refreshLookupTree() should be skipped while rolled back")
+	}
+
+	// a new load ends the rollback
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "fourth.pac"))
+	if isRolledBack() {
+		t.Errorf("recording a new snapshot should end the rollback")
+	}
+
+	// the same content as the newest snapshot makes it active again instead of adding one
+	if _, err := rollbackToSnapshot(3); err != nil {
+		t.Fatalf("rollbackToSnapshot(3) unexpected error: %v", err)
+	}
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "fourth.pac"))
+	if infos = listSnapshots(); len(infos) != 2 || infos[1].ID != 4 || !infos[1].Active || isRolledBack() {
+		t.Errorf("listSnapshots() = %+v, want snapshot 4 active again", infos)
+	}
+	// so does the same commit, even if the content differs
+	d := getServed()
+	recordSnapshot(newSnapshot(&servedData{root: d.root, wpad: d.wpad}, nil, nil, 0, "abc123"))
+	recordSnapshot(newSnapshot(d, nil, nil, 1, "abc123"))
+	if infos = listSnapshots(); len(infos) != 2 || infos[1].ID != 5 || infos[1].Commit != "abc123" {
+		t.Errorf("listSnapshots() = %+v, want a single snapshot 5 of the commit", infos)
+	}
+}
+
+func TestSnapshotPersistence(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	conf := &Config{DefaultPACFile: "default.pac", ContactInfo: "Test Contact", SnapshotHistory: 2, SnapshotDir: dir}
+	resetSnapshots(t, conf)
+
+	loadTestSnapshot(createLookupElement("10.43.0.0", 16, "germany.pac"))
+	zone := createLookupElement("10.0.0.0", 8, "second.pac")
+	zone.IPMap.Comment = "the whole company"
+	loadTestSnapshot(zone)
+	loadTestSnapshot(createLookupElement("10.0.0.0", 8, "third.pac"))
+
+	// only the last two snapshots are kept on disk
+	if _, err := os.Stat(snapshotPath(dir, 1)); !os.IsNotExist(err) {
+		t.Errorf("snapshot 1 should have been removed from disk")
+	}
+	// a broken snapshot must not stop loading the others
+	writeTestFile(t, snapshotPath(dir, 99)+".json", "{")
+	writeTestFile(t, filepath.Join(dir, "snapshot-000004.json"), "{")
+
+	// simulate a restart
+	resetSnapshots(t, conf)
+	loadSnapshotHistory()
+
+	infos := listSnapshots()
+	if len(infos) != 2 || infos[0].ID != 2 || infos[1].ID != 3 {
+		t.Fatalf("listSnapshots() after restart = %+v, want snapshots 2 and 3", infos)
+	}
+	if nextSnapshotID != 4 {
+		t.Errorf("nextSnapshotID = %d, want 4", nextSnapshotID)
+	}
+
+	if _, err := rollbackToSnapshot(2); err != nil {
+		t.Fatalf("rollbackToSnapshot(2) unexpected error: %v", err)
+	}
+	pac, _ := findInTree(getServed().tree, createIPNet("10.1.2.3", 32))
+	if pac.IPMap.Filename != "second.pac" || pac.Variant != "// Test PAC file" {
+		t.Errorf("after rollback findInTree() = %s %q, want second.pac", pac.IPMap.Filename, pac.Variant)
+	}
+	if root := getServed().root; root.PAC.content != "// default by {{ .Contact }}" {
+		t.Errorf("default PAC template was not restored: %q", root.PAC.content)
+	}
+
+	// metadata of the zones survives the roundtrip
+	s, err := readSnapshot(snapshotPath(dir, 2))
+	if err != nil {
+		t.Fatalf("readSnapshot() unexpected error: %v", err)
+	}
+	if len(s.Elements) != 1 || !s.Elements[0].IPMap.IPNet.IsIdentical(*createIPNet("10.0.0.0", 8)) || s.Elements[0].IPMap.Comment != "the whole company" {
+		t.Errorf("readSnapshot() elements = %+v", s.Elements)
+	}
+
+	// so do the zones and pacs that are not served, e.g. a zone outside its window
+	upcoming := createLookupElement("10.1.0.0", 16, "upcoming.pac")
+	s.Zones, s.PACs = append(s.zones(), upcoming.IPMap), append(s.pacs(), upcoming.PAC)
+	if err := writeSnapshot(dir, s); err != nil {
+		t.Fatalf("writeSnapshot() unexpected error: %v", err)
+	}
+	if s, err = readSnapshot(snapshotPath(dir, 2)); err != nil {
+		t.Fatalf("readSnapshot() unexpected error: %v", err)
+	}
+	if len(s.Elements) != 1 || len(s.zones()) != 2 || len(s.pacs()) != 2 || s.pacs()[1].content != upcoming.PAC.content {
+		t.Errorf("readSnapshot() = %d elements, zones %v, pacs %v", len(s.Elements), s.zones(), s.pacs())
+	}
+}
+
+func TestSnapshotsOfReloads(t *testing.T) {
+	oldZones, oldPACs := zoneProvider, pacProvider
+	oldIPMaps, oldCachedPACs := cachedIPMaps, cachedPACs
+	defer func() {
+		zoneProvider, pacProvider = oldZones, oldPACs
+		cachedIPMaps, cachedPACs = oldIPMaps, oldCachedPACs
+		currentStatus = reloadStatus{}
+	}()
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	resetSnapshots(t, &Config{
+		DefaultPACFile:  filepath.Join(dir, "default.pac"),
+		WPADFile:        filepath.Join(dir, "wpad.dat"),
+		ContactInfo:     "Test Contact",
+		SnapshotHistory: 10,
+	})
+
+	good := createLookupElement("10.0.0.0", 8, "good.pac")
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{good.IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{good.PAC}}
+	updateLookupTree()
+	if _, err := rollbackToSnapshot(1); err != nil {
+		t.Fatalf("rollbackToSnapshot(1) unexpected error: %v", err)
+	}
+
+	// a load with problems is served, so it is recorded with them and ends the rollback
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{createLookupElement("10.0.0.0", 8, "missing.pac").IPMap}, problems: 1}
+	updateLookupTree()
+	if infos := listSnapshots(); len(infos) != 2 || infos[1].Problems == 0 || !infos[1].Active {
+		t.Errorf("listSnapshots() = %+v, want the load with problems as second, active snapshot", infos)
+	}
+	if isRolledBack() {
+		t.Errorf("a load with problems should end the rollback")
+	}
+	// loading the same content again does not add another snapshot
+	updateLookupTree()
+	if infos := listSnapshots(); len(infos) != 2 || !infos[1].Active {
+		t.Errorf("listSnapshots() = %+v, want no snapshot for the same content", infos)
+	}
+
+	// rollbacks and reloads swap the served data concurrently
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{good.IPMap}}
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		for i := 0; i < 20; i++ {
+			if _, err := rollbackToSnapshot(1); err != nil {
+				t.Errorf("rollbackToSnapshot(1) unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		updateLookupTree()
+	}
+	<-done
+	if d := getServed(); d.tree == nil || d.root == nil || d.wpad == nil {
+		t.Errorf("served data is incomplete: %+v", d)
+	}
+	if infos := listSnapshots(); len(infos) != 3 {
+		t.Errorf("listSnapshots() = %+v, want a single snapshot of the repeated reloads", infos)
+	}
+}
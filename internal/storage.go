@@ -9,49 +9,98 @@ package internal
  */
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2/log"
 )
 
-var lookupTree *lookupTreeNode
-var wpadPAC *LookupElement
-var rootPAC *LookupElement
+// servedData is everything required to serve clients
+// it is only replaced as a whole, so a request never mixes the tree of one load with the default PAC of another
+type servedData struct {
+	tree *lookupTreeNode
+	// root is the default PAC, the root of the tree is rendered from it
+	root *LookupElement
+	wpad *LookupElement
+	// elements are the elements the tree was built from
+	elements []*LookupElement
+}
+
+// served is the data currently served, see getServed
+var served atomic.Pointer[servedData]
+
+// treeLock serializes loading and replacing the served data
+var treeLock sync.Mutex
+
+// getServed returns the data currently served
+// it is empty until the first load
+func getServed() *servedData {
+	if d := served.Load(); d != nil {
+		return d
+	}
+	return &servedData{}
+}
 
 // InitCaches does an initial fetch of all Zones and PAC Files
 // this differs from the automated lookup in that it also errors out when minor problems are found
 func InitCaches() error {
 	config := GetConfig()
+	initLookupCache(config.LookupCacheSize, config.LookupCachePrefix)
+	initRequestStats(config.ZoneMetricsLimit, config.TopClientSubnets)
+	// snapshots of previous runs are available for rollbacks
+	loadSnapshotHistory()
 	problemCounter := updateLookupTree()
 	if problemCounter > 0 {
 		log.Errorf("There were %d minor problems while initialising caches. Please check the logs for details.", problemCounter)
-		if !config.IgnoreMinors {
+		// rather serve the last known good data than nothing or a degraded tree
+		if bootFromLastKnownGood() {
+			problemCounter = 0
+		} else if getServed().tree == nil {
+			return errors.New("unable to build a lookup tree without the default PAC - exiting")
+		} else if !config.IgnoreMinors {
 			return errors.New("zones or pac files includes errors - exiting")
 		}
 	}
+	// overrides are restored once the pacs they serve are loaded
+	loadOverrides()
 	log.Info("Finished initial loading of IPMap and PACs - starting")
+	markInitialised(config.IPMapFile != "")
 
 	// start a regular task to refresh the lookup tree
-	if config.MaxCacheAge > 0 {
-		go executeRegular(updateLookupTree)
-	}
+	// it also rebuilds the tree from the cached zones whenever a scheduled zone becomes active or inactive
+	go executeRegular(refreshLookupTree, rebuildLookupTree, time.Duration(config.MaxCacheAge)*time.Second)
 
 	return nil
 }
 
-func loadDefaults() int {
+// loadDefaults (re)loads the default PAC and the WPAD file
+// they are read from pacs if it is a defaultsProvider, e.g. a git commit, and from the filesystem otherwise
+// the ones of current are kept if they fail to load
+// it returns both, the amount of problems found and if the default PAC was loaded
+func loadDefaults(pacs PACProvider, current *servedData) (*LookupElement, *LookupElement, int, bool) {
 	config := GetConfig()
+	read := func(file string) (*pacTemplate, error) {
+		return readAndParse(".", file)
+	}
+	if p, ok := pacs.(defaultsProvider); ok {
+		read = p.LoadDefault
+	}
 
+	root, wpad := current.root, current.wpad
 	problemCounter := 0
+	defaultLoaded := false
 	log.Debugf("Trying to load default PAC (%s) and WPAD (%s)", config.DefaultPACFile, config.WPADFile)
 
-	rawDefault, err1 := readAndParse(".", config.DefaultPACFile)
+	rawDefault, err1 := read(config.DefaultPACFile)
 	if err1 == nil {
 		newRootPAC, err2 := NewLookupElement(&ipMap{}, rawDefault, config.ContactInfo)
 		if err2 == nil {
-			// assign to cached root pac if successful
-			rootPAC = &newRootPAC
+			// replace the cached root pac if successful
+			root = &newRootPAC
+			defaultLoaded = true
 		} else {
 			problemCounter++
 			log.Errorf("Failed to parse Default PAC File \"%s\": %s", config.DefaultPACFile, err2.Error())
@@ -61,12 +110,12 @@ func loadDefaults() int {
 		log.Errorf("Failed to read Default PAC File \"%s\": %s", config.DefaultPACFile, err1.Error())
 	}
 
-	rawWPAD, err1 := readAndParse(".", config.WPADFile)
+	rawWPAD, err1 := read(config.WPADFile)
 	if err1 == nil {
 		newWPAD, err2 := NewLookupElement(&ipMap{}, rawWPAD, config.ContactInfo)
 		if err2 == nil {
-			// assign to cached wpad if successful
-			wpadPAC = &newWPAD
+			// replace the cached wpad if successful
+			wpad = &newWPAD
 		} else {
 			problemCounter++
 			log.Errorf("Failed to parse WPAD File \"%s\": %s", config.WPADFile, err2.Error())
@@ -76,26 +125,157 @@ func loadDefaults() int {
 		log.Errorf("Failed to read WPAD File \"%s\": %s", config.WPADFile, err1.Error())
 	}
 
-	return problemCounter
+	return root, wpad, problemCounter, defaultLoaded
 }
 
-func executeRegular(task func() int) {
-	tick := time.Tick(time.Duration(GetConfig().MaxCacheAge) * time.Second)
-	for range tick {
-		log.Infof("Max Cache Age reached - Refreshing Lookup Tree")
-		task()
+// executeRegular runs refresh every interval (if > 0) and rebuild at every transition of the zones
+func executeRegular(refresh func() int, rebuild func(), interval time.Duration) {
+	nextRefresh := time.Now().Add(interval)
+	for {
+		wake, isTransition := nextRefresh, false
+		if t := getNextTransition(); t != nil && (interval <= 0 || t.Before(wake)) {
+			wake, isTransition = *t, true
+		} else if interval <= 0 {
+			// nothing to do until a reload schedules a transition
+			<-transitionChanged
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-transitionChanged:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		if isTransition {
+			log.Infof("Zones change at %s - Rebuilding Lookup Tree", wake.Format(time.RFC3339))
+			rebuild()
+			clearPastTransition(time.Now())
+		} else {
+			log.Infof("Max Cache Age reached - Refreshing Lookup Tree")
+			refresh()
+			nextRefresh = time.Now().Add(interval)
+		}
 	}
 }
 
+// serveLookupTree replaces the served data, the tree is built if it is nil
+// the overrides are rendered again, so they serve the PACs loaded with it
+// the caller has to hold the treeLock
+func serveLookupTree(d *servedData) *servedData {
+	if d.tree == nil {
+		d.tree = buildLookupTree(d.root, d.elements)
+	}
+	served.Store(d)
+	resetLookupCache()
+	refreshOverrides()
+	return d
+}
+
+// refreshLookupTree is the regular refresh
+// it is skipped while we are rolled back to a snapshot
+func refreshLookupTree() int {
+	if isRolledBack() {
+		log.Warnf("Skipping refresh since a snapshot was rolled back - reload to resume refreshing")
+		return 0
+	}
+	return updateLookupTree()
+}
+
+// rebuildLookupTree builds the tree again from the cached zones and pacs, at the transitions of the zones
+// the sources are not read, so the zones also change on time while rolled back or while a source is broken
+func rebuildLookupTree() {
+	config := GetConfig()
+	now := time.Now()
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	current := getServed()
+	if current.root == nil {
+		// nothing is served yet
+		return
+	}
+	scheduleTransition(nextZoneTransition(cachedIPMaps, now))
+	// the cached pacs already contain the ones kept from earlier loads
+	table, _, _ := matchIPMapToPac(cachedPACs, nil, filterActiveZones(cachedIPMaps, now), config.ContactInfo)
+	table, conflicts, rejected := resolveDuplicateZones(table, config.DuplicateZones)
+	if rejected {
+		log.Errorf("Found %d conflicting zones - keep serving the current tree", conflicts)
+		return
+	}
+	d := serveLookupTree(&servedData{root: current.root, wpad: current.wpad, elements: table})
+	log.Infof("The following LookupTree was rebuilt:\n%s", stringifyLookupTree(d.tree))
+	recordServed(d, cachedIPMaps, cachedPACs, cachedFallbackPACs, getReloadStatus().DefaultPACLoaded)
+}
+
 func updateLookupTree() int {
 	config := GetConfig()
+	now := time.Now()
+	ctx, span := tracer.Start(context.Background(), "updateLookupTree")
+	// recordLoad is called on every path, so the span gets the outcome of the load
+	// the served data is only recorded by recordServed if the load replaced it
+	defer endReloadSpan(span)
+	// nothing else may replace the served data while we load, it would be overwritten by our swap
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	current := getServed()
+	// a load that is not served must not replace the zones and pacs the served tree is rebuilt from
+	oldIPMaps, oldPACs, oldFallbackPACs := cachedIPMaps, cachedPACs, cachedFallbackPACs
+	zones, pacs := getProviders(config)
 	// reload default PACs
-	minorProblems1 := loadDefaults()
+	root, wpad, defaultProblems, defaultLoaded := loadDefaults(pacs, current)
 	// first we build a "flat" lookup element list
 	// this maps IPMap to PAC
-	table, minorProblems2 := buildLookupElementList(config.IPMapFile, config.PACRoot, config.ContactInfo)
+	table, loaded := buildLookupElementList(ctx, zones, pacs, config.ContactInfo, config.DuplicateZones, now)
+	loaded.Defaults = defaultProblems
+	problems := loaded.total()
+	if problems > 0 && !config.IgnoreMinors && isServingLastKnownGood() {
+		// only replace the last known good snapshot (including its defaults) by a load without problems
+		// unless minor problems are ignored, like they are for the served tree
+		log.Warnf("Zones and PACs still have %d problems - keep serving the last known good snapshot", problems)
+		cachedIPMaps, cachedPACs, cachedFallbackPACs = oldIPMaps, oldPACs, oldFallbackPACs
+		recordLoad(reloadFailed, now, loaded)
+		return problems
+	}
+	if root == nil {
+		// the tree can not be built without a default PAC
+		// this only happens if it failed to load since the start
+		log.Errorf("No default PAC loaded - unable to build the lookup tree")
+		recordLoad(reloadFailed, now, loaded)
+		return problems
+	}
+	if table == nil && current.tree != nil {
+		// neither zones nor pacs could be loaded (or the zones were rejected), keep serving the current tree
+		recordLoad(reloadFailed, now, loaded)
+		return problems
+	}
 	// then we build an optimized lookup tree to faster serve clients
-	lookupTree = buildLookupTree(table)
-	log.Infof("The following LookupTree was loaded:\n%s", stringifyLookupTree(lookupTree))
-	return minorProblems1 + minorProblems2
+	d := serveLookupTree(&servedData{
+		tree:     traceBuildLookupTree(ctx, root, table),
+		root:     root,
+		wpad:     wpad,
+		elements: table,
+	})
+	scheduleTransition(nextZoneTransition(cachedIPMaps, now))
+	log.Infof("The following LookupTree was loaded:\n%s", stringifyLookupTree(d.tree))
+	recordServed(d, cachedIPMaps, cachedPACs, cachedFallbackPACs, defaultLoaded)
+	if problems > 0 {
+		recordLoad(reloadDegraded, now, loaded)
+	} else {
+		recordLoad(reloadSuccess, now, loaded)
+	}
+	commit := ""
+	if src, ok := zones.(committedProvider); ok && src.Commit() != "" {
+		commit = src.Commit()
+		recordCommit(commit)
+	}
+	// every served load can be rolled back to, only clean loads are the last known good
+	s := newSnapshot(d, cachedIPMaps, cachedPACs, problems, commit)
+	recordSnapshot(s)
+	if problems == 0 {
+		saveLastKnownGood(s)
+	}
+	leaveLastKnownGood()
+	return problems
 }
@@ -0,0 +1,308 @@
+package internal
+
+/**
+ * telemetry exports traces and metrics to an OpenTelemetry collector via OTLP (gRPC or HTTP)
+ *
+ * it is disabled unless otlpEndpoint is set.
+ * the exported metrics are the ones of the prometheus registry, bridged to OTLP,
+ * so the collector receives the same values a scrape would.
+ *
+ * spans are recorded for
+ * - the handling of requests, with the zone and PAC served and a child span for the lookup (findPAC)
+ * - reloads (updateLookupTree), with the problems by category and child spans
+ *   for loading the zones (readIPMap) and PACs (readTemplateFiles) and for building the tree (buildLookupTree)
+ *
+ * the request path only touches the tracer if tracing is enabled, so it does not allocate otherwise
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/timeforaninja/pacserver/pkg/IP"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// protocols of the OTLP exporters
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http"
+)
+
+// instrumentationName identifies the spans of the server
+const instrumentationName = "github.com/timeforaninja/pacserver"
+
+var (
+	// tracer is a no-op until StartTelemetry is called
+	tracer trace.Tracer = noop.NewTracerProvider().Tracer(instrumentationName)
+	// tracingEnabled is checked on the request path before touching the tracer
+	tracingEnabled bool
+	// telemetryShutdown flushes and stops the exporters
+	telemetryShutdown []func(context.Context) error
+	telemetryLock     sync.Mutex
+)
+
+// StartTelemetry starts the OTLP exporters configured in the config, if any
+func StartTelemetry() error {
+	conf := GetConfig()
+	if conf.OTLPEndpoint == "" {
+		return nil
+	}
+	ctx := context.Background()
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("pacserver")),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to describe the service: %s", err.Error())
+	}
+
+	traceExporter, err := newTraceExporter(ctx, conf)
+	if err != nil {
+		return fmt.Errorf("unable to create the OTLP trace exporter: %s", err.Error())
+	}
+	traceProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+		// incoming requests that were sampled upstream are sampled as well
+		sdktrace.WithSampler(sdktrace.ParentBased(requestSampler{ratio: sdktrace.TraceIDRatioBased(conf.OTLPTraceRatio)})),
+	)
+	shutdown := []func(context.Context) error{traceProvider.Shutdown}
+
+	if conf.OTLPMetricsInterval > 0 {
+		metricExporter, err := newMetricExporter(ctx, conf)
+		if err != nil {
+			_ = traceProvider.Shutdown(ctx)
+			return fmt.Errorf("unable to create the OTLP metric exporter: %s", err.Error())
+		}
+		reader := sdkmetric.NewPeriodicReader(metricExporter,
+			sdkmetric.WithInterval(time.Duration(conf.OTLPMetricsInterval)*time.Second),
+			sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(prometheus.GathererFunc(gatherServedMetrics)))),
+		)
+		meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+		shutdown = append(shutdown, meterProvider.Shutdown)
+	}
+
+	telemetryLock.Lock()
+	defer telemetryLock.Unlock()
+	tracer = traceProvider.Tracer(instrumentationName)
+	tracingEnabled = true
+	telemetryShutdown = shutdown
+	log.Infof("Exporting traces and metrics via OTLP/%s to %s", conf.OTLPProtocol, conf.OTLPEndpoint)
+	return nil
+}
+
+// ShutdownTelemetry exports the remaining spans and metrics and stops the exporters
+func ShutdownTelemetry(ctx context.Context) error {
+	telemetryLock.Lock()
+	defer telemetryLock.Unlock()
+	var errs []error
+	for _, shutdown := range telemetryShutdown {
+		errs = append(errs, shutdown(ctx))
+	}
+	tracer = noop.NewTracerProvider().Tracer(instrumentationName)
+	tracingEnabled = false
+	telemetryShutdown = nil
+	return errors.Join(errs...)
+}
+
+// requestSampler samples a share of the requests, but every reload
+type requestSampler struct {
+	ratio sdktrace.Sampler
+}
+
+func (s requestSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Kind == trace.SpanKindServer {
+		return s.ratio.ShouldSample(p)
+	}
+	return sdktrace.AlwaysSample().ShouldSample(p)
+}
+
+func (s requestSampler) Description() string {
+	return "RequestSampler{" + s.ratio.Description() + "}"
+}
+
+func newTraceExporter(ctx context.Context, conf *Config) (sdktrace.SpanExporter, error) {
+	if conf.OTLPProtocol == OTLPProtocolHTTP {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.OTLPEndpoint)}
+		if conf.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(conf.OTLPEndpoint)}
+	if conf.OTLPInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func newMetricExporter(ctx context.Context, conf *Config) (sdkmetric.Exporter, error) {
+	if conf.OTLPProtocol == OTLPProtocolHTTP {
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(conf.OTLPEndpoint)}
+		if conf.OTLPInsecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(conf.OTLPEndpoint)}
+	if conf.OTLPInsecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// fiberCarrier reads and writes the trace context from and to the headers of a request
+type fiberCarrier struct {
+	c *fiber.Ctx
+}
+
+func (fc fiberCarrier) Get(key string) string {
+	return fc.c.Get(key)
+}
+
+func (fc fiberCarrier) Set(key, value string) {
+	fc.c.Request().Header.Set(key, value)
+}
+
+func (fc fiberCarrier) Keys() []string {
+	keys := make([]string, 0)
+	fc.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// tracingMiddleware records a span for each request of the routes after it
+// the span continues the trace of the client, if it sent a traceparent header
+func tracingMiddleware(c *fiber.Ctx) error {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), fiberCarrier{c})
+	ctx, span := tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	route := routeOf(c)
+	status := responseStatus(c, err)
+	span.SetName(c.Method() + " " + route)
+	span.SetAttributes(
+		semconv.HTTPRequestMethodKey.String(c.Method()),
+		semconv.HTTPRoute(route),
+		semconv.ClientAddress(c.IP()),
+		semconv.HTTPResponseStatusCode(status),
+		semconv.UserAgentOriginal(c.Get(fiber.HeaderUserAgent)),
+	)
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+// traceLookup starts the span of findPAC as a child of the request span
+func traceLookup(c *fiber.Ctx, ip IP.IP, networkBits int) trace.Span {
+	_, span := tracer.Start(c.UserContext(), "findPAC", trace.WithAttributes(
+		attribute.String("pacserver.lookup.ip", ip.ToString()),
+		attribute.Int("pacserver.lookup.cidr", networkBits),
+		attribute.Bool("pacserver.lookup.cached", clientLookupCache != nil && networkBits == 32),
+	))
+	return span
+}
+
+// endLookup ends the span of findPAC with the zone found
+func endLookup(span trace.Span, pac *LookupElement, found bool) {
+	if !found {
+		span.SetStatus(codes.Error, "invalid network, serving the default PAC")
+	}
+	span.SetAttributes(zoneAttributes(pac)...)
+	span.End()
+}
+
+// traceServedPAC adds the zone and PAC served to the request span
+func traceServedPAC(c *fiber.Ctx, pac *LookupElement, debug bool) {
+	span := trace.SpanFromContext(c.UserContext())
+	span.SetAttributes(zoneAttributes(pac)...)
+	span.SetAttributes(attribute.Bool("pacserver.debug", debug))
+}
+
+func zoneAttributes(pac *LookupElement) []attribute.KeyValue {
+	if pac == nil || pac.IPMap == nil {
+		return []attribute.KeyValue{attribute.String("pacserver.pac", "default")}
+	}
+	variant := "stable"
+	if pac.isCanary {
+		variant = "canary"
+	}
+	return []attribute.KeyValue{
+		attribute.String("pacserver.zone", pac.IPMap.IPNet.ToString()),
+		attribute.String("pacserver.pac", pac.IPMap.Filename),
+		attribute.String("pacserver.variant", variant),
+	}
+}
+
+// traceLoad starts a child span of a reload around loading the zones or PACs
+func traceLoad(ctx context.Context, name string) trace.Span {
+	_, span := tracer.Start(ctx, name)
+	return span
+}
+
+// endLoad ends the span of loading count zones or PACs
+func endLoad(span trace.Span, count, problems int, err error) {
+	span.SetAttributes(attribute.Int("pacserver.loaded", count), attribute.Int("pacserver.problems", problems))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceBuildLookupTree builds the lookup tree of the elements in a child span of the reload
+func traceBuildLookupTree(ctx context.Context, defaultPAC *LookupElement, elements []*LookupElement) *lookupTreeNode {
+	_, span := tracer.Start(ctx, "buildLookupTree")
+	defer span.End()
+	tree := buildLookupTree(defaultPAC, elements)
+	span.SetAttributes(attribute.Int("pacserver.zones", len(elements)), attribute.Int("pacserver.tree_depth", treeDepth(tree)))
+	return tree
+}
+
+// endReloadSpan ends the span of a reload with the outcome recorded by recordLoad
+func endReloadSpan(span trace.Span) {
+	stats := getReloadStatus()
+	span.SetAttributes(
+		attribute.String("pacserver.reload.result", stats.Result),
+		attribute.Int("pacserver.zones", stats.Zones),
+		attribute.Int("pacserver.pacs", stats.PACs),
+		attribute.Int("pacserver.pacs_cached_fallback", stats.CachedPACs),
+		attribute.Int("pacserver.problems", stats.Problems.total()),
+	)
+	for category, count := range stats.Problems.byCategory() {
+		span.SetAttributes(attribute.Int("pacserver.problems."+category, int(count)))
+	}
+	if stats.Result == reloadFailed {
+		span.SetStatus(codes.Error, "the previous lookup tree is kept")
+	}
+	span.End()
+}
@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStandIn receives OTLP like a local OpenTelemetry collector
+type collectorStandIn struct {
+	lock    sync.Mutex
+	spans   []*tracepb.Span
+	metrics []string
+}
+
+func (s *collectorStandIn) addSpans(req *coltracepb.ExportTraceServiceRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			s.spans = append(s.spans, ss.Spans...)
+		}
+	}
+}
+
+func (s *collectorStandIn) addMetrics(req *colmetricpb.ExportMetricsServiceRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				s.metrics = append(s.metrics, m.Name)
+			}
+		}
+	}
+}
+
+// span returns the first span received with the name
+func (s *collectorStandIn) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.spans))
+	for _, span := range s.spans {
+		if span.Name == name {
+			return span
+		}
+		names = append(names, span.Name)
+	}
+	t.Fatalf("no span %q received, only %v", name, names)
+	return nil
+}
+
+type grpcTraceService struct {
+	coltracepb.UnimplementedTraceServiceServer
+	collector *collectorStandIn
+}
+
+func (g grpcTraceService) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	g.collector.addSpans(req)
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type grpcMetricsService struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	collector *collectorStandIn
+}
+
+func (g grpcMetricsService) Export(_ context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	g.collector.addMetrics(req)
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+// startCollector starts a collector stand-in for the protocol and returns its endpoint
+func startCollector(t *testing.T, protocol string) (*collectorStandIn, string) {
+	t.Helper()
+	collector := &collectorStandIn{}
+	if protocol == OTLPProtocolGRPC {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() unexpected error: %v", err)
+		}
+		server := grpc.NewServer()
+		coltracepb.RegisterTraceServiceServer(server, grpcTraceService{collector: collector})
+		colmetricpb.RegisterMetricsServiceServer(server, grpcMetricsService{collector: collector})
+		go func() { _ = server.Serve(listener) }()
+		t.Cleanup(server.Stop)
+		return collector, listener.Addr().String()
+	}
+
+	mux := http.NewServeMux()
+	receive := func(req proto.Message, add func()) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil || proto.Unmarshal(body, req) != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			add()
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	traces := &coltracepb.ExportTraceServiceRequest{}
+	mux.HandleFunc("/v1/traces", receive(traces, func() { collector.addSpans(traces) }))
+	metrics := &colmetricpb.ExportMetricsServiceRequest{}
+	mux.HandleFunc("/v1/metrics", receive(metrics, func() { collector.addMetrics(metrics) }))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return collector, strings.TrimPrefix(server.URL, "http://")
+}
+
+// spanAttribute returns the value of the attribute of the span as a string
+func spanAttribute(span *tracepb.Span, key string) string {
+	for _, kv := range span.Attributes {
+		if kv.Key != key {
+			continue
+		}
+		switch v := kv.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			return v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			return strconv.FormatInt(v.IntValue, 10)
+		}
+	}
+	return ""
+}
+
+func TestTelemetryExport(t *testing.T) {
+	oldConf, oldZones, oldPACs := confStorage, zoneProvider, pacProvider
+	oldServed := served.Load()
+	oldIPMaps, oldCachedPACs, oldFallback := cachedIPMaps, cachedPACs, cachedFallbackPACs
+	defer func() {
+		confStorage, zoneProvider, pacProvider = oldConf, oldZones, oldPACs
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs, cachedFallbackPACs = oldIPMaps, oldCachedPACs, oldFallback
+		currentStatus = reloadStatus{}
+		servedRegistry = nil
+	}()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	elements := webserverTestZones()
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{elements[0].IPMap, elements[1].IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{elements[0].PAC, elements[1].PAC}}
+
+	for _, protocol := range []string{OTLPProtocolGRPC, OTLPProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			collector, endpoint := startCollector(t, protocol)
+			confStorage = &Config{
+				DefaultPACFile:      filepath.Join(dir, "default.pac"),
+				WPADFile:            filepath.Join(dir, "wpad.dat"),
+				ContactInfo:         "Test Contact",
+				OTLPEndpoint:        endpoint,
+				OTLPProtocol:        protocol,
+				OTLPInsecure:        true,
+				OTLPTraceRatio:      1,
+				OTLPMetricsInterval: 60,
+			}
+			resetServedData()
+			if err := StartTelemetry(); err != nil {
+				t.Fatalf("StartTelemetry() unexpected error: %v", err)
+			}
+			defer func() { _ = ShutdownTelemetry(context.Background()) }()
+
+			updateLookupTree()
+			app := fiber.New()
+			trackPac := setupPrometheus(app)
+			app.Use(tracingMiddleware)
+			registerPACRoutes(app, trackPac)
+			ctx := newRequest("/", net.ParseIP("10.1.2.3"))
+			traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+			ctx.Request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			app.Handler()(ctx)
+
+			// shutting down exports the remaining spans and metrics
+			if err := ShutdownTelemetry(context.Background()); err != nil {
+				t.Fatalf("ShutdownTelemetry() unexpected error: %v", err)
+			}
+			if tracingEnabled {
+				t.Errorf("tracing is still enabled after ShutdownTelemetry()")
+			}
+
+			reload := collector.span(t, "updateLookupTree")
+			if got := spanAttribute(reload, "pacserver.reload.result"); got != reloadSuccess {
+				t.Errorf("updateLookupTree pacserver.reload.result = %q, want %q", got, reloadSuccess)
+			}
+			if got := spanAttribute(reload, "pacserver.zones"); got != "2" {
+				t.Errorf("updateLookupTree pacserver.zones = %q, want 2", got)
+			}
+			if got := spanAttribute(reload, "pacserver.problems.matching"); got != "0" {
+				t.Errorf("updateLookupTree pacserver.problems.matching = %q, want 0", got)
+			}
+			for _, name := range []string{"readIPMap", "readTemplateFiles", "buildLookupTree"} {
+				if child := collector.span(t, name); string(child.ParentSpanId) != string(reload.SpanId) {
+					t.Errorf("%s is not a child span of updateLookupTree", name)
+				}
+			}
+			if got := spanAttribute(collector.span(t, "readIPMap"), "pacserver.loaded"); got != "2" {
+				t.Errorf("readIPMap pacserver.loaded = %q, want 2", got)
+			}
+
+			request := collector.span(t, "GET /")
+			if got := hex.EncodeToString(request.TraceId); got != traceID {
+				t.Errorf("GET / trace id = %s, want the one of the traceparent %s", got, traceID)
+			}
+			if spanAttribute(request, "pacserver.zone") != "10.1.2.0/24" || spanAttribute(request, "pacserver.pac") != "office.pac" {
+				t.Errorf("GET / attributes = %v, want the zone and PAC served", request.Attributes)
+			}
+			if got := spanAttribute(request, "http.response.status_code"); got != "200" {
+				t.Errorf("GET / http.response.status_code = %q, want 200", got)
+			}
+			lookup := collector.span(t, "findPAC")
+			if string(lookup.ParentSpanId) != string(request.SpanId) || spanAttribute(lookup, "pacserver.zone") != "10.1.2.0/24" {
+				t.Errorf("findPAC is not a child span of the request or misses its zone: %v", lookup.Attributes)
+			}
+
+			collector.lock.Lock()
+			defer collector.lock.Unlock()
+			exported := strings.Join(collector.metrics, " ")
+			for _, want := range []string{"app_reloads", "app_pac_file", "app_response_time_hist_seconds"} {
+				if !strings.Contains(exported, want) {
+					t.Errorf("the metrics exported do not include %s: %s", want, exported)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestSampler(t *testing.T) {
+	t.Parallel()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(requestSampler{ratio: sdktrace.TraceIDRatioBased(0)})),
+	)
+	tr := provider.Tracer(instrumentationName)
+
+	_, request := tr.Start(context.Background(), "GET /", trace.WithSpanKind(trace.SpanKindServer))
+	request.End()
+	ctx, reload := tr.Start(context.Background(), "updateLookupTree")
+	_, child := tr.Start(ctx, "readIPMap")
+	child.End()
+	reload.End()
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+	if strings.Join(names, ",") != "readIPMap,updateLookupTree" {
+		t.Errorf("a ratio of 0 exported %v, want the reload only", names)
+	}
+}
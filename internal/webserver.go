@@ -3,10 +3,12 @@ package internal
 /**
  * the webserver includes everything required for the webserver
  * this means creation of the webserver, registering routes,
- * and the main "getFileForIP" function to reply to user requests
+ * and the main "serveFromIPNet" function to reply to user requests
  */
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -17,8 +19,9 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/compress"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	fiberUtils "github.com/gofiber/fiber/v2/utils"
 	"github.com/timeforaninja/pacserver/pkg/IP"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func LaunchServer() {
@@ -42,6 +45,14 @@ func LaunchServer() {
 		// IdleTimeout: Maximum time to wait for the next request when keep-alive is enabled.
 		// Connection is closed if no new request is received within this duration.
 		IdleTimeout: 120 * time.Second,
+
+		// ProxyHeader is read for the client IP (c.IP()) instead of the source of the connection
+		// if TrustedProxies are set, only for connections from them
+		// invalid IPs in the header are skipped, without a valid one the source of the connection is used
+		ProxyHeader:             GetConfig().ProxyHeader,
+		EnableIPValidation:      true,
+		EnableTrustedProxyCheck: len(GetConfig().TrustedProxies) > 0,
+		TrustedProxies:          GetConfig().TrustedProxies,
 	})
 
 	// Set up signal handling for SIGHUP, SIGINT, and SIGTERM
@@ -50,24 +61,66 @@ func LaunchServer() {
 	// Enable transport Compression
 	app.Use(compress.New())
 
-	// middleware to write access log
-	app.Use(logger.New(logger.Config{
-		// For more options, see the Config section
-		Format:     "${time} ${ip} ${status} - ${method} ${path}\n",
-		TimeFormat: "2006-Jan-02 15:04:05",
-		Output:     getAccessLogger(),
-	}))
+	// health endpoints are registered before the access log and metrics
+	// so that probes by load balancers do not flood either of them
+	registerHealthRoutes(app)
+
+	// middleware to write access log, unless it is disabled
+	if output := getAccessLogger(); output != nil {
+		app.Use(newAccessLogger(GetConfig().AccessLogFormat, output))
+	}
+
+	// admin routes are registered before the PAC routes, which would otherwise match them
+	registerAdminRoutes(app)
 
 	trackPac := setupPrometheus(app)
+	if tracingEnabled {
+		app.Use(tracingMiddleware)
+	}
+
+	// the proxies are checked while serving only
+	StartProxyChecks()
 
+	registerPACRoutes(app, trackPac)
+
+	// Start the server
+	err := app.Listen(fmt.Sprintf(":%d", GetConfig().Port))
+	if err != nil {
+		log.Errorf("Server error: %v", err)
+		// Ensure PID file is removed before exiting
+		err2 := RemovePidFile()
+		if err2 != nil {
+			log.Errorf("Failed to remove PID file: %v", err2)
+		}
+		os.Exit(1)
+	}
+}
+
+// registerPACRoutes registers the routes serving PACs
+// the "/:ip" route matches everything, so they have to be registered last
+func registerPACRoutes(app *fiber.App, trackPac func(pac *LookupElement)) {
 	// Route for serving wpad.dat file
 	app.Get("/wpad.dat", func(c *fiber.Ctx) error {
-		log.Debug("Received for /wpad.dat")
+		if debugLogging {
+			log.Debug("Received for /wpad.dat")
+		}
+		// the client IP picks the order of proxy pools
+		// IPv6 clients only match overrides for all clients, like for the other routes
+		clientNet, bits := IP.Net{}, 0
+		ip, ok := clientIPv4(c)
+		if ok {
+			clientNet, bits = IP.Net{NetworkAddress: ip, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}, 32
+		}
+		// emergency overrides win over the wpad, too
+		if o, pac, ipNet := findOverride(ip, bits); o != nil {
+			overrideRequestCounter.Inc()
+			return servePAC(c, pac, nil, &ipNet, "", 0, trackPac)
+		}
 		return servePAC(
 			c,
-			wpadPAC,
+			getServed().wpad,
 			make([]*LookupElement, 0),
-			&IP.Net{},
+			&clientNet,
 			"", 0,
 			trackPac,
 		)
@@ -76,12 +129,19 @@ func LaunchServer() {
 	// Define (testing) route where the IP is passed as a parameter
 	app.Get("/:ip", func(c *fiber.Ctx) error {
 		ip := c.Params("ip")
-		log.Debugf("Received for /:ip with ip=%s", ip)
+		if debugLogging {
+			log.Debugf("Received for /:ip with ip=%s", ip)
+		}
+
+		// full IPs do not need to be padded
+		if parsed, ok := IP.ParseIP(ip); ok {
+			return serveFromIP(c, parsed, ip, 32, trackPac)
+		}
 
 		// check the ip syntax
 		// if it fails, we default to serving for the source ip
 		if !IP.IsValidPartialIP(ip) {
-			return serveFromIPNet(c, c.IP(), 32, trackPac)
+			return serveFromClient(c, 32, trackPac)
 		}
 
 		// count the IP octets to get the bit-length
@@ -93,7 +153,9 @@ func LaunchServer() {
 	// second testing route allowing for ip and cidr
 	app.Get("/:ip/:cidr", func(c *fiber.Ctx) error {
 		ip := c.Params("ip")
-		log.Debugf("Received for /:ip/:cidr with ip=%s and cidr=%s", ip, c.Params("cidr"))
+		if debugLogging {
+			log.Debugf("Received for /:ip/:cidr with ip=%s and cidr=%s", ip, c.Params("cidr"))
+		}
 
 		// (try to) read cidr
 		// if it fails, we default to a /32 host net
@@ -102,10 +164,15 @@ func LaunchServer() {
 			cidr = 32
 		}
 
+		// full IPs do not need to be padded
+		if parsed, ok := IP.ParseIP(ip); ok {
+			return serveFromIP(c, parsed, ip, cidr, trackPac)
+		}
+
 		// check the ip syntax
 		// if it fails, we default to serving for the source ip
 		if !IP.IsValidPartialIP(ip) {
-			return serveFromIPNet(c, c.IP(), cidr, trackPac)
+			return serveFromClient(c, cidr, trackPac)
 		}
 
 		return serveFromIPNet(c, IP.PadPartialIP(ip), cidr, trackPac)
@@ -114,31 +181,90 @@ func LaunchServer() {
 	// Default route for handling requests with no path
 	// use the requesters source ip
 	app.Get("/", func(c *fiber.Ctx) error {
-		log.Debug("Received for /")
-		return serveFromIPNet(c, c.IP(), 32, trackPac)
+		if debugLogging {
+			log.Debug("Received for /")
+		}
+		return serveFromClient(c, 32, trackPac)
 	})
 
-	// Start the server
-	err := app.Listen(fmt.Sprintf(":%d", GetConfig().Port))
-	if err != nil {
-		log.Errorf("Server error: %v", err)
-		// Ensure PID file is removed before exiting
-		err2 := RemovePidFile()
-		if err2 != nil {
-			log.Errorf("Failed to remove PID file: %v", err2)
+	// only requests matching none of the routes get here, e.g. other methods
+	// they are marked for the metrics and traces, fiber replies with 404 or 405
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(unmatchedRoute, true)
+		return c.Next()
+	})
+}
+
+// serveFromIPNet is the main function that resolves the PAC file for a given IP
+func serveFromIPNet(c *fiber.Ctx, ipStr string, networkBits int, trackPac func(pac *LookupElement)) error {
+	if debugLogging {
+		log.Debugf("Received request for IP: %s, Bits: %d", ipStr, networkBits)
+	}
+	ip, ok := IP.ParseIP(ipStr)
+	if !ok {
+		// e.g. IPv6 clients only match overrides for all clients, which contain 0.0.0.0/0
+		if o, pac, ipNet := findOverride(IP.IP{}, 0); o != nil {
+			overrideRequestCounter.Inc()
+			return servePAC(c, pac, nil, &ipNet, ipStr, networkBits, trackPac)
 		}
-		os.Exit(1)
+		// fallback to the root/default node with the default pac
+		root := getServed().tree.data
+		return servePAC(c, root, []*LookupElement{root}, &IP.Net{}, ipStr, networkBits, trackPac)
 	}
+	return serveFromIP(c, ip, ipStr, networkBits, trackPac)
 }
 
-// getFileForIP is the main function that resolves the PAC file for a given IP
-func serveFromIPNet(c *fiber.Ctx, ipStr string, networkBits int, trackPac func(pac *LookupElement)) error {
-	log.Debugf("Received request for IP: %s, Bits: %d", ipStr, networkBits)
-	pac, ipNet, stackTrace := findPAC(ipStr, networkBits)
+// serveFromClient resolves the PAC file for the client IP of the request
+// the IP is only formatted for IPv6 clients and the debug output
+func serveFromClient(c *fiber.Ctx, networkBits int, trackPac func(pac *LookupElement)) error {
+	ip, ok := clientIPv4(c)
+	if !ok {
+		return serveFromIPNet(c, c.IP(), networkBits, trackPac)
+	}
+	ipStr := ""
+	if hasDebugQuery(c) {
+		ipStr = c.IP()
+	}
+	return serveFromIP(c, ip, ipStr, networkBits, trackPac)
+}
+
+// clientIPv4 returns the IPv4 of the client, false for IPv6 clients
+// with a proxyHeader it is the IP resolved by fiber (c.IP()),
+// otherwise the source of the connection, which is read without formatting it
+func clientIPv4(c *fiber.Ctx) (IP.IP, bool) {
+	if GetConfig().ProxyHeader != "" {
+		return IP.ParseIP(c.IP())
+	}
+	ip4 := c.Context().RemoteIP().To4()
+	if ip4 == nil {
+		return IP.IP{}, false
+	}
+	return IP.IP{Value: binary.BigEndian.Uint32(ip4)}, true
+}
 
-	return servePAC(c, pac, stackTrace, ipNet, ipStr, networkBits, trackPac)
+func serveFromIP(c *fiber.Ctx, ip IP.IP, ipStr string, networkBits int, trackPac func(pac *LookupElement)) error {
+	// emergency overrides win over all zones
+	if o, pac, ipNet := findOverride(ip, networkBits); o != nil {
+		overrideRequestCounter.Inc()
+		return servePAC(c, pac, nil, &ipNet, ipStr, networkBits, trackPac)
+	}
+	var span trace.Span
+	if tracingEnabled {
+		span = traceLookup(c, ip, networkBits)
+	}
+	pac, ipNet, ok := findPAC(ip, networkBits)
+	if span != nil {
+		endLookup(span, pac, ok)
+	}
+	if !ok {
+		return servePAC(c, pac, []*LookupElement{pac}, &ipNet, ipStr, networkBits, trackPac)
+	}
+	// the stack is only needed for the debug output, servePAC looks it up if required
+	return servePAC(c, pac, nil, &ipNet, ipStr, networkBits, trackPac)
 }
 
+// servePAC sends the PAC of the Lookup Element
+// the non-debug path does not allocate, so the Variant is sent without copying it
 func servePAC(
 	c *fiber.Ctx,
 	pac *LookupElement,
@@ -147,23 +273,49 @@ func servePAC(
 	ipStr string, networkBits int,
 	trackPac func(pac *LookupElement),
 ) error {
+	// canary rollouts decide between both versions of the zone
+	zone := pac
+	pac = pac.rolloutFor(ipNet)
+
 	// Track which PAC file was served
 	trackPac(pac)
+	recordRequest(zone, ipNet)
+	debug := hasDebugQuery(c)
+	if tracingEnabled {
+		traceServedPAC(c, pac, debug)
+	}
+	variant := pac.variantFor(ipNet.NetworkAddress)
+	noteLookup(c, zone, pac, ipNet, variant, debug)
 
-	// Check for any case variation of "debug"
-	hasDebug := false
-	for key := range c.Queries() {
-		if strings.EqualFold(key, "debug") {
-			hasDebug = true
-			break
+	if debug {
+		if stackTrace == nil {
+			_, stackTrace = findInTree(getServed().tree, ipNet)
 		}
-	}
-	if hasDebug {
-		pacMeta, err := json.MarshalIndent(fiber.Map{
+		meta := fiber.Map{
 			"requested":        fmt.Sprintf("%s/%d", ipStr, networkBits),
 			"parsed_requested": ipNet.ToString(),
 			"pac":              pac._stringify(),
-		}, "", "\t")
+			"zone_source":      pac.IPMap.Source,
+		}
+		if commit := getReloadStatus().Commit; commit != "" {
+			meta["source_commit"] = commit
+		}
+		if window := pac.IPMap.debugWindow(time.Now()); window != nil {
+			meta["active_window"] = window
+		}
+		if o := overrideOf(pac); o != nil {
+			meta["override"] = o
+		}
+		if len(pac.proxies) > 0 {
+			meta["proxies"] = pac.proxies
+		}
+		if canary := zone.debugCanary(ipNet); canary != nil {
+			meta["canary"] = canary
+		}
+		if pac.clientVariants != nil {
+			meta["proxy_pool_bucket"] = clientBucket(ipNet.NetworkAddress)
+		}
+		pacMeta, err := json.MarshalIndent(meta, "", "\t")
 		if err != nil {
 			log.Errorf("Error marshaling debug JSON: %v", err)
 			return err
@@ -176,25 +328,47 @@ func servePAC(
 			strings.Join([]string{
 				string(pacMeta),
 				treeMeta,
-				pac.Variant,
+				variant,
 			},
 				"\n\n---------------------------------------\n\n",
 			))
 	} else {
 		c.Set("content-type", "application/x-ns-proxy-autoconfig")
-		return c.SendString(pac.Variant)
+		// the variant is never modified, so the body can reference it
+		c.Response().SetBodyRaw(fiberUtils.UnsafeBytes(variant))
+		return nil
 	}
 }
 
-func findPAC(ipStr string, networkBits int) (*LookupElement, *IP.Net, []*LookupElement) {
-	ipNet, err := IP.NewIPNetFromMixed(ipStr, networkBits)
+// hasDebugQuery checks for any case variation of the "debug" flag
+// the query args are visited directly, since c.Queries() copies them into a map
+func hasDebugQuery(c *fiber.Ctx) bool {
+	hasDebug := false
+	c.Context().QueryArgs().VisitAll(func(key, _ []byte) {
+		if !hasDebug && bytes.EqualFold(key, debugQuery) {
+			hasDebug = true
+		}
+	})
+	return hasDebug
+}
+
+var debugQuery = []byte("debug")
+
+// findPAC returns the Lookup Element for the network of ip
+// if networkBits is not a valid CIDR, the root/default node is returned and ok is false
+func findPAC(ip IP.IP, networkBits int) (pac *LookupElement, ipNet IP.Net, ok bool) {
+	tree := getServed().tree
+
+	// lookups of single client IPs are served from the lookup cache, if enabled
+	if cache := clientLookupCache; cache != nil && networkBits == 32 {
+		return findCachedInTree(cache, tree, ip), IP.Net{NetworkAddress: ip, CIDR: IP.CIDR{Value: 32, Mask: IP.Mask32}}, true
+	}
+
+	ipNet, err := IP.NewIPNetFromIP(ip, networkBits)
 	if err != nil {
-		// fallback to the root/default node with the default pac
-		return lookupTree.data, &IP.Net{}, []*LookupElement{lookupTree.data}
+		return tree.data, IP.Net{}, false
 	}
 
 	// search db for best pac
-	pac, stackTrace := findInTree(lookupTree, &ipNet)
-
-	return pac, &ipNet, stackTrace
+	return findElementInTree(tree, &ipNet), ipNet, true
 }
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/valyala/fasthttp"
+)
+
+// run with: go test ./internal -run '^$' -bench ServePAC -benchmem
+// the requests are passed to the PAC routes directly, without a listener or the middlewares
+
+func benchmarkServePAC(b *testing.B, uri string, cacheSize int) {
+	log.SetLevel(log.LevelInfo)
+	handler := setupPACRoutes(b, webserverTestZones())
+	current := getServed()
+	serveLookupTree(&servedData{root: current.root, wpad: current.wpad, elements: generateZones(benchmarkZones, true)})
+	initLookupCache(cacheSize, 32)
+
+	// a busy floor of 1024 clients, which fits into the lookup cache
+	hosts := randomHosts(1024)
+	requests := make([]*fasthttp.RequestCtx, len(hosts))
+	for i, h := range hosts {
+		v := h.NetworkAddress.Value
+		requests[i] = newRequest(uri, net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := requests[i%len(requests)]
+		handler(ctx)
+		ctx.Response.Reset()
+	}
+}
+
+func BenchmarkServePACClient(b *testing.B) {
+	benchmarkServePAC(b, "/", 0)
+}
+
+func BenchmarkServePACClientCached(b *testing.B) {
+	benchmarkServePAC(b, "/", 4096)
+}
+
+func BenchmarkServePACIP(b *testing.B) {
+	benchmarkServePAC(b, "/10.1.2.3", 0)
+}
+
+func BenchmarkServePACIPAndCIDR(b *testing.B) {
+	benchmarkServePAC(b, "/10.1.2.0/24", 0)
+}
+
+func BenchmarkServePACDebug(b *testing.B) {
+	benchmarkServePAC(b, "/?debug", 0)
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// setupPACRoutes serves a small tree through the PAC routes and restores the served data after the test
+// requests are passed to the returned handler directly, without a listener or the middlewares
+func setupPACRoutes(tb testing.TB, elements []*LookupElement) fasthttp.RequestHandler {
+	tb.Helper()
+	oldConf, oldServed := confStorage, served.Load()
+	tb.Cleanup(func() {
+		confStorage = oldConf
+		served.Store(oldServed)
+		initLookupCache(0, 32)
+	})
+	confStorage = &Config{DefaultPACFile: "default.pac", ContactInfo: "Test Contact"}
+	serveLookupTree(&servedData{
+		root:     &LookupElement{PAC: &pacTemplate{Filename: "default.pac", content: "// default"}},
+		wpad:     &LookupElement{IPMap: &ipMap{Filename: "wpad.dat"}, PAC: &pacTemplate{Filename: "wpad.dat"}, Variant: "// wpad"},
+		elements: elements,
+	})
+
+	app := fiber.New()
+	registerPACRoutes(app, trackPACFile)
+	return app.Handler()
+}
+
+// newRequest prepares a request for uri from the client
+func newRequest(uri string, client net.IP) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: client, Port: 50000}, nil)
+	ctx.Request.SetRequestURI(uri)
+	// without a method, fasthttp allocates the default on every call
+	ctx.Request.Header.SetMethod(fiber.MethodGet)
+	return ctx
+}
+
+func webserverTestZones() []*LookupElement {
+	elements := []*LookupElement{
+		createLookupElement("10.0.0.0", 8, "company.pac"),
+		createLookupElement("10.1.2.0", 24, "office.pac"),
+	}
+	for _, e := range elements {
+		e.Variant = "// " + e.IPMap.Filename
+	}
+	return elements
+}
+
+func TestPACRoutes(t *testing.T) {
+	handler := setupPACRoutes(t, webserverTestZones())
+
+	tests := []struct {
+		name   string
+		uri    string
+		client string
+		// cacheSize enables the lookup cache
+		cacheSize int
+		want      string
+	}{
+		{name: "Source IP", uri: "/", client: "10.1.2.3", want: "// office.pac"},
+		{name: "Source IP from the cache", uri: "/", client: "10.1.2.3", cacheSize: 64, want: "// office.pac"},
+		{name: "Source IP outside of all zones", uri: "/", client: "192.168.0.1", want: "// default"},
+		{name: "IPv6 source IP", uri: "/", client: "2001:db8::1", want: "// default"},
+		{name: "Full IP", uri: "/10.1.2.200", client: "192.168.0.1", want: "// office.pac"},
+		{name: "Partial IP", uri: "/10.1", client: "192.168.0.1", want: "// company.pac"},
+		{name: "Invalid IP falls back to the source IP", uri: "/foo", client: "10.1.2.3", want: "// office.pac"},
+		{name: "IP and CIDR", uri: "/10.1.2.0/16", client: "192.168.0.1", want: "// company.pac"},
+		{name: "Invalid CIDR", uri: "/10.1.2.0/40", client: "10.1.2.3", want: "// default"},
+		{name: "WPAD", uri: "/wpad.dat", client: "10.1.2.3", want: "// wpad"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initLookupCache(tt.cacheSize, 32)
+			// the second request of the cached case is a hit
+			for i := 0; i < 2; i++ {
+				ctx := newRequest(tt.uri, net.ParseIP(tt.client))
+				handler(ctx)
+				if got := string(ctx.Response.Body()); got != tt.want {
+					t.Errorf("GET %s from %s = %q, want %q", tt.uri, tt.client, got, tt.want)
+				}
+				if got := string(ctx.Response.Header.ContentType()); got != "application/x-ns-proxy-autoconfig" {
+					t.Errorf("GET %s content-type = %s", tt.uri, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPACRoutesDebug(t *testing.T) {
+	handler := setupPACRoutes(t, webserverTestZones())
+
+	tests := []struct {
+		name   string
+		uri    string
+		client string
+		want   []string
+	}{
+		{
+			name:   "Source IP",
+			uri:    "/?debug",
+			client: "10.1.2.3",
+			want:   []string{`"requested": "10.1.2.3/32"`, `"parsed_requested": "10.1.2.3/32"`, "10.0.0.0/8 | pac(company.pac)", "10.1.2.0/24 | pac(office.pac)", "// office.pac"},
+		},
+		{
+			name:   "Upper case flag",
+			uri:    "/10.1.2.0/16?DEBUG=1",
+			client: "192.168.0.1",
+			want:   []string{`"requested": "10.1.2.0/16"`, `"parsed_requested": "10.1.0.0/16"`, "10.0.0.0/8 | pac(company.pac)", "// company.pac"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newRequest(tt.uri, net.ParseIP(tt.client))
+			handler(ctx)
+			body := string(ctx.Response.Body())
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("GET %s does not contain %q:\n%s", tt.uri, want, body)
+				}
+			}
+		})
+	}
+}
+
+// the non-debug path must not allocate per request
+func TestPACRoutesDoNotAllocate(t *testing.T) {
+	handler := setupPACRoutes(t, webserverTestZones())
+
+	for _, cacheSize := range []int{0, 64} {
+		initLookupCache(cacheSize, 32)
+		for _, uri := range []string{"/", "/10.1.2.200", "/10.1.2.0/24", "/wpad.dat"} {
+			ctx := newRequest(uri, net.ParseIP("10.1.2.3"))
+			allocs := testing.AllocsPerRun(100, func() {
+				handler(ctx)
+				ctx.Response.Reset()
+			})
+			if allocs > 0 {
+				t.Errorf("GET %s (cache size %d) allocates %.1f times per request", uri, cacheSize, allocs)
+			}
+		}
+	}
+}
+
+func TestPACRoutesOverride(t *testing.T) {
+	handler := setupPACRoutes(t, webserverTestZones())
+	setupOverrides(t, "")
+	mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Networks: []string{"10.1.2.0/24"}, Duration: "1h", Reason: "proxy outage"})
+
+	tests := []struct {
+		name   string
+		uri    string
+		client string
+		want   []string
+	}{
+		{name: "Source IP within the override", uri: "/", client: "10.1.2.3", want: []string{directPACContent}},
+		{name: "Source IP outside of the override", uri: "/", client: "10.2.0.1", want: []string{"// company.pac"}},
+		{name: "Full IP within the override", uri: "/10.1.2.200", client: "192.168.0.1", want: []string{directPACContent}},
+		{name: "Network larger than the override", uri: "/10.1.0.0/16", client: "192.168.0.1", want: []string{"// company.pac"}},
+		{name: "IPv6 source IP does not match", uri: "/", client: "2001:db8::1", want: []string{"// default"}},
+		{name: "WPAD within the override", uri: "/wpad.dat", client: "10.1.2.3", want: []string{directPACContent}},
+		{name: "WPAD outside of the override", uri: "/wpad.dat", client: "10.2.0.1", want: []string{"// wpad"}},
+		{
+			name:   "Debug output flags the override",
+			uri:    "/?debug",
+			client: "10.1.2.3",
+			want:   []string{`"override": {`, `"reason": "proxy outage"`, "10.1.2.0/24 | pac(DIRECT) // proxy outage", "10.1.2.0/24 | pac(office.pac)", directPACContent},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newRequest(tt.uri, net.ParseIP(tt.client))
+			handler(ctx)
+			body := string(ctx.Response.Body())
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("GET %s from %s does not contain %q:\n%s", tt.uri, tt.client, want, body)
+				}
+			}
+		})
+	}
+
+	ctx := newRequest("/", net.ParseIP("10.1.2.3"))
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+		ctx.Response.Reset()
+	})
+	if allocs > 0 {
+		t.Errorf("GET / with an override allocates %.1f times per request", allocs)
+	}
+
+	// an override for all clients also applies to IPv6 clients
+	mustAddOverride(t, OverrideRequest{PAC: OverrideDirect, Duration: "1h"})
+	enableRequestStats(t, 10, 0)
+	for _, uri := range []string{"/", "/wpad.dat"} {
+		ctx = newRequest(uri, net.ParseIP("2001:db8::1"))
+		handler(ctx)
+		if got := string(ctx.Response.Body()); got != directPACContent {
+			t.Errorf("GET %s from an IPv6 client with an override for all clients = %q", uri, got)
+		}
+	}
+	// the networks of overrides are not counted as zones
+	want := []zoneRequests{{otherZones, 0}, {overrideZones, 2}}
+	if got := listRequestStats().Zones; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("listRequestStats().Zones = %v, want %v", got, want)
+	}
+}
+
+func TestPACRoutesProxyHeader(t *testing.T) {
+	setupPACRoutes(t, webserverTestZones())
+	confStorage.ProxyHeader = fiber.HeaderXForwardedFor
+
+	app := fiber.New(fiber.Config{
+		ProxyHeader:             fiber.HeaderXForwardedFor,
+		EnableIPValidation:      true,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          []string{"192.168.0.1"},
+	})
+	registerPACRoutes(app, trackPACFile)
+	handler := app.Handler()
+
+	tests := []struct {
+		name   string
+		uri    string
+		client string
+		header string
+		want   string
+	}{
+		{name: "Client from the header", uri: "/", client: "192.168.0.1", header: "10.1.2.3", want: "// office.pac"},
+		{name: "First valid IP of the header", uri: "/", client: "192.168.0.1", header: "unknown, 10.2.0.1, 10.1.2.3", want: "// company.pac"},
+		{name: "Invalid header falls back to the source IP", uri: "/", client: "192.168.0.1", header: "unknown", want: "// default"},
+		{name: "IPv6 client from the header", uri: "/", client: "192.168.0.1", header: "2001:db8::1", want: "// default"},
+		{name: "Header of an untrusted proxy", uri: "/", client: "10.2.0.1", header: "10.1.2.3", want: "// company.pac"},
+		{name: "Requested IP wins over the header", uri: "/10.2.0.1", client: "192.168.0.1", header: "10.1.2.3", want: "// company.pac"},
+		{name: "Debug output of the client from the header", uri: "/?debug", client: "192.168.0.1", header: "10.1.2.3", want: `"requested": "10.1.2.3/32"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newRequest(tt.uri, net.ParseIP(tt.client))
+			ctx.Request.Header.Set(fiber.HeaderXForwardedFor, tt.header)
+			handler(ctx)
+			if got := string(ctx.Response.Body()); !strings.Contains(got, tt.want) {
+				t.Errorf("GET %s from %s for %s = %q, want %q", tt.uri, tt.client, tt.header, got, tt.want)
+			}
+		})
+	}
+
+	// without trusted proxies, the header is read without allocating
+	app = fiber.New(fiber.Config{ProxyHeader: fiber.HeaderXForwardedFor, EnableIPValidation: true})
+	registerPACRoutes(app, trackPACFile)
+	handler = app.Handler()
+	ctx := newRequest("/", net.ParseIP("192.168.0.1"))
+	ctx.Request.Header.Set(fiber.HeaderXForwardedFor, "10.1.2.3")
+	allocs := testing.AllocsPerRun(100, func() {
+		handler(ctx)
+		ctx.Response.Reset()
+	})
+	if allocs > 0 {
+		t.Errorf("GET / with a proxy header allocates %.1f times per request", allocs)
+	}
+}
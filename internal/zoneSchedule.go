@@ -0,0 +1,189 @@
+package internal
+
+/**
+ * zones can be limited to a validity window (validFrom / validUntil)
+ * and to recurring windows, which open at every match of a cron schedule and stay open for a duration,
+ * e.g. for office moves or incident drills
+ *
+ * zones outside their windows are left out when the Lookup Elements are built.
+ * the refresh loop rebuilds the tree at the next transition, so zones become active and inactive on time
+ */
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// maxMergedWindows limits how many overlapping windows are merged into one, e.g. for "* * * * *"
+const maxMergedWindows = 7 * 24 * 60
+
+var (
+	// nextTransition is the next time a zone of the served tree becomes active or inactive
+	nextTransition     *time.Time
+	nextTransitionLock sync.Mutex
+	// transitionChanged wakes up the refresh loop to pick up a new nextTransition
+	transitionChanged = make(chan bool, 1)
+)
+
+// isScheduled checks if the zone is limited to any validity or schedule window
+func (x1 *ipMap) isScheduled() bool {
+	return x1.ValidFrom != nil || x1.ValidUntil != nil || x1.Schedule != nil
+}
+
+// isActiveAt checks if the zone is within its (optional) validity and schedule windows
+func (x1 *ipMap) isActiveAt(t time.Time) bool {
+	if x1.ValidFrom != nil && t.Before(*x1.ValidFrom) {
+		return false
+	}
+	if x1.ValidUntil != nil && !t.Before(*x1.ValidUntil) {
+		return false
+	}
+	if x1.Schedule != nil {
+		_, ok := x1.scheduleStartAt(t)
+		return ok
+	}
+	return true
+}
+
+// scheduleStartAt returns the start of the earliest window of the schedule containing t
+// the window opened at start contains t if t-Duration < start <= t
+func (x1 *ipMap) scheduleStartAt(t time.Time) (time.Time, bool) {
+	start := x1.Schedule.Next(t.Add(-x1.Duration))
+	return start, !start.IsZero() && !start.After(t)
+}
+
+// scheduleEnd returns the end of the window opened at start
+// windows opening before it ends are merged, since the zone stays active in between
+func (x1 *ipMap) scheduleEnd(start time.Time) time.Time {
+	end := start.Add(x1.Duration)
+	for i := 0; i < maxMergedWindows; i++ {
+		next := x1.Schedule.Next(start)
+		if next.IsZero() || next.After(end) {
+			break
+		}
+		start, end = next, next.Add(x1.Duration)
+	}
+	return end
+}
+
+// activeWindow returns the window the zone is active in at t
+// from or until are nil if the window is open on that side
+func (x1 *ipMap) activeWindow(t time.Time) (from, until *time.Time) {
+	from, until = x1.ValidFrom, x1.ValidUntil
+	if x1.Schedule != nil {
+		if start, ok := x1.scheduleStartAt(t); ok {
+			end := x1.scheduleEnd(start)
+			if from == nil || start.After(*from) {
+				from = &start
+			}
+			if until == nil || end.Before(*until) {
+				until = &end
+			}
+		}
+	}
+	return from, until
+}
+
+// scheduleWindow describes the window of a zone in the debug output
+type scheduleWindow struct {
+	From     *time.Time `json:"from,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Schedule string     `json:"schedule,omitempty"`
+}
+
+// debugWindow returns the active window of a zone with a window, or nil
+func (x1 *ipMap) debugWindow(t time.Time) *scheduleWindow {
+	if x1.ValidFrom == nil && x1.ValidUntil == nil && x1.Schedule == nil {
+		return nil
+	}
+	window := &scheduleWindow{}
+	window.From, window.Until = x1.activeWindow(t)
+	if x1.Schedule != nil {
+		window.Schedule = fmt.Sprintf("%s for %s", x1.Schedule.String(), x1.Duration.String())
+	}
+	return window
+}
+
+// nextTransitionAfter returns the next time after t at which the zone may become active or inactive
+// it is nil if the zone never changes again
+func (x1 *ipMap) nextTransitionAfter(t time.Time) *time.Time {
+	if x1.ValidUntil != nil && !t.Before(*x1.ValidUntil) {
+		return nil
+	}
+	if x1.ValidFrom != nil && t.Before(*x1.ValidFrom) {
+		// the schedule is only evaluated once the zone is valid
+		return x1.ValidFrom
+	}
+
+	next := x1.ValidUntil
+	if x1.Schedule != nil {
+		var change time.Time
+		if start, ok := x1.scheduleStartAt(t); ok {
+			change = x1.scheduleEnd(start)
+		} else {
+			change = x1.Schedule.Next(t)
+		}
+		if !change.IsZero() && (next == nil || change.Before(*next)) {
+			next = &change
+		}
+	}
+	return next
+}
+
+// nextZoneTransition returns the earliest transition of all zones after now, or nil
+func nextZoneTransition(zones []*ipMap, now time.Time) *time.Time {
+	var next *time.Time
+	for _, zone := range zones {
+		t := zone.nextTransitionAfter(now)
+		if t != nil && (next == nil || t.Before(*next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// filterActiveZones drops all zones that are outside their windows
+func filterActiveZones(mappings []*ipMap, now time.Time) []*ipMap {
+	active := make([]*ipMap, 0, len(mappings))
+	for _, m := range mappings {
+		if !m.isActiveAt(now) {
+			log.Infof("Skipping zone %s from \"%s\" since it is outside its validity window", m.IPNet.ToString(), m.Source)
+			continue
+		}
+		active = append(active, m)
+	}
+	return active
+}
+
+// scheduleTransition stores the next transition and wakes up the refresh loop
+func scheduleTransition(t *time.Time) {
+	nextTransitionLock.Lock()
+	nextTransition = t
+	nextTransitionLock.Unlock()
+	if t != nil {
+		log.Infof("The zones change at %s - the lookup tree will be rebuilt then", t.Format(time.RFC3339))
+	}
+	select {
+	case transitionChanged <- true:
+	default:
+	}
+}
+
+func getNextTransition() *time.Time {
+	nextTransitionLock.Lock()
+	defer nextTransitionLock.Unlock()
+	return nextTransition
+}
+
+// clearPastTransition forgets a transition that was not replaced by the rebuild at it,
+// e.g. because the refresh was skipped, so the refresh loop does not spin on it
+func clearPastTransition(now time.Time) {
+	nextTransitionLock.Lock()
+	defer nextTransitionLock.Unlock()
+	if nextTransition != nil && !nextTransition.After(now) {
+		nextTransition = nil
+	}
+}
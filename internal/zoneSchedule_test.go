@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timeforaninja/pacserver/pkg/cron"
+)
+
+// 2024-03-01 is a friday
+func scheduleTestTime(day, hour, minute int) time.Time {
+	return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+}
+
+// scheduledZone creates a zone with a window of duration at every match of expr
+func scheduledZone(expr string, duration time.Duration) *ipMap {
+	schedule, err := cron.Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+	return &ipMap{IPNet: forceIPNet("10.0.0.0", 8), Filename: "scheduled.pac", Schedule: schedule, Duration: duration}
+}
+
+func withValidity(zone *ipMap, from, until *time.Time) *ipMap {
+	zone.ValidFrom, zone.ValidUntil = from, until
+	return zone
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestScheduledIsActiveAt(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		zone *ipMap
+		at   time.Time
+		want bool
+	}{
+		{name: "Within office hours", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 12, 0), want: true},
+		{name: "Start is inclusive", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 8, 0), want: true},
+		{name: "End is exclusive", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 18, 0), want: false},
+		{name: "Before office hours", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 7, 59), want: false},
+		{name: "Weekend", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(2, 12, 0), want: false},
+		{name: "Window over midnight", zone: scheduledZone("0 22 * * *", 8*time.Hour), at: scheduleTestTime(2, 3, 0), want: true},
+		{
+			name: "Schedule after validUntil",
+			zone: withValidity(scheduledZone("0 8 * * 1-5", 10*time.Hour), nil, timePtr(scheduleTestTime(4, 0, 0))),
+			at:   scheduleTestTime(4, 9, 0),
+			want: false,
+		},
+		{
+			name: "Schedule before validFrom",
+			zone: withValidity(scheduledZone("0 8 * * 1-5", 10*time.Hour), timePtr(scheduleTestTime(1, 13, 0)), nil),
+			at:   scheduleTestTime(1, 12, 0),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.zone.isActiveAt(tt.at); got != tt.want {
+				t.Errorf("isActiveAt(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebugWindow(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		zone         *ipMap
+		at           time.Time
+		wantNil      bool
+		wantFrom     *time.Time
+		wantUntil    *time.Time
+		wantSchedule string
+	}{
+		{
+			name:    "Zone without window",
+			zone:    &ipMap{IPNet: forceIPNet("10.0.0.0", 8)},
+			at:      scheduleTestTime(1, 12, 0),
+			wantNil: true,
+		},
+		{
+			name:      "Validity window",
+			zone:      withValidity(&ipMap{IPNet: forceIPNet("10.0.0.0", 8)}, timePtr(scheduleTestTime(1, 0, 0)), nil),
+			at:        scheduleTestTime(1, 12, 0),
+			wantFrom:  timePtr(scheduleTestTime(1, 0, 0)),
+			wantUntil: nil,
+		},
+		{
+			name:         "Office hours",
+			zone:         scheduledZone("0 8 * * 1-5", 10*time.Hour),
+			at:           scheduleTestTime(1, 12, 0),
+			wantFrom:     timePtr(scheduleTestTime(1, 8, 0)),
+			wantUntil:    timePtr(scheduleTestTime(1, 18, 0)),
+			wantSchedule: "0 8 * * 1-5 for 10h0m0s",
+		},
+		{
+			name:         "Overlapping windows are merged",
+			zone:         scheduledZone("0 8,12 * * *", 6*time.Hour),
+			at:           scheduleTestTime(1, 9, 0),
+			wantFrom:     timePtr(scheduleTestTime(1, 8, 0)),
+			wantUntil:    timePtr(scheduleTestTime(1, 18, 0)),
+			wantSchedule: "0 8,12 * * * for 6h0m0s",
+		},
+		{
+			name:         "validUntil ends the window early",
+			zone:         withValidity(scheduledZone("0 8 * * 1-5", 10*time.Hour), nil, timePtr(scheduleTestTime(1, 15, 0))),
+			at:           scheduleTestTime(1, 12, 0),
+			wantFrom:     timePtr(scheduleTestTime(1, 8, 0)),
+			wantUntil:    timePtr(scheduleTestTime(1, 15, 0)),
+			wantSchedule: "0 8 * * 1-5 for 10h0m0s",
+		},
+	}
+
+	equal := func(a, b *time.Time) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Equal(*b))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.zone.debugWindow(tt.at)
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("debugWindow() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("debugWindow() = nil")
+			}
+			if !equal(got.From, tt.wantFrom) || !equal(got.Until, tt.wantUntil) || got.Schedule != tt.wantSchedule {
+				t.Errorf("debugWindow() = %v - %v (%q), want %v - %v (%q)", got.From, got.Until, got.Schedule, tt.wantFrom, tt.wantUntil, tt.wantSchedule)
+			}
+		})
+	}
+}
+
+func TestNextTransitionAfter(t *testing.T) {
+	t.Parallel()
+
+	from, until := scheduleTestTime(1, 0, 0), scheduleTestTime(8, 0, 0)
+	tests := []struct {
+		name string
+		zone *ipMap
+		at   time.Time
+		want *time.Time
+	}{
+		{name: "Zone without window", zone: &ipMap{}, at: scheduleTestTime(1, 12, 0), want: nil},
+		{name: "Before validFrom", zone: withValidity(&ipMap{}, &from, &until), at: scheduleTestTime(1, 0, 0).Add(-time.Hour), want: &from},
+		{name: "Within validity", zone: withValidity(&ipMap{}, &from, &until), at: scheduleTestTime(1, 12, 0), want: &until},
+		{name: "After validUntil", zone: withValidity(&ipMap{}, &from, &until), at: until, want: nil},
+		{name: "Within office hours", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 12, 0), want: timePtr(scheduleTestTime(1, 18, 0))},
+		{name: "After office hours", zone: scheduledZone("0 8 * * 1-5", 10*time.Hour), at: scheduleTestTime(1, 18, 0), want: timePtr(scheduleTestTime(4, 8, 0))},
+		{
+			name: "validUntil before the window ends",
+			zone: withValidity(scheduledZone("0 8 * * 1-5", 10*time.Hour), nil, timePtr(scheduleTestTime(1, 15, 0))),
+			at:   scheduleTestTime(1, 12, 0),
+			want: timePtr(scheduleTestTime(1, 15, 0)),
+		},
+		{
+			name: "Schedule waits for validFrom",
+			zone: withValidity(scheduledZone("0 8 * * 1-5", 10*time.Hour), timePtr(scheduleTestTime(3, 0, 0)), nil),
+			at:   scheduleTestTime(1, 12, 0),
+			want: timePtr(scheduleTestTime(3, 0, 0)),
+		},
+		{name: "Schedule never matches", zone: scheduledZone("0 0 30 2 *", time.Hour), at: scheduleTestTime(1, 12, 0), want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.zone.nextTransitionAfter(tt.at)
+			if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+				t.Errorf("nextTransitionAfter(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Earliest of all zones", func(t *testing.T) {
+		zones := []*ipMap{
+			{},
+			withValidity(&ipMap{}, &from, &until),
+			scheduledZone("0 8 * * 1-5", 10*time.Hour),
+		}
+		want := scheduleTestTime(1, 18, 0)
+		if got := nextZoneTransition(zones, scheduleTestTime(1, 12, 0)); got == nil || !got.Equal(want) {
+			t.Errorf("nextZoneTransition() = %v, want %s", got, want)
+		}
+		if got := nextZoneTransition(zones[:1], scheduleTestTime(1, 12, 0)); got != nil {
+			t.Errorf("nextZoneTransition() = %v, want nil", got)
+		}
+	})
+}
+
+func TestScheduledZonesOnRebuild(t *testing.T) {
+	oldConf, oldZones, oldPACs := confStorage, zoneProvider, pacProvider
+	oldServed := served.Load()
+	oldIPMaps, oldCachedPACs := cachedIPMaps, cachedPACs
+	defer func() {
+		confStorage, zoneProvider, pacProvider = oldConf, oldZones, oldPACs
+		served.Store(oldServed)
+		cachedIPMaps, cachedPACs = oldIPMaps, oldCachedPACs
+		currentStatus = reloadStatus{}
+		scheduleTransition(nil)
+	}()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	confStorage = &Config{
+		DefaultPACFile: filepath.Join(dir, "default.pac"),
+		WPADFile:       filepath.Join(dir, "wpad.dat"),
+		ContactInfo:    "Test Contact",
+	}
+
+	now := time.Now()
+	current := createLookupElement("10.0.0.0", 8, "current.pac")
+	current.IPMap.ValidUntil = timePtr(now.Add(2 * time.Hour))
+	upcoming := createLookupElement("10.1.0.0", 16, "upcoming.pac")
+	upcoming.IPMap.ValidFrom = timePtr(now.Add(time.Hour))
+	// the unscheduled zones of the same networks are no conflicts
+	base := createLookupElement("10.1.0.0", 16, "base.pac")
+	office := createLookupElement("10.2.0.0", 16, "office.pac")
+	drill := createLookupElement("10.2.0.0", 16, "drill.pac")
+	drill.IPMap.ValidUntil = timePtr(now.Add(time.Hour))
+	resetServedData()
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{current.IPMap, upcoming.IPMap, base.IPMap, drill.IPMap, office.IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{current.PAC, upcoming.PAC, base.PAC, drill.PAC, office.PAC}}
+
+	if problems := updateLookupTree(); problems != 0 {
+		t.Fatalf("updateLookupTree() = %d problems, want 0", problems)
+	}
+	// the upcoming zone is left out of the tree, but kept for the rebuild at its start
+	if pac, _ := findInTree(getServed().tree, createIPNet("10.1.2.3", 32)); pac.IPMap.Filename != "base.pac" {
+		t.Errorf("findInTree() = %s, want base.pac", pac.IPMap.Filename)
+	}
+	if len(cachedIPMaps) != 5 {
+		t.Errorf("%d zones cached, want 5", len(cachedIPMaps))
+	}
+	// the active scheduled zone takes precedence over the unscheduled one
+	if pac, _ := findInTree(getServed().tree, createIPNet("10.2.0.1", 32)); pac.IPMap.Filename != "drill.pac" {
+		t.Errorf("findInTree() = %s, want drill.pac", pac.IPMap.Filename)
+	}
+	if got := getNextTransition(); got == nil || !got.Equal(*upcoming.IPMap.ValidFrom) {
+		t.Errorf("getNextTransition() = %v, want %s", got, upcoming.IPMap.ValidFrom)
+	}
+
+	// a past transition is cleared, a future one is kept
+	clearPastTransition(now)
+	if getNextTransition() == nil {
+		t.Errorf("clearPastTransition() cleared a future transition")
+	}
+	clearPastTransition(now.Add(time.Hour))
+	if got := getNextTransition(); got != nil {
+		t.Errorf("clearPastTransition() kept %s", got)
+	}
+}
+
+func TestRebuildAtTransitions(t *testing.T) {
+	oldZones, oldPACs := zoneProvider, pacProvider
+	defer func() {
+		zoneProvider, pacProvider = oldZones, oldPACs
+		currentStatus = reloadStatus{}
+		scheduleTransition(nil)
+	}()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "default.pac"), "// default")
+	writeTestFile(t, filepath.Join(dir, "wpad.dat"), "// wpad")
+	resetSnapshots(t, &Config{
+		DefaultPACFile:  filepath.Join(dir, "default.pac"),
+		WPADFile:        filepath.Join(dir, "wpad.dat"),
+		ContactInfo:     "Test Contact",
+		SnapshotHistory: 10,
+	})
+
+	now := time.Now()
+	upcoming := createLookupElement("10.1.0.0", 16, "upcoming.pac")
+	upcoming.IPMap.ValidFrom = timePtr(now.Add(time.Hour))
+	base := createLookupElement("10.1.0.0", 16, "base.pac")
+	office := createLookupElement("10.2.0.0", 16, "office.pac")
+	drill := createLookupElement("10.2.0.0", 16, "drill.pac")
+	drill.IPMap.ValidUntil = timePtr(now.Add(30 * time.Minute))
+	resetServedData()
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{upcoming.IPMap, base.IPMap, drill.IPMap, office.IPMap}}
+	pacProvider = memoryPACProvider{pacs: []*pacTemplate{upcoming.PAC, base.PAC, drill.PAC, office.PAC}}
+	if problems := updateLookupTree(); problems != 0 {
+		t.Fatalf("updateLookupTree() = %d problems, want 0", problems)
+	}
+	// a later load without the scheduled zones, then a rollback to the first one
+	zoneProvider = memoryZoneProvider{zones: []*ipMap{office.IPMap}}
+	updateLookupTree()
+	if _, err := rollbackToSnapshot(1); err != nil {
+		t.Fatalf("rollbackToSnapshot(1) unexpected error: %v", err)
+	}
+	if got := getNextTransition(); got == nil || !got.Equal(*drill.IPMap.ValidUntil) {
+		t.Errorf("getNextTransition() after the rollback = %v, want %s", got, drill.IPMap.ValidUntil)
+	}
+
+	// the rebuild at the transitions does not read the broken sources
+	zoneProvider = memoryZoneProvider{err: errors.New("broken")}
+	pacProvider = memoryPACProvider{err: errors.New("broken")}
+	drill.IPMap.ValidUntil = timePtr(now.Add(-time.Minute))
+	upcoming.IPMap.ValidFrom = timePtr(now.Add(-time.Minute))
+	rebuildLookupTree()
+	for ip, want := range map[string]string{"10.1.2.3": "upcoming.pac", "10.2.0.1": "office.pac"} {
+		if pac, _ := findInTree(getServed().tree, createIPNet(ip, 32)); pac.IPMap.Filename != want {
+			t.Errorf("findInTree(%s) after the transitions = %s, want %s", ip, pac.IPMap.Filename, want)
+		}
+	}
+	if !isRolledBack() {
+		t.Errorf("the rebuild at a transition ended the rollback")
+	}
+	if got := getNextTransition(); got != nil {
+		t.Errorf("getNextTransition() after the last transition = %v, want nil", got)
+	}
+}
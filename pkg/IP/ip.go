@@ -32,7 +32,7 @@ func newIP(srcIP string) (IP, error) {
 	return IP{Value: ip}, nil
 }
 
-func (ip IP) toString() string {
+func (ip IP) ToString() string {
 	// Extract each byte from the uint32 IP value
 	byte1 := ip.Value >> 24 & 0xFF
 	byte2 := ip.Value >> 16 & 0xFF
@@ -42,3 +42,31 @@ func (ip IP) toString() string {
 	// Format the bytes into the standard IP address format
 	return fmt.Sprintf("%d.%d.%d.%d", byte1, byte2, byte3, byte4)
 }
+
+// ParseIP parses a full IP like newIP, but without the regex and without allocations
+// it accepts the same input: four octets of one to three digits each, none above 255
+func ParseIP(srcIP string) (IP, bool) {
+	var ip uint32
+	octets, digits, octet := 0, 0, uint32(0)
+	for i := 0; i <= len(srcIP); i++ {
+		if i == len(srcIP) || srcIP[i] == '.' {
+			if digits == 0 || octet > 255 {
+				return IP{}, false
+			}
+			ip = ip<<8 | octet
+			octets++
+			digits, octet = 0, 0
+			continue
+		}
+		c := srcIP[i]
+		if c < '0' || c > '9' || digits == 3 {
+			return IP{}, false
+		}
+		octet = octet*10 + uint32(c-'0')
+		digits++
+	}
+	if octets != 4 {
+		return IP{}, false
+	}
+	return IP{Value: ip}, true
+}
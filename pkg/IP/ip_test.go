@@ -97,8 +97,44 @@ func TestIP_toString(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.ip.toString(); got != tt.want {
-				t.Errorf("IP.toString() = %v, want %v", got, tt.want)
+			if got := tt.ip.ToString(); got != tt.want {
+				t.Errorf("IP.ToString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	inputs := []string{
+		"192.168.1.1",
+		"0.0.0.0",
+		"255.255.255.255",
+		"010.001.000.099",
+		"300.155.22.47",
+		"256.0.0.1",
+		"1.2.3.1000",
+		"",
+		".",
+		"1.2.3.",
+		".1.2.3",
+		"1..2.3",
+		"1.2.3.4.5",
+		"192.168.2",
+		"192.abc.1.d",
+		" 1.2.3.4",
+		"2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+	}
+
+	// ParseIP has to accept exactly what newIP accepts
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			want, err := newIP(input)
+			got, ok := ParseIP(input)
+			if ok != (err == nil) {
+				t.Fatalf("ParseIP(%q) ok = %v, newIP() error = %v", input, ok, err)
+			}
+			if got.Value != want.Value {
+				t.Errorf("ParseIP(%q) = %v, want %v", input, got, want)
 			}
 		})
 	}
@@ -1,6 +1,9 @@
 package IP
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
 type Net struct {
 	NetworkAddress IP   `json:"network_address"`
@@ -34,15 +37,35 @@ func NewIPNetFromMixed(ipStr string, cidrStr int) (Net, error) {
 	if err != nil {
 		return Net{}, err
 	}
-	cidr, err := NewCIDR(cidrStr)
+	return NewIPNetFromIP(ip, cidrStr)
+}
+
+// NewIPNetFromIP is NewIPNetFromMixed for an already parsed IP
+func NewIPNetFromIP(ip IP, cidrInt int) (Net, error) {
+	cidr, err := NewCIDR(cidrInt)
 	if err != nil {
 		return Net{}, err
 	}
 	return newIPNet(ip, cidr), nil
 }
 
+// NewIPNetFromNotation parses a network in "ip/cidr" notation
+// a plain ip without a cidr is treated as a single host (/32)
+func NewIPNetFromNotation(str string) (Net, error) {
+	ipStr, cidrStr, found := strings.Cut(strings.TrimSpace(str), "/")
+	if !found {
+		cidrStr = "32"
+	}
+	return NewIPNetFromStr(ipStr, cidrStr)
+}
+
 func (net1 Net) ToString() string {
-	return net1.NetworkAddress.toString() + "/" + strconv.Itoa(int(net1.GetRawCIDR()))
+	return net1.NetworkAddress.ToString() + "/" + strconv.Itoa(int(net1.GetRawCIDR()))
+}
+
+// LastAddress returns the last (broadcast) address of the network
+func (net1 Net) LastAddress() IP {
+	return IP{Value: net1.NetworkAddress.Value | ^net1.CIDR.Mask}
 }
 
 func (net1 Net) GetRawCIDR() uint8 {
@@ -60,3 +83,25 @@ func (net1 Net) includesIP(ip IP) bool {
 func (net1 Net) IsIdentical(net2 Net) bool {
 	return net1.NetworkAddress.Value == net2.NetworkAddress.Value && net1.CIDR.Value == net2.CIDR.Value
 }
+
+// RangeToNets returns the minimal list of networks that exactly cover the range first-last
+func RangeToNets(first, last IP) []Net {
+	nets := make([]Net, 0)
+	// uint64 so we do not overflow after 255.255.255.255
+	start, end := uint64(first.Value), uint64(last.Value)
+	for start <= end {
+		// grow the network as long as it is aligned to start and does not exceed end
+		cidr := 32
+		for cidr > 0 {
+			size := uint64(1) << (32 - (cidr - 1))
+			if start%size != 0 || start+size-1 > end {
+				break
+			}
+			cidr--
+		}
+		mask, _ := NewCIDR(cidr)
+		nets = append(nets, newIPNet(IP{Value: uint32(start)}, mask))
+		start += uint64(1) << (32 - cidr)
+	}
+	return nets
+}
@@ -61,6 +61,63 @@ func TestNewIPNetFromStr(t *testing.T) {
 	}
 }
 
+func TestNewIPNetFromNotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		str       string
+		wantIPNet Net
+		wantErr   bool
+	}{
+		{
+			name: "valid network",
+			str:  "192.168.0.0/24",
+			wantIPNet: Net{
+				NetworkAddress: IP{Value: 3232235520},
+				CIDR:           CIDR{Value: 24, Mask: Mask24},
+			},
+		},
+		{
+			name: "surrounding whitespace",
+			str:  " 192.168.0.12/24 ",
+			wantIPNet: Net{
+				NetworkAddress: IP{Value: 3232235520},
+				CIDR:           CIDR{Value: 24, Mask: Mask24},
+			},
+		},
+		{
+			name: "plain ip defaults to a host net",
+			str:  "192.168.0.1",
+			wantIPNet: Net{
+				NetworkAddress: IP{Value: 3232235521},
+				CIDR:           CIDR{Value: 32, Mask: Mask32},
+			},
+		},
+		{
+			name:    "invalid IP",
+			str:     "192.168.0.abc/24",
+			wantErr: true,
+		},
+		{
+			name:    "invalid CIDR",
+			str:     "192.168.0.0/33",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIPNet, err := NewIPNetFromNotation(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewIPNetFromNotation() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(gotIPNet, tt.wantIPNet) {
+				t.Errorf("NewIPNetFromNotation() = %v, want %v", gotIPNet, tt.wantIPNet)
+			}
+		})
+	}
+}
+
 func TestNewIPNetFromMixed(t *testing.T) {
 	type args struct {
 		ipStr   string
@@ -375,6 +432,31 @@ func TestToString(t *testing.T) {
 	}
 }
 
+func TestLastAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipNet    string
+		expected string
+	}{
+		{"Class A", "10.0.0.0/8", "10.255.255.255"},
+		{"Non-octet CIDR", "192.168.4.0/22", "192.168.7.255"},
+		{"Single host", "192.168.1.1/32", "192.168.1.1"},
+		{"Everything", "0.0.0.0/0", "255.255.255.255"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipNet, err := NewIPNetFromNotation(tt.ipNet)
+			if err != nil {
+				t.Fatalf("NewIPNetFromNotation() unexpected error: %v", err)
+			}
+			if result := ipNet.LastAddress().ToString(); result != tt.expected {
+				t.Errorf("LastAddress() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestGetRawCIDR(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -432,3 +514,38 @@ func TestGetRawCIDR(t *testing.T) {
 		})
 	}
 }
+
+func TestRangeToNets(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    string
+		last     string
+		expected []string
+	}{
+		{"Single host", "10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}},
+		{"Exact network", "10.0.0.0", "10.255.255.255", []string{"10.0.0.0/8"}},
+		{"Everything", "0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"Unaligned start", "10.0.0.1", "10.0.0.7", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30"}},
+		{"Gap before a subnet", "10.1.0.0", "10.1.1.255", []string{"10.1.0.0/23"}},
+		{"Rest after a subnet", "10.1.3.0", "10.1.255.255", []string{
+			"10.1.3.0/24", "10.1.4.0/22", "10.1.8.0/21", "10.1.16.0/20", "10.1.32.0/19", "10.1.64.0/18", "10.1.128.0/17",
+		}},
+		{"Up to the last address", "255.255.255.254", "255.255.255.255", []string{"255.255.255.254/31"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, _ := NewIPNetFromNotation(tt.first)
+			last, _ := NewIPNetFromNotation(tt.last)
+			result := RangeToNets(first.NetworkAddress, last.NetworkAddress)
+			if len(result) != len(tt.expected) {
+				t.Fatalf("RangeToNets() returned %d networks, want %d", len(result), len(tt.expected))
+			}
+			for i, n := range result {
+				if n.ToString() != tt.expected[i] {
+					t.Errorf("RangeToNets()[%d] = %v, want %v", i, n.ToString(), tt.expected[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package cron
+
+/**
+ * a minimal parser for cron expressions with the five standard fields:
+ * minute hour day-of-month month day-of-week
+ *
+ * every field supports "*", numbers, ranges "a-b", lists "a,b" and steps "/n" after "*", a range or a number.
+ * names of months and weekdays are not supported, both 0 and 7 are sunday.
+ * like in cron, if both day-of-month and day-of-week are restricted, a day matching either of them matches
+ */
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrFieldCount = errors.New("cron expression must have 5 fields: minute hour day-of-month month day-of-week")
+
+type Schedule struct {
+	expr string
+	// the allowed values of every field as bitsets
+	minute, hour, dom, month, dow uint64
+	// domAll and dowAll are set if the field is "*"
+	domAll, dowAll bool
+}
+
+type fieldRange struct {
+	name     string
+	min, max int
+}
+
+var fieldRanges = []fieldRange{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day-of-month", 1, 31},
+	{"month", 1, 12},
+	{"day-of-week", 0, 7},
+}
+
+// searchLimit stops the search for the next match of expressions that never match, like "0 0 30 2 *"
+const searchLimit = 5 * 366 * 24 * time.Hour
+
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(fieldRanges) {
+		return nil, ErrFieldCount
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		b, err := parseField(field, fieldRanges[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	// sunday can be written as 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		expr:   strings.Join(fields, " "),
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAll: fields[2] == "*",
+		dowAll: fields[4] == "*",
+	}, nil
+}
+
+func parseField(field string, r fieldRange) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step \"%s\" in %s", stepStr, r.name)
+			}
+		}
+
+		first, last := r.min, r.max
+		if rangeStr != "*" {
+			firstStr, lastStr, isRange := strings.Cut(rangeStr, "-")
+			var err error
+			first, err = parseValue(firstStr, r)
+			if err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				last, err = parseValue(lastStr, r)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "a/n" means from a to the end of the field
+				last = r.max
+			}
+			if first > last {
+				return 0, fmt.Errorf("invalid range \"%s\" in %s", rangeStr, r.name)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(str string, r fieldRange) (int, error) {
+	v, err := strconv.Atoi(str)
+	if err != nil || v < r.min || v > r.max {
+		return 0, fmt.Errorf("invalid value \"%s\" in %s, must be %d-%d", str, r.name, r.min, r.max)
+	}
+	return v, nil
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Matches checks if the minute of t matches the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	return s.minute&(1<<t.Minute()) != 0 &&
+		s.hour&(1<<t.Hour()) != 0 &&
+		s.month&(1<<int(t.Month())) != 0 &&
+		s.matchesDay(t)
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAll || s.dowAll {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first minute after t matching the schedule, in the location of t
+// it returns the zero time if the schedule never matches
+func (s *Schedule) Next(t time.Time) time.Time {
+	limit := t.Add(searchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// daylight saving time can move a local time backwards
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// MarshalText allows to store a schedule as its expression, e.g. in JSON
+func (s *Schedule) MarshalText() ([]byte, error) {
+	return []byte(s.expr), nil
+}
+
+func (s *Schedule) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
@@ -0,0 +1,144 @@
+package cron
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "Every minute", expr: "* * * * *"},
+		{name: "Office hours", expr: "0 8 * * 1-5"},
+		{name: "Lists and steps", expr: "0,30 */2 1-15/7 1,6 0"},
+		{name: "Sunday as 7", expr: "0 0 * * 7"},
+		{name: "Too few fields", expr: "0 8 * *", wantErr: true},
+		{name: "Too many fields", expr: "0 8 * * * 2024", wantErr: true},
+		{name: "Minute out of range", expr: "60 * * * *", wantErr: true},
+		{name: "Day of month zero", expr: "0 0 0 * *", wantErr: true},
+		{name: "Reversed range", expr: "0 18-8 * * *", wantErr: true},
+		{name: "Invalid step", expr: "*/0 * * * *", wantErr: true},
+		{name: "Month names are not supported", expr: "0 0 1 jan *", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2024-03-01 is a friday
+	from := time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{
+			name: "Every minute is the next full minute",
+			expr: "* * * * *",
+			from: from,
+			want: time.Date(2024, 3, 1, 12, 35, 0, 0, time.UTC),
+		},
+		{
+			name: "Strictly after a match",
+			expr: "35 12 * * *",
+			from: time.Date(2024, 3, 1, 12, 35, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 2, 12, 35, 0, 0, time.UTC),
+		},
+		{
+			name: "Weekdays skip the weekend",
+			expr: "0 8 * * 1-5",
+			from: from,
+			want: time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Day of month or day of week",
+			expr: "0 0 15 * 0",
+			from: from,
+			want: time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Leap day",
+			expr: "0 0 29 2 *",
+			from: from,
+			want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Never",
+			expr: "0 0 30 2 *",
+			from: from,
+			want: time.Time{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.expr, err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+			if !tt.want.IsZero() && !s.Matches(tt.want) {
+				t.Errorf("Matches(%s) = false", tt.want)
+			}
+		})
+	}
+}
+
+func TestNextInLocation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	s, _ := Parse("30 2 * * *")
+	// 02:30 does not exist on the day the clocks are set forward
+	got := s.Next(time.Date(2024, 3, 30, 12, 0, 0, 0, berlin))
+	if got.Before(time.Date(2024, 3, 31, 0, 0, 0, 0, berlin)) || got.After(time.Date(2024, 4, 1, 2, 30, 0, 0, berlin)) {
+		t.Errorf("Next() over a daylight saving time change = %s", got)
+	}
+
+	// the hour is read in the location, not in UTC
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	s, _ = Parse("0 9 * * *")
+	want := time.Date(2024, 3, 2, 9, 0, 0, 0, kolkata)
+	if got := s.Next(time.Date(2024, 3, 1, 9, 30, 0, 0, kolkata)); !got.Equal(want) {
+		t.Errorf("Next() with a half hour offset = %s, want %s", got, want)
+	}
+}
+
+func TestTextRoundtrip(t *testing.T) {
+	s, _ := Parse("0  8 * *   1-5")
+	data, err := json.Marshal(struct{ S *Schedule }{s})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if string(data) != `{"S":"0 8 * * 1-5"}` {
+		t.Errorf("json.Marshal() = %s", data)
+	}
+
+	var parsed struct{ S *Schedule }
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if *parsed.S != *s {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", parsed.S, s)
+	}
+	if err := json.Unmarshal([]byte(`{"S":"bogus"}`), &parsed); err == nil {
+		t.Errorf("json.Unmarshal() of an invalid expression should fail")
+	}
+}
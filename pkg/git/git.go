@@ -0,0 +1,71 @@
+package git
+
+/**
+ * a minimal read-only wrapper around the git cli
+ *
+ * all reads go directly to the object database of a specific commit,
+ * so the working tree of the repository is never touched
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// run executes git inside the repository and returns stdout
+func run(repo string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// ResolveRef converts a branch, tag or (short) commit hash to the full commit hash
+func ResolveRef(repo, ref string) (string, error) {
+	out, err := run(repo, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ListFiles lists all files below path (recursively) in the given commit
+// the returned paths are relative to the repository root and use forward slashes
+func ListFiles(repo, commit, path string) ([]string, error) {
+	out, err := run(repo, "ls-tree", "-r", "--name-only", "-z", commit, "--", path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// ReadFile returns the content of a file in the given commit
+func ReadFile(repo, commit, path string) ([]byte, error) {
+	return run(repo, "cat-file", "blob", commit+":"+path)
+}
+
+// IsFile checks if path is a file (and not a directory) in the given commit
+func IsFile(repo, commit, path string) (bool, error) {
+	out, err := run(repo, "cat-file", "-t", commit+":"+path)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "blob", nil
+}
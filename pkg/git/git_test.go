@@ -0,0 +1,111 @@
+package git
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setupRepo creates a repository with two commits
+// and returns the path and both commit hashes
+func setupRepo(t *testing.T) (string, string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := t.TempDir()
+	gitCmd := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+	write := func(path, content string) {
+		full := filepath.Join(repo, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gitCmd("init", "-q")
+	write("zones.csv", "10.0.0.0,8,a.pac\n")
+	write("pacs/a.pac", "// version 1")
+	gitCmd("add", "-A")
+	gitCmd("commit", "-q", "-m", "first")
+	first, err := ResolveRef(repo, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("pacs/a.pac", "// version 2")
+	write("pacs/nested/b.pac", "// b")
+	gitCmd("add", "-A")
+	gitCmd("commit", "-q", "-m", "second")
+	second, err := ResolveRef(repo, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, first, second
+}
+
+func TestGitRepository(t *testing.T) {
+	repo, first, second := setupRepo(t)
+
+	t.Run("ResolveRef with short hash", func(t *testing.T) {
+		got, err := ResolveRef(repo, first[:8])
+		if err != nil || got != first {
+			t.Errorf("ResolveRef() = %q, %v, want %q", got, err, first)
+		}
+	})
+
+	t.Run("ResolveRef with unknown ref", func(t *testing.T) {
+		if _, err := ResolveRef(repo, "does-not-exist"); err == nil {
+			t.Errorf("ResolveRef() expected an error")
+		}
+	})
+
+	t.Run("ListFiles per commit", func(t *testing.T) {
+		got, err := ListFiles(repo, first, "pacs")
+		if err != nil || !reflect.DeepEqual(got, []string{"pacs/a.pac"}) {
+			t.Errorf("ListFiles(first) = %v, %v", got, err)
+		}
+		got, err = ListFiles(repo, second, "pacs")
+		if err != nil || !reflect.DeepEqual(got, []string{"pacs/a.pac", "pacs/nested/b.pac"}) {
+			t.Errorf("ListFiles(second) = %v, %v", got, err)
+		}
+	})
+
+	t.Run("ReadFile per commit", func(t *testing.T) {
+		got, err := ReadFile(repo, first, "pacs/a.pac")
+		if err != nil || string(got) != "// version 1" {
+			t.Errorf("ReadFile(first) = %q, %v", got, err)
+		}
+		got, err = ReadFile(repo, second, "pacs/a.pac")
+		if err != nil || string(got) != "// version 2" {
+			t.Errorf("ReadFile(second) = %q, %v", got, err)
+		}
+	})
+
+	t.Run("IsFile", func(t *testing.T) {
+		if isFile, err := IsFile(repo, second, "zones.csv"); err != nil || !isFile {
+			t.Errorf("IsFile(zones.csv) = %v, %v, want true", isFile, err)
+		}
+		if isFile, err := IsFile(repo, second, "pacs"); err != nil || isFile {
+			t.Errorf("IsFile(pacs) = %v, %v, want false", isFile, err)
+		}
+		if _, err := IsFile(repo, second, "missing"); err == nil {
+			t.Errorf("IsFile(missing) expected an error")
+		}
+	})
+}
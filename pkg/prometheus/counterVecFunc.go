@@ -0,0 +1,44 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CounterVecFunc implements the prometheus.Collector interface
+//
+// like GaugeVecFunc, but for values that only ever increase
+// e.g. counts kept by the application itself
+type CounterVecFunc struct {
+	metric   *prometheus.Desc
+	callback func() map[string]float64
+}
+
+func NewCounterVecFunc(
+	opts prometheus.CounterOpts,
+	labelNames []string,
+	callback func() map[string]float64,
+) *CounterVecFunc {
+	desc := prometheus.V2.NewDesc(
+		prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		prometheus.UnconstrainedLabels(labelNames),
+		opts.ConstLabels,
+	)
+	return &CounterVecFunc{
+		metric:   desc,
+		callback: callback,
+	}
+}
+
+// Describe sends the super-set of all possible descriptors of metrics
+func (c *CounterVecFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.metric
+}
+
+// Collect is called by the Prometheus registry when collecting metrics
+func (c *CounterVecFunc) Collect(ch chan<- prometheus.Metric) {
+	values := c.callback()
+	for label, value := range values {
+		ch <- prometheus.MustNewConstMetric(c.metric, prometheus.CounterValue, value, label)
+	}
+}